@@ -2,7 +2,6 @@ package gold
 
 import (
 	"errors"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -15,137 +14,125 @@ type WAC struct {
 	w    http.ResponseWriter
 	user string
 	key  string
+	// the ACL document that decided the last check, the authorization that granted
+	// the mode (if allowed), and whether the authorization names the request origin
+	grantACL      string
+	grantAuth     string
+	grantByOrigin bool
+	// policies that are about to be written, used instead of the ACL files on disk
+	policies map[string]*Graph
+	// the capability link used by the request, if any
+	capability *Capability
 }
 
-// NewWAC creates a new WAC object
+// wacModes lists the access modes, in the order used by the WAC-Allow header
+var wacModes = []string{"Read", "Write", "Append", "Control"}
+
+// NewWAC creates a new WAC object. The response writer may be nil when the
+// result is only inspected, in which case no authentication challenge is set.
 func NewWAC(req *httpRequest, srv *Server, w http.ResponseWriter, user string, key string) *WAC {
 	return &WAC{req: req, srv: srv, w: w, user: user, key: key}
 }
 
 // Return an HTTP code and error (200 if authd, 401 if auth required, 403 if not authorized, 500 if error)
 func (acl *WAC) allow(mode string, path string) (int, error) {
+	status, err := acl.decide(mode, path)
+	acl.audit(mode, path, status, err)
+	return status, err
+}
+
+func (acl *WAC) decide(mode string, path string) (int, error) {
+	// delegates cannot go beyond their grants
+	if len(acl.req.Delegations) > 0 && len(acl.user) > 0 && acl.user == acl.req.User {
+		if status, err := acl.allowDelegation(mode, path); status != 200 || err != nil {
+			acl.grantACL, acl.grantAuth = "", ""
+			return status, err
+		}
+	}
+	// and so do scoped bearer tokens
+	if acl.req.Token != nil && len(acl.user) > 0 && acl.user == acl.req.User {
+		if status, err := acl.allowToken(mode, path); status != 200 || err != nil {
+			acl.grantACL, acl.grantAuth = "", ""
+			return status, err
+		}
+	}
+	if acl.allowCapability(mode, path) {
+		acl.grantACL, acl.grantAuth = "", "capability:"+acl.capability.ID
+		return 200, nil
+	}
+	status, err := acl.allowPolicies(mode, path)
+	if status != 200 || err != nil {
+		return status, err
+	}
+	return acl.allowOrigin(mode, path)
+}
+
+// allowPolicies checks the ACL policies that apply to the resource
+func (acl *WAC) allowPolicies(mode string, path string) (int, error) {
 	origin := acl.req.Header.Get("Origin")
-	accessType := "accessTo"
+	acl.grantACL, acl.grantAuth, acl.grantByOrigin = "", "", false
+	// the resource's own ACL uses acl:accessTo, inherited ACLs use acl:default (or the older acl:defaultForNew)
+	accessTypes := []string{"accessTo"}
 	p, err := acl.req.pathInfo(path)
 	if err != nil {
 		return 500, err
 	}
+	if p.File == p.AclFile {
+		// ACL resources are governed by acl:Control over the resource they protect
+		mode = "Control"
+		path = strings.TrimSuffix(p.URI, acl.srv.Config.ACLSuffix)
+		p, err = acl.req.pathInfo(path)
+		if err != nil {
+			return 500, err
+		}
+	}
 	depth := strings.Split(p.Path, "/")
 
+	// acl:Write implies acl:Append, and acl:Control implies every mode with ControlGrantsAll
+	modes := []string{mode}
+	if mode == "Append" {
+		modes = append(modes, "Write")
+	}
+	if acl.srv.Config.ControlGrantsAll && mode != "Control" {
+		modes = append(modes, "Control")
+	}
+
 	for d := len(depth); d >= 0; d-- {
 		p, err := acl.req.pathInfo(path)
 		if err != nil {
 			return 500, err
 		}
 
-		acl.srv.debug.Println("Checking " + accessType + " <" + mode + "> to " + p.URI + " for WebID: " + acl.user)
+		acl.srv.debug.Println("Checking " + strings.Join(accessTypes, "/") + " <" + mode + "> to " + p.URI + " for WebID: " + acl.user)
 		acl.srv.debug.Println("Looking for policies in " + p.AclFile)
 
-		aclGraph := NewGraph(p.AclURI)
-		aclGraph.ReadFile(p.AclFile)
+		aclGraph, ok := acl.policies[p.AclFile]
+		if !ok {
+			aclGraph = acl.srv.aclCache.get(p.AclURI, p.AclFile)
+		}
 		if aclGraph.Len() > 0 {
 			acl.srv.debug.Println("Found policies in " + p.AclFile)
-			// TODO make it more elegant instead of duplicating code
-			for _, i := range aclGraph.All(nil, ns.acl.Get("mode"), ns.acl.Get("Control")) {
-				for range aclGraph.All(i.Subject, ns.acl.Get(accessType), NewResource(p.URI)) {
-					//@@TODO add resourceKey to ACL vocab
-					if len(acl.user) > 0 {
-						acl.srv.debug.Println("Looking for policy matching user:", acl.user)
-						for range aclGraph.All(i.Subject, ns.acl.Get("owner"), NewResource(acl.user)) {
-							acl.srv.debug.Println(mode + " access allowed (as owner) for: " + acl.user)
-							return 200, nil
-						}
-						for range aclGraph.All(i.Subject, ns.acl.Get("agent"), NewResource(acl.user)) {
-							acl.srv.debug.Println(mode + " access allowed (as agent) for: " + acl.user)
-							return 200, nil
-						}
-					}
-					if len(acl.key) > 0 {
-						acl.srv.debug.Println("Looking for policy matching key:", acl.key)
-						for range aclGraph.All(i.Subject, ns.acl.Get("resourceKey"), NewLiteral(acl.key)) {
-							acl.srv.debug.Println(mode + " access allowed based on matching resource key")
-							return 200, nil
-						}
-					}
-					for _, t := range aclGraph.All(i.Subject, ns.acl.Get("agentClass"), nil) {
-						// check for foaf groups
-						acl.srv.debug.Println("Found agentClass policy")
-						if t.Object.Equal(ns.foaf.Get("Agent")) {
-							acl.srv.debug.Println(mode + " access allowed as FOAF Agent")
-							return 200, nil
-						}
-
-						groupURI := debrack(t.Object.String())
-						groupGraph := NewGraph(groupURI)
-						groupGraph.LoadURI(groupURI)
-						if groupGraph.Len() > 0 && groupGraph.One(t.Object, ns.rdf.Get("type"), ns.foaf.Get("Group")) != nil {
-							for range groupGraph.All(t.Object, ns.foaf.Get("member"), NewResource(acl.user)) {
-								acl.srv.debug.Println(acl.user + " listed as a member of the group " + groupURI)
-								return 200, nil
-							}
-						}
-					}
-				}
-			}
-			for _, i := range aclGraph.All(nil, ns.acl.Get("mode"), ns.acl.Get(mode)) {
-				acl.srv.debug.Println("Found " + accessType + " policy for <" + mode + ">")
-
-				for range aclGraph.All(i.Subject, ns.acl.Get(accessType), NewResource(p.URI)) {
-					origins := aclGraph.All(i.Subject, ns.acl.Get("origin"), nil)
-					if len(origin) > 0 && len(origins) > 0 {
-						acl.srv.debug.Println("Origin set to: " + brack(origin))
-						for _, o := range origins {
-							if brack(origin) == o.Object.String() {
-								acl.srv.debug.Println("Found policy for origin: " + o.Object.String())
-								goto allowOrigin
-							}
-						}
+			for _, m := range modes {
+				for _, i := range aclGraph.All(nil, ns.acl.Get("mode"), ns.acl.Get(m)) {
+					acl.srv.debug.Println("Found policy for <" + m + ">")
+					if !acl.appliesTo(aclGraph, i.Subject, accessTypes, p) || !acl.matchOrigin(aclGraph, i.Subject, origin) {
 						continue
-					} else {
-						acl.srv.debug.Println("No origin found, moving on")
 					}
-				allowOrigin:
-					if len(acl.user) > 0 {
-						acl.srv.debug.Println("Looking for policy matching user:", acl.user)
-						for range aclGraph.All(i.Subject, ns.acl.Get("owner"), NewResource(acl.user)) {
-							acl.srv.debug.Println(mode + " access allowed (as owner) for: " + acl.user)
-							return 200, nil
-						}
-						for range aclGraph.All(i.Subject, ns.acl.Get("agent"), NewResource(acl.user)) {
-							acl.srv.debug.Println(mode + " access allowed (as agent) for: " + acl.user)
-							return 200, nil
-						}
-					}
-					if len(acl.key) > 0 {
-						acl.srv.debug.Println("Looking for policy matching key:", acl.key)
-						for range aclGraph.All(i.Subject, ns.acl.Get("resourceKey"), NewLiteral(acl.key)) {
-							acl.srv.debug.Println(mode + " access allowed based on matching resource key")
-							return 200, nil
-						}
-					}
-					for _, t := range aclGraph.All(i.Subject, ns.acl.Get("agentClass"), nil) {
-						// check for foaf groups
-						acl.srv.debug.Println("Found agentClass policy")
-						if t.Object.Equal(ns.foaf.Get("Agent")) {
-							acl.srv.debug.Println(mode + " access allowed as FOAF Agent")
-							return 200, nil
-						}
-						groupURI := debrack(t.Object.String())
-						groupGraph := NewGraph(groupURI)
-						groupGraph.LoadURI(groupURI)
-						if groupGraph.Len() > 0 && groupGraph.One(t.Object, ns.rdf.Get("type"), ns.foaf.Get("Group")) != nil {
-							for range groupGraph.All(t.Object, ns.foaf.Get("member"), NewResource(acl.user)) {
-								acl.srv.debug.Println(acl.user + " listed as a member of the group " + groupURI)
-								return 200, nil
-							}
-						}
+					if acl.matchAgent(aclGraph, i.Subject, mode, p) {
+						acl.grantACL, acl.grantAuth = p.AclURI, debrack(i.Subject.String())
+						acl.grantByOrigin = len(origin) > 0 && aclGraph.One(i.Subject, ns.acl.Get("origin"), NewResource(origin)) != nil
+						return 200, nil
 					}
 				}
 			}
+			acl.grantACL = p.AclURI
 			if len(acl.user) == 0 && len(acl.key) == 0 {
 				acl.srv.debug.Println("Authentication required")
+				if acl.w == nil {
+					return 401, errors.New("Access to " + p.URI + " requires authentication")
+				}
 				tokenValues := map[string]string{
-					"secret": string(acl.srv.cookieSalt),
+					"secret": acl.srv.cookie.salt(),
 				}
 				// set validity for now + 1 min
 				validity := 1 * time.Minute
@@ -154,7 +141,7 @@ func (acl *WAC) allow(mode string, path string) (int, error) {
 					acl.srv.debug.Println("Error generating Auth token: ", err)
 					return 500, err
 				}
-				wwwAuth := `WebID-RSA source="` + acl.req.BaseURI() + `", nonce="` + token + `"`
+				wwwAuth := `WebID-RSA source="` + acl.req.BaseURI() + `", nonce="` + token + `", algorithm="SHA-256"`
 				acl.w.Header().Set("WWW-Authenticate", wwwAuth)
 				return 401, errors.New("Access to " + p.URI + " requires authentication")
 			}
@@ -162,7 +149,7 @@ func (acl *WAC) allow(mode string, path string) (int, error) {
 			return 403, errors.New("Access denied for: " + acl.user)
 		}
 
-		accessType = "defaultForNew"
+		accessTypes = []string{"default", "defaultForNew"}
 
 		// cd one level: walkPath("/foo/bar/baz") => /foo/bar/
 		// decrement depth
@@ -177,6 +164,219 @@ func (acl *WAC) allow(mode string, path string) (int, error) {
 	return 200, nil
 }
 
+// allowOrigin caps the modes granted to web apps running on other origins, using the
+// acl:trustedApp entries of the pod owner's profile (or the user's, if the pod has no owner).
+// Authorizations that name the origin and resources that are public are not capped.
+func (acl *WAC) allowOrigin(mode string, path string) (int, error) {
+	origin := strings.TrimSuffix(acl.req.Header.Get("Origin"), "/")
+	if len(origin) == 0 || len(acl.user) == 0 || acl.grantByOrigin {
+		return 200, nil
+	}
+	p, err := acl.req.pathInfo(path)
+	if err != nil {
+		return 500, err
+	}
+	if origin == p.Obj.Scheme+"://"+p.Obj.Host {
+		return 200, nil
+	}
+	if p.File == p.AclFile {
+		mode = "Control"
+	}
+
+	owner := acl.req.getAccountWebID()
+	if len(owner) == 0 {
+		owner = acl.user
+	}
+	if acl.trustedApp(owner, origin, mode, p) {
+		acl.srv.debug.Println(mode + " access allowed for trusted app: " + origin)
+		return 200, nil
+	}
+	public := NewWAC(acl.req, acl.srv, nil, "", "")
+	if status, err := public.allowPolicies(mode, path); status == 200 && err == nil {
+		return 200, nil
+	}
+	acl.srv.debug.Println(mode + " access denied for untrusted app: " + origin)
+	acl.grantAuth = ""
+	return 403, errors.New("The application " + origin + " is not trusted with " + mode + " access")
+}
+
+// trustedApp checks if the owner's profile lists the origin as a trusted app for the mode
+func (acl *WAC) trustedApp(owner string, origin string, mode string, p *pathInfo) bool {
+	modes := []Term{ns.acl.Get(mode)}
+	if mode == "Append" {
+		modes = append(modes, ns.acl.Get("Write"))
+	}
+	profile := acl.document(owner, p)
+	for _, app := range profile.All(NewResource(owner), ns.acl.Get("trustedApp"), nil) {
+		if profile.One(app.Object, ns.acl.Get("origin"), NewResource(origin)) == nil &&
+			profile.One(app.Object, ns.acl.Get("origin"), NewResource(origin+"/")) == nil {
+			continue
+		}
+		for _, m := range modes {
+			if profile.One(app.Object, ns.acl.Get("mode"), m) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aclTerms lists the terms of the ACL vocabulary understood by the server
+var aclTerms = map[string]bool{
+	"Access":             true,
+	"Authorization":      true,
+	"AuthenticatedAgent": true,
+	"Read":               true,
+	"Write":              true,
+	"Append":             true,
+	"Control":            true,
+	"accessTo":           true,
+	"accessToClass":      true,
+	"default":            true,
+	"defaultForNew":      true,
+	"agent":              true,
+	"agentClass":         true,
+	"agentGroup":         true,
+	"origin":             true,
+	"mode":               true,
+	"owner":              true,
+	"resourceKey":        true,
+	"password":           true,
+	"delegates":          true,
+	"trustedApp":         true,
+}
+
+// checkACL validates the policies that are about to be written to an ACL resource.
+// It returns 400 if they use unknown ACL terms or modes, and 409 if the author
+// would lose acl:Control over the resource.
+func (acl *WAC) checkACL(resource *pathInfo, g *Graph) (int, error) {
+	for triple := range g.triples {
+		for _, t := range []Term{triple.Predicate, triple.Object} {
+			r, ok := t.(*Resource)
+			if ok && strings.HasPrefix(r.URI, string(ns.acl)) && !aclTerms[strings.TrimPrefix(r.URI, string(ns.acl))] {
+				return 400, errors.New("Unknown ACL term: " + r.String())
+			}
+		}
+	}
+	for _, t := range g.All(nil, ns.acl.Get("mode"), nil) {
+		known := false
+		for _, mode := range wacModes {
+			known = known || t.Object.Equal(ns.acl.Get(mode))
+		}
+		if !known {
+			return 400, errors.New("Unknown access mode: " + t.Object.String())
+		}
+	}
+
+	check := NewWAC(acl.req, acl.srv, nil, acl.user, acl.key)
+	check.policies = map[string]*Graph{resource.AclFile: g}
+	if status, err := check.AllowControl(resource.URI); status != 200 || err != nil {
+		acl.srv.debug.Println("Refusing ACL change that removes Control for: " + acl.user)
+		return 409, errors.New("The new policies would remove your acl:Control access to " + strings.TrimSuffix(resource.URI, acl.srv.Config.ACLSuffix))
+	}
+	return 200, nil
+}
+
+// appliesTo checks if an authorization targets the resource through one of the access types
+func (acl *WAC) appliesTo(aclGraph *Graph, auth Term, accessTypes []string, p *pathInfo) bool {
+	for _, accessType := range accessTypes {
+		if len(aclGraph.All(auth, ns.acl.Get(accessType), NewResource(p.URI))) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin checks if the request Origin is allowed by an authorization
+func (acl *WAC) matchOrigin(aclGraph *Graph, auth Term, origin string) bool {
+	origins := aclGraph.All(auth, ns.acl.Get("origin"), nil)
+	if len(origin) == 0 || len(origins) == 0 {
+		acl.srv.debug.Println("No origin found, moving on")
+		return true
+	}
+	acl.srv.debug.Println("Origin set to: " + brack(origin))
+	for _, o := range origins {
+		if brack(origin) == o.Object.String() {
+			acl.srv.debug.Println("Found policy for origin: " + o.Object.String())
+			return true
+		}
+	}
+	return false
+}
+
+// matchAgent checks if the current agent is one of the agents of an authorization
+func (acl *WAC) matchAgent(aclGraph *Graph, auth Term, mode string, p *pathInfo) bool {
+	if len(acl.user) > 0 {
+		acl.srv.debug.Println("Looking for policy matching user:", acl.user)
+		for range aclGraph.All(auth, ns.acl.Get("owner"), NewResource(acl.user)) {
+			acl.srv.debug.Println(mode + " access allowed (as owner) for: " + acl.user)
+			return true
+		}
+		for range aclGraph.All(auth, ns.acl.Get("agent"), NewResource(acl.user)) {
+			acl.srv.debug.Println(mode + " access allowed (as agent) for: " + acl.user)
+			return true
+		}
+	}
+	if len(acl.key) > 0 {
+		acl.srv.debug.Println("Looking for policy matching key:", acl.key)
+		for range aclGraph.All(auth, ns.acl.Get("resourceKey"), NewLiteral(acl.key)) {
+			acl.srv.debug.Println(mode + " access allowed based on matching resource key")
+			return true
+		}
+	}
+	for _, t := range aclGraph.All(auth, ns.acl.Get("agentClass"), nil) {
+		acl.srv.debug.Println("Found agentClass policy")
+		if t.Object.Equal(ns.foaf.Get("Agent")) {
+			acl.srv.debug.Println(mode + " access allowed as FOAF Agent")
+			return true
+		}
+		if len(acl.user) == 0 {
+			continue
+		}
+		if t.Object.Equal(ns.acl.Get("AuthenticatedAgent")) {
+			acl.srv.debug.Println(mode + " access allowed as authenticated agent: " + acl.user)
+			return true
+		}
+		// check for foaf groups
+		groupURI := debrack(t.Object.String())
+		groupGraph := acl.document(groupURI, p)
+		if groupGraph.Len() > 0 && len(groupGraph.All(t.Object, ns.rdf.Get("type"), ns.foaf.Get("Group"))) > 0 {
+			for range groupGraph.All(t.Object, ns.foaf.Get("member"), NewResource(acl.user)) {
+				acl.srv.debug.Println(acl.user + " listed as a member of the group " + groupURI)
+				return true
+			}
+		}
+	}
+	if len(acl.user) > 0 {
+		// check for vcard groups
+		for _, t := range aclGraph.All(auth, ns.acl.Get("agentGroup"), nil) {
+			groupURI := debrack(t.Object.String())
+			acl.srv.debug.Println("Found agentGroup policy for " + groupURI)
+			for range acl.document(groupURI, p).All(t.Object, ns.vcard.Get("hasMember"), NewResource(acl.user)) {
+				acl.srv.debug.Println(acl.user + " listed as a member of the group " + groupURI)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// document returns the graph of a group or profile document, read from disk for local documents
+func (acl *WAC) document(uri string, p *pathInfo) *Graph {
+	doc := defrag(uri)
+	if !strings.HasPrefix(doc, "http:") && !strings.HasPrefix(doc, "https:") {
+		return NewGraph(p.AclURI)
+	}
+	if strings.HasPrefix(doc, p.Base+"/") {
+		g, err := acl.req.pathInfo(doc)
+		if err == nil && g.Exists && !g.IsDir {
+			// local files are cached like ACL files
+			return acl.srv.aclCache.get(doc, g.File)
+		}
+	}
+	return acl.srv.groupCache.get(doc)
+}
+
 func walkPath(base string, depth []string) string {
 	path := base + "/"
 	if len(depth) > 0 {
@@ -205,17 +405,22 @@ func (acl *WAC) AllowControl(path string) (int, error) {
 	return acl.allow("Control", path)
 }
 
-func verifyDelegator(delegator string, delegatee string) bool {
-	g := NewGraph(delegator)
-	err := g.LoadURI(delegator)
-	if err != nil {
-		log.Println("Error loading graph for " + delegator)
-	}
-
-	for _, val := range g.All(NewResource(delegator), NewResource("http://www.w3.org/ns/auth/acl#delegates"), nil) {
-		if debrack(val.Object.String()) == delegatee {
-			return true
+// AllowedModes returns the modes (in lower case) granted on the resource
+func (acl *WAC) AllowedModes(path string) []string {
+	modes := []string{}
+	for _, mode := range wacModes {
+		if status, err := acl.allow(mode, path); status == 200 && err == nil {
+			modes = append(modes, strings.ToLower(mode))
 		}
 	}
-	return false
+	return modes
+}
+
+// AllowHeader returns the value of the WAC-Allow header for the current user and
+// for anonymous agents
+func (acl *WAC) AllowHeader(path string) string {
+	user := NewWAC(acl.req, acl.srv, nil, acl.user, acl.key)
+	user.capability = acl.capability
+	public := NewWAC(acl.req, acl.srv, nil, "", "")
+	return `user="` + strings.Join(user.AllowedModes(path), " ") + `",public="` + strings.Join(public.AllowedModes(path), " ") + `"`
 }
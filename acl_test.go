@@ -4,7 +4,10 @@ package gold
 import (
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -154,7 +157,7 @@ func TestResourceKey(t *testing.T) {
 		"	a <http://www.w3.org/ns/auth/acl#Authorization> ;" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + ">, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#PublicWithKey>" +
 		"	a <http://www.w3.org/ns/auth/acl#Authorization> ;" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + ">;" +
@@ -216,7 +219,7 @@ func TestACLOrigin(t *testing.T) {
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + ">, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#origin> <" + origin1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#Public>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agentClass> <http://xmlns.com/foaf/0.1/Agent>;" +
@@ -299,7 +302,7 @@ func TestACLOwnerOnly(t *testing.T) {
 	body := "<#Owner>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + ">, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#owner> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Control> ."
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ."
 	request, err = http.NewRequest("PUT", acl, strings.NewReader(body))
 	assert.NoError(t, err)
 	request.Header.Add("Content-Type", "text/turtle")
@@ -385,7 +388,7 @@ func TestACLReadOnly(t *testing.T) {
 		"	a <http://www.w3.org/ns/auth/acl#Authorization> ;" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + ">, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#Public>" +
 		"	a <http://www.w3.org/ns/auth/acl#Authorization> ;" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + ">;" +
@@ -509,7 +512,7 @@ func TestACLAppendOnly(t *testing.T) {
 	body := "<#Owner>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + "abc>, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#AppendOnly>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + aclDir + "abc>;" +
 		"	<http://www.w3.org/ns/auth/acl#agentClass> <http://xmlns.com/foaf/0.1/Agent>;" +
@@ -605,7 +608,7 @@ func TestACLRestricted(t *testing.T) {
 	body := "<#Owner>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + "abc>, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#Restricted>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + "abc>;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user2 + ">;" +
@@ -705,7 +708,7 @@ func TestACLPathWithSpaces(t *testing.T) {
 	body := "<#Owner>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + spacesDir + ">, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ."
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ."
 	request, err = http.NewRequest("PUT", acl, strings.NewReader(body))
 	assert.NoError(t, err)
 	request.Header.Add("Content-Type", "text/turtle")
@@ -771,7 +774,7 @@ func TestACLGroup(t *testing.T) {
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + "abc>, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#defaultForNew> <" + aclDir + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#Group>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + "abc>;" +
 		"	<http://www.w3.org/ns/auth/acl#agentClass> <" + testServer.URL + aclDir + "group#>;" +
@@ -874,7 +877,7 @@ func TestACLDefaultForNew(t *testing.T) {
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + ">, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#defaultForNew> <" + aclDir + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#Default>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#defaultForNew> <" + aclDir + ">;" +
@@ -974,7 +977,7 @@ func TestACLWebIDDelegation(t *testing.T) {
 	body := "<#Owner>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + "abcd>, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ."
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ."
 	request, err = http.NewRequest("PUT", acl, strings.NewReader(body))
 	assert.NoError(t, err)
 	request.Header.Add("Content-Type", "text/turtle")
@@ -1000,6 +1003,374 @@ func TestACLWebIDDelegation(t *testing.T) {
 	assert.Equal(t, 200, response.StatusCode)
 }
 
+const (
+	wacDir = "/_test/wacdir/"
+)
+
+func wacDo(t *testing.T, client *http.Client, method string, uri string, body string) int {
+	request, err := http.NewRequest(method, uri, strings.NewReader(body))
+	assert.NoError(t, err)
+	if len(body) > 0 {
+		request.Header.Add("Content-Type", "text/turtle")
+	}
+	response, err := client.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	return response.StatusCode
+}
+
+// wacACL returns an ACL giving user1 full control over wacDir, followed by the given policies
+func wacACL(policies string) string {
+	return "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+		"@prefix foaf: <http://xmlns.com/foaf/0.1/> .\n" +
+		"<#Owner> acl:accessTo <" + testServer.URL + wacDir + ">, <" + testServer.URL + wacDir + ".acl> ;\n" +
+		"	acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user1 + "> ;\n" +
+		"	acl:mode acl:Read, acl:Write, acl:Control .\n" + policies
+}
+
+func TestWACInit(t *testing.T) {
+	assert.Equal(t, 201, wacDo(t, user1h, "MKCOL", testServer.URL+wacDir, ""))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("")))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", testServer.URL+wacDir+"doc", "<a> <b> <c> ."))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", testServer.URL+wacDir+"sub/doc", "<a> <b> <c> ."))
+	assert.Equal(t, 401, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+"doc", ""))
+}
+
+func TestWACDefault(t *testing.T) {
+	policies := "<#Public> acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agentClass foaf:Agent ;\n" +
+		"	acl:mode acl:Read ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+
+	// acl:default applies to the members (at any depth) but not to the container itself
+	assert.Equal(t, 200, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 200, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"sub/doc", ""))
+	assert.Equal(t, 401, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir, ""))
+	assert.Equal(t, 401, wacDo(t, httpClient, "PUT", testServer.URL+wacDir+"doc", "<d> <e> <f> ."))
+
+	// a resource ACL replaces the inherited one
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", testServer.URL+wacDir+"doc.acl", "<#Owner> <http://www.w3.org/ns/auth/acl#accessTo> <doc>, <doc.acl> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#agent> <"+user1+"> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ."))
+	assert.Equal(t, 401, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 200, wacDo(t, user1h, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 200, wacDo(t, user1h, "DELETE", testServer.URL+wacDir+"doc.acl", ""))
+	assert.Equal(t, 200, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"doc", ""))
+
+	// the older acl:defaultForNew is still understood
+	policies = "<#Public> acl:defaultForNew <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agentClass foaf:Agent ;\n" +
+		"	acl:mode acl:Read ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+	assert.Equal(t, 200, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"doc", ""))
+}
+
+func TestWACAccessToDoesNotInherit(t *testing.T) {
+	policies := "<#User2> acl:accessTo <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user2 + "> ;\n" +
+		"	acl:mode acl:Read ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir, ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+"sub/doc", ""))
+}
+
+func TestWACAuthenticatedAgent(t *testing.T) {
+	policies := "<#Users> acl:accessTo <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agentClass acl:AuthenticatedAgent ;\n" +
+		"	acl:mode acl:Read, acl:Write ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir, ""))
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 200, wacDo(t, user2h, "PUT", testServer.URL+wacDir+"doc", "<a> <b> <c> ."))
+	// acl:Write implies acl:Append
+	assert.Equal(t, 200, wacDo(t, user2h, "POST", testServer.URL+wacDir+"doc", "<d> <e> <f> ."))
+	assert.Equal(t, 401, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"doc", ""))
+}
+
+func TestWACAgentGroup(t *testing.T) {
+	group := testServer.URL + "/_test/wacgroup.ttl"
+	members := "<#readers> a <http://www.w3.org/2006/vcard/ns#Group> ;\n" +
+		"	<http://www.w3.org/2006/vcard/ns#hasMember> <" + user2 + "> ."
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", group, members))
+
+	policies := "<#Readers> acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agentGroup <" + group + "#readers> ;\n" +
+		"	acl:mode acl:Read ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "PUT", testServer.URL+wacDir+"doc", "<a> <b> <c> ."))
+	assert.Equal(t, 401, wacDo(t, httpClient, "HEAD", testServer.URL+wacDir+"doc", ""))
+
+	// membership changes are picked up
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", group, "<#readers> a <http://www.w3.org/2006/vcard/ns#Group> ."))
+	assert.Equal(t, 403, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+"doc", ""))
+
+	assert.Equal(t, 200, wacDo(t, user1h, "DELETE", group, ""))
+}
+
+func TestWACAllowHeader(t *testing.T) {
+	policies := "<#Public> acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agentClass foaf:Agent ;\n" +
+		"	acl:mode acl:Read .\n" +
+		"<#User2> acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user2 + "> ;\n" +
+		"	acl:mode acl:Append ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+
+	for client, allow := range map[*http.Client]string{
+		user1h:     `user="read write append control",public="read"`,
+		user2h:     `user="read append",public="read"`,
+		httpClient: `user="read",public="read"`,
+	} {
+		request, err := http.NewRequest("HEAD", testServer.URL+wacDir+"doc", nil)
+		assert.NoError(t, err)
+		response, err := client.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, allow, response.Header.Get("WAC-Allow"))
+		assert.Empty(t, response.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestWACPermissionsAPI(t *testing.T) {
+	uri := testServer.URL + wacDir + "doc"
+	api := testServer.URL + "/" + SystemPrefix + "/permissions?uri=" + url.QueryEscape(uri)
+
+	request, err := http.NewRequest("GET", api, nil)
+	assert.NoError(t, err)
+	response, err := user2h.Do(request)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+
+	var perms permissionsResponse
+	assert.NoError(t, json.Unmarshal(body, &perms))
+	assert.Equal(t, uri, perms.URI)
+	assert.Equal(t, user2, perms.WebID)
+	assert.Equal(t, []string{"read", "append"}, perms.Modes)
+	assert.Equal(t, testServer.URL+wacDir+".acl", perms.Grant["append"].ACL)
+	assert.Equal(t, testServer.URL+wacDir+".acl#User2", perms.Grant["append"].Authorization)
+	assert.Equal(t, testServer.URL+wacDir+".acl#Public", perms.Grant["read"].Authorization)
+	assert.False(t, perms.Grant["write"].Allowed)
+	assert.Equal(t, 403, perms.Grant["write"].Status)
+
+	// checking someone else requires Control
+	request, err = http.NewRequest("GET", api+"&webid="+url.QueryEscape(user1), nil)
+	assert.NoError(t, err)
+	response, err = user2h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 403, response.StatusCode)
+
+	request, err = http.NewRequest("GET", api+"&webid="+url.QueryEscape(user2), nil)
+	assert.NoError(t, err)
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 401, response.StatusCode)
+
+	request, err = http.NewRequest("GET", api+"&webid="+url.QueryEscape(user2), nil)
+	assert.NoError(t, err)
+	response, err = user1h.Do(request)
+	assert.NoError(t, err)
+	body, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.NoError(t, json.Unmarshal(body, &perms))
+	assert.Equal(t, []string{"read", "append"}, perms.Modes)
+
+	// anonymous agents can check their own permissions
+	request, err = http.NewRequest("GET", api, nil)
+	assert.NoError(t, err)
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	body, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.NoError(t, json.Unmarshal(body, &perms))
+	assert.Equal(t, []string{"read"}, perms.Modes)
+	assert.Equal(t, 401, perms.Grant["write"].Status)
+
+	request, err = http.NewRequest("GET", testServer.URL+"/"+SystemPrefix+"/permissions?uri="+url.QueryEscape("https://elsewhere.example/doc"), nil)
+	assert.NoError(t, err)
+	response, err = user1h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 400, response.StatusCode)
+}
+
+func TestWACControlForACL(t *testing.T) {
+	policies := "<#User2> acl:accessTo <" + testServer.URL + wacDir + ">, <" + testServer.URL + wacDir + ".acl> ;\n" +
+		"	acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user2 + "> ;\n" +
+		"	acl:mode acl:Read, acl:Write ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+
+	// Read and Write on the container do not extend to its ACL
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+"doc", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+".acl", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "PUT", testServer.URL+wacDir+".acl", wacACL("")))
+	assert.Equal(t, 403, wacDo(t, user2h, "DELETE", testServer.URL+wacDir+".acl", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "PUT", testServer.URL+wacDir+"doc.acl", ""))
+	assert.Equal(t, 200, wacDo(t, user1h, "HEAD", testServer.URL+wacDir+".acl", ""))
+}
+
+func TestWACValidateACL(t *testing.T) {
+	assert.Equal(t, 400, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("<#Broken> acl:mode")))
+	assert.Equal(t, 400, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("<#Typo> acl:acessTo <"+testServer.URL+wacDir+"> .")))
+	assert.Equal(t, 400, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("<#Typo> acl:accessTo <"+testServer.URL+wacDir+"> ; acl:mode acl:Reed .")))
+	assert.Equal(t, 400, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("<#Typo> acl:accessTo <"+testServer.URL+wacDir+"> ; acl:mode <http://example.org/Read> .")))
+
+	request, err := http.NewRequest("PUT", testServer.URL+wacDir+".acl", strings.NewReader(wacACL("")))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/ld+json")
+	response, err := user1h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 415, response.StatusCode)
+
+	request, err = http.NewRequest("PATCH", testServer.URL+wacDir+".acl", strings.NewReader("INSERT DATA { <#Typo> <http://www.w3.org/ns/auth/acl#agnet> <"+user2+"> . }"))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/sparql-update")
+	response, err = user1h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 400, response.StatusCode)
+}
+
+func TestWACPreventLockout(t *testing.T) {
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("")))
+
+	policies := "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+		"<#Owner> acl:accessTo <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user1 + "> ;\n" +
+		"	acl:mode acl:Read, acl:Write ."
+	assert.Equal(t, 409, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", policies))
+	assert.Equal(t, 409, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", "<a> <b> <c> ."))
+
+	request, err := http.NewRequest("PATCH", testServer.URL+wacDir+".acl", strings.NewReader("DELETE DATA { <#Owner> <http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Control> . }"))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/sparql-update")
+	response, err := user1h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 409, response.StatusCode)
+	assert.Equal(t, 200, wacDo(t, user1h, "HEAD", testServer.URL+wacDir+".acl", ""))
+
+	// handing Control over to someone else is fine, as long as the author keeps it
+	policies = "<#User2> acl:accessTo <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user2 + "> ;\n" +
+		"	acl:mode acl:Control ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+".acl", ""))
+
+	// removing a resource ACL falls back to the inherited policies
+	owners := "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+		"<#Owners> acl:accessTo <" + testServer.URL + wacDir + "sub/> ;\n" +
+		"	acl:default <" + testServer.URL + wacDir + "sub/> ;\n" +
+		"	acl:agent <" + user1 + ">, <" + user2 + "> ;\n" +
+		"	acl:mode acl:Control ."
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", testServer.URL+wacDir+"sub/.acl", owners))
+	assert.Equal(t, 409, wacDo(t, user2h, "DELETE", testServer.URL+wacDir+"sub/.acl", ""))
+	assert.Equal(t, 200, wacDo(t, user1h, "DELETE", testServer.URL+wacDir+"sub/.acl", ""))
+
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("")))
+}
+
+func TestWACTrustedApp(t *testing.T) {
+	app := "https://app.example"
+	withOrigin := func(client *http.Client, method string, uri string, origin string) int {
+		request, err := http.NewRequest(method, uri, strings.NewReader("<a> <b> <c> ."))
+		assert.NoError(t, err)
+		request.Header.Add("Content-Type", "text/turtle")
+		request.Header.Add("Origin", origin)
+		response, err := client.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	trust := func(verb string, modes string) {
+		request, err := http.NewRequest("PATCH", user1, strings.NewReader(verb+" DATA { <#id> <http://www.w3.org/ns/auth/acl#trustedApp> <#app> . "+
+			"<#app> <http://www.w3.org/ns/auth/acl#origin> <"+app+"> ; <http://www.w3.org/ns/auth/acl#mode> "+modes+" . }"))
+		assert.NoError(t, err)
+		request.Header.Add("Content-Type", "application/sparql-update")
+		response, err := user1h.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, 200, response.StatusCode)
+	}
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("")))
+
+	// apps that are not trusted get nothing, the pod itself gets everything
+	assert.Equal(t, 403, withOrigin(user1h, "HEAD", testServer.URL+wacDir+"doc", app))
+	assert.Equal(t, 200, withOrigin(user1h, "HEAD", testServer.URL+wacDir+"doc", testServer.URL))
+	assert.Equal(t, 200, withOrigin(user1h, "PUT", testServer.URL+wacDir+"doc", testServer.URL))
+
+	trust("INSERT", "<http://www.w3.org/ns/auth/acl#Read>")
+	assert.Equal(t, 200, withOrigin(user1h, "HEAD", testServer.URL+wacDir+"doc", app))
+	assert.Equal(t, 403, withOrigin(user1h, "PUT", testServer.URL+wacDir+"doc", app))
+	assert.Equal(t, 403, withOrigin(user1h, "HEAD", testServer.URL+wacDir+".acl", app))
+	assert.Equal(t, 403, withOrigin(user1h, "HEAD", testServer.URL+wacDir+"doc", "https://evil.example"))
+
+	trust("INSERT", "<http://www.w3.org/ns/auth/acl#Write>")
+	assert.Equal(t, 200, withOrigin(user1h, "PUT", testServer.URL+wacDir+"doc", app))
+	assert.Equal(t, 200, withOrigin(user1h, "POST", testServer.URL+wacDir+"doc", app))
+	trust("DELETE", "<http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>")
+	assert.Equal(t, 403, withOrigin(user1h, "HEAD", testServer.URL+wacDir+"doc", app))
+
+	// public resources stay readable, and authorizations naming the origin are not capped
+	policies := "<#Public> acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agentClass foaf:Agent ;\n" +
+		"	acl:mode acl:Read .\n" +
+		"<#App> acl:default <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user2 + "> ;\n" +
+		"	acl:origin <" + app + "> ;\n" +
+		"	acl:mode acl:Write ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+	assert.Equal(t, 200, withOrigin(user1h, "HEAD", testServer.URL+wacDir+"doc", app))
+	assert.Equal(t, 403, withOrigin(user1h, "PUT", testServer.URL+wacDir+"doc", app))
+	assert.Equal(t, 200, withOrigin(user2h, "PUT", testServer.URL+wacDir+"doc", app))
+	assert.Equal(t, 200, withOrigin(httpClient, "HEAD", testServer.URL+wacDir+"doc", app))
+
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("")))
+}
+
+func TestWACControlOnly(t *testing.T) {
+	policies := "<#User2> acl:accessTo <" + testServer.URL + wacDir + "> ;\n" +
+		"	acl:agent <" + user2 + "> ;\n" +
+		"	acl:mode acl:Control ."
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL(policies)))
+
+	// acl:Control only covers the ACL resource
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir+".acl", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "HEAD", testServer.URL+wacDir, ""))
+
+	config.ControlGrantsAll = true
+	assert.Equal(t, 200, wacDo(t, user2h, "HEAD", testServer.URL+wacDir, ""))
+	config.ControlGrantsAll = false
+
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", testServer.URL+wacDir+".acl", wacACL("")))
+}
+
+func TestWACCleanUp(t *testing.T) {
+	for _, path := range []string{"sub/doc", "sub/", "doc", ".acl", ""} {
+		assert.Equal(t, 200, wacDo(t, user1h, "DELETE", testServer.URL+wacDir+path, ""))
+	}
+}
+
 func TestACLCleanUp(t *testing.T) {
 	request, err := http.NewRequest("DELETE", testServer.URL+aclDir+"abcd", nil)
 	assert.NoError(t, err)
@@ -1026,7 +1397,7 @@ func TestACLCleanUp(t *testing.T) {
 func TestACLwalkPath(t *testing.T) {
 	config.Debug = false
 	s := NewServer(config)
-	req := &httpRequest{nil, s, "", "", "", false}
+	req := &httpRequest{nil, s, "", "", "", false, "", "", nil, nil}
 
 	path := "http://example.org/foo/bar/baz"
 	p, _ := req.pathInfo(path)
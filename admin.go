@@ -0,0 +1,368 @@
+package gold
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const accountType = "Accounts"
+
+// accountRecord is what the server keeps about an account, in the bucket of its host
+type accountRecord struct {
+	Base      string    `json:"base"`
+	WebID     string    `json:"webid,omitempty"`
+	Created   time.Time `json:"created"`
+	Suspended bool      `json:"suspended,omitempty"`
+	// Legal suspensions are answered with 451 instead of 403
+	Legal  bool   `json:"legal,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// adminAccount is an account as listed by the admin API
+type adminAccount struct {
+	accountRecord
+	DiskUsed     int64     `json:"diskUsed"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+type adminRequest struct {
+	Action   string `json:"action"`
+	Account  string `json:"account"`
+	Reason   string `json:"reason"`
+	Legal    bool   `json:"legal"`
+	Password string `json:"password"`
+}
+
+// isAdmin tells if the WebID is one of the server administrators
+func (s *Server) isAdmin(webid string) bool {
+	return len(webid) > 0 && hasString(s.Config.Admins, webid)
+}
+
+// putAccount saves the record of an account
+func (s *Server) putAccount(rec *accountRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket, err := tx.CreateBucketIfNotExists([]byte(hostOf(rec.Base)))
+		if err != nil {
+			return err
+		}
+		bucket, err := hostBucket.CreateBucketIfNotExists([]byte(accountType))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(rec.Base), data)
+	})
+}
+
+// getAccount returns the record of the account with the given base URI, or nil if there is none
+func (s *Server) getAccount(base string) (*accountRecord, error) {
+	var rec *accountRecord
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(hostOf(base)))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(accountType))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(base))
+		if data == nil {
+			return nil
+		}
+		rec = new(accountRecord)
+		return json.Unmarshal(data, rec)
+	})
+	return rec, err
+}
+
+// deleteAccountRecord removes the record of an account
+func (s *Server) deleteAccountRecord(base string) error {
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(hostOf(base)))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(accountType))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(base))
+	})
+}
+
+// accountSuspension returns the record of the suspended account holding the resource, if any.
+// Accounts are either at the root of a host, or one level below it.
+func (s *Server) accountSuspension(resource *pathInfo) *accountRecord {
+	if s.BoltDB == nil || resource == nil {
+		return nil
+	}
+	bases := []string{resource.Base + "/"}
+	if i := strings.Index(resource.Path, "/"); i > 0 {
+		bases = append(bases, resource.Base+"/"+resource.Path[:i+1])
+	}
+	for _, base := range bases {
+		rec, err := s.getAccount(base)
+		if err != nil {
+			s.debug.Println("Could not read the account record of " + base + ": " + err.Error())
+		} else if rec != nil && rec.Suspended {
+			return rec
+		}
+	}
+	return nil
+}
+
+// accountUsage returns the disk usage of the account and the time of its last change
+func accountUsage(root string) (int64, time.Time) {
+	var size int64
+	var last time.Time
+	filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err == nil && f != nil {
+			size += f.Size()
+			if f.ModTime().After(last) {
+				last = f.ModTime()
+			}
+		}
+		return nil
+	})
+	return size, last.UTC()
+}
+
+// accountBases returns the base URIs of the accounts found in the data root, that is the
+// folders (hosts with vhosts) holding a WebID profile
+func (req *httpRequest) accountBases() ([]string, error) {
+	resource, err := req.pathInfo(req.BaseURI())
+	if err != nil {
+		return nil, err
+	}
+	bases := []string{}
+	if !req.Server.Config.Vhosts {
+		if _, err := os.Stat(filepath.Join(req.Server.Config.DataRoot, "profile", "card")); err == nil {
+			bases = append(bases, resource.Base+"/")
+		}
+	}
+	dirs, err := ioutil.ReadDir(req.Server.Config.DataRoot)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(req.Server.Config.DataRoot, dir.Name(), "profile", "card")); err != nil {
+			continue
+		}
+		if req.Server.Config.Vhosts {
+			bases = append(bases, resource.Obj.Scheme+"://"+dir.Name()+"/")
+		} else {
+			bases = append(bases, resource.Base+"/"+dir.Name()+"/")
+		}
+	}
+	return bases, nil
+}
+
+// listAccounts describes the accounts of the server. Accounts created before their records
+// were kept date from their ACL.
+func (req *httpRequest) listAccounts() ([]*adminAccount, error) {
+	s := req.Server
+	bases, err := req.accountBases()
+	if err != nil {
+		return nil, err
+	}
+	list := []*adminAccount{}
+	for _, base := range bases {
+		root, err := req.pathInfo(base)
+		if err != nil {
+			return nil, err
+		}
+		account := &adminAccount{accountRecord: accountRecord{Base: base, WebID: base + "profile/card#me"}}
+		if rec, err := s.getAccount(base); err != nil {
+			return nil, err
+		} else if rec != nil {
+			account.accountRecord = *rec
+		} else if stat, err := os.Stat(root.AclFile); err == nil {
+			account.Created = stat.ModTime().UTC()
+		}
+		account.DiskUsed, account.LastActivity = accountUsage(root.File)
+		sessions, err := s.listSessions(hostOf(base), account.WebID)
+		if err == nil && len(sessions) > 0 && sessions[0].LastSeen.After(account.LastActivity) {
+			account.LastActivity = sessions[0].LastSeen
+		}
+		list = append(list, account)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Base < list[j].Base })
+	return list, nil
+}
+
+// resetCredentials removes the password, second factor, sessions and authorization tokens of
+// the WebID on the host, and returns how many of them were removed
+func (s *Server) resetCredentials(host string, webid string) (int, error) {
+	n, err := s.revokeSessions(host, webid, nil, "")
+	if err != nil {
+		return n, err
+	}
+	if tokens, err := s.getTokensByType(authzTokenType, host); err == nil {
+		for token, values := range tokens {
+			if values["webid"] != webid {
+				continue
+			}
+			if err = s.deletePersistedToken(authzTokenType, host, token); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	if e, err := s.getTOTP(host, webid); err != nil {
+		return n, err
+	} else if e != nil {
+		if err = s.putTOTP(host, &totpEnrolment{WebID: webid}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	removed, err := s.deleteCredential(host, webid)
+	if removed {
+		n++
+	}
+	return n, err
+}
+
+// adminAccountOf returns the record of an existing account (an empty one if it has none) and
+// the path of its root. Only the bases listed by accountBases are accepted.
+func (req *httpRequest) adminAccountOf(base string) (*accountRecord, *pathInfo, error) {
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	bases, err := req.accountBases()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasString(bases, base) {
+		return nil, nil, errors.New("Unknown account " + base)
+	}
+	root, err := req.pathInfo(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	rec, err := req.Server.getAccount(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec == nil {
+		rec = &accountRecord{Base: base, WebID: base + "profile/card#me"}
+		if stat, err := os.Stat(root.AclFile); err == nil {
+			rec.Created = stat.ModTime().UTC()
+		}
+	}
+	return rec, root, nil
+}
+
+// accountAdmin is the API of the server administrators. It lists the accounts (GET), suspends,
+// unsuspends or resets the credentials of an account (POST, with a JSON action), and deletes
+// an account (DELETE, with an account parameter).
+func accountAdmin(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if !s.isAdmin(req.User) {
+		return SystemReturn{Status: 403, Body: "Only server administrators can use this API"}
+	}
+	if s.BoltDB == nil {
+		return SystemReturn{Status: 503, Body: "The admin API requires a database"}
+	}
+	w.Header().Set(HCType, "application/json")
+
+	switch req.Method {
+	case "GET", "HEAD":
+		list, err := req.listAccounts()
+		if err != nil {
+			s.debug.Println("Could not list the accounts: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200, Body: string(data)}
+
+	case "DELETE":
+		rec, root, err := req.adminAccountOf(req.FormValue("account"))
+		if err != nil {
+			return SystemReturn{Status: 404, Body: err.Error()}
+		}
+		// only folders strictly under the data root can be removed
+		rel, err := filepath.Rel(filepath.Clean(s.Config.DataRoot), filepath.Clean(root.File))
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return SystemReturn{Status: 400, Body: "The account at the root of the server cannot be deleted"}
+		}
+		if _, err = s.resetCredentials(hostOf(rec.Base), rec.WebID); err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		if err = os.RemoveAll(root.File); err != nil {
+			s.debug.Println("Could not delete " + root.File + ": " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		if err = s.deleteAccountRecord(rec.Base); err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		s.profileCache.flush(rec.WebID)
+		s.debug.Println(req.User + " deleted the account " + rec.Base)
+		return SystemReturn{Status: 200}
+
+	case "POST":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		var adminReq adminRequest
+		if err = json.Unmarshal(data, &adminReq); err != nil {
+			return SystemReturn{Status: 400, Body: err.Error()}
+		}
+		rec, _, err := req.adminAccountOf(adminReq.Account)
+		if err != nil {
+			return SystemReturn{Status: 404, Body: err.Error()}
+		}
+
+		result := map[string]interface{}{"account": rec.Base}
+		switch adminReq.Action {
+		case "suspend":
+			rec.Suspended, rec.Legal, rec.Reason = true, adminReq.Legal, adminReq.Reason
+			err = s.putAccount(rec)
+		case "unsuspend":
+			rec.Suspended, rec.Legal, rec.Reason = false, false, ""
+			err = s.putAccount(rec)
+		case "reset":
+			var n int
+			n, err = s.resetCredentials(hostOf(rec.Base), rec.WebID)
+			result["removed"] = n
+			if err == nil && len(adminReq.Password) > 0 {
+				err = s.setPassword(rec.Base, rec.WebID, adminReq.Password)
+			}
+		default:
+			return SystemReturn{Status: 400, Body: "Unknown action " + adminReq.Action}
+		}
+		if err != nil {
+			s.debug.Println("Admin " + adminReq.Action + " error for " + rec.Base + ": " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		s.debug.Println(req.User + " applied " + adminReq.Action + " to the account " + rec.Base)
+		data, err = json.Marshal(result)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200, Body: string(data)}
+	}
+	return SystemReturn{Status: 405, Body: "405 - Method Not Allowed: " + req.Method}
+}
@@ -0,0 +1,131 @@
+package gold
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testLogin logs in with a password on the server, and returns the session cookie
+func testLogin(t *testing.T, server string, webid string, pass string) string {
+	response, _ := oidcDo(t, httpClient, "POST", server+"/"+SystemPrefix+"/login", url.Values{
+		"webid":    {webid},
+		"password": {pass},
+	}, nil)
+	for _, c := range response.Cookies() {
+		return c.Name + "=" + c.Value
+	}
+	return ""
+}
+
+func TestAdminAPI(t *testing.T) {
+	defer startTestBolt(t, handler2, "_test/admin.db")()
+	defer removeTestAccount("dave")
+	admin := "https://admin.example/profile/card#me"
+	config2.Admins = []string{admin}
+	defer func() { config2.Admins = nil }()
+
+	ts := httptest.NewUnstartedServer(handler2)
+	ts.TLS = new(tls.Config)
+	ts.TLS.NextProtos = []string{"http/1.1"}
+	ts.StartTLS()
+	defer ts.Close()
+
+	base := ts.URL + "/dave/"
+	dave := base + "profile/card#me"
+	api := ts.URL + "/" + SystemPrefix + "/admin"
+	response, _ := oidcDo(t, httpClient, "POST", ts.URL+"/"+SystemPrefix+"/new", url.Values{
+		"username": {"dave"},
+		"password": {"davepass"},
+	}, nil)
+	assert.Equal(t, 200, response.StatusCode)
+
+	login := func(webid string, pass string) string {
+		return testLogin(t, ts.URL, webid, pass)
+	}
+	do := func(method string, uri string, body string, cookie string) (*http.Response, string) {
+		request, err := http.NewRequest(method, uri, strings.NewReader(body))
+		assert.NoError(t, err)
+		if len(cookie) > 0 {
+			request.Header.Add("Cookie", cookie)
+		}
+		response, err := httpClient.Do(request)
+		assert.NoError(t, err)
+		data, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return response, string(data)
+	}
+
+	assert.NoError(t, handler2.setPassword(ts.URL+"/", admin, "secret"))
+	adminCookie := login(admin, "secret")
+	assert.NotEmpty(t, adminCookie)
+	daveCookie := login(dave, "davepass")
+	assert.NotEmpty(t, daveCookie)
+
+	response, _ = do("GET", api, "", "")
+	assert.Equal(t, 401, response.StatusCode)
+	response, _ = do("GET", api, "", daveCookie)
+	assert.Equal(t, 403, response.StatusCode)
+
+	response, body := do("GET", api, "", adminCookie)
+	assert.Equal(t, 200, response.StatusCode)
+	var list []*adminAccount
+	assert.NoError(t, json.Unmarshal([]byte(body), &list))
+	assert.Len(t, list, 1)
+	assert.Equal(t, base, list[0].Base)
+	assert.Equal(t, dave, list[0].WebID)
+	assert.False(t, list[0].Created.IsZero())
+	assert.False(t, list[0].LastActivity.IsZero())
+	assert.True(t, list[0].DiskUsed > 0)
+
+	// suspended accounts are only reachable by admins
+	response, _ = do("GET", base+"profile/card", "", "")
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = do("POST", api, `{"action":"suspend","account":"`+base+`","reason":"spam"}`, adminCookie)
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = do("GET", base+"profile/card", "", daveCookie)
+	assert.Equal(t, 403, response.StatusCode)
+	response, _ = do("GET", base+"profile/card", "", adminCookie)
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = do("POST", api, `{"action":"suspend","account":"`+base+`","legal":true}`, adminCookie)
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = do("GET", base+"profile/card", "", "")
+	assert.Equal(t, 451, response.StatusCode)
+	response, _ = do("POST", api, `{"action":"unsuspend","account":"`+base+`"}`, adminCookie)
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = do("GET", base+"profile/card", "", "")
+	assert.Equal(t, 200, response.StatusCode)
+
+	// resetting the credentials ends the sessions and replaces the password
+	response, body = do("POST", api, `{"action":"reset","account":"`+base+`","password":"newpass"}`, adminCookie)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Contains(t, body, `"removed":3`)
+	response, _ = do("GET", base+"profile/card", "", daveCookie)
+	assert.Empty(t, response.Header.Get("User"))
+	assert.Empty(t, login(dave, "davepass"))
+	assert.NotEmpty(t, login(dave, "newpass"))
+
+	response, _ = do("POST", api, `{"action":"rename","account":"`+base+`"}`, adminCookie)
+	assert.Equal(t, 400, response.StatusCode)
+	response, _ = do("DELETE", api+"?account="+url.QueryEscape(ts.URL+"/nobody/"), "", adminCookie)
+	assert.Equal(t, 404, response.StatusCode)
+	response, _ = do("DELETE", api+"?account="+url.QueryEscape(base+"../"), "", adminCookie)
+	assert.Equal(t, 404, response.StatusCode)
+	response, _ = do("DELETE", api+"?account="+url.QueryEscape(base+"profile/"), "", adminCookie)
+	assert.Equal(t, 404, response.StatusCode)
+	response, _ = do("DELETE", api+"?account="+url.QueryEscape(base), "", adminCookie)
+	assert.Equal(t, 200, response.StatusCode)
+	_, err := os.Stat(config2.DataRoot + "dave/")
+	assert.True(t, os.IsNotExist(err))
+	cred, err := handler2.getCredential(hostOf(base), dave)
+	assert.NoError(t, err)
+	assert.Nil(t, cred)
+}
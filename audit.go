@@ -0,0 +1,281 @@
+package gold
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// auditQueryLimit is the default number of entries returned by the audit API
+	auditQueryLimit = 100
+)
+
+// AuditEntry is a single access decision of the audit log
+type AuditEntry struct {
+	Time          time.Time  `json:"time"`
+	Host          string     `json:"host"`
+	Remote        string     `json:"remote,omitempty"`
+	WebID         string     `json:"webid,omitempty"`
+	Delegate      string     `json:"delegate,omitempty"`
+	AuthMethod    string     `json:"authMethod,omitempty"`
+	ClientID      string     `json:"clientId,omitempty"`
+	Origin        string     `json:"origin,omitempty"`
+	Method        string     `json:"method"`
+	URI           string     `json:"uri"`
+	Mode          string     `json:"mode"`
+	Decision      string     `json:"decision"`
+	Status        int        `json:"status"`
+	ACL           string     `json:"acl,omitempty"`
+	Authorization string     `json:"authorization,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	LockedUntil   *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// auditLog appends JSON lines to a file, which is rotated once it reaches maxSize
+// (file -> file.1 -> file.2 ...), keeping at most the given number of backups
+type auditLog struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func newAuditLog(path string, maxSize int64, backups int) *auditLog {
+	return &auditLog{path: path, maxSize: maxSize, backups: backups}
+}
+
+// Write appends an entry to the log
+func (l *auditLog) Write(e *AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		if err = l.open(); err != nil {
+			return err
+		}
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err = l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, stat.Size()
+	return nil
+}
+
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	os.Remove(l.backup(l.backups))
+	for i := l.backups - 1; i > 0; i-- {
+		os.Rename(l.backup(i), l.backup(i+1))
+	}
+	if l.backups > 0 {
+		if err := os.Rename(l.path, l.backup(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *auditLog) backup(i int) string {
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// Query returns the last entries (oldest first) that match the filter, reading the
+// rotated files too
+func (l *auditLog) Query(match func(*AuditEntry) bool, limit int) ([]*AuditEntry, error) {
+	// the files are opened under the lock, so that a rotation does not move them while they
+	// are read, and then read without blocking the writers
+	files, err := l.snapshot()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*AuditEntry{}
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			e := new(AuditEntry)
+			if json.Unmarshal(scanner.Bytes(), e) != nil || !match(e) {
+				continue
+			}
+			entries = append(entries, e)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// snapshot opens the backups (oldest first) and the current log, each limited to its
+// current size
+func (l *auditLog) snapshot() ([]io.ReadCloser, error) {
+	l.Lock()
+	defer l.Unlock()
+	files := []io.ReadCloser{}
+	for i := l.backups; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.backup(i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return files, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return files, err
+		}
+		files = append(files, struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, stat.Size()), f})
+	}
+	return files, nil
+}
+
+// Close closes the current log file
+func (l *auditLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// audit records an access decision of the request
+func (acl *WAC) audit(mode string, path string, status int, err error) {
+	if acl.srv.auditLog == nil || acl.w == nil {
+		return
+	}
+	e := &AuditEntry{
+		Time:          time.Now().UTC(),
+		Host:          acl.req.Host,
+		Remote:        acl.req.RemoteAddr,
+		WebID:         acl.user,
+		AuthMethod:    acl.req.AuthMethod,
+		ClientID:      acl.req.ClientID,
+		Origin:        acl.req.Header.Get("Origin"),
+		Method:        acl.req.Method,
+		URI:           path,
+		Mode:          mode,
+		Decision:      "deny",
+		Status:        status,
+		ACL:           acl.grantACL,
+		Authorization: acl.grantAuth,
+	}
+	if status == 200 && err == nil {
+		e.Decision = "allow"
+	} else if err != nil {
+		e.Reason = err.Error()
+	}
+	if len(acl.user) == 0 && len(acl.key) > 0 {
+		e.AuthMethod = "key"
+	}
+	if len(acl.user) > 0 && acl.user == acl.req.User {
+		e.Delegate = acl.req.delegate()
+	}
+	if werr := acl.srv.auditLog.Write(e); werr != nil {
+		acl.srv.debug.Println("Audit log error: " + werr.Error())
+	}
+}
+
+// accountAudit returns the audit log entries of the pod, filtered by the webid, uri (prefix),
+// decision and since (RFC 3339) parameters. Only the owner of the pod can query the log.
+func accountAudit(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if !req.IsOwner {
+		return SystemReturn{Status: 403, Body: "Only the owner of the pod can read the audit log"}
+	}
+	if s.auditLog == nil {
+		return SystemReturn{Status: 404, Body: "The audit log is disabled"}
+	}
+
+	webid, uri, decision := req.FormValue("webid"), req.FormValue("uri"), req.FormValue("decision")
+	var since time.Time
+	if len(req.FormValue("since")) > 0 {
+		var err error
+		since, err = time.Parse(time.RFC3339, req.FormValue("since"))
+		if err != nil {
+			return SystemReturn{Status: 400, Body: err.Error()}
+		}
+	}
+	limit := auditQueryLimit
+	if len(req.FormValue("limit")) > 0 {
+		n, err := strconv.Atoi(req.FormValue("limit"))
+		if err != nil || n <= 0 {
+			return SystemReturn{Status: 400, Body: fmt.Sprintf("Invalid limit: %q", req.FormValue("limit"))}
+		}
+		limit = n
+	}
+
+	entries, err := s.auditLog.Query(func(e *AuditEntry) bool {
+		return e.Host == req.Host &&
+			(len(webid) == 0 || e.WebID == webid) &&
+			(len(uri) == 0 || strings.HasPrefix(e.URI, uri)) &&
+			(len(decision) == 0 || e.Decision == decision) &&
+			!e.Time.Before(since)
+	}, limit)
+	if err != nil {
+		s.debug.Println("Audit log error: " + err.Error())
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	w.Header().Set(HCType, "application/json")
+	return SystemReturn{Status: 200, Body: string(data)}
+}
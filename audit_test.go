@@ -0,0 +1,152 @@
+package gold
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	file := "_test/rotate.log"
+	err := os.MkdirAll("_test", 0755)
+	assert.NoError(t, err)
+	l := newAuditLog(file, 300, 2)
+	defer func() {
+		l.Close()
+		for _, f := range []string{file, file + ".1", file + ".2", file + ".3"} {
+			os.Remove(f)
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		err = l.Write(&AuditEntry{Time: time.Now(), Host: "example.org", URI: "https://example.org/" + string('a'+rune(i)), Method: "GET", Mode: "Read", Decision: "allow", Status: 200})
+		assert.NoError(t, err)
+	}
+	for _, f := range []string{file, file + ".1", file + ".2"} {
+		stat, err := os.Stat(f)
+		assert.NoError(t, err)
+		assert.True(t, stat.Size() <= 300)
+	}
+	_, err = os.Stat(file + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// the oldest entries are dropped along with the oldest backup, the rest are read in order
+	entries, err := l.Query(func(e *AuditEntry) bool { return true }, 100)
+	assert.NoError(t, err)
+	assert.True(t, len(entries) > 0 && len(entries) < 10)
+	assert.Equal(t, "https://example.org/j", entries[len(entries)-1].URI)
+	for i := 1; i < len(entries); i++ {
+		assert.True(t, entries[i-1].URI < entries[i].URI)
+	}
+
+	entries, err = l.Query(func(e *AuditEntry) bool { return true }, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "https://example.org/i", entries[0].URI)
+
+	// queries do not hold up writes, nor see the entries written and rotated meanwhile
+	n := 0
+	entries, err = l.Query(func(e *AuditEntry) bool {
+		if n++; n == 1 {
+			for i := 0; i < 5; i++ {
+				assert.NoError(t, l.Write(&AuditEntry{Time: time.Now(), Host: "example.org", URI: "https://example.org/z", Method: "GET", Mode: "Read", Decision: "allow", Status: 200}))
+			}
+		}
+		return true
+	}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.org/j", entries[len(entries)-1].URI)
+}
+
+func TestAuditLogAPI(t *testing.T) {
+	file := "_test/audit.log"
+	handler.Config.AuditLog = file
+	handler.auditLog = newAuditLog(file, 0, 0)
+	defer func() {
+		handler.auditLog.Close()
+		handler.auditLog = nil
+		handler.Config.AuditLog = ""
+		os.Remove(file)
+	}()
+
+	dir := testServer.URL + "/_test/auditdir/"
+	api := testServer.URL + "/" + SystemPrefix + "/audit"
+	owner := "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+		"<#Owner> acl:accessTo <" + dir + "> ;\n" +
+		"	acl:default <" + dir + "> ;\n" +
+		"	acl:agent <" + user1 + "> ;\n" +
+		"	acl:mode acl:Read, acl:Write, acl:Control ."
+	assert.Equal(t, 201, wacDo(t, user1h, "MKCOL", dir, ""))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+".acl", owner))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+"doc", "<a> <b> <c> ."))
+	assert.Equal(t, 401, wacDo(t, httpClient, "HEAD", dir+"doc", ""))
+	assert.Equal(t, 403, wacDo(t, user2h, "HEAD", dir+"doc", ""))
+	assert.Equal(t, 200, wacDo(t, user1h, "HEAD", dir+"doc", ""))
+
+	query := func(client *http.Client, params string) (int, []AuditEntry) {
+		var entries []AuditEntry
+		request, err := http.NewRequest("GET", api+params, nil)
+		assert.NoError(t, err)
+		response, err := client.Do(request)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.NoError(t, err)
+		if response.StatusCode == 200 {
+			assert.NoError(t, json.Unmarshal(data, &entries))
+		}
+		return response.StatusCode, entries
+	}
+
+	status, _ := query(httpClient, "")
+	assert.Equal(t, 401, status)
+
+	status, entries := query(user1h, "?uri="+url.QueryEscape(dir+"doc")+"&decision=deny")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "", entries[0].WebID)
+	assert.Equal(t, 401, entries[0].Status)
+	assert.Equal(t, user2, entries[1].WebID)
+	assert.Equal(t, "WebID-TLS", entries[1].AuthMethod)
+	assert.Equal(t, "HEAD", entries[1].Method)
+	assert.Equal(t, "Read", entries[1].Mode)
+	assert.Equal(t, 403, entries[1].Status)
+	assert.Equal(t, dir+".acl", entries[1].ACL)
+	assert.Empty(t, entries[1].Authorization)
+
+	status, entries = query(user1h, "?uri="+url.QueryEscape(dir+"doc")+"&webid="+url.QueryEscape(user1)+"&limit=1")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "allow", entries[0].Decision)
+	assert.Equal(t, "HEAD", entries[0].Method)
+	assert.Equal(t, dir+".acl", entries[0].ACL)
+	assert.Equal(t, dir+".acl#Owner", entries[0].Authorization)
+
+	status, _ = query(user1h, "?since=yesterday")
+	assert.Equal(t, 400, status)
+	status, entries = query(user1h, "?since="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	assert.Equal(t, 200, status)
+	assert.Empty(t, entries)
+
+	// only the owner of the pod can read the log
+	rootACL := handler.Config.ACLSuffix
+	err := ioutil.WriteFile(rootACL, []byte("<#Owner> <http://www.w3.org/ns/auth/acl#accessTo> <"+testServer.URL+"/> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#agent> <"+user1+"> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Write> ."), 0644)
+	assert.NoError(t, err)
+	status, _ = query(user2h, "")
+	assert.Equal(t, 403, status)
+	status, _ = query(user1h, "")
+	assert.Equal(t, 200, status)
+	os.Remove(rootACL)
+
+	for _, path := range []string{"doc", ".acl", ""} {
+		assert.Equal(t, 200, wacDo(t, user1h, "DELETE", dir+path, ""))
+	}
+}
@@ -18,7 +18,7 @@ type DigestAuthentication struct {
 
 // DigestAuthorization structure
 type DigestAuthorization struct {
-	Type, Source, Username, Nonce, Signature string
+	Type, Source, Username, Nonce, Signature, Algorithm string
 }
 
 func (req *httpRequest) authn(w http.ResponseWriter) string {
@@ -28,17 +28,52 @@ func (req *httpRequest) authn(w http.ResponseWriter) string {
 	}
 	if len(user) > 0 {
 		req.Server.debug.Println("Cookie auth OK for User: " + user)
+		req.AuthMethod = "cookie"
 		return user
 	}
 
-	// try WebID-RSA
-	if len(req.Header.Get("Authorization")) > 0 {
+	// try Solid-OIDC
+	if strings.HasPrefix(req.Header.Get("Authorization"), "DPoP ") {
+		user, req.ClientID, err = DPoPAuth(req)
+		if err != nil {
+			req.Server.debug.Println("DPoP auth error:", err)
+		}
+		if len(user) > 0 {
+			req.Server.debug.Println("DPoP auth OK for User: " + user + " with client: " + req.ClientID)
+			req.AuthMethod = "DPoP"
+		}
+	} else if len(req.Header.Get("Signature-Input")) > 0 {
+		// try HTTP Message Signatures
+		user, err = HTTPSignatureAuth(req)
+		if err != nil {
+			req.Server.debug.Println("HTTP Signature auth error:", err)
+		}
+		if len(user) > 0 {
+			req.Server.debug.Println("HTTP Signature auth OK for User: " + user)
+			req.AuthMethod = "HTTP-Signature"
+		}
+	} else if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") && req.Server.BoltDB != nil {
+		// try persisted bearer tokens
+		token, err := ParseBearerAuthorizationHeader(req.Header.Get("Authorization"))
+		if err == nil {
+			user, err = GetAuthzFromToken(token, req)
+		}
+		if err != nil {
+			req.Server.debug.Println("Bearer auth error:", err)
+		}
+		if len(user) > 0 {
+			req.Server.debug.Println("Bearer auth OK for User: " + user)
+			req.AuthMethod = "bearer"
+		}
+	} else if len(req.Header.Get("Authorization")) > 0 {
+		// try WebID-RSA
 		user, err = WebIDDigestAuth(req)
 		if err != nil {
 			req.Server.debug.Println("WebID-RSA auth error:", err)
 		}
 		if len(user) > 0 {
 			req.Server.debug.Println("WebID-RSA auth OK for User: " + user)
+			req.AuthMethod = "WebID-RSA"
 		}
 	}
 	// fall back to WebID-TLS
@@ -49,18 +84,24 @@ func (req *httpRequest) authn(w http.ResponseWriter) string {
 		}
 		if len(user) > 0 {
 			req.Server.debug.Println("WebID-TLS auth OK for User: " + user)
+			req.AuthMethod = "WebID-TLS"
 		}
 	}
 
 	if len(user) > 0 {
 		if len(req.Header.Get("On-Behalf-Of")) > 0 {
 			delegator := debrack(req.Header.Get("On-Behalf-Of"))
-			if verifyDelegator(delegator, user) {
-				req.Server.debug.Println("Setting delegation user to:", delegator)
+			if grants := req.delegations(delegator, user); len(grants) > 0 {
+				req.Server.debug.Println("Setting delegation user to: " + delegator + " (delegate: " + user + ")")
+				req.Delegations = grants
 				user = delegator
 			}
 		}
-		req.Server.userCookieSet(w, user)
+		// with a session registry, only interactive logins (password, recovery, signup and
+		// OIDC) get a session, since clients authenticating every request would fill it up
+		if req.Server.BoltDB == nil && req.AuthMethod != "DPoP" && req.AuthMethod != "HTTP-Signature" && req.AuthMethod != "bearer" && len(req.Delegations) == 0 {
+			req.userCookieSet(w, user)
+		}
 		return user
 	}
 
@@ -69,46 +110,95 @@ func (req *httpRequest) authn(w http.ResponseWriter) string {
 	return user
 }
 
-func (req *httpRequest) userCookie() (string, error) {
+func (req *httpRequest) sessionValues() (map[string]string, error) {
 	value := make(map[string]string)
 	cookie, err := req.Cookie("Session")
 	if err != nil {
-		return "", errors.New(err.Error() + " Got: " + fmt.Sprintf("%s", req.Cookies()))
+		return nil, errors.New(err.Error() + " Got: " + fmt.Sprintf("%s", req.Cookies()))
 	}
 	err = req.Server.cookie.Decode("Session", cookie.Value, &value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// sessionID returns the ID of the registered session of the request, if any
+func (req *httpRequest) sessionID() string {
+	value, err := req.sessionValues()
+	if err != nil {
+		return ""
+	}
+	return value["sid"]
+}
+
+func (req *httpRequest) userCookie() (string, error) {
+	value, err := req.sessionValues()
 	if err != nil {
 		return "", err
 	}
+	// sessions must be in the registry, so that they can be revoked
+	if req.Server.BoltDB != nil {
+		if len(value["sid"]) == 0 {
+			return "", errors.New("Session is not registered")
+		}
+		webid, err := req.Server.checkSession(hostOf(req.BaseURI()), value["sid"])
+		if err != nil {
+			return "", err
+		}
+		if webid != value["user"] {
+			return "", errors.New("Session does not belong to " + value["user"])
+		}
+	}
 	return value["user"], nil
 }
 
-func (srv *Server) userCookieSet(w http.ResponseWriter, user string) error {
+func (req *httpRequest) userCookieSet(w http.ResponseWriter, user string) error {
 	value := map[string]string{
 		"user": user,
 	}
+	t := time.Duration(req.Server.Config.CookieAge) * time.Hour
+	expires := time.Now().Add(t)
+	if req.Server.BoltDB != nil {
+		sess, err := req.Server.newSession(hostOf(req.BaseURI()), user, expires, req.RemoteAddr, req.UserAgent())
+		if err != nil {
+			return err
+		}
+		value["sid"] = sess.ID
+	}
 
-	encoded, err := srv.cookie.Encode("Session", value)
+	encoded, err := req.Server.cookie.Encode("Session", value)
 	if err != nil {
 		return err
 	}
-	t := time.Duration(srv.Config.CookieAge) * time.Hour
 	cookieCfg := &http.Cookie{
-		Expires: time.Now().Add(t),
-		Name:    "Session",
-		Path:    "/",
-		Value:   encoded,
-		Secure:  true,
+		Expires:  expires,
+		Name:     "Session",
+		Path:     "/",
+		Value:    encoded,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, cookieCfg)
 	return nil
 }
 
-func (srv *Server) userCookieDelete(w http.ResponseWriter) {
+func (req *httpRequest) userCookieDelete(w http.ResponseWriter) {
+	if sid := req.sessionID(); len(sid) > 0 && req.Server.BoltDB != nil {
+		value, _ := req.sessionValues()
+		_, err := req.Server.revokeSessions(hostOf(req.BaseURI()), value["user"], []string{sid}, "")
+		if err != nil {
+			req.Server.debug.Println("Could not revoke the session: " + err.Error())
+		}
+	}
 	http.SetCookie(w, &http.Cookie{
-		Name:   "Session",
-		Value:  "deleted",
-		Path:   "/",
-		MaxAge: -1,
+		Name:     "Session",
+		Value:    "deleted",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
 }
 
@@ -179,6 +269,7 @@ func ParseDigestAuthorizationHeader(header string) (*DigestAuthorization, error)
 		opts["username"],
 		opts["nonce"],
 		opts["sig"],
+		opts["algorithm"],
 	}
 	return &auth, nil
 }
@@ -253,7 +344,7 @@ func IsTokenDateValid(valid string) error {
 
 func GetAuthzFromToken(token string, req *httpRequest) (string, error) {
 	// values, err := GetValuesFromToken("Authorization", token, req, s)
-	values, err := req.Server.getPersistedToken("Authorization", req.Host, token)
+	values, err := req.Server.getPersistedToken(authzTokenType, req.Host, token)
 	if err != nil {
 		return "", err
 	}
@@ -269,6 +360,8 @@ func GetAuthzFromToken(token string, req *httpRequest) (string, error) {
 	if len(origin) > 0 && origin != values["origin"] {
 		return "", errors.New("Cannot authorize user: " + req.User + ". Origin: " + origin + " does not match the origin in the token: " + values["origin"])
 	}
+	req.Server.touchToken(req.Host, token, values)
+	req.Token = values
 	return values["webid"], nil
 }
 
@@ -2,6 +2,7 @@ package gold
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
@@ -22,7 +23,7 @@ func TestUrlEncodeDecode(t *testing.T) {
 
 func TestNewSecureToken(t *testing.T) {
 	tokenValues := map[string]string{
-		"secret": string(handler.cookieSalt),
+		"secret": handler.cookie.salt(),
 	}
 	validity := 1 * time.Minute
 	token, err := NewSecureToken("WWW-Authenticate", tokenValues, validity, handler)
@@ -103,7 +104,7 @@ func TestCookieAuth(t *testing.T) {
 	body := "<#Owner>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + "abc>, <" + acl + ">;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user1 + ">;" +
-		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ." +
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> ." +
 		"<#Restricted>" +
 		"	<http://www.w3.org/ns/auth/acl#accessTo> <" + aclDir + "abc>;" +
 		"	<http://www.w3.org/ns/auth/acl#agent> <" + user2 + ">;" +
@@ -182,6 +183,42 @@ func TestWebIDRSAAuth(t *testing.T) {
 	assert.Equal(t, 200, response.StatusCode)
 }
 
+func TestWebIDRSAAuthSHA256(t *testing.T) {
+	request, err := http.NewRequest("GET", testServer.URL+aclDir+"abc", nil)
+	assert.NoError(t, err)
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, response.StatusCode)
+
+	p, err := ParseDigestAuthenticateHeader(response.Header.Get("WWW-Authenticate"))
+	assert.NoError(t, err)
+	assert.Equal(t, "SHA-256", p.Algorithm)
+
+	signer, err := ParseRSAPrivateKey(user1k)
+	assert.NoError(t, err)
+	claim := sha256.Sum256([]byte(p.Source + user1 + p.Nonce))
+	signed, err := signer.Sign(claim[:])
+	assert.NoError(t, err)
+	b64Sig := base64.StdEncoding.EncodeToString(signed)
+
+	authHeader := `WebID-RSA source="` + p.Source + `", username="` + user1 + `", nonce="` + p.Nonce + `", sig="` + b64Sig + `", algorithm="SHA-256"`
+	request, err = http.NewRequest("GET", testServer.URL+aclDir+"abc", nil)
+	assert.NoError(t, err)
+	request.Header.Add("Authorization", authHeader)
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+
+	// the claim must match the algorithm
+	authHeader = `WebID-RSA source="` + p.Source + `", username="` + user1 + `", nonce="` + p.Nonce + `", sig="` + b64Sig + `", algorithm="SHA-1"`
+	request, err = http.NewRequest("GET", testServer.URL+aclDir+"abc", nil)
+	assert.NoError(t, err)
+	request.Header.Add("Authorization", authHeader)
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, response.StatusCode)
+}
+
 func TestWebIDRSAAuthBadSource(t *testing.T) {
 	request, err := http.NewRequest("GET", testServer.URL+aclDir+"abc", nil)
 	assert.NoError(t, err)
@@ -20,7 +20,7 @@ func mockAccept(accept string) (al AcceptList, err error) {
 	req := &http.Request{}
 	req.Header = make(http.Header)
 	req.Header["Accept"] = []string{accept}
-	myreq := &httpRequest{req, nil, "", "", "", false}
+	myreq := &httpRequest{req, nil, "", "", "", false, "", "", nil, nil}
 	al, err = myreq.Accept()
 	return
 }
@@ -0,0 +1,383 @@
+package gold
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// aclCacheSize is the maximum number of parsed ACL files kept in memory
+	aclCacheSize = 4096
+	// groupCacheSize is the maximum number of remote group documents kept in memory
+	groupCacheSize = 1024
+	// groupCacheMaxAge caps the validity advertised by group servers
+	groupCacheMaxAge = 24 * time.Hour
+	// groupRetryAge is how long a failed group fetch is remembered, so that an
+	// unreachable server is not queried on every request
+	groupRetryAge = time.Minute
+	// profileCacheSize is the maximum number of WebID profiles kept in memory
+	profileCacheSize = 4096
+	// profileCacheMaxAge caps the validity advertised by profile servers
+	profileCacheMaxAge = 24 * time.Hour
+	// profileRetryAge is how long a failed profile fetch is remembered
+	profileRetryAge = 30 * time.Second
+	// profileRefetchAge is the minimum time between two fetches of a profile that
+	// is refreshed because it did not contain the expected key
+	profileRefetchAge = 10 * time.Second
+)
+
+type aclCacheEntry struct {
+	etag  string
+	graph *Graph
+}
+
+// aclCache holds the parsed ACL graphs, keyed by ACL file and revalidated with the file ETag.
+// The cached graphs are shared between requests and must not be modified.
+type aclCache struct {
+	sync.RWMutex
+	entries map[string]*aclCacheEntry
+}
+
+func newACLCache() *aclCache {
+	return &aclCache{entries: map[string]*aclCacheEntry{}}
+}
+
+// get returns the ACL graph for the given ACL file, parsing it only if it changed
+func (c *aclCache) get(uri string, file string) *Graph {
+	etag, err := NewETag(file)
+	if err != nil {
+		// missing file
+		c.invalidate(file)
+		return NewGraph(uri)
+	}
+
+	c.RLock()
+	entry, ok := c.entries[file]
+	c.RUnlock()
+	if ok && entry.etag == etag && entry.graph.URI() == uri {
+		return entry.graph
+	}
+
+	g := NewGraph(uri)
+	g.ReadFile(file)
+	c.Lock()
+	if len(c.entries) >= aclCacheSize {
+		c.entries = map[string]*aclCacheEntry{}
+	}
+	c.entries[file] = &aclCacheEntry{etag: etag, graph: g}
+	c.Unlock()
+	return g
+}
+
+// invalidate drops the cached graph of an ACL file
+func (c *aclCache) invalidate(file string) {
+	c.Lock()
+	delete(c.entries, file)
+	c.Unlock()
+}
+
+type groupCacheEntry struct {
+	graph        *Graph
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+// groupCache holds the remote group documents used by acl:agentClass policies.
+// Entries are kept for the duration advertised by the group server (or the default
+// age), then revalidated with If-None-Match / If-Modified-Since.
+type groupCache struct {
+	sync.Mutex
+	entries map[string]*groupCacheEntry
+	client  *http.Client
+	age     time.Duration
+}
+
+func newGroupCache(age time.Duration, timeout time.Duration) *groupCache {
+	return &groupCache{
+		entries: map[string]*groupCacheEntry{},
+		client: &http.Client{
+			Transport: fetchTransport,
+			Timeout:   timeout,
+		},
+		age: age,
+	}
+}
+
+// get returns the group document, fetching it only if the cached copy has expired
+func (c *groupCache) get(uri string) *Graph {
+	doc := defrag(uri)
+	c.Lock()
+	entry, ok := c.entries[doc]
+	c.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.graph
+	}
+	if !ok {
+		entry = &groupCacheEntry{graph: NewGraph(doc)}
+	}
+
+	fresh, err := c.fetch(doc, entry)
+	if err != nil {
+		// keep serving the last known copy (if any) for a while
+		fresh = &groupCacheEntry{
+			graph:        entry.graph,
+			etag:         entry.etag,
+			lastModified: entry.lastModified,
+			expires:      time.Now().Add(groupRetryAge),
+		}
+	}
+
+	c.Lock()
+	if len(c.entries) >= groupCacheSize {
+		c.entries = map[string]*groupCacheEntry{}
+	}
+	c.entries[doc] = fresh
+	c.Unlock()
+	return fresh.graph
+}
+
+func (c *groupCache) fetch(doc string, entry *groupCacheEntry) (*groupCacheEntry, error) {
+	q, err := http.NewRequest("GET", doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	q.Header.Set("Accept", "text/turtle,text/n3,application/rdf+xml")
+	if len(entry.etag) > 0 {
+		q.Header.Set("If-None-Match", entry.etag)
+	}
+	if len(entry.lastModified) > 0 {
+		q.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+	r, err := c.client.Do(q)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	fresh := &groupCacheEntry{
+		graph:        entry.graph,
+		etag:         entry.etag,
+		lastModified: entry.lastModified,
+		expires:      time.Now().Add(c.maxAge(r.Header)),
+	}
+	switch r.StatusCode {
+	case 200:
+		fresh.graph = NewGraph(doc)
+		fresh.graph.ParseBase(r.Body, r.Header.Get("Content-Type"), doc)
+		fresh.etag = r.Header.Get("ETag")
+		fresh.lastModified = r.Header.Get("Last-Modified")
+	case 304:
+	default:
+		// the group is gone or not readable
+		fresh.graph = NewGraph(doc)
+		fresh.etag, fresh.lastModified = "", ""
+		fresh.expires = time.Now().Add(groupRetryAge)
+	}
+	return fresh, nil
+}
+
+// maxAge returns the validity of a response based on its Cache-Control header
+func (c *groupCache) maxAge(h http.Header) time.Duration {
+	return cacheMaxAge(h, c.age, groupCacheMaxAge)
+}
+
+// cacheMaxAge returns the validity of a response based on its Cache-Control and
+// Expires headers, capped to max, or def if the server did not say
+func cacheMaxAge(h http.Header, def time.Duration, max time.Duration) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.Atoi(directive[len("max-age="):])
+			if err != nil || secs < 0 {
+				continue
+			}
+			age := time.Duration(secs) * time.Second
+			if age > max {
+				age = max
+			}
+			return age
+		}
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		age := time.Until(expires)
+		if age < 0 {
+			age = 0
+		} else if age > max {
+			age = max
+		}
+		return age
+	}
+	return def
+}
+
+type profileCacheEntry struct {
+	graph        *Graph
+	err          error
+	etag         string
+	lastModified string
+	fetched      time.Time
+	expires      time.Time
+}
+
+// profileCache holds the WebID profiles fetched during authentication. Entries are kept
+// for the duration advertised by the profile server (or the default age), then
+// revalidated with If-None-Match / If-Modified-Since. The cached graphs are shared
+// between requests and must not be modified.
+type profileCache struct {
+	sync.Mutex
+	entries map[string]*profileCacheEntry
+	client  *http.Client
+	age     time.Duration
+	maxSize int64
+}
+
+func newProfileCache(age time.Duration, timeout time.Duration, maxSize int64) *profileCache {
+	return &profileCache{
+		entries: map[string]*profileCacheEntry{},
+		client: &http.Client{
+			Transport: fetchTransport,
+			Timeout:   timeout,
+		},
+		age:     age,
+		maxSize: maxSize,
+	}
+}
+
+// get returns the profile document of a WebID. With refresh, a cached copy is
+// revalidated unless it was fetched very recently, e.g. when a key was not found in it.
+func (c *profileCache) get(webid string, refresh bool) (*Graph, error) {
+	doc := defrag(webid)
+	c.Lock()
+	entry, ok := c.entries[doc]
+	c.Unlock()
+	if ok && (time.Now().Before(entry.expires) || entry.err != nil && time.Since(entry.fetched) < profileRetryAge) &&
+		(!refresh || time.Since(entry.fetched) < profileRefetchAge) {
+		return entry.graph, entry.err
+	}
+	if !ok {
+		entry = &profileCacheEntry{}
+	}
+
+	fresh := c.fetch(doc, entry)
+	c.Lock()
+	if len(c.entries) >= profileCacheSize {
+		c.entries = map[string]*profileCacheEntry{}
+	}
+	c.entries[doc] = fresh
+	c.Unlock()
+	return fresh.graph, fresh.err
+}
+
+func (c *profileCache) fetch(doc string, entry *profileCacheEntry) *profileCacheEntry {
+	fresh := &profileCacheEntry{fetched: time.Now()}
+	fail := func(err error) *profileCacheEntry {
+		fresh.err = err
+		fresh.expires = fresh.fetched
+		return fresh
+	}
+
+	q, err := http.NewRequest("GET", doc, nil)
+	if err != nil {
+		return fail(err)
+	}
+	q.Header.Set("Accept", "text/turtle,text/n3,application/rdf+xml")
+	if entry.graph != nil {
+		if len(entry.etag) > 0 {
+			q.Header.Set("If-None-Match", entry.etag)
+		}
+		if len(entry.lastModified) > 0 {
+			q.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+	r, err := c.client.Do(q)
+	if err != nil {
+		return fail(err)
+	}
+	defer r.Body.Close()
+
+	switch {
+	case r.StatusCode == 304 && entry.graph != nil:
+		fresh.graph = entry.graph
+		fresh.etag, fresh.lastModified = entry.etag, entry.lastModified
+	case r.StatusCode == 200:
+		if r.ContentLength > c.maxSize {
+			return fail(fmt.Errorf("The profile %s is larger than %d bytes", doc, c.maxSize))
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, c.maxSize+1))
+		if err != nil {
+			return fail(err)
+		}
+		if int64(len(body)) > c.maxSize {
+			return fail(fmt.Errorf("The profile %s is larger than %d bytes", doc, c.maxSize))
+		}
+		fresh.graph = NewGraph(doc)
+		fresh.graph.ParseBase(bytes.NewReader(body), r.Header.Get("Content-Type"), doc)
+		fresh.etag = r.Header.Get("ETag")
+		fresh.lastModified = r.Header.Get("Last-Modified")
+	default:
+		return fail(fmt.Errorf("Could not fetch graph from %s - HTTP %d", doc, r.StatusCode))
+	}
+	fresh.expires = fresh.fetched.Add(cacheMaxAge(r.Header, c.age, profileCacheMaxAge))
+	return fresh
+}
+
+// flush drops the cached profile of a WebID (all profiles if the WebID is empty),
+// and returns the number of entries dropped
+func (c *profileCache) flush(webid string) int {
+	c.Lock()
+	defer c.Unlock()
+	if len(webid) == 0 {
+		n := len(c.entries)
+		c.entries = map[string]*profileCacheEntry{}
+		return n
+	}
+	doc := defrag(webid)
+	if _, ok := c.entries[doc]; !ok {
+		return 0
+	}
+	delete(c.entries, doc)
+	return 1
+}
+
+// accountProfileCache drops cached WebID profiles, e.g. after a user removed a key from
+// their profile. Users can flush their own profile, owners and administrators any profile
+// (or all of them).
+func accountProfileCache(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if req.Method != "POST" && req.Method != "DELETE" {
+		return SystemReturn{Status: 405, Body: "405 - Method Not Allowed: " + req.Method}
+	}
+
+	webid, all := req.FormValue("webid"), req.FormValue("all") == "true"
+	if len(webid) == 0 {
+		webid = req.User
+	}
+	if (all || defrag(webid) != defrag(req.User)) && !req.IsOwner && !s.isAdmin(req.User) {
+		return SystemReturn{Status: 403, Body: "You can only flush your own profile"}
+	}
+	if all {
+		webid = ""
+	}
+	n := s.profileCache.flush(webid)
+	s.debug.Println("Flushed", n, "cached profile(s) for", req.User)
+
+	data, err := json.Marshal(map[string]int{"flushed": n})
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	w.Header().Set(HCType, "application/json")
+	return SystemReturn{Status: 200, Body: string(data)}
+}
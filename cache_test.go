@@ -0,0 +1,252 @@
+package gold
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLCache(t *testing.T) {
+	file := "_test/cache.acl"
+	uri := testServer.URL + "/" + file
+	err := os.MkdirAll("_test", 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(file, []byte("<#a> <http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read> ."), 0644)
+	assert.NoError(t, err)
+	defer os.Remove(file)
+
+	c := newACLCache()
+	g1 := c.get(uri, file)
+	assert.Equal(t, 1, g1.Len())
+	assert.True(t, g1 == c.get(uri, file))
+
+	// changes to the file are picked up through the ETag
+	err = ioutil.WriteFile(file, []byte("<#a> <http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write> ."), 0644)
+	assert.NoError(t, err)
+	g2 := c.get(uri, file)
+	assert.Equal(t, 2, g2.Len())
+	assert.False(t, g1 == g2)
+
+	c.invalidate(file)
+	assert.False(t, g2 == c.get(uri, file))
+
+	os.Remove(file)
+	assert.Equal(t, 0, c.get(uri, file).Len())
+}
+
+func TestGroupCache(t *testing.T) {
+	var hits, notModified int32
+	groups := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(304)
+			return
+		}
+		w.Header().Set("Content-Type", "text/turtle")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=1")
+		fmt.Fprint(w, "<#g> a <http://xmlns.com/foaf/0.1/Group> ; <http://xmlns.com/foaf/0.1/member> <https://alice.example/#me> .")
+	}))
+	defer groups.Close()
+
+	c := newGroupCache(time.Minute, time.Second)
+	g := c.get(groups.URL + "/group#g")
+	assert.Equal(t, 2, g.Len())
+	assert.Equal(t, 2, c.get(groups.URL+"/group#g").Len())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// revalidated once expired
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, 2, c.get(groups.URL+"/group#g").Len())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+}
+
+func TestGroupCacheTimeout(t *testing.T) {
+	var hits int32
+	done := make(chan bool)
+	groups := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-done
+	}))
+	defer groups.Close()
+	defer close(done)
+
+	c := newGroupCache(time.Minute, 100*time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, 0, c.get(groups.URL+"/group#g").Len())
+	assert.True(t, time.Since(start) < time.Second)
+
+	// the failure is remembered
+	assert.Equal(t, 0, c.get(groups.URL+"/group#g").Len())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestProfileCache(t *testing.T) {
+	var hits, notModified int32
+	profiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/big":
+			w.Header().Set("Content-Type", "text/turtle")
+			fmt.Fprint(w, "<#me> <http://xmlns.com/foaf/0.1/name> \""+strings.Repeat("a", 200)+"\" .")
+			return
+		case "/gone":
+			w.WriteHeader(404)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(304)
+			return
+		}
+		w.Header().Set("Content-Type", "text/turtle")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=1")
+		fmt.Fprint(w, "<#me> <http://xmlns.com/foaf/0.1/name> \"Alice\" .")
+	}))
+	defer profiles.Close()
+
+	c := newProfileCache(time.Minute, time.Second, 100)
+	g, err := c.get(profiles.URL+"/profile#me", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, g.Len())
+	// profiles that were just fetched are not fetched again, even when refreshed
+	g2, err := c.get(profiles.URL+"/profile#me", true)
+	assert.NoError(t, err)
+	assert.True(t, g == g2)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// revalidated once expired
+	time.Sleep(1100 * time.Millisecond)
+	g2, err = c.get(profiles.URL+"/profile#me", false)
+	assert.NoError(t, err)
+	assert.True(t, g == g2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+
+	// flushed entries are fetched again
+	assert.Equal(t, 1, c.flush(profiles.URL+"/profile#you"))
+	assert.Equal(t, 0, c.flush(profiles.URL+"/profile"))
+	_, err = c.get(profiles.URL+"/profile#me", false)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// large and missing profiles are rejected
+	_, err = c.get(profiles.URL+"/big#me", false)
+	assert.Error(t, err)
+	_, err = c.get(profiles.URL+"/gone#me", false)
+	assert.Error(t, err)
+	_, err = c.get(profiles.URL+"/gone#me", false)
+	assert.Error(t, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&hits))
+
+	assert.Equal(t, 3, c.flush(""))
+}
+
+func TestProfileCacheTimeout(t *testing.T) {
+	done := make(chan bool)
+	profiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer profiles.Close()
+	defer close(done)
+
+	c := newProfileCache(time.Minute, 100*time.Millisecond, 1000)
+	start := time.Now()
+	_, err := c.get(profiles.URL+"/profile#me", false)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestProfileCacheVerifiesCertificates(t *testing.T) {
+	profiles := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/turtle")
+		w.Write([]byte("<#me> <http://xmlns.com/foaf/0.1/name> \"Me\" ."))
+	}))
+	defer profiles.Close()
+
+	c := newProfileCache(time.Minute, time.Second, 1000)
+	_, err := c.get(profiles.URL+"/profile#me", false)
+	assert.NoError(t, err)
+
+	// the test certificate is only trusted by the shared transport
+	c = newProfileCache(time.Minute, time.Second, 1000)
+	c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{}}
+	_, err = c.get(profiles.URL+"/profile#me", false)
+	assert.Error(t, err)
+}
+
+func TestProfileCacheAPI(t *testing.T) {
+	defer publishTestUsers(t)()
+	webid := testServer.URL + "/_test/cacheuser#id"
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwk, err := NewJWK(&key.PublicKey)
+	assert.NoError(t, err)
+	jwkJSON, err := json.Marshal(jwk)
+	assert.NoError(t, err)
+	quoted, err := json.Marshal(string(jwkJSON))
+	assert.NoError(t, err)
+	assert.Equal(t, 201, wacDo(t, httpClient, "PUT", webid, "<#id> <http://www.w3.org/ns/auth/cert#key> <#key> .\n"+
+		"<#key> <https://w3id.org/security#publicKeyJwk> "+string(quoted)+" ."))
+	client := newKeyClient(t, webid, key)
+
+	api := testServer.URL + "/" + SystemPrefix + "/profilecache"
+	flush := func(client *http.Client, method string, params string) (int, string) {
+		request, err := http.NewRequest(method, api+params, nil)
+		assert.NoError(t, err)
+		response, err := client.Do(request)
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.NoError(t, err)
+		return response.StatusCode, string(body)
+	}
+
+	status, _ := flush(httpClient, "POST", "")
+	assert.Equal(t, 401, status)
+	status, _ = flush(client, "GET", "")
+	assert.Equal(t, 405, status)
+	status, body := flush(client, "POST", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"flushed":1}`, body)
+	status, body = flush(client, "DELETE", "?webid="+url.QueryEscape(webid))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"flushed":1}`, body)
+
+	// only the owner of the pod can flush other profiles
+	rootACL := handler.Config.ACLSuffix
+	err = ioutil.WriteFile(rootACL, []byte("<#Owner> <http://www.w3.org/ns/auth/acl#accessTo> <"+testServer.URL+"/> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#agent> <"+user1+"> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Write> .\n"+
+		"<#Public> <http://www.w3.org/ns/auth/acl#default> <"+testServer.URL+"/> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#agentClass> <http://xmlns.com/foaf/0.1/Agent> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read> ."), 0644)
+	assert.NoError(t, err)
+	status, _ = flush(client, "POST", "?webid="+url.QueryEscape(user1))
+	assert.Equal(t, 403, status)
+	status, _ = flush(client, "POST", "?all=true")
+	assert.Equal(t, 403, status)
+	status, body = flush(user1h, "POST", "?webid="+url.QueryEscape(webid))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"flushed":1}`, body)
+	os.Remove(rootACL)
+
+	assert.Equal(t, 200, wacDo(t, httpClient, "DELETE", webid, ""))
+}
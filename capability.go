@@ -0,0 +1,400 @@
+package gold
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// capabilityParam is the query parameter carrying a capability token
+	capabilityParam = "cap"
+	// capabilityAge is the validity of a capability link when none is given
+	capabilityAge = 24 * time.Hour
+
+	capabilityType    = "Capability"
+	capabilityKeyType = "CapabilityKey"
+)
+
+// Capability is a share link granting some modes on a resource, or on all the resources
+// under a prefix, until it expires or runs out of uses. The token of the link is only
+// returned when the capability is created.
+type Capability struct {
+	ID      string   `json:"id"`
+	Issuer  string   `json:"issuer"`
+	Scope   string   `json:"scope"`
+	Prefix  bool     `json:"prefix"`
+	Modes   []string `json:"modes"`
+	Created int64    `json:"created"`
+	Expires int64    `json:"expires"`
+	MaxUses int      `json:"maxUses,omitempty"`
+	Used    int      `json:"used"`
+	Token   string   `json:"token,omitempty"`
+	Link    string   `json:"link,omitempty"`
+	// counted is set once the use of the capability by a request has been counted
+	counted bool
+}
+
+type capabilityRequest struct {
+	URI     string   `json:"uri"`
+	Prefix  bool     `json:"prefix"`
+	Modes   []string `json:"modes"`
+	Expires string   `json:"expires"`
+	TTL     int64    `json:"ttl"`
+	Uses    int      `json:"uses"`
+}
+
+// covers checks if the capability applies to the resource
+func (c *Capability) covers(uri string) bool {
+	return uri == c.Scope || (c.Prefix && scopeCovers(c.Scope, uri))
+}
+
+// sign returns the signature of the capability fields
+func (c *Capability) sign(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%t\n%s\n%d\n%d", c.ID, c.Issuer, c.Scope, c.Prefix, strings.Join(c.Modes, " "), c.Expires, c.MaxUses)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// capabilityKey returns the signing key of the host, creating it if needed
+func capabilityKey(tx *bolt.Tx, host string) ([]byte, error) {
+	hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := hostBucket.CreateBucketIfNotExists([]byte(capabilityKeyType))
+	if err != nil {
+		return nil, err
+	}
+	if key := bucket.Get([]byte("key")); key != nil {
+		return key, nil
+	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, bucket.Put([]byte("key"), key)
+}
+
+// newCapability saves a capability to the bolt db and returns its token
+func (s *Server) newCapability(host string, c *Capability) (string, error) {
+	if s.BoltDB == nil {
+		return "", errors.New("Capabilities require a database")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	c.ID = hex.EncodeToString(id)
+	c.Created = time.Now().Unix()
+
+	var token string
+	// bucket(host) -> bucket(Capability) -> id -> capability
+	err := s.BoltDB.Update(func(tx *bolt.Tx) error {
+		key, err := capabilityKey(tx, host)
+		if err != nil {
+			return err
+		}
+		bucket, err := tx.Bucket([]byte(host)).CreateBucketIfNotExists([]byte(capabilityType))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		token = c.ID + "." + c.sign(key)
+		return bucket.Put([]byte(c.ID), data)
+	})
+	return token, err
+}
+
+// checkCapability checks the token of a capability link. Uses are only counted once the
+// capability grants access, by countCapability.
+func (s *Server) checkCapability(host string, token string) (*Capability, error) {
+	if s.BoltDB == nil {
+		return nil, errors.New("Capabilities require a database")
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed capability token")
+	}
+	c := new(Capability)
+	err := s.BoltDB.Update(func(tx *bolt.Tx) error {
+		key, err := capabilityKey(tx, host)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte(host)).Bucket([]byte(capabilityType))
+		if bucket == nil {
+			return errors.New("Unknown capability")
+		}
+		data := bucket.Get([]byte(parts[0]))
+		if data == nil {
+			return errors.New("Unknown capability")
+		}
+		if err = json.Unmarshal(data, c); err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(c.sign(key)), []byte(parts[1])) {
+			return errors.New("Invalid capability signature")
+		}
+		return c.usable()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// usable checks that the capability has not expired nor been used up
+func (c *Capability) usable() error {
+	if time.Now().Unix() > c.Expires {
+		return errors.New("The capability has expired")
+	}
+	if c.MaxUses > 0 && c.Used >= c.MaxUses {
+		return errors.New("The capability has been used up")
+	}
+	return nil
+}
+
+// countCapability counts one use of the capability, unless it was used up in the meantime
+func (s *Server) countCapability(host string, c *Capability) error {
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return errors.New("Unknown capability")
+		}
+		bucket := hostBucket.Bucket([]byte(capabilityType))
+		if bucket == nil {
+			return errors.New("Unknown capability")
+		}
+		data := bucket.Get([]byte(c.ID))
+		if data == nil {
+			return errors.New("Unknown capability")
+		}
+		stored := new(Capability)
+		if err := json.Unmarshal(data, stored); err != nil {
+			return err
+		}
+		if err := stored.usable(); err != nil {
+			return err
+		}
+		stored.Used++
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		c.Used = stored.Used
+		return bucket.Put([]byte(c.ID), data)
+	})
+}
+
+// getCapabilities returns the capabilities of the host issued by the given WebID
+func (s *Server) getCapabilities(host string, issuer string) ([]*Capability, error) {
+	caps := []*Capability{}
+	if s.BoltDB == nil {
+		return caps, errors.New("Capabilities require a database")
+	}
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(capabilityType))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			c := new(Capability)
+			if err := json.Unmarshal(v, c); err == nil && c.Issuer == issuer {
+				caps = append(caps, c)
+			}
+			return nil
+		})
+	})
+	return caps, err
+}
+
+// revokeCapability deletes a capability issued by the given WebID
+func (s *Server) revokeCapability(host string, id string, issuer string) error {
+	if s.BoltDB == nil {
+		return errors.New("Capabilities require a database")
+	}
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return errors.New("Unknown capability")
+		}
+		bucket := hostBucket.Bucket([]byte(capabilityType))
+		if bucket == nil {
+			return errors.New("Unknown capability")
+		}
+		c := new(Capability)
+		data := bucket.Get([]byte(id))
+		if data == nil || json.Unmarshal(data, c) != nil || c.Issuer != issuer {
+			return errors.New("Unknown capability")
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// allowCapability checks if the capability link of the request grants the mode on the
+// resource. Links never grant access to ACL resources, and stop working once their
+// issuer loses Control over the resource.
+func (acl *WAC) allowCapability(mode string, path string) bool {
+	c := acl.capability
+	if c == nil {
+		return false
+	}
+	p, err := acl.req.pathInfo(path)
+	if err != nil || p.File == p.AclFile {
+		return false
+	}
+	if !c.covers(p.URI) || !scopeGrants(c.Modes, mode) {
+		return false
+	}
+	issuer := NewWAC(acl.req, acl.srv, nil, c.Issuer, "")
+	if status, err := issuer.allowPolicies("Control", p.URI); status != 200 || err != nil {
+		acl.srv.debug.Println("The issuer of capability " + c.ID + " no longer controls " + p.URI)
+		return false
+	}
+	// a request counts as one use, however many checks it needs
+	if !c.counted {
+		if err = acl.srv.countCapability(acl.req.Host, c); err != nil {
+			acl.srv.debug.Println("Capability error: " + err.Error())
+			return false
+		}
+		c.counted = true
+	}
+	acl.srv.debug.Println(mode + " access allowed by capability " + c.ID)
+	return true
+}
+
+// accountCapabilities lists (GET), creates (POST) and revokes (DELETE) the capability
+// links of the current user
+func accountCapabilities(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if s.BoltDB == nil {
+		return SystemReturn{Status: 503, Body: "Capabilities require a database"}
+	}
+	w.Header().Set(HCType, "application/json")
+
+	switch req.Method {
+	case "GET", "HEAD":
+		caps, err := s.getCapabilities(req.Host, req.User)
+		if err != nil {
+			s.debug.Println("Capability listing error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		data, err := json.Marshal(caps)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200, Body: string(data)}
+
+	case "DELETE":
+		err := s.revokeCapability(req.Host, req.FormValue("id"), req.User)
+		if err != nil {
+			return SystemReturn{Status: 404, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200}
+
+	case "POST":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		var capReq capabilityRequest
+		if err = json.Unmarshal(data, &capReq); err != nil {
+			return SystemReturn{Status: 400, Body: err.Error()}
+		}
+		c, status, err := req.newCapabilityFrom(capReq, s)
+		if err != nil {
+			return SystemReturn{Status: status, Body: err.Error()}
+		}
+		c.Token, err = s.newCapability(req.Host, c)
+		if err != nil {
+			s.debug.Println("Capability error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		c.Link = c.Scope + "?" + capabilityParam + "=" + encodeQuery(c.Token)
+		data, err = json.Marshal(c)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 201, Body: string(data)}
+	}
+	return SystemReturn{Status: 405, Body: "405 - Method Not Allowed: " + req.Method}
+}
+
+// newCapabilityFrom validates a capability request; the user needs Control over the scope
+func (req *httpRequest) newCapabilityFrom(capReq capabilityRequest, s *Server) (*Capability, int, error) {
+	base, _ := req.pathInfo(req.BaseURI())
+	if !strings.HasPrefix(capReq.URI, base.Base+"/") {
+		return nil, 400, errors.New("The resource " + capReq.URI + " is not hosted on this server")
+	}
+	resource, err := req.pathInfo(capReq.URI)
+	if err != nil {
+		return nil, 400, err
+	}
+	if resource.File == resource.AclFile {
+		return nil, 400, errors.New("Capabilities cannot grant access to ACL resources")
+	}
+	status, err := NewWAC(req, s, nil, req.User, "").AllowControl(resource.URI)
+	if status != 200 || err != nil {
+		return nil, 403, errors.New("You need Control access to " + resource.URI + " to share it")
+	}
+
+	c := &Capability{
+		Issuer:  req.User,
+		Scope:   resource.URI,
+		Prefix:  capReq.Prefix,
+		MaxUses: capReq.Uses,
+	}
+	if c.Prefix && !strings.HasSuffix(c.Scope, "/") {
+		return nil, 400, errors.New("Prefix capabilities must be scoped to a container")
+	}
+	for _, mode := range capReq.Modes {
+		m, ok := map[string]string{"read": "Read", "write": "Write", "append": "Append"}[strings.ToLower(mode)]
+		if !ok {
+			return nil, 400, errors.New("Capabilities cannot grant the mode " + mode)
+		}
+		c.Modes = append(c.Modes, m)
+	}
+	if len(c.Modes) == 0 {
+		return nil, 400, errors.New("Missing modes")
+	}
+	if capReq.Uses < 0 {
+		return nil, 400, errors.New("Invalid number of uses")
+	}
+
+	expires := time.Now().Add(capabilityAge)
+	switch {
+	case len(capReq.Expires) > 0:
+		expires, err = time.Parse(time.RFC3339, capReq.Expires)
+		if err != nil {
+			return nil, 400, err
+		}
+	case capReq.TTL > 0:
+		expires = time.Now().Add(time.Duration(capReq.TTL) * time.Second)
+	}
+	if !expires.After(time.Now()) {
+		return nil, 400, errors.New("The expiry date must be in the future")
+	}
+	c.Expires = expires.Unix()
+	return c, 200, nil
+}
@@ -0,0 +1,162 @@
+package gold
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilityCovers(t *testing.T) {
+	c := &Capability{Scope: "https://h/dir/", Prefix: true, Modes: []string{"Write"}}
+	assert.True(t, c.covers("https://h/dir/"))
+	assert.True(t, c.covers("https://h/dir/doc"))
+	assert.False(t, c.covers("https://h/dir-private/doc"))
+
+	// prefixes only apply to containers
+	c = &Capability{Scope: "https://h/doc", Prefix: true}
+	assert.True(t, c.covers("https://h/doc"))
+	assert.False(t, c.covers("https://h/doc-private"))
+}
+
+func TestCapabilityLinks(t *testing.T) {
+	defer publishTestUsers(t)()
+	boltPath := handler.Config.BoltPath
+	handler.Config.BoltPath = "_test/capabilities.db"
+	err := os.MkdirAll("_test", 0755)
+	assert.NoError(t, err)
+	err = handler.StartBolt()
+	assert.NoError(t, err)
+	defer func() {
+		handler.BoltDB.Close()
+		handler.BoltDB = nil
+		handler.Config.BoltPath = boltPath
+		os.Remove("_test/capabilities.db")
+	}()
+
+	dir := testServer.URL + "/_test/capdir/"
+	api := testServer.URL + "/" + SystemPrefix + "/capabilities"
+	owner := "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+		"<#Owner> acl:accessTo <" + dir + "> ;\n" +
+		"	acl:default <" + dir + "> ;\n" +
+		"	acl:agent <" + user1 + "> ;\n" +
+		"	acl:mode acl:Read, acl:Write, acl:Control ."
+	assert.Equal(t, 201, wacDo(t, user1h, "MKCOL", dir, ""))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+".acl", owner))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+"doc", "<a> <b> <c> ."))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+"sub/doc", "<a> <b> <c> ."))
+
+	mint := func(client *http.Client, body string) (int, Capability) {
+		var c Capability
+		request, err := http.NewRequest("POST", api, strings.NewReader(body))
+		assert.NoError(t, err)
+		request.Header.Add("Content-Type", "application/json")
+		response, err := client.Do(request)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.NoError(t, err)
+		if response.StatusCode == 201 {
+			assert.NoError(t, json.Unmarshal(data, &c))
+		}
+		return response.StatusCode, c
+	}
+	withCap := func(method string, uri string, c Capability) int {
+		return wacDo(t, httpClient, method, uri+"?"+capabilityParam+"="+url.QueryEscape(c.Token), "<a> <b> <c> .")
+	}
+
+	// only those who control the resource can share it
+	status, _ := mint(user2h, `{"uri": "`+dir+`doc", "modes": ["read"]}`)
+	assert.Equal(t, 403, status)
+	status, _ = mint(httpClient, `{"uri": "`+dir+`doc", "modes": ["read"]}`)
+	assert.Equal(t, 401, status)
+	status, _ = mint(user1h, `{"uri": "`+dir+`doc", "modes": ["control"]}`)
+	assert.Equal(t, 400, status)
+	status, _ = mint(user1h, `{"uri": "`+dir+`.acl", "modes": ["read"]}`)
+	assert.Equal(t, 400, status)
+	status, _ = mint(user1h, `{"uri": "`+dir+`doc", "modes": ["read"], "expires": "2001-01-01T00:00:00Z"}`)
+	assert.Equal(t, 400, status)
+
+	status, read := mint(user1h, `{"uri": "`+dir+`doc", "modes": ["read"], "uses": 2}`)
+	assert.Equal(t, 201, status)
+	assert.Equal(t, user1, read.Issuer)
+	assert.Equal(t, dir+"doc", read.Scope)
+	assert.Equal(t, []string{"Read"}, read.Modes)
+	assert.Equal(t, dir+"doc?"+capabilityParam+"="+url.QueryEscape(read.Token), read.Link)
+	assert.True(t, read.Expires > time.Now().Unix())
+
+	assert.Equal(t, 401, wacDo(t, httpClient, "HEAD", dir+"doc", ""))
+	assert.Equal(t, 200, withCap("HEAD", dir+"doc", read))
+	// requests that are not granted do not use the link up
+	assert.Equal(t, 401, withCap("PUT", dir+"doc", read))
+	assert.Equal(t, 200, withCap("HEAD", dir+"doc", read))
+	// the link has now been used twice
+	assert.Equal(t, 401, withCap("HEAD", dir+"doc", read))
+
+	// tampered links are rejected
+	status, write := mint(user1h, `{"uri": "`+dir+`", "prefix": true, "modes": ["Write"], "ttl": 60}`)
+	assert.Equal(t, 201, status)
+	forged := write
+	forged.Token = write.Token[:strings.Index(write.Token, ".")+1] + "AAAA"
+	assert.Equal(t, 401, withCap("PUT", dir+"sub/doc", forged))
+	assert.Equal(t, 200, withCap("PUT", dir+"sub/doc", write))
+	assert.Equal(t, 200, withCap("POST", dir+"doc", write))
+	assert.Equal(t, 401, withCap("HEAD", dir+"doc", write))
+	assert.Equal(t, 401, withCap("PUT", dir+".acl", write))
+	status, doc := mint(user1h, `{"uri": "`+dir+`doc", "modes": ["read"]}`)
+	assert.Equal(t, 201, status)
+	assert.Equal(t, 200, withCap("HEAD", dir+"doc", doc))
+	assert.Equal(t, 401, withCap("HEAD", dir+"sub/doc", doc))
+
+	// listing does not reveal the tokens
+	request, err := http.NewRequest("GET", api, nil)
+	assert.NoError(t, err)
+	response, err := user1h.Do(request)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	var caps []Capability
+	assert.NoError(t, json.Unmarshal(data, &caps))
+	assert.Equal(t, 3, len(caps))
+	for _, c := range caps {
+		assert.Empty(t, c.Token)
+		if c.ID == read.ID {
+			assert.Equal(t, 2, c.Used)
+		}
+	}
+
+	request, err = http.NewRequest("GET", api, nil)
+	assert.NoError(t, err)
+	response, err = user2h.Do(request)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+
+	// revocation
+	assert.Equal(t, 404, wacDo(t, user2h, "DELETE", api+"?id="+write.ID, ""))
+	assert.Equal(t, 200, wacDo(t, user1h, "DELETE", api+"?id="+write.ID, ""))
+	assert.Equal(t, 401, withCap("PUT", dir+"sub/doc", write))
+
+	// links stop working when the issuer loses Control
+	status, write = mint(user1h, `{"uri": "`+dir+`", "prefix": true, "modes": ["write"]}`)
+	assert.Equal(t, 201, status)
+	shared := strings.Replace(owner, "<"+user1+">", "<"+user1+">, <"+user2+">", 1)
+	assert.Equal(t, 200, wacDo(t, user1h, "PUT", dir+".acl", shared))
+	withoutUser1 := strings.Replace(owner, "<"+user1+">", "<"+user2+">", 1)
+	assert.Equal(t, 200, wacDo(t, user2h, "PUT", dir+".acl", withoutUser1))
+	assert.Equal(t, 401, withCap("PUT", dir+"sub/doc", write))
+
+	for _, path := range []string{"sub/doc", "sub/", "doc", ".acl", ""} {
+		assert.Equal(t, 200, wacDo(t, user2h, "DELETE", dir+path, ""))
+	}
+}
@@ -44,12 +44,39 @@ type ServerConfig struct {
 	// Debug (display or hide stdout logging)
 	Debug bool
 
+	// Streaming enables streaming serialization of RDF responses (turtle, n-triples and JSON-LD)
+	Streaming bool
+
+	// ControlGrantsAll makes acl:Control grant every access mode, as older versions did
+	ControlGrantsAll bool
+
 	// CookieAge contains the validity duration for cookies (in hours)
 	CookieAge int64
 
 	// TokenAge contains the validity duration for recovery tokens (in minutes)
 	TokenAge int64
 
+	// GroupCacheAge contains the default validity duration for cached group documents (in seconds)
+	GroupCacheAge int64
+
+	// GroupFetchTimeout contains the timeout for fetching remote group documents (in seconds)
+	GroupFetchTimeout int64
+
+	// ProfileCacheAge contains the default validity duration for cached WebID profiles (in seconds)
+	ProfileCacheAge int64
+
+	// ProfileFetchTimeout contains the timeout for fetching WebID profiles during authentication (in seconds)
+	ProfileFetchTimeout int64
+
+	// ProfileMaxSize is the maximum size (in bytes) of the WebID profiles fetched during authentication
+	ProfileMaxSize int64
+
+	// SignatureMaxAge is the window (in seconds) in which HTTP Message Signatures are accepted
+	SignatureMaxAge int64
+
+	// SignatureMaxBody is the maximum size (in bytes) of the body of a request signed with HTTP Message Signatures
+	SignatureMaxBody int64
+
 	// METASuffix sets the default suffix for meta files (e.g. ,meta or .meta)
 	MetaSuffix string
 
@@ -89,6 +116,36 @@ type ServerConfig struct {
 	// BoltPath points to the location of the Bolt db on the filesystem
 	BoltPath string
 
+	// KeyFile points to the file holding the keys used to sign cookies and tokens (kept in memory if empty)
+	KeyFile string
+
+	// KeyRotation is the age (in hours) after which the signing keys are rotated at startup (0 disables rotation)
+	KeyRotation int64
+
+	// LoginMaxFailures is the number of failed password logins after which a WebID is locked out (0 disables throttling)
+	LoginMaxFailures int
+
+	// LoginMaxFailuresIP is the number of failed password logins after which a client IP is locked out
+	LoginMaxFailuresIP int
+
+	// LoginLockout contains the duration of a lockout (in minutes)
+	LoginLockout int64
+
+	// Admins lists the WebIDs of the server administrators
+	Admins []string
+
+	// ImportMaxSize is the maximum size (in bytes) of an uploaded account archive
+	ImportMaxSize int64
+
+	// AuditLog points to the file where access decisions are logged (disabled if empty)
+	AuditLog string
+
+	// AuditLogMaxSize is the size (in bytes) after which the audit log is rotated
+	AuditLogMaxSize int64
+
+	// AuditLogBackups is the number of rotated audit logs to keep
+	AuditLogBackups int
+
 	// SMTPConfig holds the settings for the remote SMTP user/server
 	SMTPConfig EmailConfig
 }
@@ -96,20 +153,35 @@ type ServerConfig struct {
 // NewServerConfig creates a new config object
 func NewServerConfig() *ServerConfig {
 	return &ServerConfig{
-		CookieAge:  8736, // hours (1 year)
-		TokenAge:   5,
-		HSTS:       true,
-		WebIDTLS:   true,
-		MetaSuffix: ".meta",
-		ACLSuffix:  ".acl",
-		DataApp:    "tabulator",
-		DirIndex:   []string{"index.html", "index.htm"},
-		DirApp:     "http://linkeddata.github.io/warp/#list/",
-		SignUpApp:  "https://solid.github.io/solid-signup/?domain=",
-		DiskLimit:  100000000, // 100MB
-		DataRoot:   serverDefaultRoot(),
-		BoltPath:   filepath.Join(os.TempDir(), "bolt.db"),
-		ProxyLocal: true,
+		CookieAge:           8736, // hours (1 year)
+		TokenAge:            5,
+		GroupCacheAge:       300,
+		GroupFetchTimeout:   5,
+		ProfileCacheAge:     300,
+		ProfileFetchTimeout: 5,
+		ProfileMaxSize:      1000000, // 1MB
+		SignatureMaxAge:     300,
+		SignatureMaxBody:    100000000, // 100MB
+		HSTS:                true,
+		WebIDTLS:            true,
+		MetaSuffix:          ".meta",
+		ACLSuffix:           ".acl",
+		DataApp:             "tabulator",
+		DirIndex:            []string{"index.html", "index.htm"},
+		DirApp:              "http://linkeddata.github.io/warp/#list/",
+		SignUpApp:           "https://solid.github.io/solid-signup/?domain=",
+		DiskLimit:           100000000, // 100MB
+		DataRoot:            serverDefaultRoot(),
+		BoltPath:            filepath.Join(os.TempDir(), "bolt.db"),
+		KeyFile:             filepath.Join(os.TempDir(), "gold-keys.json"),
+		KeyRotation:         720, // 30 days
+		ProxyLocal:          true,
+		LoginMaxFailures:    5,
+		LoginMaxFailuresIP:  20,
+		LoginLockout:        15,
+		AuditLogMaxSize:     10000000, // 10MB
+		AuditLogBackups:     5,
+		ImportMaxSize:       1000000000, // 1GB
 	}
 }
 
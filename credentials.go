@@ -0,0 +1,194 @@
+package gold
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	credentialType = "Credentials"
+
+	// argon2id parameters (RFC 9106, second recommended option)
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+var errNoCredentialStore = errors.New("Password logins require the Bolt database")
+
+// credential holds the password hash of a WebID for an account
+type credential struct {
+	WebID   string    `json:"webid"`
+	Account string    `json:"account"`
+	Hash    string    `json:"hash"`
+	Updated time.Time `json:"updated"`
+}
+
+// hashPassword returns the argon2id hash of a password with a new random salt,
+// encoded together with its parameters
+func hashPassword(pass string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pass), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks a password against a hash made by hashPassword
+func verifyPassword(hash string, pass string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("Unsupported password hash")
+	}
+	var version int
+	var memory, passes uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("Unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &passes, &threads); err != nil {
+		return false, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(pass), salt, passes, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// hostOf returns the host (and port) of an account URI
+func hostOf(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// setPassword stores a new password hash for the WebID
+func (s *Server) setPassword(account string, webid string, pass string) error {
+	if s.BoltDB == nil {
+		return errNoCredentialStore
+	}
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(credential{WebID: webid, Account: account, Hash: hash, Updated: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket, err := tx.CreateBucketIfNotExists([]byte(hostOf(account)))
+		if err != nil {
+			return err
+		}
+		bucket, err := hostBucket.CreateBucketIfNotExists([]byte(credentialType))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(webid), data)
+	})
+}
+
+// getCredential returns the stored credential of the WebID on the host, or nil if there is none
+func (s *Server) getCredential(host string, webid string) (*credential, error) {
+	if s.BoltDB == nil {
+		return nil, errNoCredentialStore
+	}
+	var c *credential
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(credentialType))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(webid))
+		if data == nil {
+			return nil
+		}
+		c = new(credential)
+		return json.Unmarshal(data, c)
+	})
+	return c, err
+}
+
+// deleteCredential removes the stored credential of the WebID on the host, and tells if there was one
+func (s *Server) deleteCredential(host string, webid string) (bool, error) {
+	if s.BoltDB == nil {
+		return false, errNoCredentialStore
+	}
+	found := false
+	err := s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(credentialType))
+		if bucket == nil || bucket.Get([]byte(webid)) == nil {
+			return nil
+		}
+		found = true
+		return bucket.Delete([]byte(webid))
+	})
+	return found, err
+}
+
+// legacyPassword returns the salted password hash kept for the WebID in the account
+// ACL by older versions, or an empty string
+func legacyPassword(kb *Graph, webid string) string {
+	for _, m := range kb.All(nil, ns.acl.Get("mode"), ns.acl.Get("Control")) {
+		p := kb.One(m.Subject, ns.acl.Get("password"), nil)
+		if p != nil && kb.One(m.Subject, ns.acl.Get("agent"), NewResource(webid)) != nil {
+			return unquote(p.Object.String())
+		}
+	}
+	return ""
+}
+
+// stripPasswords removes from an ACL file the acl:password triples of the policies of the WebID
+func stripPasswords(aclURI string, aclFile string, webid string) error {
+	g := NewGraph(aclURI)
+	g.ReadFile(aclFile)
+	var passwords []*Triple
+	for _, t := range g.All(nil, ns.acl.Get("password"), nil) {
+		if len(g.All(t.Subject, ns.acl.Get("agent"), NewResource(webid))) > 0 {
+			passwords = append(passwords, t)
+		}
+	}
+	if len(passwords) == 0 {
+		return nil
+	}
+	for _, t := range passwords {
+		g.Remove(t)
+	}
+	f, err := os.OpenFile(aclFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return g.WriteFile(f, "text/turtle")
+}
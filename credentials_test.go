@@ -0,0 +1,83 @@
+package gold
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("secret")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=4$"))
+
+	// every hash has its own salt
+	other, err := hashPassword("secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+
+	ok, err := verifyPassword(hash, "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = verifyPassword(hash, "Secret")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = verifyPassword(saltedPassword("salt", "secret"), "secret")
+	assert.Error(t, err)
+}
+
+func TestPasswordMigration(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/credentials.db")()
+
+	webid := "https://alice.example/profile/card#me"
+	rootACL := handler.Config.ACLSuffix
+	err := ioutil.WriteFile(rootACL, []byte("<#Owner> <http://www.w3.org/ns/auth/acl#accessTo> <"+testServer.URL+"/> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#agent> <"+webid+"> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#password> \""+saltedPassword(handler.Config.Salt, "secret")+"\" ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Write>, <http://www.w3.org/ns/auth/acl#Control> .\n"+
+		"<#Other> <http://www.w3.org/ns/auth/acl#accessTo> <"+testServer.URL+"/> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#agent> <https://bob.example/profile/card#me> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#password> \"bobhash\" ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read>, <http://www.w3.org/ns/auth/acl#Control> ."), 0644)
+	assert.NoError(t, err)
+	defer os.Remove(rootACL)
+
+	login := func(pass string) int {
+		response, _ := oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/login", url.Values{
+			"webid":    {webid},
+			"password": {pass},
+		}, nil)
+		return response.StatusCode
+	}
+	assert.Equal(t, 403, login("wrong"))
+	cred, err := handler.getCredential(hostOf(testServer.URL), webid)
+	assert.NoError(t, err)
+	assert.Nil(t, cred)
+
+	// the legacy hash is moved to the credential store at the first login
+	assert.Equal(t, 301, login("secret"))
+	cred, err = handler.getCredential(hostOf(testServer.URL), webid)
+	assert.NoError(t, err)
+	assert.NotNil(t, cred)
+	assert.Equal(t, webid, cred.WebID)
+	acl, err := ioutil.ReadFile(rootACL)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(acl), saltedPassword(handler.Config.Salt, "secret"))
+	assert.Contains(t, string(acl), webid)
+	// only the password of the WebID is removed
+	assert.Contains(t, string(acl), "bobhash")
+	// and the policies still apply to the root
+	g := NewGraph(testServer.URL + "/" + rootACL)
+	g.Parse(strings.NewReader(string(acl)), "text/turtle")
+	owner := NewResource(testServer.URL + "/" + rootACL + "#Owner")
+	assert.NotNil(t, g.One(owner, ns.acl.Get("accessTo"), NewResource(testServer.URL+"/")))
+	assert.NotNil(t, g.One(owner, ns.acl.Get("mode"), ns.acl.Get("Control")))
+
+	assert.Equal(t, 301, login("secret"))
+	assert.Equal(t, 403, login("wrong"))
+}
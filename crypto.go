@@ -2,8 +2,13 @@ package gold
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -30,6 +35,22 @@ type rsaPrivKey struct {
 	*rsa.PrivateKey
 }
 
+type ecdsaPubKey struct {
+	*ecdsa.PublicKey
+}
+
+type ecdsaPrivKey struct {
+	*ecdsa.PrivateKey
+}
+
+type ed25519PubKey struct {
+	ed25519.PublicKey
+}
+
+type ed25519PrivKey struct {
+	ed25519.PrivateKey
+}
+
 // ParseRSAPublicKeyNE parses a modulus and exponent and returns a new verifier object
 func ParseRSAPublicKeyNE(keyT, keyN, keyE string) (Verifier, error) {
 	if len(keyN) == 0 && len(keyE) == 0 {
@@ -66,6 +87,43 @@ func ParseRSAPrivateKey(key *rsa.PrivateKey) (Signer, error) {
 	return newSignerFromKey(key)
 }
 
+// ParsePublicKey returns a new verifier object for an RSA, EC or Ed25519 public key
+func ParsePublicKey(key crypto.PublicKey) (Verifier, error) {
+	return newVerifierFromKey(key)
+}
+
+// ParsePrivateKey returns a new signer object for an RSA, EC or Ed25519 private key
+func ParsePrivateKey(key crypto.PrivateKey) (Signer, error) {
+	return newSignerFromKey(key)
+}
+
+// ParsePublicPEMKey parses a PEM encoded RSA, EC or Ed25519 public key and returns a new verifier object
+func ParsePublicPEMKey(pemBytes []byte) (Verifier, error) {
+	key, err := parsePublicPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifierFromKey(key)
+}
+
+func parsePublicPEM(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("No key found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		// some tools write PKIX keys with this type too
+		if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("Unsupported key type %q", block.Type)
+}
+
 // ParseRSAPublicPEMKey parses a PEM encoded private key and returns a new verifier object
 func ParseRSAPublicPEMKey(pemBytes []byte) (Verifier, error) {
 	block, _ := pem.Decode(pemBytes)
@@ -114,6 +172,10 @@ func newSignerFromKey(k interface{}) (Signer, error) {
 	switch t := k.(type) {
 	case *rsa.PrivateKey:
 		sKey = &rsaPrivKey{t}
+	case *ecdsa.PrivateKey:
+		sKey = &ecdsaPrivKey{t}
+	case ed25519.PrivateKey:
+		sKey = &ed25519PrivKey{t}
 	default:
 		return nil, fmt.Errorf("Unsupported key type %T", k)
 	}
@@ -125,18 +187,76 @@ func newVerifierFromKey(k interface{}) (Verifier, error) {
 	switch t := k.(type) {
 	case *rsa.PublicKey:
 		vKey = &rsaPubKey{t}
+	case *ecdsa.PublicKey:
+		vKey = &ecdsaPubKey{t}
+	case ed25519.PublicKey:
+		vKey = &ed25519PubKey{t}
 	default:
 		return nil, fmt.Errorf("Unsupported key type %T", k)
 	}
 	return vKey, nil
 }
 
-// Sign signs data with rsa-sha256
+// digestHash returns the hash function that produced a digest, going by its size
+func digestHash(digest []byte) (crypto.Hash, error) {
+	switch len(digest) {
+	case sha1.Size:
+		return crypto.SHA1, nil
+	case sha256.Size:
+		return crypto.SHA256, nil
+	case sha512.Size384:
+		return crypto.SHA384, nil
+	case sha512.Size:
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("Unsupported digest size %d", len(digest))
+}
+
+// Sign signs a SHA-1 or SHA-2 digest with RSA PKCS#1 v1.5
 func (r *rsaPrivKey) Sign(data []byte) ([]byte, error) {
-	return rsa.SignPKCS1v15(rand.Reader, r.PrivateKey, crypto.SHA1, data)
+	hash, err := digestHash(data)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.SignPKCS1v15(rand.Reader, r.PrivateKey, hash, data)
 }
 
-// Verify verifies the message using a rsa-sha256 signature
+// Verify verifies an RSA PKCS#1 v1.5 signature of a SHA-1 or SHA-2 digest
 func (r *rsaPubKey) Verify(message []byte, sig []byte) error {
-	return rsa.VerifyPKCS1v15(r.PublicKey, crypto.SHA1, message, sig)
+	hash, err := digestHash(message)
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(r.PublicKey, hash, message, sig)
+}
+
+// Sign signs a digest with ECDSA, returning an ASN.1 encoded signature
+func (k *ecdsaPrivKey) Sign(data []byte) ([]byte, error) {
+	return ecdsa.SignASN1(rand.Reader, k.PrivateKey, data)
+}
+
+// Verify verifies an ECDSA signature of a digest, either ASN.1 encoded or as the
+// concatenated r and s values produced by most hardware tokens
+func (k *ecdsaPubKey) Verify(message []byte, sig []byte) error {
+	if ecdsa.VerifyASN1(k.PublicKey, message, sig) {
+		return nil
+	}
+	size := (k.Curve.Params().BitSize + 7) / 8
+	if len(sig) == 2*size && ecdsa.Verify(k.PublicKey, message, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+		return nil
+	}
+	return errors.New("Invalid ECDSA signature")
+}
+
+// Sign signs data with Ed25519
+func (k *ed25519PrivKey) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(k.PrivateKey, data), nil
+}
+
+// Verify verifies an Ed25519 signature
+func (k *ed25519PubKey) Verify(message []byte, sig []byte) error {
+	if !ed25519.Verify(k.PublicKey, message, sig) {
+		return errors.New("Invalid Ed25519 signature")
+	}
+	return nil
 }
@@ -1,8 +1,16 @@
 package gold
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -147,3 +155,36 @@ oYi+1hqp1fIekaxsyQIDAQAB
 	err = parser.Verify(claim[:], signed)
 	assert.NoError(t, err)
 }
+
+func TestSignAndVerifyModernKeys(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	claim := sha256.Sum256([]byte("some string"))
+
+	for _, priv := range []interface {
+		Public() crypto.PublicKey
+	}{ecKey, edKey} {
+		signer, err := ParsePrivateKey(priv)
+		assert.NoError(t, err)
+		signed, err := signer.Sign(claim[:])
+		assert.NoError(t, err)
+
+		der, err := x509.MarshalPKIXPublicKey(priv.Public())
+		assert.NoError(t, err)
+		parser, err := ParsePublicPEMKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		assert.NoError(t, err)
+		assert.NoError(t, parser.Verify(claim[:], signed))
+
+		other := sha256.Sum256([]byte("other string"))
+		assert.Error(t, parser.Verify(other[:], signed))
+	}
+
+	// hardware tokens often return the raw r and s values of ECDSA signatures
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, claim[:])
+	assert.NoError(t, err)
+	parser, err := ParsePublicKey(&ecKey.PublicKey)
+	assert.NoError(t, err)
+	assert.NoError(t, parser.Verify(claim[:], append(padded(r, 32), padded(s, 32)...)))
+}
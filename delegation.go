@@ -0,0 +1,386 @@
+package gold
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// delegationAge is the validity of a delegation grant when none is given
+	delegationAge = 30 * 24 * time.Hour
+
+	delegationType = "Delegation"
+)
+
+// Delegation lets the delegatee act on behalf of the delegator (with the On-Behalf-Of
+// header), on the resources under the prefixes and with the modes of the grant. Grants
+// are either managed through the API, or declared in the delegator's profile:
+//
+//	<#me> acl:delegates [
+//		acl:agent <https://app.example/#id> ;
+//		acl:accessTo </photos/> ;
+//		acl:mode acl:Read ;
+//		st:expires "2027-01-01T00:00:00Z"^^xsd:dateTime ] .
+//
+// A plain acl:delegates <agent> statement is a grant without prefixes or modes, which
+// gives the delegatee all the rights of the delegator.
+type Delegation struct {
+	ID        string   `json:"id,omitempty"`
+	Delegator string   `json:"delegator"`
+	Delegatee string   `json:"delegatee"`
+	Prefixes  []string `json:"prefixes,omitempty"`
+	Modes     []string `json:"modes,omitempty"`
+	Created   int64    `json:"created,omitempty"`
+	Expires   int64    `json:"expires,omitempty"`
+	Source    string   `json:"source"`
+}
+
+type delegationRequest struct {
+	Delegatee string   `json:"delegatee"`
+	Prefixes  []string `json:"prefixes"`
+	Modes     []string `json:"modes"`
+	Expires   string   `json:"expires"`
+	TTL       int64    `json:"ttl"`
+}
+
+// active checks if the grant has not expired
+func (d *Delegation) active() bool {
+	return d.Expires == 0 || time.Now().Unix() < d.Expires
+}
+
+// covers checks if the grant applies to the resource; prefixes ending with a slash
+// cover the resources of the container
+func (d *Delegation) covers(uri string) bool {
+	if len(d.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range d.Prefixes {
+		if scopeCovers(prefix, uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// grants checks if the grant includes the mode (Write implies Append)
+func (d *Delegation) grants(mode string) bool {
+	return len(d.Modes) == 0 || scopeGrants(d.Modes, mode)
+}
+
+// profileDelegations returns the grants declared in the delegator's profile, for the
+// given delegatee (or for all of them if empty)
+func profileDelegations(g *Graph, delegator string, delegatee string) []*Delegation {
+	grants := []*Delegation{}
+	if g == nil {
+		return grants
+	}
+	for _, t := range g.All(NewResource(delegator), ns.acl.Get("delegates"), nil) {
+		agents := g.All(t.Object, ns.acl.Get("agent"), nil)
+		if len(agents) == 0 {
+			if r, ok := t.Object.(*Resource); ok && (len(delegatee) == 0 || r.URI == delegatee) {
+				grants = append(grants, &Delegation{Delegator: delegator, Delegatee: r.URI, Source: "profile"})
+			}
+			continue
+		}
+		d := &Delegation{Delegator: delegator, Source: "profile"}
+		for _, p := range []string{"accessTo", "default"} {
+			for _, r := range g.All(t.Object, ns.acl.Get(p), nil) {
+				if prefix, ok := r.Object.(*Resource); ok {
+					d.Prefixes = append(d.Prefixes, prefix.URI)
+				}
+			}
+		}
+		for _, m := range g.All(t.Object, ns.acl.Get("mode"), nil) {
+			if mode, ok := m.Object.(*Resource); ok {
+				d.Modes = append(d.Modes, strings.TrimPrefix(mode.URI, string(ns.acl)))
+			}
+		}
+		// a scoped grant without modes grants nothing
+		if len(d.Modes) == 0 {
+			continue
+		}
+		if e := g.One(t.Object, ns.st.Get("expires"), nil); e != nil {
+			lit, ok := e.Object.(*Literal)
+			if !ok {
+				continue
+			}
+			expires, err := time.Parse(time.RFC3339, lit.Value)
+			if err != nil {
+				continue
+			}
+			d.Expires = expires.Unix()
+		}
+		for _, a := range agents {
+			r, ok := a.Object.(*Resource)
+			if !ok || (len(delegatee) > 0 && r.URI != delegatee) {
+				continue
+			}
+			grant := *d
+			grant.Delegatee = r.URI
+			grants = append(grants, &grant)
+		}
+	}
+	return grants
+}
+
+// delegations returns the active grants under which the delegatee may act on behalf of
+// the delegator, from the database and from the delegator's (cached) profile
+func (req *httpRequest) delegations(delegator string, delegatee string) []*Delegation {
+	s := req.Server
+	grants := []*Delegation{}
+	if s.BoltDB != nil {
+		stored, err := s.getDelegations(hostOf(req.BaseURI()), delegator)
+		if err != nil {
+			s.debug.Println("Delegation error: " + err.Error())
+		}
+		for _, d := range stored {
+			if d.Delegatee == delegatee && d.active() {
+				grants = append(grants, d)
+			}
+		}
+	}
+	g, err := s.profileCache.get(delegator, false)
+	found := profileDelegations(g, delegator, delegatee)
+	if len(found) == 0 && len(grants) == 0 {
+		// the grant may have been added since the profile was cached
+		g, err = s.profileCache.get(delegator, true)
+		found = profileDelegations(g, delegator, delegatee)
+	}
+	if err != nil {
+		s.debug.Println("Error loading the profile of " + delegator + ": " + err.Error())
+	}
+	for _, d := range found {
+		if d.active() {
+			grants = append(grants, d)
+		}
+	}
+	return grants
+}
+
+// delegate returns the agent acting on behalf of the user, if any
+func (req *httpRequest) delegate() string {
+	if len(req.Delegations) == 0 {
+		return ""
+	}
+	return req.Delegations[0].Delegatee
+}
+
+// allowDelegation checks if one of the delegation grants of the request allows the mode
+// on the resource. ACL resources need Control over the resource they protect.
+func (acl *WAC) allowDelegation(mode string, path string) (int, error) {
+	p, err := acl.req.pathInfo(path)
+	if err != nil {
+		return 500, err
+	}
+	uri := p.URI
+	if p.File == p.AclFile {
+		mode = "Control"
+		uri = strings.TrimSuffix(p.URI, acl.srv.Config.ACLSuffix)
+	}
+	for _, d := range acl.req.Delegations {
+		if d.covers(uri) && d.grants(mode) {
+			return 200, nil
+		}
+	}
+	acl.srv.debug.Println(mode + " access to " + uri + " is not delegated to " + acl.req.delegate())
+	return 403, errors.New("The delegation to " + acl.req.delegate() + " does not grant " + mode + " access to " + uri)
+}
+
+// newDelegation saves a delegation grant to the bolt db
+func (s *Server) newDelegation(host string, d *Delegation) error {
+	if s.BoltDB == nil {
+		return errors.New("Delegations require a database")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	d.ID = hex.EncodeToString(id)
+	d.Created = time.Now().Unix()
+	d.Source = "api"
+
+	// bucket(host) -> bucket(Delegation) -> id -> delegation
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+		if err != nil {
+			return err
+		}
+		bucket, err := hostBucket.CreateBucketIfNotExists([]byte(delegationType))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(d.ID), data)
+	})
+}
+
+// getDelegations returns the grants of the host given by the delegator
+func (s *Server) getDelegations(host string, delegator string) ([]*Delegation, error) {
+	grants := []*Delegation{}
+	if s.BoltDB == nil {
+		return grants, errors.New("Delegations require a database")
+	}
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(delegationType))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			d := new(Delegation)
+			if err := json.Unmarshal(v, d); err == nil && d.Delegator == delegator {
+				grants = append(grants, d)
+			}
+			return nil
+		})
+	})
+	return grants, err
+}
+
+// revokeDelegation deletes a grant given by the delegator
+func (s *Server) revokeDelegation(host string, id string, delegator string) error {
+	if s.BoltDB == nil {
+		return errors.New("Delegations require a database")
+	}
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return errors.New("Unknown delegation")
+		}
+		bucket := hostBucket.Bucket([]byte(delegationType))
+		if bucket == nil {
+			return errors.New("Unknown delegation")
+		}
+		d := new(Delegation)
+		data := bucket.Get([]byte(id))
+		if data == nil || json.Unmarshal(data, d) != nil || d.Delegator != delegator {
+			return errors.New("Unknown delegation")
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// accountDelegations lists (GET, including the grants of the user's profile), creates (POST)
+// and revokes (DELETE) the delegation grants of the current user
+func accountDelegations(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if s.BoltDB == nil {
+		return SystemReturn{Status: 503, Body: "Delegations require a database"}
+	}
+	host := hostOf(req.BaseURI())
+	w.Header().Set(HCType, "application/json")
+
+	switch req.Method {
+	case "GET", "HEAD":
+		grants, err := s.getDelegations(host, req.User)
+		if err != nil {
+			s.debug.Println("Delegation listing error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		if g, err := s.profileCache.get(req.User, false); err == nil {
+			grants = append(grants, profileDelegations(g, req.User, "")...)
+		}
+		data, err := json.Marshal(grants)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200, Body: string(data)}
+
+	case "DELETE":
+		err := s.revokeDelegation(host, req.FormValue("id"), req.User)
+		if err != nil {
+			return SystemReturn{Status: 404, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200}
+
+	case "POST":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		var delReq delegationRequest
+		if err = json.Unmarshal(data, &delReq); err != nil {
+			return SystemReturn{Status: 400, Body: err.Error()}
+		}
+		d, err := req.newDelegationFrom(delReq)
+		if err != nil {
+			return SystemReturn{Status: 400, Body: err.Error()}
+		}
+		if err = s.newDelegation(host, d); err != nil {
+			s.debug.Println("Delegation error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		data, err = json.Marshal(d)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 201, Body: string(data)}
+	}
+	return SystemReturn{Status: 405, Body: "405 - Method Not Allowed: " + req.Method}
+}
+
+// newDelegationFrom validates a delegation request; grants need at least one prefix on
+// this server and one mode
+func (req *httpRequest) newDelegationFrom(delReq delegationRequest) (*Delegation, error) {
+	if !strings.HasPrefix(delReq.Delegatee, "http:") && !strings.HasPrefix(delReq.Delegatee, "https:") {
+		return nil, errors.New("The delegatee must be a WebID")
+	}
+	if delReq.Delegatee == req.User {
+		return nil, errors.New("You cannot delegate to yourself")
+	}
+	d := &Delegation{Delegator: req.User, Delegatee: delReq.Delegatee}
+
+	base, _ := req.pathInfo(req.BaseURI())
+	for _, prefix := range delReq.Prefixes {
+		if !strings.HasPrefix(prefix, base.Base+"/") {
+			return nil, errors.New("The resource " + prefix + " is not hosted on this server")
+		}
+		d.Prefixes = append(d.Prefixes, prefix)
+	}
+	if len(d.Prefixes) == 0 {
+		return nil, errors.New("Missing prefixes")
+	}
+	for _, mode := range delReq.Modes {
+		m, ok := map[string]string{"read": "Read", "write": "Write", "append": "Append", "control": "Control"}[strings.ToLower(mode)]
+		if !ok {
+			return nil, errors.New("Unknown mode " + mode)
+		}
+		d.Modes = append(d.Modes, m)
+	}
+	if len(d.Modes) == 0 {
+		return nil, errors.New("Missing modes")
+	}
+
+	var err error
+	expires := time.Now().Add(delegationAge)
+	switch {
+	case len(delReq.Expires) > 0:
+		expires, err = time.Parse(time.RFC3339, delReq.Expires)
+		if err != nil {
+			return nil, err
+		}
+	case delReq.TTL > 0:
+		expires = time.Now().Add(time.Duration(delReq.TTL) * time.Second)
+	}
+	if !expires.After(time.Now()) {
+		return nil, errors.New("The expiry date must be in the future")
+	}
+	d.Expires = expires.Unix()
+	return d, nil
+}
@@ -0,0 +1,130 @@
+package gold
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileDelegations(t *testing.T) {
+	me := "https://alice.example/profile/card#me"
+	app := "https://app.example/#id"
+	g := NewGraph("https://alice.example/profile/card")
+	g.Parse(strings.NewReader(`@prefix acl: <http://www.w3.org/ns/auth/acl#> .
+@prefix st: <http://www.w3.org/ns/solid/terms#> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+<#me> acl:delegates <https://bot.example/#id>, [
+		acl:agent <`+app+`> ;
+		acl:accessTo </photos/>, </notes/todo> ;
+		acl:mode acl:Read, acl:Write
+	], [
+		acl:agent <`+app+`> ;
+		acl:accessTo </private/> ;
+		acl:mode acl:Read ;
+		st:expires "2001-01-01T00:00:00Z"^^xsd:dateTime
+	] .`), "text/turtle")
+
+	grants := profileDelegations(g, me, "")
+	assert.Len(t, grants, 3)
+
+	grants = profileDelegations(g, me, "https://bot.example/#id")
+	assert.Len(t, grants, 1)
+	assert.True(t, grants[0].covers("https://alice.example/private/x"))
+	assert.True(t, grants[0].grants("Control"))
+
+	grants = profileDelegations(g, me, app)
+	assert.Len(t, grants, 2)
+	for _, d := range grants {
+		if d.active() {
+			assert.True(t, d.covers("https://alice.example/photos/2020/a.jpg"))
+			assert.True(t, d.covers("https://alice.example/notes/todo"))
+			assert.False(t, d.covers("https://alice.example/notes/todo2"))
+			assert.True(t, d.grants("Append"))
+			assert.False(t, d.grants("Control"))
+		} else {
+			assert.Equal(t, []string{"https://alice.example/private/"}, d.Prefixes)
+		}
+	}
+}
+
+func TestScopedDelegation(t *testing.T) {
+	defer publishTestUsers(t)()
+	defer startTestBolt(t, handler, "_test/delegation.db")()
+
+	dir := testServer.URL + "/_test/delegdir/"
+	grant := defrag(user1) + "#delegation"
+	sparqlData := `INSERT DATA { <` + user1 + `> <http://www.w3.org/ns/auth/acl#delegates> <` + grant + `> .
+	<` + grant + `> <http://www.w3.org/ns/auth/acl#agent> <` + user2 + `> .
+	<` + grant + `> <http://www.w3.org/ns/auth/acl#accessTo> <` + dir + `> .
+	<` + grant + `> <http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Read> . }`
+	request, err := http.NewRequest("PATCH", user1, strings.NewReader(sparqlData))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/sparql-update")
+	response, err := user1h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 200, response.StatusCode)
+
+	acl := "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+		"<#Owner> acl:accessTo <" + dir + ">, <" + dir + ".acl> ;\n" +
+		"	acl:default <" + dir + "> ;\n" +
+		"	acl:agent <" + user1 + "> ;\n" +
+		"	acl:mode acl:Read, acl:Write, acl:Control ."
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+".acl", acl))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+"abc", "<a> <b> <c> ."))
+
+	delegated := func(method string, uri string, body string) *http.Response {
+		request, err := http.NewRequest(method, uri, strings.NewReader(body))
+		assert.NoError(t, err)
+		if len(body) > 0 {
+			request.Header.Add("Content-Type", "text/turtle")
+		}
+		request.Header.Add("On-Behalf-Of", "<"+user1+">")
+		response, err := user2h.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		return response
+	}
+
+	// the profile grant allows reading only
+	response = delegated("GET", dir+"abc", "")
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, user1, response.Header.Get("User"))
+	assert.Equal(t, user2, response.Header.Get("Delegate"))
+	assert.Equal(t, 403, delegated("PUT", dir+"abc", "<d> <e> <f> .").StatusCode)
+	assert.Equal(t, 403, delegated("GET", dir+".acl", "").StatusCode)
+	assert.Equal(t, 403, delegated("GET", testServer.URL+"/"+SystemPrefix+"/delegations", "").StatusCode)
+
+	// a grant from the API allows writing, until it is revoked
+	request, err = http.NewRequest("POST", testServer.URL+"/"+SystemPrefix+"/delegations",
+		strings.NewReader(`{"delegatee":"`+user2+`","prefixes":["`+dir+`"],"modes":["write"],"ttl":60}`))
+	assert.NoError(t, err)
+	response, err = user1h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 201, response.StatusCode)
+
+	grants, err := handler.getDelegations(hostOf(testServer.URL), user1)
+	assert.NoError(t, err)
+	assert.Len(t, grants, 1)
+	assert.Equal(t, user2, grants[0].Delegatee)
+	assert.True(t, grants[0].Expires <= time.Now().Add(time.Minute).Unix())
+
+	assert.Equal(t, 200, delegated("GET", dir+"abc", "").StatusCode)
+	assert.Equal(t, 200, delegated("PUT", dir+"abc", "<d> <e> <f> .").StatusCode)
+
+	request, err = http.NewRequest("DELETE", testServer.URL+"/"+SystemPrefix+"/delegations?id="+grants[0].ID, nil)
+	assert.NoError(t, err)
+	response, err = user1h.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, 403, delegated("PUT", dir+"abc", "<g> <h> <i> .").StatusCode)
+
+	for _, path := range []string{"abc", ".acl", ""} {
+		assert.Equal(t, 200, wacDo(t, user1h, "DELETE", dir+path, ""))
+	}
+}
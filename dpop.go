@@ -0,0 +1,301 @@
+package gold
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dpopSkew is how far the iat of a DPoP proof may be from the server time
+	dpopSkew = 5 * time.Minute
+)
+
+// htuOf returns the URI of a request as used in the htu claim of DPoP proofs,
+// i.e. without its query and fragment
+func htuOf(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String()
+}
+
+// verifyDPoPProof checks a DPoP proof (RFC 9449) for the request method and URI, and
+// returns its claims and the thumbprint of the key that signed it
+func verifyDPoPProof(proof string, method string, uri string) (*jwtClaims, string, error) {
+	if len(proof) == 0 {
+		return nil, "", errors.New("Missing DPoP proof")
+	}
+	header, claims, verify, err := parseJWT(proof)
+	if err != nil {
+		return nil, "", err
+	}
+	if header.Typ != "dpop+jwt" || header.JWK == nil {
+		return nil, "", errors.New("The DPoP proof must be a dpop+jwt with a jwk header")
+	}
+	pub, err := header.JWK.PublicKey()
+	if err != nil {
+		return nil, "", err
+	}
+	if err = verify(pub); err != nil {
+		return nil, "", err
+	}
+	if claims.HTM != method {
+		return nil, "", errors.New("The DPoP proof is for method " + claims.HTM)
+	}
+	if htuOf(claims.HTU) != htuOf(uri) {
+		return nil, "", errors.New("The DPoP proof is for " + claims.HTU)
+	}
+	if len(claims.ID) == 0 {
+		return nil, "", errors.New("The DPoP proof has no jti")
+	}
+	iat := time.Unix(claims.IssuedAt, 0)
+	if iat.Before(time.Now().Add(-dpopSkew)) || iat.After(time.Now().Add(dpopSkew)) {
+		return nil, "", errors.New("The DPoP proof is not fresh")
+	}
+	jkt, err := header.JWK.Thumbprint()
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, jkt, nil
+}
+
+const (
+	// jwksCacheAge is how long the keys of an issuer are cached by default
+	jwksCacheAge = 10 * time.Minute
+	// jwksRefetchAge is the minimum time between two fetches of the keys of an issuer,
+	// used when a token names a key that is not in the cached set
+	jwksRefetchAge = time.Minute
+	// replayCacheSize bounds the number of DPoP proofs remembered
+	replayCacheSize = 100000
+	// untrustedIssuerAge is how long an issuer that a WebID does not trust is remembered
+	untrustedIssuerAge = time.Minute
+)
+
+// replayCache remembers the DPoP proofs seen recently, so that they can only be used once
+type replayCache struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: map[string]time.Time{}}
+}
+
+// check records the proof ID until the given time, and returns false if it was already seen
+func (c *replayCache) check(id string, until time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if expires, ok := c.seen[id]; ok && now.Before(expires) {
+		return false
+	}
+	if len(c.seen) >= replayCacheSize {
+		for k, expires := range c.seen {
+			if now.After(expires) {
+				delete(c.seen, k)
+			}
+		}
+		if len(c.seen) >= replayCacheSize {
+			c.seen = map[string]time.Time{}
+		}
+	}
+	c.seen[id] = until
+	return true
+}
+
+// has tells if the ID was recorded and has not expired
+func (c *replayCache) has(id string) bool {
+	c.Lock()
+	defer c.Unlock()
+	expires, ok := c.seen[id]
+	return ok && time.Now().Before(expires)
+}
+
+type jwksCacheEntry struct {
+	keys    []*JWK
+	fetched time.Time
+	expires time.Time
+}
+
+// jwksCache holds the signing keys of the OpenID Providers, found through their discovery document
+type jwksCache struct {
+	sync.Mutex
+	entries map[string]*jwksCacheEntry
+	client  *http.Client
+}
+
+func newJWKSCache(timeout time.Duration) *jwksCache {
+	return &jwksCache{
+		entries: map[string]*jwksCacheEntry{},
+		client: &http.Client{
+			Transport: fetchTransport,
+			Timeout:   timeout,
+		},
+	}
+}
+
+// key returns the key of the issuer with the given ID (any key if the ID is empty)
+func (c *jwksCache) key(issuer string, kid string) (*JWK, error) {
+	c.Lock()
+	entry, ok := c.entries[issuer]
+	c.Unlock()
+	if !ok || time.Now().After(entry.expires) || (entry.find(kid) == nil && time.Since(entry.fetched) > jwksRefetchAge) {
+		fresh, err := c.fetch(issuer)
+		if err != nil {
+			return nil, err
+		}
+		c.Lock()
+		c.entries[issuer] = fresh
+		c.Unlock()
+		entry = fresh
+	}
+	if key := entry.find(kid); key != nil {
+		return key, nil
+	}
+	return nil, errors.New("Unknown key " + kid + " for issuer " + issuer)
+}
+
+func (e *jwksCacheEntry) find(kid string) *JWK {
+	for _, k := range e.keys {
+		if len(kid) == 0 || k.Kid == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+func (c *jwksCache) fetch(issuer string) (*jwksCacheEntry, error) {
+	if !strings.HasPrefix(issuer, "https://") {
+		return nil, errors.New("Issuer " + issuer + " does not use https")
+	}
+	var config oidcConfiguration
+	if err := c.getJSON(strings.TrimSuffix(issuer, "/")+oidcDiscoveryPath, &config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != issuer {
+		return nil, errors.New("The discovery document of " + issuer + " is for issuer " + config.Issuer)
+	}
+	if len(config.JWKSURI) == 0 {
+		return nil, errors.New("The discovery document of " + issuer + " has no jwks_uri")
+	}
+	var set JWKSet
+	if err := c.getJSON(config.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	return &jwksCacheEntry{keys: set.Keys, fetched: time.Now(), expires: time.Now().Add(jwksCacheAge)}, nil
+}
+
+func (c *jwksCache) getJSON(uri string, v interface{}) error {
+	if !strings.HasPrefix(uri, "https://") {
+		return errors.New("Invalid URL " + uri)
+	}
+	r, err := c.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return errors.New("Could not fetch " + uri + ": " + r.Status)
+	}
+	return json.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(v)
+}
+
+// DPoPAuth performs Solid-OIDC authentication: it checks the DPoP-bound access token of
+// the request and returns the WebID and client ID it was issued for
+func DPoPAuth(req *httpRequest) (string, string, error) {
+	authz := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(authz) != 2 || authz[0] != "DPoP" {
+		return "", "", errors.New("Not a DPoP authorization")
+	}
+	token := strings.TrimSpace(authz[1])
+
+	proof, jkt, err := verifyDPoPProof(req.Header.Get("DPoP"), req.Method, req.BaseURI())
+	if err != nil {
+		return "", "", err
+	}
+	if !req.Server.dpopReplay.check(jkt+" "+proof.ID, time.Now().Add(2*dpopSkew)) {
+		return "", "", errors.New("The DPoP proof has already been used")
+	}
+	ath := sha256.Sum256([]byte(token))
+	if len(proof.ATH) == 0 {
+		return "", "", errors.New("The DPoP proof has no access token hash")
+	} else if proof.ATH != b64(ath[:]) {
+		return "", "", errors.New("The DPoP proof is for another access token")
+	}
+
+	header, claims, verify, err := parseJWT(token)
+	if err != nil {
+		return "", "", err
+	}
+	if claims.Cnf == nil || claims.Cnf.JKT != jkt {
+		return "", "", errors.New("The access token is not bound to the DPoP key")
+	}
+	now := time.Now()
+	if claims.Expires < now.Unix() || claims.IssuedAt > now.Add(dpopSkew).Unix() {
+		return "", "", errors.New("The access token has expired")
+	}
+	if !claims.Audience.contains("solid") {
+		return "", "", errors.New("The access token is not meant for Solid servers")
+	}
+	webid := claims.WebID
+	if len(webid) == 0 && strings.HasPrefix(claims.Subject, "http") {
+		webid = claims.Subject
+	}
+	if !strings.HasPrefix(webid, "http") || len(claims.Issuer) == 0 {
+		return "", "", errors.New("The access token has no WebID or issuer")
+	}
+
+	// the WebID must trust the issuer, which is checked before fetching anything from it.
+	// Issuers that are not trusted are remembered, so that their tokens do not fetch the profile.
+	issuer := webid + " " + claims.Issuer
+	if req.Server.untrusted.has(issuer) {
+		return "", "", errors.New("The issuer " + claims.Issuer + " is not an oidcIssuer of " + webid)
+	}
+	trusted := false
+	for _, refresh := range []bool{false, true} {
+		g, err := req.Server.profileCache.get(webid, refresh)
+		if err != nil {
+			return "", "", err
+		}
+		for _, t := range g.All(NewResource(webid), ns.st.Get("oidcIssuer"), nil) {
+			if strings.TrimSuffix(debrack(t.Object.String()), "/") == strings.TrimSuffix(claims.Issuer, "/") {
+				trusted = true
+				break
+			}
+		}
+		if trusted {
+			break
+		}
+	}
+	if !trusted {
+		req.Server.untrusted.check(issuer, time.Now().Add(untrustedIssuerAge))
+		return "", "", errors.New("The issuer " + claims.Issuer + " is not an oidcIssuer of " + webid)
+	}
+
+	key, err := req.Server.jwksCache.key(claims.Issuer, header.Kid)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return "", "", err
+	}
+	if err = verify(pub); err != nil {
+		return "", "", err
+	}
+
+	clientID := claims.ClientID
+	if len(clientID) == 0 {
+		clientID = claims.Azp
+	}
+	return webid, clientID, nil
+}
@@ -0,0 +1,181 @@
+package gold
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDPoPReplayCache(t *testing.T) {
+	c := newReplayCache()
+	assert.True(t, c.check("a", time.Now().Add(time.Minute)))
+	assert.False(t, c.check("a", time.Now().Add(time.Minute)))
+	assert.True(t, c.check("b", time.Now().Add(-time.Second)))
+	assert.True(t, c.check("b", time.Now().Add(time.Minute)))
+}
+
+func TestJWKSCacheVerifiesIssuers(t *testing.T) {
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(oidcConfiguration{Issuer: "https://" + req.Host})
+	}))
+	defer idp.Close()
+
+	c := newJWKSCache(time.Second)
+	_, err := c.key("http://"+idp.Listener.Addr().String(), "")
+	assert.Error(t, err)
+	_, err = c.key(idp.URL, "")
+	assert.EqualError(t, err, "The discovery document of "+idp.URL+" has no jwks_uri")
+
+	// certificates that cannot be verified are rejected
+	c = newJWKSCache(time.Second)
+	c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{}}
+	_, err = c.key(idp.URL, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate")
+}
+
+func TestDPoPResourceServer(t *testing.T) {
+	// a stand-in OpenID Provider
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	var issuer string
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case oidcDiscoveryPath:
+			json.NewEncoder(w).Encode(oidcConfiguration{Issuer: issuer, JWKSURI: issuer + "/jwks"})
+		case "/jwks":
+			jwk, _ := NewJWK(&issuerKey.PublicKey)
+			jwk.Kid = "k1"
+			json.NewEncoder(w).Encode(JWKSet{Keys: []*JWK{jwk}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer idp.Close()
+	issuer = idp.URL
+
+	trust := func(verb string) {
+		request, err := http.NewRequest("PATCH", user1, strings.NewReader(verb+" DATA { <#id> <http://www.w3.org/ns/solid/terms#oidcIssuer> <"+issuer+"> . }"))
+		assert.NoError(t, err)
+		request.Header.Add("Content-Type", "application/sparql-update")
+		response, err := user1h.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, 200, response.StatusCode)
+	}
+	defer publishTestUsers(t)()
+	trust("INSERT")
+	defer trust("DELETE")
+
+	dir := testServer.URL + "/_test/dpopdir/"
+	owner := "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+		"<#Owner> acl:accessTo <" + dir + "> ;\n" +
+		"	acl:default <" + dir + "> ;\n" +
+		"	acl:agent <" + user1 + "> ;\n" +
+		"	acl:mode acl:Read, acl:Write, acl:Control ."
+	assert.Equal(t, 201, wacDo(t, user1h, "MKCOL", dir, ""))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+".acl", owner))
+	assert.Equal(t, 201, wacDo(t, user1h, "PUT", dir+"doc", "<a> <b> <c> ."))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwk, err := NewJWK(&key.PublicKey)
+	assert.NoError(t, err)
+	jkt, err := jwk.Thumbprint()
+	assert.NoError(t, err)
+	claims := func() jwtClaims {
+		return jwtClaims{
+			Issuer:   issuer,
+			Subject:  user1,
+			Audience: audience{"solid"},
+			WebID:    user1,
+			ClientID: "https://app.example/id",
+			IssuedAt: time.Now().Unix(),
+			Expires:  time.Now().Add(time.Hour).Unix(),
+			Cnf:      &confirmation{JKT: jkt},
+		}
+	}
+	mint := func(signer *ecdsa.PrivateKey, c jwtClaims) string {
+		token, err := signJWT(signer, jwsHeader{Typ: "at+jwt", Kid: "k1"}, c)
+		assert.NoError(t, err)
+		return token
+	}
+	do := func(method string, uri string, token string, proof string) *http.Response {
+		request, err := http.NewRequest(method, uri, nil)
+		assert.NoError(t, err)
+		request.Header.Set("Authorization", "DPoP "+token)
+		request.Header.Set("DPoP", proof)
+		response, err := httpClient.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		return response
+	}
+
+	token := mint(issuerKey, claims())
+	proof := dpopBoundProof(t, key, "GET", dir+"doc", token)
+	response := do("GET", dir+"doc", token, proof)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, user1, response.Header.Get("User"))
+	assert.Empty(t, response.Header.Get("Set-Cookie"))
+
+	// proofs can only be used once, for the request they were made for
+	assert.Equal(t, 401, do("GET", dir+"doc", token, proof).StatusCode)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, key, "GET", dir, token)).StatusCode)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, key, "HEAD", dir+"doc", token)).StatusCode)
+
+	// the proof must be made for the access token
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopProof(t, key, "GET", dir+"doc")).StatusCode)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, key, "GET", dir+"doc", mint(issuerKey, claims())+"x")).StatusCode)
+
+	// stale proofs, stolen tokens, expired tokens and forged tokens are rejected
+	ath := sha256.Sum256([]byte(token))
+	stale, err := signJWT(key, jwsHeader{Typ: "dpop+jwt", JWK: jwk}, jwtClaims{HTM: "GET", HTU: dir + "doc", IssuedAt: time.Now().Add(-time.Hour).Unix(), ID: "stale", ATH: b64(ath[:])})
+	assert.NoError(t, err)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, stale).StatusCode)
+	thief, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, thief, "GET", dir+"doc", token)).StatusCode)
+	expired := claims()
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+	token = mint(issuerKey, expired)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, key, "GET", dir+"doc", token)).StatusCode)
+	token = mint(thief, claims())
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, key, "GET", dir+"doc", token)).StatusCode)
+
+	// the issuer must be listed in the WebID profile, and is not looked up again for a while once it was not
+	untrusted := claims()
+	untrusted.Issuer = "https://idp.example"
+	token = mint(issuerKey, untrusted)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, key, "GET", dir+"doc", token)).StatusCode)
+	flushed := handler.profileCache.flush(user1)
+	assert.Equal(t, 1, flushed)
+	token = mint(issuerKey, untrusted)
+	assert.Equal(t, 401, do("GET", dir+"doc", token, dpopBoundProof(t, key, "GET", dir+"doc", token)).StatusCode)
+	assert.Equal(t, 0, handler.profileCache.flush(user1))
+
+	// apps cannot manage the account of the user
+	for _, path := range []string{"export", "tokens", "sessions"} {
+		uri := testServer.URL + "/" + SystemPrefix + "/" + path
+		token = mint(issuerKey, claims())
+		assert.Equal(t, 403, do("GET", uri, token, dpopBoundProof(t, key, "GET", uri, token)).StatusCode)
+	}
+
+	// the WebID of the token is used for all access modes
+	token = mint(issuerKey, claims())
+	assert.Equal(t, 200, do("DELETE", dir+"doc", token, dpopBoundProof(t, key, "DELETE", dir+"doc", token)).StatusCode)
+
+	for _, path := range []string{".acl", ""} {
+		assert.Equal(t, 200, wacDo(t, user1h, "DELETE", dir+path, ""))
+	}
+}
@@ -0,0 +1,259 @@
+package gold
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// exportVersion is the version of the archive layout
+	exportVersion = 1
+	// exportManifestName is the name of the manifest in the archive; the files of the
+	// account are under exportDataDir
+	exportManifestName = "manifest.json"
+	exportDataDir      = "data/"
+)
+
+// exportManifest describes an account archive
+type exportManifest struct {
+	Version    int           `json:"version"`
+	WebID      string        `json:"webid"`
+	Base       string        `json:"base"`
+	Created    time.Time     `json:"created"`
+	Normalized string        `json:"normalized,omitempty"`
+	Files      []*exportFile `json:"files"`
+}
+
+// exportFile is an entry of the manifest; containers have a path ending with a slash
+type exportFile struct {
+	Path         string    `json:"path"`
+	ContentType  string    `json:"contentType,omitempty"`
+	OriginalType string    `json:"originalType,omitempty"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Modified     time.Time `json:"modified"`
+}
+
+// archiveWriter adds files to a tar or zip archive
+type archiveWriter interface {
+	add(name string, size int64, modified time.Time, r io.Reader) error
+	addDir(name string, modified time.Time) error
+	Close() error
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (a tarArchive) add(name string, size int64, modified time.Time, r io.Reader) error {
+	err := a.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modified, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a, r)
+	return err
+}
+
+func (a tarArchive) addDir(name string, modified time.Time) error {
+	return a.WriteHeader(&tar.Header{Name: name, Mode: 0755, ModTime: modified, Typeflag: tar.TypeDir})
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (a zipArchive) add(name string, size int64, modified time.Time, r io.Reader) error {
+	f, err := a.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (a zipArchive) addDir(name string, modified time.Time) error {
+	_, err := a.CreateHeader(&zip.FileHeader{Name: name, Modified: modified})
+	return err
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "tar":
+		return tarArchive{tar.NewWriter(w)}, nil
+	case "zip":
+		return zipArchive{zip.NewWriter(w)}, nil
+	}
+	return nil, errors.New("Unknown archive format " + format)
+}
+
+// storedContentType returns the content type of a stored file. Sidecars, and documents
+// without a known extension, are kept as Turtle.
+func (s *Server) storedContentType(file string) string {
+	if strings.HasSuffix(file, s.Config.ACLSuffix) || strings.HasSuffix(file, s.Config.MetaSuffix) {
+		return "text/turtle"
+	}
+	ctype, _, _ := MimeLookup(file)
+	if len(ctype) == 0 {
+		ctype, _ = GuessMimeType(file)
+	}
+	if ctype == "text/plain" {
+		return "text/turtle"
+	}
+	return ctype
+}
+
+// normalizeRDF returns the document serialized with the given mime type, or nil if it
+// is not an RDF document or cannot be parsed
+func normalizeRDF(file string, uri string, ctype string, mime string) []byte {
+	ctype = strings.TrimSpace(strings.Split(ctype, ";")[0])
+	if LookupExt(ctype) == "" || ctype == mime {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	g := NewGraph(uri)
+	g.Parse(f, ctype)
+	if g.Len() == 0 {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	if err = g.Stream(context.Background(), buf, mime); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// writeExport writes an archive of the tree under root (served at base) to w, followed by its
+// manifest. RDF documents are serialized with the normalize mime type, if not empty.
+func (s *Server) writeExport(w io.Writer, format string, root string, base string, webid string, normalize string) error {
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	manifest := &exportManifest{
+		Version:    exportVersion,
+		WebID:      webid,
+		Base:       base,
+		Created:    time.Now().UTC(),
+		Normalized: normalize,
+		Files:      []*exportFile{},
+	}
+	root = filepath.Clean(root)
+
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		entry := &exportFile{Path: rel, Modified: info.ModTime().UTC()}
+		if info.IsDir() {
+			entry.Path += "/"
+			manifest.Files = append(manifest.Files, entry)
+			return archive.addDir(exportDataDir+entry.Path, entry.Modified)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		entry.ContentType = s.storedContentType(file)
+		h := sha256.New()
+		if len(normalize) > 0 {
+			if data := normalizeRDF(file, base+"/"+rel, entry.ContentType, normalize); data != nil {
+				entry.OriginalType, entry.ContentType = entry.ContentType, normalize
+				entry.Size = int64(len(data))
+				manifest.Files = append(manifest.Files, entry)
+				err = archive.add(exportDataDir+rel, entry.Size, entry.Modified, io.TeeReader(bytes.NewReader(data), h))
+				entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+				return err
+			}
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		entry.Size = info.Size()
+		manifest.Files = append(manifest.Files, entry)
+		err = archive.add(exportDataDir+rel, entry.Size, entry.Modified, io.TeeReader(io.LimitReader(f, entry.Size), h))
+		entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = archive.add(exportManifestName, int64(len(data)), manifest.Created, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// accountExport streams an archive (format=tar or zip) of the account to its owner. With
+// normalize=text/turtle, application/n-triples or application/ld+json (true is Turtle),
+// RDF documents are converted to a single serialization.
+func accountExport(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if !req.IsOwner {
+		return SystemReturn{Status: 403, Body: "Only the owner of the account can export it"}
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		return SystemReturn{Status: 405, Body: "405 - Method Not Allowed: " + req.Method}
+	}
+	format := req.FormValue("format")
+	if len(format) == 0 {
+		format = "tar"
+	}
+	if format != "tar" && format != "zip" {
+		return SystemReturn{Status: 400, Body: "Unknown archive format " + format}
+	}
+	normalize := req.FormValue("normalize")
+	if normalize == "true" {
+		normalize = "text/turtle"
+	}
+	if _, ok := streamWriters[normalize]; len(normalize) > 0 && !ok {
+		return SystemReturn{Status: 400, Body: "Cannot normalize documents to " + normalize}
+	}
+	resource, err := req.pathInfo(req.BaseURI())
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	root, err := req.pathInfo(resource.Base)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	webid := req.getAccountWebID()
+	if len(webid) == 0 {
+		webid = req.User
+	}
+
+	name := strings.Replace(root.Obj.Host, ":", "_", -1) + "-" + time.Now().UTC().Format("20060102") + "." + format
+	w.Header().Set(HCType, map[string]string{"tar": "application/x-tar", "zip": "application/zip"}[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.WriteHeader(200)
+	err = s.writeExport(w, format, root.File, root.Base, webid, normalize)
+	if err != nil {
+		// the response has already started, all we can do is log the error
+		s.debug.Println("Export error for " + root.Base + ": " + err.Error())
+	}
+	return SystemReturn{}
+}
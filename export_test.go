@@ -0,0 +1,132 @@
+package gold
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeExportTree creates a small account tree under root
+func writeExportTree(t *testing.T, root string) {
+	files := map[string]string{
+		"profile/card":     "<#me> a <http://xmlns.com/foaf/0.1/Person> .",
+		"profile/card.acl": "<#owner> <http://www.w3.org/ns/auth/acl#agent> </profile/card#me> .",
+		"notes.ttl":        "@prefix dct: <http://purl.org/dc/terms/> .\n<#n1> dct:title \"Note\" .",
+		"notes.ttl.meta":   "<notes.ttl> <http://purl.org/dc/terms/creator> </profile/card#me> .",
+		"photos/a.png":     "\x89PNG\r\n\x1a\n",
+	}
+	for name, data := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0644))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "empty"), 0755))
+}
+
+// readExport returns the files of an archive, by name
+func readExport(t *testing.T, format string, data []byte) map[string][]byte {
+	files := map[string][]byte{}
+	if format == "zip" {
+		r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		for _, f := range r.File {
+			rc, err := f.Open()
+			assert.NoError(t, err)
+			files[f.Name], err = ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			rc.Close()
+		}
+		return files
+	}
+	r := tar.NewReader(bytes.NewReader(data))
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		if err != nil {
+			break
+		}
+		files[h.Name], err = ioutil.ReadAll(r)
+		assert.NoError(t, err)
+	}
+	return files
+}
+
+func TestWriteExport(t *testing.T) {
+	root := "_test/export/"
+	defer os.RemoveAll(root)
+	writeExportTree(t, root)
+	base := "https://alice.example"
+	webid := base + "/profile/card#me"
+
+	for _, format := range []string{"tar", "zip"} {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, handler.writeExport(buf, format, root, base, webid, ""))
+		files := readExport(t, format, buf.Bytes())
+
+		manifest := new(exportManifest)
+		assert.NoError(t, json.Unmarshal(files[exportManifestName], manifest))
+		assert.Equal(t, exportVersion, manifest.Version)
+		assert.Equal(t, webid, manifest.WebID)
+		assert.Equal(t, base, manifest.Base)
+		assert.Len(t, manifest.Files, 8)
+		types := map[string]string{}
+		for _, f := range manifest.Files {
+			types[f.Path] = f.ContentType
+			if strings.HasSuffix(f.Path, "/") {
+				continue
+			}
+			sum := sha256.Sum256(files[exportDataDir+f.Path])
+			assert.Equal(t, hex.EncodeToString(sum[:]), f.SHA256, f.Path)
+			assert.Equal(t, int64(len(files[exportDataDir+f.Path])), f.Size, f.Path)
+		}
+		assert.Equal(t, "text/turtle", types["profile/card"])
+		assert.Equal(t, "text/turtle", types["profile/card.acl"])
+		assert.Equal(t, "text/turtle", types["notes.ttl.meta"])
+		assert.Equal(t, "image/png", types["photos/a.png"])
+		assert.Contains(t, types, "empty/")
+	}
+}
+
+func TestWriteExportNormalized(t *testing.T) {
+	root := "_test/export/"
+	defer os.RemoveAll(root)
+	writeExportTree(t, root)
+	base := "https://alice.example"
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, handler.writeExport(buf, "tar", root, base, base+"/profile/card#me", "application/n-triples"))
+	files := readExport(t, "tar", buf.Bytes())
+	manifest := new(exportManifest)
+	assert.NoError(t, json.Unmarshal(files[exportManifestName], manifest))
+	assert.Equal(t, "application/n-triples", manifest.Normalized)
+	for _, f := range manifest.Files {
+		switch f.Path {
+		case "notes.ttl":
+			assert.Equal(t, "application/n-triples", f.ContentType)
+			assert.Equal(t, "text/turtle", f.OriginalType)
+			assert.Equal(t, `<https://alice.example/notes.ttl#n1> <http://purl.org/dc/terms/title> "Note" .`,
+				strings.TrimSpace(string(files[exportDataDir+f.Path])))
+		case "photos/a.png":
+			assert.Equal(t, "image/png", f.ContentType)
+			assert.Empty(t, f.OriginalType)
+		}
+	}
+}
+
+func TestAccountExportUnauthenticated(t *testing.T) {
+	response, _ := oidcDo(t, httpClient, "GET", testServer.URL+"/"+SystemPrefix+"/export", nil, nil)
+	assert.Equal(t, 401, response.StatusCode)
+}
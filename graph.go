@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -39,11 +40,20 @@ var (
 			},
 		},
 	}
+
+	// fetchTransport is used for the documents that authentication relies on (WebID profiles,
+	// groups, client IDs and the keys of OpenID Providers), so it verifies certificates
+	fetchTransport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{},
+	}
 )
 
 // Graph structure
 type Graph struct {
 	triples map[*Triple]bool
+	// prefixes maps the namespace prefixes found while parsing to their URIs
+	prefixes map[string]string
 
 	uri  string
 	term Term
@@ -56,9 +66,10 @@ func NewGraph(uri string) *Graph {
 	}
 
 	return &Graph{
-		triples: make(map[*Triple]bool),
-		uri:     uri,
-		term:    NewResource(uri),
+		triples:  make(map[*Triple]bool),
+		prefixes: make(map[string]string),
+		uri:      uri,
+		term:     NewResource(uri),
 	}
 }
 
@@ -77,6 +88,16 @@ func (g *Graph) URI() string {
 	return g.uri
 }
 
+// Prefixes returns the namespace prefixes declared in the parsed documents
+func (g *Graph) Prefixes() map[string]string {
+	return g.prefixes
+}
+
+// SetPrefix declares a namespace prefix used when writing the graph as Turtle
+func (g *Graph) SetPrefix(prefix string, uri string) {
+	g.prefixes[prefix] = uri
+}
+
 func term2term(term crdf.Term) Term {
 	switch term := term.(type) {
 	case *crdf.Blank:
@@ -85,6 +106,9 @@ func term2term(term crdf.Term) Term {
 		if len(term.Datatype) > 0 {
 			return NewLiteralWithLanguageAndDatatype(term.Value, term.Lang, NewResource(term.Datatype))
 		}
+		if len(term.Lang) > 0 {
+			return NewLiteralWithLanguage(term.Value, term.Lang)
+		}
 		return NewLiteral(term.Value)
 	case *crdf.Uri:
 		return NewResource(term.String())
@@ -204,6 +228,7 @@ func (g *Graph) Parse(reader io.Reader, mime string) {
 	parser.SetLogHandler(func(level int, message string) {
 		log.Println(message)
 	})
+	parser.SetNamespaceHandler(g.SetPrefix)
 	defer parser.Free()
 
 	for s := range parser.Parse(reader, g.uri) {
@@ -211,6 +236,29 @@ func (g *Graph) Parse(reader io.Reader, mime string) {
 	}
 }
 
+// ParseStrict is like Parse, but returns the first error reported by the parser
+func (g *Graph) ParseStrict(reader io.Reader, mime string) error {
+	parserName := mimeParser[mime]
+	if len(parserName) == 0 || parserName == "jsonld" {
+		return fmt.Errorf("Cannot validate %s documents", mime)
+	}
+	var perr error
+	parser := crdf.NewParser(parserName)
+	parser.SetLogHandler(func(level int, message string) {
+		// raptor uses 5 for errors and 6 for fatal errors
+		if level >= 5 && perr == nil {
+			perr = errors.New(message)
+		}
+	})
+	parser.SetNamespaceHandler(g.SetPrefix)
+	defer parser.Free()
+
+	for s := range parser.Parse(reader, g.uri) {
+		g.AddStatement(s)
+	}
+	return perr
+}
+
 // ParseBase is used to parse RDF data from a reader, using the provided mime type and a base URI
 func (g *Graph) ParseBase(reader io.Reader, mime string, baseURI string) {
 	if len(baseURI) < 1 {
@@ -221,6 +269,7 @@ func (g *Graph) ParseBase(reader io.Reader, mime string, baseURI string) {
 		parserName = "guess"
 	}
 	parser := crdf.NewParser(parserName)
+	parser.SetNamespaceHandler(g.SetPrefix)
 	defer parser.Free()
 	out := parser.Parse(reader, baseURI)
 	for s := range out {
@@ -379,6 +428,10 @@ func (g *Graph) WriteFile(file *os.File, mime string) error {
 	if len(serializerName) == 0 {
 		serializerName = "turtle"
 	}
+	if serializerName == "turtle" {
+		// keep the original prefixes and a stable layout, so that edits produce small diffs
+		return g.WriteTurtle(file)
+	}
 	serializer := crdf.NewSerializer(serializerName)
 	defer serializer.Free()
 	err := serializer.SetFile(file, g.uri)
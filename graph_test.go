@@ -1,6 +1,10 @@
 package gold
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 
@@ -92,3 +96,142 @@ func TestGraphAll(t *testing.T) {
 	assert.Equal(t, 1, len(g.All(nil, nil, NewResource("d"))))
 	assert.Equal(t, 2, len(g.All(nil, nil, NewResource("c"))))
 }
+
+func TestGraphStreamTurtle(t *testing.T) {
+	g := NewGraph("https://test/doc")
+	g.AddTriple(NewResource("https://test/doc"), ns.rdf.Get("type"), NewResource("http://example.org/Doc"))
+	g.AddTriple(NewResource("https://test/doc#a"), NewResource("https://test/b"), NewResource("https://test/c"))
+	g.AddTriple(NewResource("https://test/doc#a"), NewResource("https://test/b"), NewLiteral("d"))
+	g.AddTriple(NewResource("https://test/doc#a"), NewResource("https://test/b2"), NewResource("https://test/c"))
+
+	buf := new(bytes.Buffer)
+	err := g.Stream(context.Background(), buf, "text/turtle")
+	assert.NoError(t, err)
+	assert.Equal(t, "@prefix rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#> .\n\n"+
+		"<>\n    a <http://example.org/Doc> .\n\n"+
+		"<#a>\n    <b> \"d\", <c> ;\n    <b2> <c> .\n\n", buf.String())
+}
+
+func TestGraphStreamTurtleDirectory(t *testing.T) {
+	g := NewGraph("https://test/dir/.acl")
+	owner := NewResource("https://test/dir/.acl#owner")
+	g.AddTriple(owner, NewResource("http://www.w3.org/ns/auth/acl#accessTo"), NewResource("https://test/dir/"))
+	g.AddTriple(owner, NewResource("http://www.w3.org/ns/auth/acl#accessTo"), NewResource("https://test/dir/a:b"))
+	g.AddTriple(owner, NewResource("http://www.w3.org/ns/auth/acl#accessTo"), NewResource("https://test/dir/sub/"))
+	g.AddTriple(owner, NewResource("http://www.w3.org/ns/auth/acl#default"), NewResource("https://test/dir/#x"))
+
+	buf := new(bytes.Buffer)
+	err := g.Stream(context.Background(), buf, "text/turtle")
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "<./>")
+	assert.Contains(t, buf.String(), "<./#x>")
+	assert.Contains(t, buf.String(), "<./a:b>")
+	assert.Contains(t, buf.String(), "<sub/>")
+
+	// the relative references resolve to the same URIs when read again
+	g2 := NewGraph("https://test/dir/.acl")
+	g2.Parse(strings.NewReader(buf.String()), "text/turtle")
+	assert.Equal(t, g.Len(), g2.Len())
+	for _, triple := range g.All(owner, nil, nil) {
+		assert.NotNil(t, g2.One(triple.Subject, triple.Predicate, triple.Object), triple.String())
+	}
+}
+
+func TestGraphStreamNTriplesAndJSONLD(t *testing.T) {
+	g := NewGraph("https://test/")
+	g.AddTriple(NewResource("a"), NewResource("b"), NewResource("c"))
+
+	buf := new(bytes.Buffer)
+	err := g.Stream(context.Background(), buf, "application/n-triples")
+	assert.NoError(t, err)
+	assert.Equal(t, "<a> <b> <c> .\n", buf.String())
+
+	buf.Reset()
+	err = g.Stream(context.Background(), buf, "application/ld+json")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"@id":"a","b":[{"@id":"c"}]}]`, buf.String())
+}
+
+func TestGraphStreamCanceled(t *testing.T) {
+	g := NewGraph("https://test/")
+	g.AddTriple(NewResource("a"), NewResource("b"), NewResource("c"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buf := new(bytes.Buffer)
+	err := g.Stream(ctx, buf, "text/turtle")
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, buf.String())
+}
+
+func TestGraphWriteTurtle(t *testing.T) {
+	g := NewGraph("https://test/card")
+	g.Parse(strings.NewReader(`@prefix foaf: <http://xmlns.com/foaf/0.1/> .
+@prefix cert: <http://www.w3.org/ns/auth/cert#> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+
+<#me> a foaf:Person ;
+    foaf:name "Alice" ;
+    cert:key [ a cert:RSAPublicKey ; cert:exponent "65537"^^xsd:int ] .
+<> a foaf:PersonalProfileDocument ; foaf:primaryTopic <#me> .
+`), "text/turtle")
+	assert.Equal(t, "http://xmlns.com/foaf/0.1/", g.Prefixes()["foaf"])
+
+	buf := new(bytes.Buffer)
+	err := g.WriteTurtle(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "@prefix cert: <http://www.w3.org/ns/auth/cert#> .\n"+
+		"@prefix foaf: <http://xmlns.com/foaf/0.1/> .\n"+
+		"@prefix rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#> .\n"+
+		"@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .\n\n"+
+		"<>\n    a foaf:PersonalProfileDocument ;\n    foaf:primaryTopic <#me> .\n\n"+
+		"<#me>\n    a foaf:Person ;\n    cert:key [\n        a cert:RSAPublicKey ;\n        cert:exponent \"65537\"^^xsd:int\n    ] ;\n    foaf:name \"Alice\" .\n\n", buf.String())
+
+	// writing the parsed output again must not change it
+	g2 := NewGraph("https://test/card")
+	g2.Parse(strings.NewReader(buf.String()), "text/turtle")
+	assert.Equal(t, g.Len(), g2.Len())
+	buf2 := new(bytes.Buffer)
+	err = g2.WriteTurtle(buf2)
+	assert.NoError(t, err)
+	assert.Equal(t, buf.String(), buf2.String())
+}
+
+func TestGraphWriteFileContainerACL(t *testing.T) {
+	g := NewGraph("https://test/dir/.acl")
+	g.Parse(strings.NewReader(`@prefix acl: <http://www.w3.org/ns/auth/acl#> .
+<#owner> a acl:Authorization ;
+    acl:accessTo <https://test/dir/>, <https://test/dir/.acl> ;
+    acl:default <https://test/dir/> ;
+    acl:agent <https://test/dir/#me> ;
+    acl:mode acl:Read, acl:Write, acl:Control .
+`), "text/turtle")
+
+	f, err := ioutil.TempFile("", "gold-acl")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	assert.NoError(t, g.WriteFile(f, "text/turtle"))
+
+	// the directory and its fragments must not turn into the ACL document itself
+	_, err = f.Seek(0, 0)
+	assert.NoError(t, err)
+	g2 := NewGraph("https://test/dir/.acl")
+	g2.Parse(f, "text/turtle")
+	assert.Equal(t, g.Len(), g2.Len())
+	for _, triple := range g.All(NewResource("https://test/dir/.acl#owner"), nil, nil) {
+		assert.NotNil(t, g2.One(triple.Subject, triple.Predicate, triple.Object), triple.String())
+	}
+}
+
+func TestGraphWriteTurtleBlankCycle(t *testing.T) {
+	g := NewGraph("https://test/doc")
+	g.AddTriple(NewBlankNode("a"), NewResource("https://test/p"), NewBlankNode("b"))
+	g.AddTriple(NewBlankNode("b"), NewResource("https://test/p"), NewBlankNode("a"))
+
+	buf := new(bytes.Buffer)
+	err := g.WriteTurtle(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "@prefix rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#> .\n\n"+
+		"_:a\n    <p> [\n        <p> _:a\n    ] .\n\n", buf.String())
+}
@@ -0,0 +1,446 @@
+package gold
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// httpSigRequired lists the components that every signature must cover
+	httpSigRequired = []string{"@method", "@target-uri", "date"}
+
+	errNoSignature = errors.New("No matching Signature and Signature-Input")
+)
+
+// unknownKeyAge is how long a key that could not verify a signature is remembered,
+// during which its profile is not fetched again for it
+const unknownKeyAge = time.Minute
+
+// sigInput is a member of the Signature-Input dictionary (RFC 9421, section 4.1)
+type sigInput struct {
+	Label      string
+	Components []string
+	Params     map[string]string
+	// Raw is the serialized inner list, used as the value of @signature-params
+	Raw string
+}
+
+// splitDictionary splits a structured field dictionary into its members
+func splitDictionary(h string) []string {
+	var members []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(h); i++ {
+		switch c := h[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			members = append(members, strings.TrimSpace(h[start:i]))
+			start = i + 1
+		}
+	}
+	if m := strings.TrimSpace(h[start:]); len(m) > 0 {
+		members = append(members, m)
+	}
+	return members
+}
+
+// parseSFString reads a structured field string at the start of s, and returns it with the rest of s
+func parseSFString(s string) (string, string, error) {
+	if len(s) == 0 || s[0] != '"' {
+		return "", s, errors.New("Expected a string")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", errors.New("Unterminated string")
+}
+
+// parseSignatureInput parses a Signature-Input header
+func parseSignatureInput(h string) ([]*sigInput, error) {
+	var inputs []*sigInput
+	for _, member := range splitDictionary(h) {
+		eq := strings.Index(member, "=")
+		if eq < 0 {
+			return nil, errors.New("Bad Signature-Input member: " + member)
+		}
+		in := &sigInput{Label: member[:eq], Raw: member[eq+1:], Params: map[string]string{}}
+		rest := in.Raw
+		if !strings.HasPrefix(rest, "(") {
+			return nil, errors.New("Signature-Input members must be inner lists")
+		}
+		rest = strings.TrimLeft(rest[1:], " ")
+		for !strings.HasPrefix(rest, ")") {
+			var c string
+			var err error
+			c, rest, err = parseSFString(rest)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(rest, ";") {
+				return nil, errors.New("Component parameters are not supported")
+			}
+			in.Components = append(in.Components, c)
+			rest = strings.TrimLeft(rest, " ")
+			if len(rest) == 0 {
+				return nil, errors.New("Unterminated inner list")
+			}
+		}
+		rest = rest[1:]
+		for strings.HasPrefix(rest, ";") {
+			rest = rest[1:]
+			eq := strings.Index(rest, "=")
+			if eq < 0 {
+				return nil, errors.New("Bad signature parameter: " + rest)
+			}
+			name := rest[:eq]
+			rest = rest[eq+1:]
+			if strings.HasPrefix(rest, `"`) {
+				var v string
+				var err error
+				v, rest, err = parseSFString(rest)
+				if err != nil {
+					return nil, err
+				}
+				in.Params[name] = v
+			} else {
+				end := strings.Index(rest, ";")
+				if end < 0 {
+					end = len(rest)
+				}
+				in.Params[name] = rest[:end]
+				rest = rest[end:]
+			}
+		}
+		if len(rest) > 0 {
+			return nil, errors.New("Bad Signature-Input member: " + member)
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+// parseByteDictionary parses a dictionary of byte sequences, as used by the Signature and Content-Digest headers
+func parseByteDictionary(h string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	for _, member := range splitDictionary(h) {
+		eq := strings.Index(member, "=")
+		if eq < 0 {
+			return nil, errors.New("Bad dictionary member: " + member)
+		}
+		v := member[eq+1:]
+		if i := strings.Index(v, ";"); i >= 0 {
+			v = v[:i]
+		}
+		if len(v) < 2 || v[0] != ':' || v[len(v)-1] != ':' {
+			return nil, errors.New("Expected a byte sequence: " + member)
+		}
+		data, err := base64.StdEncoding.DecodeString(v[1 : len(v)-1])
+		if err != nil {
+			return nil, err
+		}
+		values[strings.ToLower(member[:eq])] = data
+	}
+	return values, nil
+}
+
+// targetURI returns the absolute URI of the request, including its query
+func (req *httpRequest) targetURI() string {
+	uri := req.BaseURI()
+	if len(req.URL.RawQuery) > 0 {
+		uri += "?" + req.URL.RawQuery
+	}
+	return uri
+}
+
+// signatureBase builds the signature base of the input (RFC 9421, section 2.5)
+func (req *httpRequest) signatureBase(in *sigInput) ([]byte, error) {
+	var b bytes.Buffer
+	for _, c := range in.Components {
+		var v string
+		switch c {
+		case "@method":
+			v = req.Method
+		case "@target-uri":
+			v = req.targetURI()
+		case "@authority":
+			v = strings.ToLower(hostOf(req.BaseURI()))
+		case "@scheme":
+			v = strings.SplitN(req.BaseURI(), ":", 2)[0]
+		case "@path":
+			v = req.URL.EscapedPath()
+		case "@query":
+			v = "?" + req.URL.RawQuery
+		default:
+			if strings.HasPrefix(c, "@") {
+				return nil, errors.New("Unsupported signature component: " + c)
+			}
+			values := req.Header[http.CanonicalHeaderKey(c)]
+			if len(values) == 0 {
+				return nil, errors.New("Missing signed header: " + c)
+			}
+			trimmed := make([]string, len(values))
+			for i := range values {
+				trimmed[i] = strings.TrimSpace(values[i])
+			}
+			v = strings.Join(trimmed, ", ")
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, errors.New("Bad value for signature component: " + c)
+		}
+		b.WriteString(`"` + c + `": ` + v + "\n")
+	}
+	b.WriteString(`"@signature-params": ` + in.Raw)
+	return b.Bytes(), nil
+}
+
+// spooledBody is a request body read once to check its digest, and kept in a temporary file
+type spooledBody struct {
+	io.Reader
+	file *os.File
+	rest io.Closer
+}
+
+func (b *spooledBody) Close() error {
+	b.file.Close()
+	os.Remove(b.file.Name())
+	return b.rest.Close()
+}
+
+// hasBody tells if the request has a body, without reading it
+func (req *httpRequest) hasBody() bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+}
+
+// checkContentDigest checks the request body against the Content-Digest header (RFC 9530).
+// The body is hashed while it is copied to a temporary file, up to SignatureMaxBody bytes,
+// and the handlers then read it from there.
+func (req *httpRequest) checkContentDigest() error {
+	digests, err := parseByteDictionary(req.Header.Get("Content-Digest"))
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "gold-signed-")
+	if err != nil {
+		return err
+	}
+	sum256, sum512 := sha256.New(), sha512.New()
+	max := req.Server.Config.SignatureMaxBody
+	n, err := io.Copy(io.MultiWriter(f, sum256, sum512), io.LimitReader(req.Body, max+1))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	// the part of the body that was read is given back, even if it does not match
+	req.Body = &spooledBody{Reader: io.MultiReader(f, req.Body), file: f, rest: req.Body}
+	if err != nil {
+		return err
+	}
+	if n > max {
+		return errors.New("The body is too large to check its Content-Digest")
+	}
+	checked := false
+	for alg, digest := range digests {
+		var sum []byte
+		switch alg {
+		case "sha-256":
+			sum = sum256.Sum(nil)
+		case "sha-512":
+			sum = sum512.Sum(nil)
+		default:
+			continue
+		}
+		if !bytes.Equal(sum, digest) {
+			return errors.New("Content-Digest does not match the body")
+		}
+		checked = true
+	}
+	if !checked {
+		return errors.New("No supported algorithm in Content-Digest")
+	}
+	return nil
+}
+
+// verifyHTTPSignature checks a signature made with the given algorithm, or with the
+// algorithms of the key type if alg is empty
+func verifyHTTPSignature(alg string, key crypto.PublicKey, base []byte, sig []byte) bool {
+	sum256 := sha256.Sum256(base)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "" || alg == "rsa-pss-sha512" {
+			sum := sha512.Sum512(base)
+			if rsa.VerifyPSS(k, crypto.SHA512, sum[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) == nil {
+				return true
+			}
+		}
+		if alg == "" || alg == "rsa-v1_5-sha256" {
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum256[:], sig) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		switch {
+		case k.Curve == elliptic.P256() && (alg == "" || alg == "ecdsa-p256-sha256"):
+			return ecdsa.Verify(k, sum256[:], r, s)
+		case k.Curve == elliptic.P384() && (alg == "" || alg == "ecdsa-p384-sha384"):
+			sum := sha512.Sum384(base)
+			return ecdsa.Verify(k, sum[:], r, s)
+		}
+	case ed25519.PublicKey:
+		if alg == "" || alg == "ed25519" {
+			return ed25519.Verify(k, base, sig)
+		}
+	}
+	return false
+}
+
+// HTTPSignatureAuth authenticates a request signed with HTTP Message Signatures (RFC 9421),
+// where the keyid is the URI of a key listed in the WebID profile of the agent
+func HTTPSignatureAuth(req *httpRequest) (string, error) {
+	inputs, err := parseSignatureInput(req.Header.Get("Signature-Input"))
+	if err != nil {
+		return "", err
+	}
+	sigs, err := parseByteDictionary(req.Header.Get("Signature"))
+	if err != nil {
+		return "", err
+	}
+	var in *sigInput
+	var sig []byte
+	for _, i := range inputs {
+		if s, ok := sigs[strings.ToLower(i.Label)]; ok {
+			in, sig = i, s
+			break
+		}
+	}
+	if in == nil {
+		return "", errNoSignature
+	}
+
+	// check coverage and freshness
+	for _, c := range httpSigRequired {
+		if !hasString(in.Components, c) {
+			return "", errors.New("The signature must cover " + c)
+		}
+	}
+	hasBody := req.hasBody()
+	if hasBody && !hasString(in.Components, "content-digest") {
+		return "", errors.New("The signature must cover content-digest")
+	}
+	window := time.Duration(req.Server.Config.SignatureMaxAge) * time.Second
+	now := time.Now()
+	created, err := strconv.ParseInt(in.Params["created"], 10, 64)
+	if err != nil {
+		return "", errors.New("Missing or bad created parameter")
+	}
+	if d := now.Sub(time.Unix(created, 0)); d > window || d < -window {
+		return "", errors.New("The signature is too old, or from the future")
+	}
+	if len(in.Params["expires"]) > 0 {
+		expires, err := strconv.ParseInt(in.Params["expires"], 10, 64)
+		if err != nil || now.After(time.Unix(expires, 0)) {
+			return "", errors.New("The signature has expired")
+		}
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return "", errors.New("Missing or bad Date header")
+	}
+	if d := now.Sub(date); d > window || d < -window {
+		return "", errors.New("The Date header is outside of the allowed window")
+	}
+
+	base, err := req.signatureBase(in)
+	if err != nil {
+		return "", err
+	}
+	keyID := in.Params["keyid"]
+	if !strings.HasPrefix(keyID, "http") {
+		return "", errors.New("The keyid must be the URI of a key in a WebID profile")
+	}
+
+	// the key must be listed in the profile document that describes it. The profile is only
+	// fetched again for keys that did not fail recently, so that bad signatures cannot make
+	// the server fetch it on every request.
+	webid := ""
+	refreshes := []bool{false, true}
+	if req.Server.unknownKeys.has(keyID) {
+		refreshes = refreshes[:1]
+	}
+	for _, refresh := range refreshes {
+		g, err := req.Server.profileCache.get(keyID, refresh)
+		if err != nil {
+			return "", err
+		}
+		for _, t := range g.All(nil, ns.cert.Get("key"), NewResource(keyID)) {
+			agent := debrack(t.Subject.String())
+			if defrag(agent) != defrag(keyID) {
+				continue
+			}
+			for _, key := range termKeys(g, t.Object) {
+				if verifyHTTPSignature(in.Params["alg"], key, base, sig) {
+					webid = agent
+					break
+				}
+			}
+		}
+		if len(webid) > 0 {
+			break
+		}
+	}
+	if len(webid) == 0 {
+		req.Server.unknownKeys.check(keyID, time.Now().Add(unknownKeyAge))
+		return "", errors.New("Could not verify the signature with key " + keyID)
+	}
+
+	// the body is only read once the signature is known to be good
+	if hasBody {
+		if err = req.checkContentDigest(); err != nil {
+			return "", err
+		}
+	}
+
+	// a signature can only be used once within the window. Since some signatures (ECDSA) can
+	// be altered and still verify, what is signed is remembered instead of the signature.
+	signed := sha256.Sum256(base)
+	if !req.Server.sigReplay.check(keyID+" "+hex.EncodeToString(signed[:]), time.Unix(created, 0).Add(window)) {
+		return "", errors.New("The signature was already used")
+	}
+	return webid, nil
+}
@@ -0,0 +1,198 @@
+package gold
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signHTTPRequest signs the request with RFC 9421 HTTP Message Signatures
+func signHTTPRequest(t *testing.T, r *http.Request, body []byte, keyID string, priv crypto.Signer, components []string, created time.Time) {
+	r.Header.Set("Date", created.UTC().Format(http.TimeFormat))
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		r.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	}
+	quoted := make([]string, len(components))
+	for i, c := range components {
+		quoted[i] = `"` + c + `"`
+	}
+	params := fmt.Sprintf(`(%s);created=%d;keyid="%s"`, strings.Join(quoted, " "), created.Unix(), keyID)
+	var base bytes.Buffer
+	for _, c := range components {
+		v := r.Header.Get(c)
+		switch c {
+		case "@method":
+			v = r.Method
+		case "@target-uri":
+			v = r.URL.String()
+		}
+		base.WriteString(`"` + c + `": ` + v + "\n")
+	}
+	base.WriteString(`"@signature-params": ` + params)
+
+	var sig []byte
+	var err error
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		params += `;alg="rsa-pss-sha512"`
+		base.WriteString(`;alg="rsa-pss-sha512"`)
+		sum := sha512.Sum512(base.Bytes())
+		sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA512, sum[:], &rsa.PSSOptions{SaltLength: 64})
+	default:
+		sig, err = priv.Sign(rand.Reader, base.Bytes(), crypto.Hash(0))
+	}
+	assert.NoError(t, err)
+	r.Header.Set("Signature-Input", "sig1="+params)
+	r.Header.Set("Signature", "sig1=:"+base64.StdEncoding.EncodeToString(sig)+":")
+}
+
+func TestParseSignatureInput(t *testing.T) {
+	inputs, err := parseSignatureInput(`sig1=("@method" "@target-uri" "content-digest");created=1618884473;keyid="https://a.example/card#k,1";alg="ed25519", sig2=("date");created=1`)
+	assert.NoError(t, err)
+	assert.Len(t, inputs, 2)
+	assert.Equal(t, "sig1", inputs[0].Label)
+	assert.Equal(t, []string{"@method", "@target-uri", "content-digest"}, inputs[0].Components)
+	assert.Equal(t, "1618884473", inputs[0].Params["created"])
+	assert.Equal(t, "https://a.example/card#k,1", inputs[0].Params["keyid"])
+	assert.Equal(t, "ed25519", inputs[0].Params["alg"])
+	assert.Equal(t, `("date");created=1`, inputs[1].Raw)
+
+	_, err = parseSignatureInput(`sig1="@method"`)
+	assert.Error(t, err)
+	_, err = parseSignatureInput(`sig1=("@method";req)`)
+	assert.Error(t, err)
+}
+
+func TestHTTPSignatureAuth(t *testing.T) {
+	doc := testServer.URL + "/_test/sigagent"
+	webid := doc + "#me"
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(edKey.Public())
+	assert.NoError(t, err)
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	jwk, err := NewJWK(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	jwkJSON, err := json.Marshal(jwk)
+	assert.NoError(t, err)
+	quote := func(s string) string {
+		q, _ := json.Marshal(s)
+		return string(q)
+	}
+	profile := "<#me> <http://www.w3.org/ns/auth/cert#key> <#ed>, <#rsa> .\n" +
+		"<#ed> <http://www.w3.org/ns/auth/cert#pem> " + quote(string(edPEM)) + " .\n" +
+		"<#rsa> <https://w3id.org/security#publicKeyJwk> " + quote(string(jwkJSON)) + " ."
+	request, err := http.NewRequest("PUT", webid, strings.NewReader(profile))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 201, response.StatusCode)
+
+	all := []string{"@method", "@target-uri", "content-digest", "date"}
+	do := func(method string, body string, keyID string, priv crypto.Signer, components []string, created time.Time) *http.Request {
+		r, err := http.NewRequest(method, testServer.URL+"/_test/sigdata", strings.NewReader(body))
+		assert.NoError(t, err)
+		r.Header.Set("Content-Type", "text/turtle")
+		signHTTPRequest(t, r, []byte(body), keyID, priv, components, created)
+		return r
+	}
+	user := func(r *http.Request) (int, string) {
+		response, err := httpClient.Do(r)
+		assert.NoError(t, err)
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return response.StatusCode, response.Header.Get("User")
+	}
+
+	// both key types, with a body
+	status, u := user(do("PUT", "<a> <b> <c> .", doc+"#ed", edKey, all, time.Now()))
+	assert.Equal(t, 201, status)
+	assert.Equal(t, webid, u)
+	signed := do("GET", "", doc+"#rsa", rsaKey, []string{"@method", "@target-uri", "date"}, time.Now())
+	status, u = user(signed)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, webid, u)
+
+	// signed requests cannot manage the account
+	tokens, err := http.NewRequest("GET", testServer.URL+"/"+SystemPrefix+"/tokens", nil)
+	assert.NoError(t, err)
+	signHTTPRequest(t, tokens, nil, doc+"#ed", edKey, []string{"@method", "@target-uri", "date"}, time.Now())
+	status, _ = user(tokens)
+	assert.Equal(t, 403, status)
+
+	// replayed
+	replay, err := http.NewRequest("GET", signed.URL.String(), nil)
+	assert.NoError(t, err)
+	replay.Header = signed.Header
+	_, u = user(replay)
+	assert.Empty(t, u)
+
+	// signing the same thing again is a replay too
+	created := time.Now().Add(-10 * time.Second)
+	_, u = user(do("GET", "", doc+"#rsa", rsaKey, []string{"@method", "@target-uri", "date"}, created))
+	assert.Equal(t, webid, u)
+	_, u = user(do("GET", "", doc+"#rsa", rsaKey, []string{"@method", "@target-uri", "date"}, created))
+	assert.Empty(t, u)
+
+	// the body must be covered, and match its digest
+	_, u = user(do("PUT", "<a> <b> <c> .", doc+"#ed", edKey, []string{"@method", "@target-uri", "date"}, time.Now()))
+	assert.Empty(t, u)
+	r := do("PUT", "<a> <b> <c> .", doc+"#ed", edKey, all, time.Now())
+	r.Body = ioutil.NopCloser(strings.NewReader("<a> <b> <d> ."))
+	_, u = user(r)
+	assert.Empty(t, u)
+
+	config.SignatureMaxBody = 4
+	_, u = user(do("PUT", "<a> <b> <c> .", doc+"#ed", edKey, all, time.Now()))
+	assert.Empty(t, u)
+	config.SignatureMaxBody = NewServerConfig().SignatureMaxBody
+
+	// too old, or without date
+	_, u = user(do("GET", "", doc+"#ed", edKey, []string{"@method", "@target-uri", "date"}, time.Now().Add(-time.Hour)))
+	assert.Empty(t, u)
+	_, u = user(do("GET", "", doc+"#ed", edKey, []string{"@method", "@target-uri"}, time.Now()))
+	assert.Empty(t, u)
+
+	// a key that is not in the profile
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.False(t, handler.unknownKeys.has(doc+"#ed"))
+	_, u = user(do("GET", "", doc+"#ed", other, []string{"@method", "@target-uri", "date"}, time.Now()))
+	assert.Empty(t, u)
+
+	// the key is then checked against the cached profile only, which still verifies good signatures
+	assert.True(t, handler.unknownKeys.has(doc+"#ed"))
+	_, u = user(do("GET", "", doc+"#ed", edKey, []string{"@method", "@target-uri", "date"}, time.Now()))
+	assert.Equal(t, webid, u)
+
+	for _, uri := range []string{testServer.URL + "/_test/sigdata", doc} {
+		request, err = http.NewRequest("DELETE", uri, nil)
+		assert.NoError(t, err)
+		response, err = httpClient.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, 200, response.StatusCode)
+	}
+}
@@ -0,0 +1,457 @@
+package gold
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	_path "path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errImportConflicts = errors.New("The account already holds some of the imported files")
+
+// ImportReport describes an account import, or what it would do with a dry run
+type ImportReport struct {
+	Base      string   `json:"base"`
+	Source    string   `json:"source"`
+	WebID     string   `json:"webid"`
+	DryRun    bool     `json:"dryRun"`
+	Files     int      `json:"files"`
+	Rewritten bool     `json:"rewritten"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// archivedFile is a file found in an archive
+type archivedFile struct {
+	size   int64
+	sha256 string
+}
+
+// walkArchive calls fn with each regular file of the archive
+func walkArchive(file string, format string, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case "tar":
+		r := tar.NewReader(f)
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !h.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			if err = fn(h.Name, r); err != nil {
+				return err
+			}
+		}
+	case "zip":
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			return err
+		}
+		for _, zf := range r.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New("Unknown archive format " + format)
+}
+
+// safeArchivePath checks that a path of the archive stays under the account root
+func safeArchivePath(p string) bool {
+	p = strings.TrimSuffix(p, "/")
+	return len(p) > 0 && !strings.HasPrefix(p, "/") && !strings.Contains(p, `\`) &&
+		_path.Clean(p) == p && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// readImport returns the manifest of the archive, once the archived files have been checked
+// against it
+func readImport(file string, format string) (*exportManifest, error) {
+	var manifest *exportManifest
+	found := map[string]archivedFile{}
+	err := walkArchive(file, format, func(name string, r io.Reader) error {
+		if name == exportManifestName {
+			manifest = new(exportManifest)
+			return json.NewDecoder(r).Decode(manifest)
+		}
+		if !strings.HasPrefix(name, exportDataDir) {
+			return errors.New("Unexpected file " + name)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, r)
+		if err != nil {
+			return err
+		}
+		found[strings.TrimPrefix(name, exportDataDir)] = archivedFile{n, hex.EncodeToString(h.Sum(nil))}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, errors.New("Missing " + exportManifestName)
+	}
+	if manifest.Version != exportVersion {
+		return nil, fmt.Errorf("Unsupported archive version %d", manifest.Version)
+	}
+	if u, err := url.Parse(manifest.Base); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, errors.New("Invalid base " + manifest.Base)
+	}
+
+	for _, entry := range manifest.Files {
+		if !safeArchivePath(entry.Path) {
+			return nil, errors.New("Invalid path " + entry.Path)
+		}
+		if strings.HasSuffix(entry.Path, "/") {
+			continue
+		}
+		f, ok := found[entry.Path]
+		if !ok {
+			return nil, errors.New("Missing file " + entry.Path)
+		}
+		if f.size != entry.Size || f.sha256 != entry.SHA256 {
+			return nil, errors.New("Checksum mismatch for " + entry.Path)
+		}
+		delete(found, entry.Path)
+	}
+	for name := range found {
+		return nil, errors.New("Unexpected file " + exportDataDir + name)
+	}
+	return manifest, nil
+}
+
+// isRDFType tells if documents of the content type can hold URIs to rewrite
+func isRDFType(ctype string) bool {
+	ctype = strings.TrimSpace(strings.Split(ctype, ";")[0])
+	_, ok := streamWriters[ctype]
+	return ok || LookupExt(ctype) != ""
+}
+
+// denormalizeRDF serializes a normalized document back to its original type, or returns it
+// unchanged if it cannot be converted
+func denormalizeRDF(data []byte, uri string, ctype string, original string) []byte {
+	g := NewGraph(uri)
+	g.Parse(bytes.NewReader(data), ctype)
+	if g.Len() == 0 {
+		return data
+	}
+	out, err := g.Serialize(original)
+	if err != nil || len(out) == 0 {
+		return data
+	}
+	return []byte(out)
+}
+
+// planImport describes the import of a checked archive under root, served at base. Files of
+// the archive that already exist there are conflicts.
+func (s *Server) planImport(manifest *exportManifest, root string, base string, dryRun bool) (*ImportReport, error) {
+	report := &ImportReport{
+		Base:      base,
+		Source:    manifest.Base,
+		WebID:     manifest.WebID,
+		DryRun:    dryRun,
+		Rewritten: manifest.Base != base,
+		Conflicts: []string{},
+	}
+	if report.Rewritten {
+		report.WebID = strings.Replace(manifest.WebID, manifest.Base+"/", base+"/", 1)
+	}
+	for _, entry := range manifest.Files {
+		if strings.HasSuffix(entry.Path, "/") {
+			continue
+		}
+		report.Files++
+		if stat, err := os.Stat(filepath.Join(root, filepath.FromSlash(entry.Path))); err == nil {
+			if stat.IsDir() {
+				return nil, errors.New("A container exists at " + base + "/" + entry.Path)
+			}
+			report.Conflicts = append(report.Conflicts, base+"/"+entry.Path)
+		}
+	}
+	sort.Strings(report.Conflicts)
+	return report, nil
+}
+
+// restoreImport writes the files of a checked archive under root, replacing existing ones.
+// URIs of the source account found in RDF documents are rewritten to the base of the report.
+func (s *Server) restoreImport(file string, format string, manifest *exportManifest, root string, report *ImportReport) error {
+	base := report.Base
+	entries := map[string]*exportFile{}
+	for _, entry := range manifest.Files {
+		if strings.HasSuffix(entry.Path, "/") {
+			if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(entry.Path)), 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		entries[entry.Path] = entry
+	}
+	err := walkArchive(file, format, func(name string, r io.Reader) error {
+		entry, ok := entries[strings.TrimPrefix(name, exportDataDir)]
+		if !ok {
+			return nil
+		}
+		target := filepath.Join(root, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if isRDFType(entry.ContentType) && (report.Rewritten || len(entry.OriginalType) > 0) {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if report.Rewritten {
+				data = bytes.Replace(data, []byte(manifest.Base+"/"), []byte(base+"/"), -1)
+			}
+			if len(entry.OriginalType) > 0 && entry.OriginalType != entry.ContentType {
+				data = denormalizeRDF(data, base+"/"+entry.Path, entry.ContentType, entry.OriginalType)
+			}
+			r = bytes.NewReader(data)
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(target, s.Config.ACLSuffix) {
+			s.aclCache.invalidate(target)
+		}
+		return os.Chtimes(target, entry.Modified, entry.Modified)
+	})
+	if err != nil {
+		return err
+	}
+	if len(report.WebID) > 0 {
+		s.profileCache.flush(report.WebID)
+	}
+	return nil
+}
+
+// spoolImport saves the uploaded archive, from the body or the archive field of a form, to
+// a temporary file, and tells its format
+func (req *httpRequest) spoolImport() (string, string, error) {
+	format := req.FormValue("format")
+	var body io.Reader = req.Body
+	ctype, _, _ := mime.ParseMediaType(req.Header.Get(HCType))
+	if ctype == "multipart/form-data" {
+		f, h, err := req.FormFile("archive")
+		if err != nil {
+			return "", "", err
+		}
+		defer f.Close()
+		body = f
+		if strings.HasSuffix(strings.ToLower(h.Filename), ".zip") && len(format) == 0 {
+			format = "zip"
+		}
+	} else if ctype == "application/zip" && len(format) == 0 {
+		format = "zip"
+	}
+	if len(format) == 0 {
+		format = "tar"
+	}
+	if format != "tar" && format != "zip" {
+		return "", "", errors.New("Unknown archive format " + format)
+	}
+
+	f, err := ioutil.TempFile("", "gold-import-")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, body); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	return f.Name(), format, nil
+}
+
+// accountImport restores an account archive, as made by accountExport, for the owner of the
+// host or a server administrator. Without a username the archive is imported into the current
+// account; with one, a new account is created first and the archive is restored under it.
+// With dryrun=true nothing is written and the report lists the conflicts with existing files,
+// which are only replaced with overwrite=true.
+func accountImport(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if req.Method != "POST" && req.Method != "PUT" {
+		return SystemReturn{Status: 405, Body: "405 - Method Not Allowed: " + req.Method}
+	}
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.URL.Query().Get("redirect"), "")}
+	}
+	if !req.IsOwner && !s.isAdmin(req.User) {
+		return SystemReturn{Status: 403, Body: "Only the owner of the server or an administrator can import accounts"}
+	}
+	// the body is only read once the importer is known, and never past the size limit
+	req.Body = http.MaxBytesReader(w, req.Body, s.Config.ImportMaxSize)
+	username := req.FormValue("username")
+	dryRun := req.FormValue("dryrun") == "true"
+
+	file, format, err := req.spoolImport()
+	if err != nil {
+		s.debug.Println("Import upload error: " + err.Error())
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			return SystemReturn{Status: 413, Body: "The archive is larger than the limit of " + strconv.FormatInt(s.Config.ImportMaxSize, 10) + " bytes"}
+		}
+		return SystemReturn{Status: 400, Body: err.Error()}
+	}
+	defer os.Remove(file)
+	manifest, err := readImport(file, format)
+	if err != nil {
+		s.debug.Println("Invalid account archive: " + err.Error())
+		return SystemReturn{Status: 400, Body: err.Error()}
+	}
+
+	resource, err := req.pathInfo(req.BaseURI())
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	root, err := req.pathInfo(resource.Base)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	base := root.Base
+	if len(username) > 0 {
+		accountBase := req.newAccountBase(username)
+		root, err = req.pathInfo(accountBase)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		if root.Exists {
+			return SystemReturn{Status: 406, Body: "An account with the same name already exists."}
+		}
+		base = strings.TrimSuffix(accountBase, "/")
+	}
+	report, err := s.planImport(manifest, root.File, base, dryRun)
+	if err != nil {
+		return SystemReturn{Status: 409, Body: err.Error()}
+	}
+
+	status := 200
+	if len(report.Conflicts) > 0 && req.FormValue("overwrite") != "true" && !dryRun {
+		status = 409
+	} else if !dryRun {
+		if len(username) > 0 {
+			// the files of the new account skeleton are replaced by the archived ones
+			if ret := newAccount(w, req, s); ret.Status != 200 {
+				return ret
+			}
+		}
+		if err = s.restoreImport(file, format, manifest, root.File, report); err != nil {
+			s.debug.Println("Import error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		status = 201
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	w.Header().Set(HCType, "application/json")
+	return SystemReturn{Status: status, Body: string(data)}
+}
+
+// ImportAccount restores an account archive (tar, or zip by extension) at the given base URI.
+// A missing account is provisioned first, the same way as a signup.
+func (s *Server) ImportAccount(archive string, base string, dryRun bool, overwrite bool) (*ImportReport, error) {
+	format := "tar"
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		format = "zip"
+	}
+	manifest, err := readImport(archive, format)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, errors.New("Invalid base " + base)
+	}
+	r, err := http.NewRequest("POST", u.Scheme+"://"+u.Host+"/"+SystemPrefix+"/new", nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+	req := &httpRequest{r, s, "", "", "", false, "", "", nil, nil}
+	root, err := req.pathInfo(base)
+	if err != nil {
+		return nil, err
+	}
+
+	username := ""
+	if !root.Exists {
+		username = strings.Trim(u.Path, "/")
+		if len(username) == 0 {
+			username = strings.Split(u.Hostname(), ".")[0]
+		}
+		if strings.Contains(username, "/") || req.newAccountBase(username) != base {
+			return nil, errors.New("Cannot provision an account at " + base)
+		}
+	}
+
+	base = strings.TrimSuffix(base, "/")
+	report, err := s.planImport(manifest, root.File, base, dryRun)
+	if err != nil || dryRun {
+		return report, err
+	}
+	if len(report.Conflicts) > 0 && !overwrite {
+		return report, errImportConflicts
+	}
+	if len(username) > 0 {
+		r.Form = url.Values{"username": {username}}
+		if ret := newAccount(httptest.NewRecorder(), req, s); ret.Status != 200 {
+			return nil, errors.New(ret.Body)
+		}
+	}
+	return report, s.restoreImport(archive, format, manifest, root.File, report)
+}
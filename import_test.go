@@ -0,0 +1,213 @@
+package gold
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestArchive exports a small account tree of https://alice.example to an archive file
+func writeTestArchive(t *testing.T, file string, normalize string) {
+	root := "_test/importsrc/"
+	defer os.RemoveAll(root)
+	writeExportTree(t, root)
+	buf := new(bytes.Buffer)
+	assert.NoError(t, handler.writeExport(buf, "tar", root, "https://alice.example", "https://alice.example/profile/card#me", normalize))
+	assert.NoError(t, ioutil.WriteFile(file, buf.Bytes(), 0644))
+}
+
+// removeTestAccount removes an account created on handler2, along with the root meta file
+// and the workspaces that signups without vhosts add to the server root
+func removeTestAccount(name string) {
+	os.RemoveAll(config2.DataRoot + name + "/")
+	os.Remove(config2.DataRoot + config2.MetaSuffix)
+	for _, ws := range workspaces {
+		os.RemoveAll(config2.DataRoot + ws.Name + "/")
+	}
+}
+
+func TestSafeArchivePath(t *testing.T) {
+	for _, p := range []string{"notes.ttl", "photos/", "photos/a.png", ".acl"} {
+		assert.True(t, safeArchivePath(p), p)
+	}
+	for _, p := range []string{"", "/", "/etc/passwd", "../x", "a/../../x", "a//b", "./a", `a\..\b`} {
+		assert.False(t, safeArchivePath(p), p)
+	}
+}
+
+func TestReadImportTampered(t *testing.T) {
+	file := "_test/tampered.tar"
+	defer os.Remove(file)
+	writeTestArchive(t, file, "")
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	_, err = readImport(file, "tar")
+	assert.NoError(t, err)
+
+	// same size, different content
+	data = bytes.Replace(data, []byte(`"Note"`), []byte(`"Nope"`), 1)
+	assert.NoError(t, ioutil.WriteFile(file, data, 0644))
+	_, err = readImport(file, "tar")
+	assert.EqualError(t, err, "Checksum mismatch for notes.ttl")
+}
+
+func TestImportArchive(t *testing.T) {
+	file := "_test/import.tar"
+	root := "_test/importdst/"
+	defer os.Remove(file)
+	defer os.RemoveAll(root)
+	writeTestArchive(t, file, "application/n-triples")
+	manifest, err := readImport(file, "tar")
+	assert.NoError(t, err)
+
+	base := "https://bob.example/bob"
+	report, err := handler.planImport(manifest, root, base, false)
+	assert.NoError(t, err)
+	assert.NoError(t, handler.restoreImport(file, "tar", manifest, root, report))
+	assert.True(t, report.Rewritten)
+	assert.Equal(t, base+"/profile/card#me", report.WebID)
+	assert.Equal(t, 5, report.Files)
+	assert.Empty(t, report.Conflicts)
+
+	// normalized documents get their original type back, with the new base
+	data, err := ioutil.ReadFile(filepath.Join(root, "notes.ttl"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "alice.example")
+	g := NewGraph(base + "/notes.ttl")
+	g.Parse(bytes.NewReader(data), "text/turtle")
+	assert.NotNil(t, g.One(NewResource(base+"/notes.ttl#n1"), nil, nil))
+	data, err = ioutil.ReadFile(filepath.Join(root, "photos/a.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, "\x89PNG\r\n\x1a\n", string(data))
+	stat, err := os.Stat(filepath.Join(root, "empty"))
+	assert.NoError(t, err)
+	assert.True(t, stat.IsDir())
+
+	// importing again conflicts with every file
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "notes.ttl"), []byte("<a> <b> <c> ."), 0644))
+	report, err = handler.planImport(manifest, root, base, true)
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Len(t, report.Conflicts, 5)
+	assert.Contains(t, report.Conflicts, base+"/notes.ttl")
+	assert.NoError(t, handler.restoreImport(file, "tar", manifest, root, report))
+	data, _ = ioutil.ReadFile(filepath.Join(root, "notes.ttl"))
+	assert.Contains(t, string(data), "Note")
+}
+
+func TestAccountImportNewAccount(t *testing.T) {
+	file := "_test/newaccount.tar"
+	writeTestArchive(t, file, "")
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	os.Remove(file)
+	defer startTestBolt(t, handler2, "_test/import.db")()
+	defer removeTestAccount("importee")
+	admin := "https://admin.example/profile/card#me"
+	config2.Admins = []string{admin}
+	defer func() { config2.Admins = nil }()
+
+	ts := httptest.NewUnstartedServer(handler2)
+	ts.TLS = new(tls.Config)
+	ts.TLS.NextProtos = []string{"http/1.1"}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the host belongs to someone else
+	assert.NoError(t, ioutil.WriteFile(config2.DataRoot+config2.ACLSuffix, []byte("<#Owner> <http://www.w3.org/ns/auth/acl#accessTo> <"+ts.URL+"/> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#agent> <https://owner.example/#me> ;\n"+
+		"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Write> ."), 0644))
+	defer os.Remove(config2.DataRoot + config2.ACLSuffix)
+	assert.NoError(t, handler2.setPassword(ts.URL+"/", admin, "secret"))
+	assert.NoError(t, handler2.setPassword(ts.URL+"/", "https://mallory.example/#me", "secret"))
+	cookie := ""
+	post := func(query string) (*http.Response, *ImportReport) {
+		request, err := http.NewRequest("POST", ts.URL+"/"+SystemPrefix+"/import?"+query, bytes.NewReader(data))
+		assert.NoError(t, err)
+		request.Header.Set("Content-Type", "application/x-tar")
+		if len(cookie) > 0 {
+			request.Header.Set("Cookie", cookie)
+		}
+		response, err := httpClient.Do(request)
+		assert.NoError(t, err)
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		report := new(ImportReport)
+		json.Unmarshal(body, report)
+		return response, report
+	}
+
+	response, _ := post("")
+	assert.Equal(t, 401, response.StatusCode)
+	response, _ = post("username=importee")
+	assert.Equal(t, 401, response.StatusCode)
+	cookie = testLogin(t, ts.URL, "https://mallory.example/#me", "secret")
+	response, _ = post("username=importee")
+	assert.Equal(t, 403, response.StatusCode)
+	_, err = os.Stat(config2.DataRoot + "importee/")
+	assert.True(t, os.IsNotExist(err))
+
+	cookie = testLogin(t, ts.URL, admin, "secret")
+	config2.ImportMaxSize = int64(len(data) - 1)
+	response, _ = post("username=importee")
+	assert.Equal(t, 413, response.StatusCode)
+	config2.ImportMaxSize = NewServerConfig().ImportMaxSize
+
+	base := ts.URL + "/importee"
+	response, report := post("username=importee&dryrun=true")
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, base+"/profile/card#me", report.WebID)
+	_, err = os.Stat(config2.DataRoot + "importee/")
+	assert.True(t, os.IsNotExist(err))
+
+	response, report = post("username=importee")
+	assert.Equal(t, 201, response.StatusCode)
+	assert.Equal(t, base, report.Base)
+	assert.Empty(t, report.Conflicts)
+	// the archived profile replaces the new one, the rest of the skeleton is kept
+	card, err := ioutil.ReadFile(config2.DataRoot + "importee/profile/card")
+	assert.NoError(t, err)
+	assert.Equal(t, "<#me> a <http://xmlns.com/foaf/0.1/Person> .", string(card))
+	_, err = os.Stat(config2.DataRoot + "importee/" + config2.ACLSuffix)
+	assert.NoError(t, err)
+	_, err = os.Stat(config2.DataRoot + "importee/photos/a.png")
+	assert.NoError(t, err)
+
+	response, _ = post("username=importee")
+	assert.Equal(t, 406, response.StatusCode)
+}
+
+func TestImportAccount(t *testing.T) {
+	file := "_test/cli.tar"
+	defer os.Remove(file)
+	defer removeTestAccount("carol")
+	writeTestArchive(t, file, "")
+
+	_, err := handler2.ImportAccount(file, "https://example.org/a/b/", false, false)
+	assert.Error(t, err)
+
+	report, err := handler2.ImportAccount(file, "https://example.org/carol/", false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.org/carol/profile/card#me", report.WebID)
+	meta, err := ioutil.ReadFile(config2.DataRoot + "carol/notes.ttl.meta")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(meta), "<notes.ttl>"))
+
+	report, err = handler2.ImportAccount(file, "https://example.org/carol", true, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Conflicts, 5)
+	os.Remove(config2.DataRoot + "carol/notes.ttl")
+	_, err = handler2.ImportAccount(file, "https://example.org/carol", false, false)
+	assert.Equal(t, errImportConflicts, err)
+	_, err = os.Stat(config2.DataRoot + "carol/notes.ttl")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,281 @@
+package gold
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// JWK is a JSON Web Key (RFC 7517) holding an EC, RSA or Ed25519 (OKP) public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKSet is a set of JSON Web Keys, as served by a jwks_uri
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	JWK *JWK   `json:"jwk,omitempty"`
+}
+
+// audience is the aud claim, which is either a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = audience(many)
+	return nil
+}
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a audience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+type confirmation struct {
+	JKT string `json:"jkt"`
+}
+
+// jwtClaims holds the claims used by Solid-OIDC ID tokens, access tokens and DPoP proofs
+type jwtClaims struct {
+	Issuer   string        `json:"iss,omitempty"`
+	Subject  string        `json:"sub,omitempty"`
+	Audience audience      `json:"aud,omitempty"`
+	Expires  int64         `json:"exp,omitempty"`
+	IssuedAt int64         `json:"iat,omitempty"`
+	ID       string        `json:"jti,omitempty"`
+	WebID    string        `json:"webid,omitempty"`
+	ClientID string        `json:"client_id,omitempty"`
+	Azp      string        `json:"azp,omitempty"`
+	Nonce    string        `json:"nonce,omitempty"`
+	Scope    string        `json:"scope,omitempty"`
+	Cnf      *confirmation `json:"cnf,omitempty"`
+	HTM      string        `json:"htm,omitempty"`
+	HTU      string        `json:"htu,omitempty"`
+	ATH      string        `json:"ath,omitempty"`
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func unb64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// padded returns the big-endian bytes of n, left padded to size
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// NewJWK returns the JWK of an EC (P-256), RSA or Ed25519 public key
+func NewJWK(pub crypto.PublicKey) (*JWK, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("Unsupported curve " + k.Curve.Params().Name)
+		}
+		return &JWK{Kty: "EC", Crv: "P-256", X: b64(padded(k.X, 32)), Y: b64(padded(k.Y, 32))}, nil
+	case *rsa.PublicKey:
+		return &JWK{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}, nil
+	case ed25519.PublicKey:
+		return &JWK{Kty: "OKP", Crv: "Ed25519", X: b64(k)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %T", pub)
+}
+
+// PublicKey returns the public key described by the JWK
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("Unsupported curve " + k.Crv)
+		}
+		x, err := unb64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := unb64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("Invalid EC key")
+		}
+		return pub, nil
+	case "RSA":
+		n, err := unb64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := unb64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("Invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("Unsupported curve " + k.Crv)
+		}
+		x, err := unb64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("Unsupported key type " + k.Kty)
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the JWK
+func (k *JWK) Thumbprint() (string, error) {
+	var members string
+	switch k.Kty {
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	default:
+		return "", errors.New("Unsupported key type " + k.Kty)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return b64(sum[:]), nil
+}
+
+// signJWT returns a compact ES256 JWS of the claims
+func signJWT(key *ecdsa.PrivateKey, header jwsHeader, claims interface{}) (string, error) {
+	header.Alg = "ES256"
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + b64(append(padded(r, 32), padded(s, 32)...)), nil
+}
+
+// parseJWT decodes a compact JWS without verifying it, returning the header, the claims
+// and a function that verifies the signature against a public key
+func parseJWT(token string) (*jwsHeader, *jwtClaims, func(crypto.PublicKey) error, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, errors.New("Malformed JWT")
+	}
+	h, err := unb64(parts[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header := new(jwsHeader)
+	if err = json.Unmarshal(h, header); err != nil {
+		return nil, nil, nil, err
+	}
+	c, err := unb64(parts[1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	claims := new(jwtClaims)
+	if err = json.Unmarshal(c, claims); err != nil {
+		return nil, nil, nil, err
+	}
+	sig, err := unb64(parts[2])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	verify := func(pub crypto.PublicKey) error {
+		return verifyJWS(header.Alg, pub, input, sig)
+	}
+	return header, claims, verify, nil
+}
+
+// verifyJWS checks an ES256, RS256 or EdDSA signature
+func verifyJWS(alg string, pub crypto.PublicKey, input []byte, sig []byte) error {
+	digest := sha256.Sum256(input)
+	switch alg {
+	case "ES256":
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return errors.New("Invalid ES256 signature")
+		}
+		if !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return errors.New("Invalid ES256 signature")
+		}
+		return nil
+	case "RS256":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("Invalid RS256 signature")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case "EdDSA":
+		k, ok := pub.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, input, sig) {
+			return errors.New("Invalid EdDSA signature")
+		}
+		return nil
+	}
+	return errors.New("Unsupported signature algorithm " + alg)
+}
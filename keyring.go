@@ -0,0 +1,281 @@
+package gold
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// keyRingSize is the number of signing keys kept: the current one, and the previous one
+	// so that sessions and tokens survive a rotation
+	keyRingSize = 2
+	// keyRingCheckInterval is how often the key file is checked for keys rotated by other instances
+	keyRingCheckInterval = time.Minute
+)
+
+// signingKey holds the secrets used for cookies, tokens and authentication nonces
+type signingKey struct {
+	ID      string    `json:"id"`
+	Hash    []byte    `json:"hash"`
+	Block   []byte    `json:"block"`
+	Salt    []byte    `json:"salt"`
+	Created time.Time `json:"created"`
+}
+
+func newSigningKey() *signingKey {
+	return &signingKey{
+		ID:      hex.EncodeToString(securecookie.GenerateRandomKey(8)),
+		Hash:    securecookie.GenerateRandomKey(32),
+		Block:   securecookie.GenerateRandomKey(32),
+		Salt:    securecookie.GenerateRandomKey(8),
+		Created: time.Now().UTC(),
+	}
+}
+
+// keyRing encodes with the current key and decodes with any key of the ring.
+// It is kept in a key file, so that it can be shared by several instances, and reloaded
+// when the file changes.
+// The data key encrypts secrets kept in Bolt, and is never rotated.
+type keyRing struct {
+	mu      sync.RWMutex
+	path    string
+	Keys    []*signingKey `json:"keys"`
+	DataKey []byte        `json:"dataKey"`
+	codecs  []securecookie.Codec
+	// modTime is the time of the key file when it was last read or written
+	modTime time.Time
+	checked time.Time
+}
+
+// newKeyRing returns a ring with a single new key, saved to path (if not empty)
+func newKeyRing(path string) *keyRing {
+	k := &keyRing{path: path, Keys: []*signingKey{newSigningKey()}, DataKey: securecookie.GenerateRandomKey(32)}
+	k.update()
+	return k
+}
+
+// loadKeyRing reads the ring from the key file, creating it if needed, and rotates
+// the keys once the current one is older than rotation (if not zero)
+func loadKeyRing(path string, rotation time.Duration) (*keyRing, error) {
+	if len(path) == 0 {
+		return newKeyRing(""), nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		k := newKeyRing(path)
+		return k, k.save()
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := &keyRing{path: path, modTime: info.ModTime(), checked: time.Now()}
+	if err = json.Unmarshal(data, k); err != nil {
+		return nil, err
+	}
+	if len(k.Keys) == 0 {
+		k.Keys = []*signingKey{newSigningKey()}
+	}
+	k.update()
+	if len(k.DataKey) == 0 {
+		// key files of older versions
+		k.DataKey = securecookie.GenerateRandomKey(32)
+		if err = k.save(); err != nil {
+			return nil, err
+		}
+	}
+	if rotation > 0 && time.Since(k.Keys[0].Created) > rotation {
+		return k, k.Rotate()
+	}
+	return k, nil
+}
+
+// update rebuilds the codecs from the keys
+func (k *keyRing) update() {
+	k.codecs = make([]securecookie.Codec, 0, len(k.Keys))
+	for _, key := range k.Keys {
+		k.codecs = append(k.codecs, securecookie.New(key.Hash, key.Block))
+	}
+}
+
+// save writes the ring to the key file
+func (k *keyRing) save() error {
+	if len(k.path) == 0 {
+		return nil
+	}
+	k.mu.RLock()
+	data, err := json.Marshal(k)
+	k.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, k.path); err != nil {
+		return err
+	}
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.modTime = info.ModTime()
+	k.mu.Unlock()
+	return nil
+}
+
+// refresh reloads the keys if the key file changed, which it checks at most every
+// keyRingCheckInterval unless force is set. It tells if the keys were reloaded.
+func (k *keyRing) refresh(force bool) bool {
+	if len(k.path) == 0 {
+		return false
+	}
+	k.mu.RLock()
+	due := force || time.Since(k.checked) >= keyRingCheckInterval
+	k.mu.RUnlock()
+	if !due {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.checked = time.Now()
+	info, err := os.Stat(k.path)
+	if err != nil || info.ModTime().Equal(k.modTime) {
+		return false
+	}
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return false
+	}
+	loaded := new(keyRing)
+	if err = json.Unmarshal(data, loaded); err != nil || len(loaded.Keys) == 0 {
+		return false
+	}
+	k.Keys = loaded.Keys
+	if len(loaded.DataKey) > 0 {
+		k.DataKey = loaded.DataKey
+	}
+	k.modTime = info.ModTime()
+	k.update()
+	return true
+}
+
+// Rotate makes a new current key, keeps the previous one and drops the older ones
+func (k *keyRing) Rotate() error {
+	k.mu.Lock()
+	k.Keys = append([]*signingKey{newSigningKey()}, k.Keys...)
+	if len(k.Keys) > keyRingSize {
+		k.Keys = k.Keys[:keyRingSize]
+	}
+	k.update()
+	k.mu.Unlock()
+	return k.save()
+}
+
+// Encode signs and encrypts a value with the current key
+func (k *keyRing) Encode(name string, value interface{}) (string, error) {
+	k.refresh(false)
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return securecookie.EncodeMulti(name, value, k.codecs...)
+}
+
+// Decode verifies and decrypts a value with any key of the ring, and retries once the keys
+// are reloaded if the key file changed
+func (k *keyRing) Decode(name string, value string, dst interface{}) error {
+	err := k.decode(name, value, dst)
+	if err != nil && k.refresh(true) {
+		err = k.decode(name, value, dst)
+	}
+	return err
+}
+
+func (k *keyRing) decode(name string, value string, dst interface{}) error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return securecookie.DecodeMulti(name, value, dst, k.codecs...)
+}
+
+// salt returns the salt of the current key
+func (k *keyRing) salt() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return string(k.Keys[0].Salt)
+}
+
+// validSalt tells if secret is the salt of any key of the ring
+func (k *keyRing) validSalt(secret string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.Keys {
+		if subtle.ConstantTimeCompare([]byte(secret), key.Salt) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// seal encrypts data with the data key
+func (k *keyRing) seal(data []byte) (string, error) {
+	gcm, err := k.aead()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(gcm.Seal(nonce, nonce, data, nil)), nil
+}
+
+// open decrypts data sealed with the data key
+func (k *keyRing) open(sealed string) ([]byte, error) {
+	gcm, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Sealed data is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func (k *keyRing) aead() (cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	block, err := aes.NewCipher(k.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RotateKeys rotates the signing keys of the server and saves them to the key file.
+// Other instances sharing the key file pick up the new key when they next check the file.
+func (s *Server) RotateKeys() error {
+	return s.cookie.Rotate()
+}
@@ -0,0 +1,92 @@
+package gold
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	path := "_test/keys.json"
+	defer os.Remove(path)
+
+	k, err := loadKeyRing(path, 0)
+	assert.NoError(t, err)
+	first, err := k.Encode("Session", map[string]string{"user": "alice"})
+	assert.NoError(t, err)
+	salt := k.salt()
+
+	// the keys survive a restart
+	k, err = loadKeyRing(path, 0)
+	assert.NoError(t, err)
+	value := map[string]string{}
+	assert.NoError(t, k.Decode("Session", first, &value))
+	assert.Equal(t, "alice", value["user"])
+
+	// the previous key is still accepted after a rotation
+	assert.NoError(t, k.Rotate())
+	assert.Len(t, k.Keys, 2)
+	assert.True(t, k.validSalt(salt))
+	assert.NotEqual(t, salt, k.salt())
+	second, err := k.Encode("Session", map[string]string{"user": "bob"})
+	assert.NoError(t, err)
+	assert.NoError(t, k.Decode("Session", first, &value))
+
+	// but not after the next one
+	assert.NoError(t, k.Rotate())
+	assert.Len(t, k.Keys, 2)
+	assert.False(t, k.validSalt(salt))
+	assert.Error(t, k.Decode("Session", first, &value))
+	assert.NoError(t, k.Decode("Session", second, &value))
+	assert.Equal(t, "bob", value["user"])
+
+	// old keys are rotated at startup
+	third, err := k.Encode("Session", map[string]string{"user": "carol"})
+	assert.NoError(t, err)
+	k.Keys[0].Created = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, k.save())
+	current := k.Keys[0].ID
+	k, err = loadKeyRing(path, time.Hour)
+	assert.NoError(t, err)
+	assert.NotEqual(t, current, k.Keys[0].ID)
+	assert.Equal(t, current, k.Keys[1].ID)
+	assert.NoError(t, k.Decode("Session", third, &value))
+	assert.Equal(t, "carol", value["user"])
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestKeyRingReload(t *testing.T) {
+	path := "_test/sharedkeys.json"
+	defer os.Remove(path)
+
+	a, err := loadKeyRing(path, 0)
+	assert.NoError(t, err)
+	b, err := loadKeyRing(path, 0)
+	assert.NoError(t, err)
+	assert.False(t, a.refresh(true))
+
+	// a value encoded with a key rotated by another instance
+	assert.NoError(t, b.Rotate())
+	value := map[string]string{}
+	encoded, err := b.Encode("Session", map[string]string{"user": "alice"})
+	assert.NoError(t, err)
+	assert.NoError(t, a.Decode("Session", encoded, &value))
+	assert.Equal(t, "alice", value["user"])
+	assert.Equal(t, b.Keys[0].ID, a.Keys[0].ID)
+
+	// new values are encoded with the new key once the file is checked
+	assert.NoError(t, b.Rotate())
+	_, err = a.Encode("Session", value)
+	assert.NoError(t, err)
+	assert.NotEqual(t, b.Keys[0].ID, a.Keys[0].ID)
+	a.checked = time.Time{}
+	encoded, err = a.Encode("Session", value)
+	assert.NoError(t, err)
+	assert.Equal(t, b.Keys[0].ID, a.Keys[0].ID)
+	assert.NoError(t, b.Decode("Session", encoded, &value))
+}
@@ -17,6 +17,7 @@ var mimeParser = map[string]string{
 	"application/ld+json":       "jsonld",
 	"application/json":          "internal",
 	"application/sparql-update": "internal",
+	"application/rdf-patch":     "internal",
 }
 
 var mimeSerializer = map[string]string{
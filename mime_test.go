@@ -11,6 +11,7 @@ var (
 	mimeParserExpect = map[string]string{
 		// "application/json":          "internal",
 		"application/sparql-update": "internal",
+		"application/rdf-patch":     "internal",
 
 		"application/ld+json": "jsonld",
 		"application/rdf+xml": "rdfxml",
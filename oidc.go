@@ -0,0 +1,623 @@
+package gold
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	_path "path"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// oidcDiscoveryPath is where the OpenID Provider configuration is published
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	// oidcPrefix is the namespace of the OpenID Provider endpoints
+	oidcPrefix = SystemPrefix + "/oidc"
+
+	oidcCodeAge    = time.Minute
+	oidcConsentAge = 10 * time.Minute
+	oidcTokenAge   = time.Hour
+	oidcRefreshAge = 30 * 24 * time.Hour
+
+	oidcKeyType     = "OIDCKey"
+	oidcClientType  = "OIDCClient"
+	oidcGrantType   = "OIDCGrant"
+	oidcCodeType    = "OIDCCode"
+	oidcRefreshType = "OIDCRefresh"
+)
+
+// oidcConfiguration is the OpenID Provider metadata served for discovery
+type oidcConfiguration struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	RegistrationEndpoint     string   `json:"registration_endpoint"`
+	ScopesSupported          []string `json:"scopes_supported"`
+	ResponseTypesSupported   []string `json:"response_types_supported"`
+	GrantTypesSupported      []string `json:"grant_types_supported"`
+	SubjectTypesSupported    []string `json:"subject_types_supported"`
+	IDTokenSigningAlgs       []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethods     []string `json:"code_challenge_methods_supported"`
+	DPoPSigningAlgs          []string `json:"dpop_signing_alg_values_supported"`
+	ClaimsSupported          []string `json:"claims_supported"`
+	SolidOIDCSupported       string   `json:"solid_oidc_supported"`
+}
+
+// oidcClient is a registered client, or the Client ID Document of a client identified by a URL
+type oidcClient struct {
+	ClientID                string   `json:"client_id"`
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientURI               string   `json:"client_uri,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	IssuedAt                int64    `json:"client_id_issued_at,omitempty"`
+}
+
+// oidcGrant is what the user agreed to: it backs consents, authorization codes and refresh tokens
+type oidcGrant struct {
+	WebID       string `json:"webid"`
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri,omitempty"`
+	Scope       string `json:"scope"`
+	Nonce       string `json:"nonce,omitempty"`
+	Challenge   string `json:"code_challenge,omitempty"`
+	JKT         string `json:"jkt,omitempty"`
+	Expires     int64  `json:"expires,omitempty"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type oidcError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// HandleOIDC is a router for the OpenID Provider endpoints
+func HandleOIDC(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if req.Request.URL.Path == oidcDiscoveryPath {
+		return oidcDiscovery(w, req, s)
+	}
+	if s.BoltDB == nil {
+		return SystemReturn{Status: 503, Body: "The identity provider requires a database"}
+	}
+	switch _path.Base(req.Request.URL.Path) {
+	case "jwks":
+		return oidcJWKS(w, req, s)
+	case "register":
+		return oidcRegister(w, req, s)
+	case "authorize":
+		return oidcAuthorize(w, req, s)
+	case "token":
+		return oidcToken(w, req, s)
+	}
+	return SystemReturn{Status: 404, Body: "Not found"}
+}
+
+// oidcIssuer returns the issuer of the host, i.e. its base URI
+func (req *httpRequest) oidcIssuer() (string, error) {
+	resource, err := req.pathInfo(req.BaseURI())
+	if err != nil {
+		return "", err
+	}
+	return resource.Base, nil
+}
+
+func oidcJSON(w http.ResponseWriter, status int, v interface{}) SystemReturn {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	w.Header().Set(HCType, "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return SystemReturn{Status: status, Body: string(data)}
+}
+
+func oidcFail(w http.ResponseWriter, status int, code string, description string) SystemReturn {
+	return oidcJSON(w, status, oidcError{Error: code, Description: description})
+}
+
+func newRandomID(size int) (string, error) {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return b64(id), nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func oidcDiscovery(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	issuer, err := req.oidcIssuer()
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	endpoint := issuer + "/" + oidcPrefix + "/"
+	return oidcJSON(w, 200, oidcConfiguration{
+		Issuer:                   issuer,
+		AuthorizationEndpoint:    endpoint + "authorize",
+		TokenEndpoint:            endpoint + "token",
+		JWKSURI:                  endpoint + "jwks",
+		RegistrationEndpoint:     endpoint + "register",
+		ScopesSupported:          []string{"openid", "webid", "offline_access"},
+		ResponseTypesSupported:   []string{"code"},
+		GrantTypesSupported:      []string{"authorization_code", "refresh_token"},
+		SubjectTypesSupported:    []string{"public"},
+		IDTokenSigningAlgs:       []string{"ES256"},
+		TokenEndpointAuthMethods: []string{"none"},
+		CodeChallengeMethods:     []string{"S256"},
+		DPoPSigningAlgs:          []string{"ES256", "RS256"},
+		ClaimsSupported:          []string{"iss", "sub", "aud", "exp", "iat", "webid", "client_id", "azp", "nonce", "cnf"},
+		SolidOIDCSupported:       "https://solidproject.org/TR/solid-oidc",
+	})
+}
+
+// oidcKey returns the signing key of the host and its key ID, creating the key if needed
+func (s *Server) oidcKey(host string) (*ecdsa.PrivateKey, string, error) {
+	var key *ecdsa.PrivateKey
+	// bucket(host) -> bucket(OIDCKey) -> key
+	err := s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+		if err != nil {
+			return err
+		}
+		bucket, err := hostBucket.CreateBucketIfNotExists([]byte(oidcKeyType))
+		if err != nil {
+			return err
+		}
+		if der := bucket.Get([]byte("key")); der != nil {
+			key, err = x509.ParseECPrivateKey(der)
+			return err
+		}
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), der)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	jwk, err := NewJWK(&key.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	kid, err := jwk.Thumbprint()
+	return key, kid, err
+}
+
+// oidcPut saves a JSON value in the bucket of the given type
+func (s *Server) oidcPut(host string, kind string, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+		if err != nil {
+			return err
+		}
+		bucket, err := hostBucket.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+// oidcGet loads a JSON value from the bucket of the given type, deleting it if remove is set
+func (s *Server) oidcGet(host string, kind string, id string, v interface{}, remove bool) (bool, error) {
+	found := false
+	err := s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+		if remove {
+			return bucket.Delete([]byte(id))
+		}
+		return nil
+	})
+	return found, err
+}
+
+func oidcJWKS(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	key, kid, err := s.oidcKey(req.Host)
+	if err != nil {
+		s.debug.Println("OIDC key error: " + err.Error())
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	jwk, err := NewJWK(&key.PublicKey)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	jwk.Kid, jwk.Use, jwk.Alg = kid, "sig", "ES256"
+	return oidcJSON(w, 200, JWKSet{Keys: []*JWK{jwk}})
+}
+
+// oidcRegister handles dynamic client registration (public clients only)
+func oidcRegister(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if req.Method != "POST" {
+		return SystemReturn{Status: 405, Body: "Method not allowed"}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, 64*1024))
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	client := new(oidcClient)
+	if err = json.Unmarshal(data, client); err != nil {
+		return oidcFail(w, 400, "invalid_client_metadata", err.Error())
+	}
+	if len(client.RedirectURIs) == 0 {
+		return oidcFail(w, 400, "invalid_redirect_uri", "At least one redirect_uri is required")
+	}
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || len(u.Fragment) > 0 {
+			return oidcFail(w, 400, "invalid_redirect_uri", "Invalid redirect_uri: "+uri)
+		}
+	}
+	for _, t := range client.ResponseTypes {
+		if t != "code" {
+			return oidcFail(w, 400, "invalid_client_metadata", "Unsupported response type: "+t)
+		}
+	}
+	client.ClientID, err = newRandomID(16)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	client.IssuedAt = time.Now().Unix()
+	client.TokenEndpointAuthMethod = "none"
+	client.ResponseTypes = []string{"code"}
+	client.GrantTypes = []string{"authorization_code", "refresh_token"}
+	if err = s.oidcPut(req.Host, oidcClientType, client.ClientID, client); err != nil {
+		s.debug.Println("OIDC registration error: " + err.Error())
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	s.debug.Println("Registered OIDC client " + client.ClientID)
+	return oidcJSON(w, 201, client)
+}
+
+// oidcClient returns a registered client, or fetches the Client ID Document of the client
+func (s *Server) oidcClient(host string, clientID string) (*oidcClient, error) {
+	client := new(oidcClient)
+	if !strings.HasPrefix(clientID, "https://") && !strings.HasPrefix(clientID, "http://") {
+		found, err := s.oidcGet(host, oidcClientType, clientID, client, false)
+		if err == nil && !found {
+			err = errors.New("Unknown client " + clientID)
+		}
+		return client, err
+	}
+
+	request, err := http.NewRequest("GET", clientID, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/ld+json, application/json")
+	fetch := &http.Client{
+		Transport: fetchTransport,
+		Timeout:   time.Duration(s.Config.GroupFetchTimeout) * time.Second,
+	}
+	response, err := fetch.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, errors.New("Could not fetch the Client ID Document " + clientID + ": " + response.Status)
+	}
+	if err = json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(client); err != nil {
+		return nil, err
+	}
+	if client.ClientID != clientID {
+		return nil, errors.New("The Client ID Document of " + clientID + " names another client_id")
+	}
+	return client, nil
+}
+
+// oidcAuthorize handles the authorization code flow: it logs the user in, asks for consent
+// and redirects back to the client with a code
+func oidcAuthorize(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	issuer, err := req.oidcIssuer()
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	clientID, redirectURI := req.FormValue("client_id"), req.FormValue("redirect_uri")
+	client, err := s.oidcClient(req.Host, clientID)
+	if err != nil {
+		s.debug.Println("OIDC client error: " + err.Error())
+		return SystemReturn{Status: 400, Body: "Invalid client: " + err.Error()}
+	}
+	if !hasString(client.RedirectURIs, redirectURI) {
+		return SystemReturn{Status: 400, Body: "The redirect_uri is not registered for client " + clientID}
+	}
+
+	// from now on errors are returned to the client
+	redirect := func(params url.Values) SystemReturn {
+		u, _ := url.Parse(redirectURI)
+		q := u.Query()
+		for k, v := range params {
+			q[k] = v
+		}
+		if state := req.FormValue("state"); len(state) > 0 {
+			q.Set("state", state)
+		}
+		q.Set("iss", issuer)
+		u.RawQuery = q.Encode()
+		w.Header().Set("Location", u.String())
+		return SystemReturn{Status: 302}
+	}
+	fail := func(code string, description string) SystemReturn {
+		return redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+	if req.FormValue("response_type") != "code" {
+		return fail("unsupported_response_type", "Only the code response type is supported")
+	}
+	scope := req.FormValue("scope")
+	if !hasString(strings.Fields(scope), "openid") {
+		return fail("invalid_scope", "The openid scope is required")
+	}
+	challenge := req.FormValue("code_challenge")
+	if len(challenge) == 0 || req.FormValue("code_challenge_method") != "S256" {
+		return fail("invalid_request", "PKCE with the S256 method is required")
+	}
+	prompt := strings.Fields(req.FormValue("prompt"))
+	action := req.Request.URL.RequestURI()
+
+	// authenticate the user
+	webid := req.User
+	if req.Method == "POST" && len(req.FormValue("password")) > 0 {
+		webid = req.FormValue("webid")
+		status, err := req.checkPassword(webid, req.FormValue("password"))
+		if err != nil {
+			setRetryAfter(w, err)
+			return SystemReturn{Status: status, Body: OIDCLoginTemplate(action, webid, err.Error())}
+		}
+		if status, err = req.checkSecondFactor(webid); err != nil {
+			setRetryAfter(w, err)
+			return SystemReturn{Status: status, Body: OIDCLoginTemplate(action, webid, err.Error())}
+		}
+		if err = req.userCookieSet(w, webid); err != nil {
+			s.debug.Println("Error setting new cookie: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+	}
+	if len(webid) == 0 {
+		if hasString(prompt, "none") {
+			return fail("login_required", "The user is not logged in")
+		}
+		return SystemReturn{Status: 200, Body: OIDCLoginTemplate(action, req.getAccountWebID(), "")}
+	}
+	if !strings.HasPrefix(webid, issuer+"/") {
+		return SystemReturn{Status: 403, Body: "This provider only issues tokens for WebIDs hosted on " + issuer}
+	}
+
+	// ask for consent, unless it was already given for these scopes
+	var grant oidcGrant
+	grantID := webid + " " + clientID
+	found, err := s.oidcGet(req.Host, oidcGrantType, grantID, &grant, false)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	consented := false
+	if req.Method == "POST" && len(req.FormValue("consent")) > 0 {
+		values, err := ValidateSecureToken("OIDCConsent", req.FormValue("token"), s)
+		if err == nil {
+			err = IsTokenDateValid(values["valid"])
+		}
+		if err != nil || values["webid"] != webid || values["client_id"] != clientID {
+			return SystemReturn{Status: 403, Body: "Invalid or expired consent form"}
+		}
+		if req.FormValue("consent") != "allow" {
+			return fail("access_denied", "The user denied the request")
+		}
+		grant = oidcGrant{WebID: webid, ClientID: clientID, Scope: scope}
+		if err = s.oidcPut(req.Host, oidcGrantType, grantID, grant); err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		consented = true
+	}
+	if !consented && (!found || !grantCovers(grant.Scope, scope) || hasString(prompt, "consent")) {
+		if hasString(prompt, "none") {
+			return fail("consent_required", "The user has not approved this client")
+		}
+		token, err := NewSecureToken("OIDCConsent", map[string]string{"webid": webid, "client_id": clientID}, oidcConsentAge, s)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		name := client.ClientName
+		if len(name) == 0 {
+			name = clientID
+		}
+		return SystemReturn{Status: 200, Body: ConsentTemplate(action, token, name, redirectURI, webid, strings.Fields(scope))}
+	}
+
+	code, err := newRandomID(32)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	err = s.oidcPut(req.Host, oidcCodeType, code, oidcGrant{
+		WebID:       webid,
+		ClientID:    clientID,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		Nonce:       req.FormValue("nonce"),
+		Challenge:   challenge,
+		Expires:     time.Now().Add(oidcCodeAge).Unix(),
+	})
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	s.debug.Println("Issued OIDC code for " + webid + " to client " + clientID)
+	return redirect(url.Values{"code": {code}})
+}
+
+// grantCovers checks if all the requested scopes were granted
+func grantCovers(granted string, requested string) bool {
+	scopes := strings.Fields(granted)
+	for _, scope := range strings.Fields(requested) {
+		if !hasString(scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// oidcToken exchanges codes and refresh tokens for DPoP-bound tokens
+func oidcToken(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if req.Method != "POST" {
+		return SystemReturn{Status: 405, Body: "Method not allowed"}
+	}
+	issuer, err := req.oidcIssuer()
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	proof, jkt, err := verifyDPoPProof(req.Header.Get("DPoP"), "POST", issuer+"/"+oidcPrefix+"/token")
+	if err == nil && !s.dpopReplay.check(jkt+" "+proof.ID, time.Now().Add(2*dpopSkew)) {
+		err = errors.New("The DPoP proof has already been used")
+	}
+	if err != nil {
+		return oidcFail(w, 400, "invalid_dpop_proof", err.Error())
+	}
+
+	var grant oidcGrant
+	clientID := req.FormValue("client_id")
+	switch req.FormValue("grant_type") {
+	case "authorization_code":
+		found, err := s.oidcGet(req.Host, oidcCodeType, req.FormValue("code"), &grant, true)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		if !found || grant.Expires < time.Now().Unix() {
+			return oidcFail(w, 400, "invalid_grant", "Invalid or expired code")
+		}
+		if grant.ClientID != clientID || grant.RedirectURI != req.FormValue("redirect_uri") {
+			return oidcFail(w, 400, "invalid_grant", "The code was issued to another client")
+		}
+		verifier := sha256.Sum256([]byte(req.FormValue("code_verifier")))
+		if b64(verifier[:]) != grant.Challenge {
+			return oidcFail(w, 400, "invalid_grant", "Invalid code_verifier")
+		}
+	case "refresh_token":
+		found, err := s.oidcGet(req.Host, oidcRefreshType, req.FormValue("refresh_token"), &grant, true)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		if !found || grant.Expires < time.Now().Unix() {
+			return oidcFail(w, 400, "invalid_grant", "Invalid or expired refresh token")
+		}
+		if grant.ClientID != clientID || grant.JKT != jkt {
+			return oidcFail(w, 400, "invalid_grant", "The refresh token is bound to another client or key")
+		}
+	default:
+		return oidcFail(w, 400, "unsupported_grant_type", "Unsupported grant type: "+req.FormValue("grant_type"))
+	}
+	grant.JKT = jkt
+
+	key, kid, err := s.oidcKey(req.Host)
+	if err != nil {
+		s.debug.Println("OIDC key error: " + err.Error())
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	jti, err := newRandomID(16)
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	now := time.Now()
+	access, err := signJWT(key, jwsHeader{Typ: "at+jwt", Kid: kid}, jwtClaims{
+		Issuer:   issuer,
+		Subject:  grant.WebID,
+		Audience: audience{"solid"},
+		WebID:    grant.WebID,
+		ClientID: grant.ClientID,
+		Azp:      grant.ClientID,
+		Scope:    grant.Scope,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(oidcTokenAge).Unix(),
+		ID:       jti,
+		Cnf:      &confirmation{JKT: jkt},
+	})
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	id, err := signJWT(key, jwsHeader{Typ: "JWT", Kid: kid}, jwtClaims{
+		Issuer:   issuer,
+		Subject:  grant.WebID,
+		Audience: audience{grant.ClientID},
+		WebID:    grant.WebID,
+		Azp:      grant.ClientID,
+		Nonce:    grant.Nonce,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(oidcTokenAge).Unix(),
+		Cnf:      &confirmation{JKT: jkt},
+	})
+	if err != nil {
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	res := oidcTokenResponse{
+		AccessToken: access,
+		IDToken:     id,
+		TokenType:   "DPoP",
+		ExpiresIn:   int64(oidcTokenAge / time.Second),
+		Scope:       grant.Scope,
+	}
+	if hasString(strings.Fields(grant.Scope), "offline_access") {
+		res.RefreshToken, err = newRandomID(32)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		grant.Nonce, grant.Challenge, grant.RedirectURI = "", "", ""
+		grant.Expires = now.Add(oidcRefreshAge).Unix()
+		if err = s.oidcPut(req.Host, oidcRefreshType, res.RefreshToken, grant); err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+	}
+	s.debug.Println("Issued OIDC tokens for " + grant.WebID + " to client " + grant.ClientID)
+	return oidcJSON(w, 200, res)
+}
@@ -0,0 +1,287 @@
+package gold
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dpopProof(t *testing.T, key *ecdsa.PrivateKey, method string, uri string) string {
+	return dpopBoundProof(t, key, method, uri, "")
+}
+
+// dpopBoundProof makes a DPoP proof for a request to a resource server with the access token
+func dpopBoundProof(t *testing.T, key *ecdsa.PrivateKey, method string, uri string, token string) string {
+	jwk, err := NewJWK(&key.PublicKey)
+	assert.NoError(t, err)
+	jti, err := newRandomID(8)
+	assert.NoError(t, err)
+	claims := jwtClaims{HTM: method, HTU: uri, IssuedAt: time.Now().Unix(), ID: jti}
+	if len(token) > 0 {
+		ath := sha256.Sum256([]byte(token))
+		claims.ATH = b64(ath[:])
+	}
+	proof, err := signJWT(key, jwsHeader{Typ: "dpop+jwt", JWK: jwk}, claims)
+	assert.NoError(t, err)
+	return proof
+}
+
+func oidcDo(t *testing.T, client *http.Client, method string, uri string, form url.Values, header map[string]string) (*http.Response, string) {
+	var request *http.Request
+	var err error
+	if form != nil {
+		request, err = http.NewRequest(method, uri, strings.NewReader(form.Encode()))
+		assert.NoError(t, err)
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		request, err = http.NewRequest(method, uri, nil)
+		assert.NoError(t, err)
+	}
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	response, err := noRedirect.Do(request)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	return response, string(data)
+}
+
+func TestOIDCProvider(t *testing.T) {
+	defer publishTestUsers(t)()
+	boltPath := handler.Config.BoltPath
+	handler.Config.BoltPath = "_test/oidc.db"
+	err := os.MkdirAll("_test", 0755)
+	assert.NoError(t, err)
+	err = handler.StartBolt()
+	assert.NoError(t, err)
+	defer func() {
+		handler.BoltDB.Close()
+		handler.BoltDB = nil
+		handler.Config.BoltPath = boltPath
+		os.Remove("_test/oidc.db")
+	}()
+
+	// discovery
+	response, body := oidcDo(t, httpClient, "GET", testServer.URL+oidcDiscoveryPath, nil, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	var config oidcConfiguration
+	assert.NoError(t, json.Unmarshal([]byte(body), &config))
+	assert.Equal(t, testServer.URL, config.Issuer)
+	assert.Equal(t, testServer.URL+"/"+oidcPrefix+"/token", config.TokenEndpoint)
+	assert.Equal(t, []string{"S256"}, config.CodeChallengeMethods)
+
+	response, body = oidcDo(t, httpClient, "GET", config.JWKSURI, nil, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	var jwks JWKSet
+	assert.NoError(t, json.Unmarshal([]byte(body), &jwks))
+	assert.Equal(t, 1, len(jwks.Keys))
+	assert.Equal(t, "EC", jwks.Keys[0].Kty)
+	pub, err := jwks.Keys[0].PublicKey()
+	assert.NoError(t, err)
+
+	// dynamic registration
+	callback := "https://app.example/callback"
+	request, err := http.NewRequest("POST", config.RegistrationEndpoint, strings.NewReader(`{"client_name": "<App>", "redirect_uris": ["`+callback+`"]}`))
+	assert.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 201, response.StatusCode)
+	var client oidcClient
+	assert.NoError(t, json.Unmarshal(data, &client))
+	assert.NotEmpty(t, client.ClientID)
+	assert.Equal(t, "none", client.TokenEndpointAuthMethod)
+
+	verifier := "a-very-long-and-random-code-verifier-for-pkce-0123456789"
+	challenge := sha256.Sum256([]byte(verifier))
+	authorize := func(clientID string, redirectURI string, scope string) string {
+		return config.AuthorizationEndpoint + "?" + url.Values{
+			"response_type":         {"code"},
+			"client_id":             {clientID},
+			"redirect_uri":          {redirectURI},
+			"scope":                 {scope},
+			"state":                 {"xyz"},
+			"nonce":                 {"n-0S6"},
+			"code_challenge":        {b64(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}.Encode()
+	}
+	uri := authorize(client.ClientID, callback, "openid webid offline_access")
+
+	// unknown redirect URIs are not redirected to
+	response, _ = oidcDo(t, user1h, "GET", authorize(client.ClientID, "https://evil.example/", "openid"), nil, nil)
+	assert.Equal(t, 400, response.StatusCode)
+
+	// anonymous users get a login form
+	response, body = oidcDo(t, httpClient, "GET", uri, nil, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Contains(t, body, `name="password"`)
+
+	// the user is asked for consent
+	response, body = oidcDo(t, user1h, "GET", uri, nil, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Contains(t, body, "&lt;App&gt;")
+	match := regexp.MustCompile(`name="token" value="([^"]+)"`).FindStringSubmatch(body)
+	assert.Equal(t, 2, len(match))
+	token := strings.Replace(match[1], "&#43;", "+", -1)
+
+	response, _ = oidcDo(t, user2h, "POST", uri, url.Values{"consent": {"allow"}, "token": {token}}, nil)
+	assert.Equal(t, 403, response.StatusCode)
+	response, _ = oidcDo(t, user1h, "POST", uri, url.Values{"consent": {"deny"}, "token": {token}}, nil)
+	assert.Equal(t, 302, response.StatusCode)
+	location, err := url.Parse(response.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "access_denied", location.Query().Get("error"))
+
+	response, _ = oidcDo(t, user1h, "POST", uri, url.Values{"consent": {"allow"}, "token": {token}}, nil)
+	assert.Equal(t, 302, response.StatusCode)
+	location, err = url.Parse(response.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(location.String(), callback+"?"))
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	assert.Equal(t, testServer.URL, location.Query().Get("iss"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	// tokens require a DPoP proof and the PKCE verifier
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {client.ClientID},
+		"redirect_uri":  {callback},
+		"code_verifier": {verifier},
+	}
+	response, body = oidcDo(t, httpClient, "POST", config.TokenEndpoint, exchange, nil)
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Contains(t, body, "invalid_dpop_proof")
+	response, body = oidcDo(t, httpClient, "POST", config.TokenEndpoint, exchange, map[string]string{"DPoP": dpopProof(t, key, "GET", config.TokenEndpoint)})
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Contains(t, body, "invalid_dpop_proof")
+
+	response, body = oidcDo(t, httpClient, "POST", config.TokenEndpoint, exchange, map[string]string{"DPoP": dpopProof(t, key, "POST", config.TokenEndpoint)})
+	assert.Equal(t, 200, response.StatusCode)
+	var tokens oidcTokenResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &tokens))
+	assert.Equal(t, "DPoP", tokens.TokenType)
+	assert.NotEmpty(t, tokens.RefreshToken)
+
+	jwk, err := NewJWK(&key.PublicKey)
+	assert.NoError(t, err)
+	jkt, err := jwk.Thumbprint()
+	assert.NoError(t, err)
+	header, claims, verify, err := parseJWT(tokens.AccessToken)
+	assert.NoError(t, err)
+	assert.NoError(t, verify(pub))
+	assert.Equal(t, jwks.Keys[0].Kid, header.Kid)
+	assert.Equal(t, user1, claims.WebID)
+	assert.Equal(t, testServer.URL, claims.Issuer)
+	assert.Equal(t, client.ClientID, claims.ClientID)
+	assert.Equal(t, jkt, claims.Cnf.JKT)
+	_, claims, verify, err = parseJWT(tokens.IDToken)
+	assert.NoError(t, err)
+	assert.NoError(t, verify(pub))
+	assert.Equal(t, user1, claims.WebID)
+	assert.Equal(t, "n-0S6", claims.Nonce)
+	assert.True(t, claims.Audience.contains(client.ClientID))
+
+	// codes can only be used once
+	response, body = oidcDo(t, httpClient, "POST", config.TokenEndpoint, exchange, map[string]string{"DPoP": dpopProof(t, key, "POST", config.TokenEndpoint)})
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Contains(t, body, "invalid_grant")
+
+	// refresh tokens are bound to the DPoP key
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}, "client_id": {client.ClientID}}
+	response, _ = oidcDo(t, httpClient, "POST", config.TokenEndpoint, refresh, map[string]string{"DPoP": dpopProof(t, other, "POST", config.TokenEndpoint)})
+	assert.Equal(t, 400, response.StatusCode)
+
+	// once approved, the user is sent straight back with a code, which needs the right verifier
+	response, _ = oidcDo(t, user1h, "GET", uri, nil, nil)
+	assert.Equal(t, 302, response.StatusCode)
+	location, err = url.Parse(response.Header.Get("Location"))
+	assert.NoError(t, err)
+	exchange.Set("code", location.Query().Get("code"))
+	exchange.Set("code_verifier", "wrong")
+	response, body = oidcDo(t, httpClient, "POST", config.TokenEndpoint, exchange, map[string]string{"DPoP": dpopProof(t, key, "POST", config.TokenEndpoint)})
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Contains(t, body, "invalid_grant")
+
+	// WebIDs hosted elsewhere are not served
+	response, _ = oidcDo(t, httpClient, "GET", authorize(client.ClientID, callback, "openid")+"&prompt=none", nil, nil)
+	assert.Equal(t, 302, response.StatusCode)
+	assert.Contains(t, response.Header.Get("Location"), "error=login_required")
+}
+
+func TestOIDCClientIDDocument(t *testing.T) {
+	defer publishTestUsers(t)()
+	boltPath := handler.Config.BoltPath
+	handler.Config.BoltPath = "_test/oidc.db"
+	err := os.MkdirAll("_test", 0755)
+	assert.NoError(t, err)
+	err = handler.StartBolt()
+	assert.NoError(t, err)
+	defer func() {
+		handler.BoltDB.Close()
+		handler.BoltDB = nil
+		handler.Config.BoltPath = boltPath
+		os.Remove("_test/oidc.db")
+	}()
+
+	callback := "https://app.example/callback"
+	var clientID string
+	app := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/ld+json")
+		fmt.Fprintf(w, `{"@context": ["https://www.w3.org/ns/solid/oidc-context.jsonld"], "client_id": %q, "client_name": "Doc App", "redirect_uris": [%q]}`, clientID, callback)
+	}))
+	defer app.Close()
+	clientID = app.URL + "/id"
+
+	challenge := sha256.Sum256([]byte("verifier"))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {callback},
+		"scope":                 {"openid webid"},
+		"code_challenge":        {b64(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	endpoint := testServer.URL + "/" + oidcPrefix + "/authorize?"
+	response, body := oidcDo(t, user1h, "GET", endpoint+params.Encode(), nil, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Contains(t, body, "Doc App")
+
+	params.Set("redirect_uri", "https://app.example/other")
+	response, _ = oidcDo(t, user1h, "GET", endpoint+params.Encode(), nil, nil)
+	assert.Equal(t, 400, response.StatusCode)
+
+	params.Set("redirect_uri", callback)
+	params.Set("client_id", app.URL+"/other")
+	response, _ = oidcDo(t, user1h, "GET", endpoint+params.Encode(), nil, nil)
+	assert.Equal(t, 400, response.StatusCode)
+}
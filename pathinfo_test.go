@@ -8,7 +8,7 @@ import (
 
 func TestPathInfoWithoutTrailingSlash(t *testing.T) {
 	sroot := serverDefaultRoot()
-	req := &httpRequest{nil, handler, "", "", "", false}
+	req := &httpRequest{nil, handler, "", "", "", false, "", "", nil, nil}
 	p, err := req.pathInfo(testServer.URL)
 	assert.Nil(t, err)
 	assert.Equal(t, testServer.URL+"/", p.URI)
@@ -25,7 +25,7 @@ func TestPathInfoWithoutTrailingSlash(t *testing.T) {
 
 func TestPathInfoWithTrailingSlash(t *testing.T) {
 	sroot := serverDefaultRoot()
-	req := &httpRequest{nil, handler, "", "", "", false}
+	req := &httpRequest{nil, handler, "", "", "", false, "", "", nil, nil}
 
 	p, err := req.pathInfo(testServer.URL + "/")
 	assert.Nil(t, err)
@@ -44,7 +44,7 @@ func TestPathInfoWithTrailingSlash(t *testing.T) {
 func TestPathInfoWithPath(t *testing.T) {
 	path := testServer.URL + "/_test/"
 	sroot := serverDefaultRoot()
-	req := &httpRequest{nil, handler, "", "", "", false}
+	req := &httpRequest{nil, handler, "", "", "", false, "", "", nil, nil}
 
 	p, err := req.pathInfo(path)
 	assert.Nil(t, err)
@@ -63,7 +63,7 @@ func TestPathInfoWithPath(t *testing.T) {
 func TestPathInfoWithPathAndChildDir(t *testing.T) {
 	path := testServer.URL + "/_test/"
 	sroot := serverDefaultRoot()
-	req := &httpRequest{nil, handler, "", "", "", false}
+	req := &httpRequest{nil, handler, "", "", "", false, "", "", nil, nil}
 
 	p, err := req.pathInfo(path + "dir/")
 	assert.Nil(t, err)
@@ -83,7 +83,7 @@ func TestPathInfoWithPathAndChildDir(t *testing.T) {
 func TestPathInfoWithPathAndChildFile(t *testing.T) {
 	path := testServer.URL + "/_test/"
 	sroot := serverDefaultRoot()
-	req := &httpRequest{nil, handler, "", "", "", false}
+	req := &httpRequest{nil, handler, "", "", "", false, "", "", nil, nil}
 
 	p, err := req.pathInfo(path + "abc")
 	assert.Nil(t, err)
@@ -103,7 +103,7 @@ func TestPathInfoWithPathAndChildFile(t *testing.T) {
 func TestPathInfoWithPathAndACLSuffix(t *testing.T) {
 	path := testServer.URL + "/_test/"
 	sroot := serverDefaultRoot()
-	req := &httpRequest{nil, handler, "", "", "", false}
+	req := &httpRequest{nil, handler, "", "", "", false, "", "", nil, nil}
 
 	p, err := req.pathInfo(path + config.ACLSuffix)
 	assert.Nil(t, err)
@@ -122,7 +122,7 @@ func TestPathInfoWithPathAndACLSuffix(t *testing.T) {
 func TestPathInfoWithPathAndMetaSuffix(t *testing.T) {
 	path := testServer.URL + "/_test/"
 	sroot := serverDefaultRoot()
-	req := &httpRequest{nil, handler, "", "", "", false}
+	req := &httpRequest{nil, handler, "", "", "", false, "", "", nil, nil}
 
 	p, err := req.pathInfo(path + config.MetaSuffix)
 	assert.Nil(t, err)
@@ -6,7 +6,7 @@ import (
 
 var (
 	ns = struct {
-		rdf, rdfs, acl, cert, foaf, stat, ldp, dct, space, st NS
+		rdf, rdfs, acl, cert, foaf, stat, ldp, dct, space, st, sh, xsd, vcard, sec NS
 	}{
 		rdf:   NewNS("http://www.w3.org/1999/02/22-rdf-syntax-ns#"),
 		rdfs:  NewNS("http://www.w3.org/2000/01/rdf-schema#"),
@@ -18,6 +18,10 @@ var (
 		dct:   NewNS("http://purl.org/dc/terms/"),
 		space: NewNS("http://www.w3.org/ns/pim/space#"),
 		st:    NewNS("http://www.w3.org/ns/solid/terms#"),
+		sh:    NewNS("http://www.w3.org/ns/shacl#"),
+		xsd:   NewNS("http://www.w3.org/2001/XMLSchema#"),
+		vcard: NewNS("http://www.w3.org/2006/vcard/ns#"),
+		sec:   NewNS("https://w3id.org/security#"),
 	}
 )
 
@@ -0,0 +1,237 @@
+package gold
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// rdfPatchMime is the media type of RDF Patch documents
+	rdfPatchMime = "application/rdf-patch"
+)
+
+// RDFPatchRow is a single change of an RDF Patch: A (add) or D (delete) a triple,
+// or PA (add) and PD (delete) a prefix
+type RDFPatchRow struct {
+	Op     string
+	Triple *Triple
+	Prefix string
+	URI    string
+}
+
+// RDFPatch contains the base URI, the header and the committed rows of an RDF Patch
+type RDFPatch struct {
+	baseURI  string
+	prefixes map[string]string
+	Header   map[string]string
+	Rows     []RDFPatchRow
+}
+
+// NewRDFPatch creates a new RDF Patch object
+func NewRDFPatch(baseURI string) *RDFPatch {
+	return &RDFPatch{
+		baseURI:  baseURI,
+		prefixes: map[string]string{},
+		Header:   map[string]string{},
+		Rows:     []RDFPatchRow{},
+	}
+}
+
+// Parse parses an RDF Patch from the reader. Rows between TX and TC are kept, rows
+// between TX and TA are dropped, and rows outside of a transaction are kept as is.
+func (patch *RDFPatch) Parse(src io.Reader) error {
+	var (
+		pending []RDFPatchRow
+		inTx    bool
+		line    int
+	)
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line++
+		row := strings.TrimSpace(scanner.Text())
+		if len(row) == 0 || strings.HasPrefix(row, "#") {
+			continue
+		}
+		if !strings.HasSuffix(row, ".") {
+			return fmt.Errorf("line %d: missing the final dot", line)
+		}
+		row = strings.TrimSpace(strings.TrimSuffix(row, "."))
+		op, args := row, ""
+		if i := strings.IndexAny(row, " \t"); i > 0 {
+			op, args = row[:i], strings.TrimSpace(row[i+1:])
+		}
+
+		switch op {
+		case "H":
+			argv := strings.Fields(args)
+			if len(argv) != 2 {
+				return fmt.Errorf("line %d: invalid header", line)
+			}
+			patch.Header[argv[0]] = argv[1]
+			continue
+		case "TX":
+			if inTx {
+				return fmt.Errorf("line %d: nested transaction", line)
+			}
+			inTx = true
+			continue
+		case "TC", "TA":
+			if !inTx {
+				return fmt.Errorf("line %d: no transaction to end", line)
+			}
+			if op == "TC" {
+				patch.Rows = append(patch.Rows, pending...)
+			}
+			pending, inTx = nil, false
+			continue
+		}
+
+		var change RDFPatchRow
+		switch op {
+		case "PA":
+			argv := strings.Fields(args)
+			if len(argv) != 2 {
+				return fmt.Errorf("line %d: invalid prefix declaration", line)
+			}
+			change = RDFPatchRow{Op: op, Prefix: strings.TrimSuffix(argv[0], ":"), URI: debrack(argv[1])}
+			patch.prefixes[change.Prefix] = change.URI
+		case "PD":
+			argv := strings.Fields(args)
+			if len(argv) == 0 {
+				return fmt.Errorf("line %d: invalid prefix deletion", line)
+			}
+			change = RDFPatchRow{Op: op, Prefix: strings.TrimSuffix(argv[0], ":")}
+			delete(patch.prefixes, change.Prefix)
+		case "A", "D":
+			triple, err := patch.parseTriple(args)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			change = RDFPatchRow{Op: op, Triple: triple}
+		default:
+			return fmt.Errorf("line %d: unknown row %q", line, op)
+		}
+		if inTx {
+			pending = append(pending, change)
+		} else {
+			patch.Rows = append(patch.Rows, change)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if inTx {
+		return errors.New("the transaction was not committed or aborted")
+	}
+	return nil
+}
+
+// parseTriple parses the terms of an A or D row, using the prefixes declared so far
+func (patch *RDFPatch) parseTriple(terms string) (*Triple, error) {
+	doc := ""
+	for prefix, uri := range patch.prefixes {
+		doc += "@prefix " + prefix + ": <" + uri + "> .\n"
+	}
+	g := NewGraph(patch.baseURI)
+	g.Parse(strings.NewReader(doc+terms+" .\n"), "text/turtle")
+	if g.Len() != 1 {
+		return nil, errors.New("expected one triple, found: " + terms)
+	}
+	for triple := range g.triples {
+		return triple, nil
+	}
+	return nil, nil
+}
+
+// Len returns the number of rows of the patch
+func (patch *RDFPatch) Len() int {
+	return len(patch.Rows)
+}
+
+// String returns the patch as a single RDF Patch transaction
+func (patch *RDFPatch) String() string {
+	keys := make([]string, 0, len(patch.Header))
+	for key := range patch.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := ""
+	for _, key := range keys {
+		out += "H " + key + " " + patch.Header[key] + " .\n"
+	}
+	out += "TX .\n"
+	for _, row := range patch.Rows {
+		switch row.Op {
+		case "PA":
+			out += "PA " + row.Prefix + ": " + brack(row.URI) + " .\n"
+		case "PD":
+			out += "PD " + row.Prefix + ": .\n"
+		default:
+			out += row.Op + " " + row.Triple.String() + "\n"
+		}
+	}
+	return out + "TC .\n"
+}
+
+// RDFPatch is used to apply an RDF Patch to a graph
+func (g *Graph) RDFPatch(patch *RDFPatch) (int, error) {
+	for _, row := range patch.Rows {
+		switch row.Op {
+		case "PA":
+			g.SetPrefix(row.Prefix, row.URI)
+		case "PD":
+			delete(g.prefixes, row.Prefix)
+		case "A":
+			if len(g.All(row.Triple.Subject, row.Triple.Predicate, row.Triple.Object)) == 0 {
+				g.Add(row.Triple)
+			}
+		case "D":
+			for _, triple := range g.All(row.Triple.Subject, row.Triple.Predicate, row.Triple.Object) {
+				g.Remove(triple)
+			}
+		}
+	}
+	return 200, nil
+}
+
+// Diff returns the RDF Patch that turns the graph into the other graph
+// (deletions first, then additions, each sorted like the Turtle output)
+func (g *Graph) Diff(other *Graph) *RDFPatch {
+	patch := NewRDFPatch(other.uri)
+	before := map[string]bool{}
+	for triple := range g.triples {
+		before[triple.String()] = true
+	}
+	after := map[string]bool{}
+	for triple := range other.triples {
+		after[triple.String()] = true
+	}
+	for _, triple := range g.sortedTriples() {
+		if !after[triple.String()] {
+			patch.Rows = append(patch.Rows, RDFPatchRow{Op: "D", Triple: triple})
+		}
+	}
+	for _, triple := range other.sortedTriples() {
+		if !before[triple.String()] {
+			patch.Rows = append(patch.Rows, RDFPatchRow{Op: "A", Triple: triple})
+		}
+	}
+	return patch
+}
+
+// respondDelta answers a successful write, with the RDF Patch describing the changes
+// if the client asked for it and the graph before the write is known
+func (req *httpRequest) respondDelta(w http.ResponseWriter, r *response, status int, before *Graph, after *Graph) *response {
+	if before == nil || after == nil || req.AcceptType != rdfPatchMime {
+		return r.respond(status)
+	}
+	w.Header().Set(HCType, rdfPatchMime)
+	return r.respond(status, before.Diff(after).String())
+}
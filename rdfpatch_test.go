@@ -0,0 +1,131 @@
+package gold
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRDFPatchParse(t *testing.T) {
+	patch := NewRDFPatch("https://test/doc")
+	err := patch.Parse(strings.NewReader(`H id <urn:uuid:1234> .
+TX .
+PA ex: <http://example.org/> .
+A <#a> ex:p "one" .
+D <#a> ex:p <#b> .
+TC .
+TX .
+A <#a> ex:p "aborted" .
+TA .
+A <#c> <http://example.org/p> "two"@en .
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "<urn:uuid:1234>", patch.Header["id"])
+	assert.Equal(t, 4, patch.Len())
+	assert.Equal(t, "PA", patch.Rows[0].Op)
+	assert.Equal(t, "ex", patch.Rows[0].Prefix)
+	assert.Equal(t, "http://example.org/", patch.Rows[0].URI)
+	assert.Equal(t, "A", patch.Rows[1].Op)
+	assert.Equal(t, `<https://test/doc#a> <http://example.org/p> "one" .`, patch.Rows[1].Triple.String())
+	assert.Equal(t, "D", patch.Rows[2].Op)
+	assert.Equal(t, `<https://test/doc#c> <http://example.org/p> "two"@en .`, patch.Rows[3].Triple.String())
+
+	for _, doc := range []string{
+		"A <a> <b> <c>\n",
+		"TX .\nA <a> <b> <c> .\n",
+		"TC .\n",
+		"A <a> <b> .\n",
+		"X <a> <b> <c> .\n",
+	} {
+		err = NewRDFPatch("https://test/doc").Parse(strings.NewReader(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func TestRDFPatchApplyAndDiff(t *testing.T) {
+	g := NewGraph("https://test/doc")
+	g.AddTriple(NewResource("https://test/doc#a"), NewResource("http://example.org/p"), NewResource("https://test/doc#b"))
+	g.AddTriple(NewResource("https://test/doc#a"), NewResource("http://example.org/q"), NewLiteral("keep"))
+
+	before := NewGraph("https://test/doc")
+	for triple := range g.triples {
+		before.Add(triple)
+	}
+
+	patch := NewRDFPatch(g.URI())
+	err := patch.Parse(strings.NewReader("TX .\nD <#a> <http://example.org/p> <#b> .\nA <#a> <http://example.org/p> \"new\" .\nA <#a> <http://example.org/q> \"keep\" .\nTC .\n"))
+	assert.NoError(t, err)
+	status, err := g.RDFPatch(patch)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 2, g.Len())
+	assert.Nil(t, g.One(NewResource("https://test/doc#a"), NewResource("http://example.org/p"), NewResource("https://test/doc#b")))
+	assert.NotNil(t, g.One(NewResource("https://test/doc#a"), NewResource("http://example.org/p"), NewLiteral("new")))
+
+	assert.Equal(t, "TX .\n"+
+		"D <https://test/doc#a> <http://example.org/p> <https://test/doc#b> .\n"+
+		"A <https://test/doc#a> <http://example.org/p> \"new\" .\n"+
+		"TC .\n", before.Diff(g).String())
+	assert.Equal(t, 0, g.Diff(g).Len())
+}
+
+func TestPATCHRDFPatch(t *testing.T) {
+	file := "_test/rdfpatch.ttl"
+	request, err := http.NewRequest("PUT", testServer.URL+"/"+file, strings.NewReader("<#a> <http://example.org/p> <#b> ."))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, response.StatusCode)
+
+	request, err = http.NewRequest("PATCH", testServer.URL+"/"+file, strings.NewReader("TX .\nD <#a> <http://example.org/p> <#b> .\nA <#a> <http://example.org/p> <#c> .\nTC .\n"))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/rdf-patch")
+	request.Header.Add("Accept", "application/rdf-patch")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "application/rdf-patch", response.Header.Get("Content-Type"))
+	assert.Equal(t, "TX .\n"+
+		"D <"+testServer.URL+"/"+file+"#a> <http://example.org/p> <"+testServer.URL+"/"+file+"#b> .\n"+
+		"A <"+testServer.URL+"/"+file+"#a> <http://example.org/p> <"+testServer.URL+"/"+file+"#c> .\n"+
+		"TC .\n", string(body))
+
+	g := NewGraph(testServer.URL + "/" + file)
+	g.ReadFile(file)
+	assert.Equal(t, 1, g.Len())
+	assert.NotNil(t, g.One(NewResource(testServer.URL+"/"+file+"#a"), NewResource("http://example.org/p"), NewResource(testServer.URL+"/"+file+"#c")))
+
+	request, err = http.NewRequest("PATCH", testServer.URL+"/"+file, strings.NewReader("TX .\nA <#a> <http://example.org/p> <#d> .\n"))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/rdf-patch")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 400, response.StatusCode)
+
+	// PUT can also report its changes
+	request, err = http.NewRequest("PUT", testServer.URL+"/"+file, strings.NewReader("<#a> <http://example.org/p> <#c>, <#e> ."))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	request.Header.Add("Accept", "application/rdf-patch")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	body, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "TX .\n"+
+		"A <"+testServer.URL+"/"+file+"#a> <http://example.org/p> <"+testServer.URL+"/"+file+"#e> .\n"+
+		"TC .\n", string(body))
+
+	// cleanup
+	os.Remove(file)
+}
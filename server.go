@@ -15,9 +15,9 @@ import (
 	_path "path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/gorilla/securecookie"
 	"golang.org/x/net/webdav"
 
 	"github.com/linkeddata/gold/pkg/apps"
@@ -42,9 +42,6 @@ const (
 )
 
 var (
-	// Streaming (stream data or not)
-	Streaming = false // experimental
-
 	debugFlags  = log.Flags() | log.Lshortfile
 	debugPrefix = "[debug] "
 
@@ -67,12 +64,20 @@ func (e *errorString) Error() string {
 type Server struct {
 	http.Handler
 
-	Config     *ServerConfig
-	cookie     *securecookie.SecureCookie
-	cookieSalt []byte
-	debug      *log.Logger
-	webdav     *webdav.Handler
-	BoltDB     *bolt.DB
+	Config       *ServerConfig
+	cookie       *keyRing
+	debug        *log.Logger
+	webdav       *webdav.Handler
+	BoltDB       *bolt.DB
+	aclCache     *aclCache
+	groupCache   *groupCache
+	auditLog     *auditLog
+	jwksCache    *jwksCache
+	profileCache *profileCache
+	dpopReplay   *replayCache
+	sigReplay    *replayCache
+	untrusted    *replayCache
+	unknownKeys  *replayCache
 }
 
 type httpRequest struct {
@@ -82,6 +87,12 @@ type httpRequest struct {
 	ContentType string
 	User        string
 	IsOwner     bool
+	AuthMethod  string
+	ClientID    string
+	// the grants under which the authenticated agent acts on behalf of User
+	Delegations []*Delegation
+	// the values of the bearer token of the request, if any
+	Token map[string]string
 }
 
 func (req httpRequest) BaseURI() string {
@@ -163,13 +174,22 @@ func handleStatusText(status int, err error) string {
 // NewServer is used to create a new Server instance
 func NewServer(config *ServerConfig) *Server {
 	s := &Server{
-		Config:     config,
-		cookie:     securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
-		cookieSalt: securecookie.GenerateRandomKey(8),
+		Config: config,
 		webdav: &webdav.Handler{
 			FileSystem: webdav.Dir(config.DataRoot),
 			LockSystem: webdav.NewMemLS(),
 		},
+		aclCache:     newACLCache(),
+		groupCache:   newGroupCache(time.Duration(config.GroupCacheAge)*time.Second, time.Duration(config.GroupFetchTimeout)*time.Second),
+		jwksCache:    newJWKSCache(time.Duration(config.GroupFetchTimeout) * time.Second),
+		dpopReplay:   newReplayCache(),
+		untrusted:    newReplayCache(),
+		sigReplay:    newReplayCache(),
+		unknownKeys:  newReplayCache(),
+		profileCache: newProfileCache(time.Duration(config.ProfileCacheAge)*time.Second, time.Duration(config.ProfileFetchTimeout)*time.Second, config.ProfileMaxSize),
+	}
+	if len(config.AuditLog) > 0 {
+		s.auditLog = newAuditLog(config.AuditLog, config.AuditLogMaxSize, config.AuditLogBackups)
 	}
 	AddRDFExtension(s.Config.ACLSuffix)
 	AddRDFExtension(s.Config.MetaSuffix)
@@ -178,6 +198,13 @@ func NewServer(config *ServerConfig) *Server {
 	} else {
 		s.debug = log.New(ioutil.Discard, "", 0)
 	}
+	var err error
+	s.cookie, err = loadKeyRing(config.KeyFile, time.Duration(config.KeyRotation)*time.Hour)
+	if err != nil {
+		// keep running, with keys that only last until the next restart
+		s.debug.Println("Could not load the signing keys from " + config.KeyFile + ": " + err.Error())
+		s.cookie = newKeyRing("")
+	}
 	s.debug.Println("---- starting server ----")
 	s.debug.Printf("config: %#v\n", s.Config)
 	return s
@@ -229,7 +256,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer func() {
 		req.Body.Close()
 	}()
-	r := s.handle(w, &httpRequest{req, s, "", "", "", false})
+	r := s.handle(w, &httpRequest{req, s, "", "", "", false, "", "", nil, nil})
 	for key := range r.headers {
 		w.Header().Set(key, r.headers.Get(key))
 	}
@@ -277,6 +304,7 @@ func ProxyReq(w http.ResponseWriter, req *httpRequest, s *Server, reqUrl string)
 			s.debug.Println(err.Error())
 		} else {
 			s.debug.Println("Authorization valid for user", user)
+			req.AuthMethod = "bearer"
 		}
 		req.User = user
 	}
@@ -291,6 +319,7 @@ func ProxyReq(w http.ResponseWriter, req *httpRequest, s *Server, reqUrl string)
 			s.debug.Println(err.Error())
 		} else {
 			s.debug.Println("Authorization valid for user", user)
+			req.AuthMethod = "bearer"
 		}
 		req.User = user
 	}
@@ -317,7 +346,7 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 
 	// CORS
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	w.Header().Set("Access-Control-Expose-Headers", "User, Location, Link, Vary, Last-Modified, WWW-Authenticate, Content-Length, Content-Type, Accept-Patch, Accept-Post, Allow, Updates-Via, Ms-Author-Via")
+	w.Header().Set("Access-Control-Expose-Headers", "User, Delegate, Location, Link, Vary, Last-Modified, WWW-Authenticate, Content-Length, Content-Type, Accept-Patch, Accept-Post, Allow, Updates-Via, Ms-Author-Via, WAC-Allow")
 	w.Header().Set("Access-Control-Max-Age", "1728000")
 
 	// RWW
@@ -331,20 +360,46 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 	user := req.authn(w)
 	req.User = user
 	w.Header().Set("User", user)
+	if delegate := req.delegate(); len(delegate) > 0 {
+		w.Header().Set("Delegate", delegate)
+	}
 	acl := NewWAC(req, s, w, user, rKey)
+	if token := req.Request.FormValue(capabilityParam); len(token) > 0 {
+		acl.capability, err = s.checkCapability(req.Host, token)
+		if err != nil {
+			s.debug.Println("Capability error: " + err.Error())
+		}
+	}
 
 	// check if is owner
 	req.IsOwner = false
 	resource, _ := req.pathInfo(req.BaseURI())
+	if req.Method != "GET" && req.Method != "HEAD" && req.Method != "OPTIONS" {
+		// drop the cached policies once the ACL resource has been modified
+		if resource.File == resource.AclFile {
+			defer s.aclCache.invalidate(resource.AclFile)
+		}
+		// and the cached profile, if this is a local WebID profile
+		defer s.profileCache.flush(resource.URI)
+	}
 	if len(user) > 0 {
-		aclStatus, err := acl.AllowWrite(resource.Base)
+		aclStatus, err := NewWAC(req, s, nil, user, "").AllowWrite(resource.Base)
 		if aclStatus == 200 && err == nil {
 			req.IsOwner = true
 		}
 	}
 
+	// suspended accounts are only reachable by the administrators
+	if rec := s.accountSuspension(resource); rec != nil && !s.isAdmin(user) {
+		s.debug.Println("Refused access to the suspended account " + rec.Base)
+		if rec.Legal {
+			return r.respond(451, "This account is unavailable for legal reasons")
+		}
+		return r.respond(403, "This account has been suspended")
+	}
+
 	// Intercept API requests
-	if strings.Contains(req.Request.URL.Path, "/"+SystemPrefix) && req.Method != "OPTIONS" {
+	if (strings.Contains(req.Request.URL.Path, "/"+SystemPrefix) || req.Request.URL.Path == oidcDiscoveryPath) && req.Method != "OPTIONS" {
 		resp := HandleSystem(w, req, s)
 		if resp.Bytes != nil && len(resp.Bytes) > 0 {
 			// copy raw bytes
@@ -389,7 +444,12 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 	contentType := "text/turtle"
 	acceptList, _ := req.Accept()
 	if len(acceptList) > 0 && acceptList[0].SubType != "*" {
-		contentType, err = acceptList.Negotiate(serializerMimes...)
+		offers := serializerMimes
+		if req.Method == "PATCH" || req.Method == "POST" || req.Method == "PUT" {
+			// writes can also answer with the changes they made
+			offers = append(offers[:len(offers):len(offers)], rdfPatchMime)
+		}
+		contentType, err = acceptList.Negotiate(offers...)
 		if err != nil {
 			s.debug.Println("Accept type not acceptable: " + err.Error())
 			return r.respond(406, "HTTP 406 - Accept type not acceptable: "+err.Error())
@@ -401,7 +461,7 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 	w.Header().Set("Link", brack(resource.AclURI)+"; rel=\"acl\", "+brack(resource.MetaURI)+"; rel=\"meta\"")
 
 	// generic headers
-	w.Header().Set("Accept-Patch", "application/json, application/sparql-update")
+	w.Header().Set("Accept-Patch", "application/json, application/sparql-update, application/rdf-patch")
 	w.Header().Set("Accept-Post", "text/turtle, application/json")
 	w.Header().Set("Allow", strings.Join(methodsAll, ", "))
 	w.Header().Set("Vary", "Origin")
@@ -491,12 +551,16 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 			w.Header().Add("Link", brack("http://www.w3.org/ns/ldp#BasicContainer")+"; rel=\"type\"")
 		}
 		w.Header().Add("Link", brack("http://www.w3.org/ns/ldp#Resource")+"; rel=\"type\"")
+		if shapesURI := req.shapesFor(resource); len(shapesURI) > 0 {
+			w.Header().Add("Link", brack(shapesURI)+"; rel=\"http://www.w3.org/ns/ldp#constrainedBy\"")
+		}
 
 		status := 501
 		aclStatus, err := acl.AllowRead(resource.URI)
 		if aclStatus > 200 || err != nil {
 			return r.respond(aclStatus, handleStatusText(aclStatus, err))
 		}
+		w.Header().Set("WAC-Allow", acl.AllowHeader(resource.URI))
 
 		if req.Method == "HEAD" {
 			w.Header().Set("Content-Length", fmt.Sprintf("%d", resource.Size))
@@ -763,37 +827,16 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 			w.Header().Set(HCType, contentType)
 		}
 
-		data := ""
-		if Streaming {
-			errCh := make(chan error, 8)
-			go func() {
-				rf, wf, err := os.Pipe()
-				if err != nil {
-					errCh <- err
-					return
-				}
-				go func() {
-					defer wf.Close()
-					err := g.WriteFile(wf, contentType)
-					if err != nil {
-						errCh <- err
-					}
-				}()
-				go func() {
-					defer rf.Close()
-					_, err := io.Copy(w, rf)
-					if err != nil {
-						errCh <- err
-					} else {
-						errCh <- nil
-					}
-				}()
-			}()
-			err = <-errCh
-		} else {
-			data, err = g.Serialize(contentType)
+		if s.Config.Streaming {
+			// the status line goes out with the first write, so later errors can only be logged
+			err = g.Stream(req.Context(), w, contentType)
+			if err != nil {
+				s.debug.Println("GET g.Stream err: " + err.Error())
+			}
+			return
 		}
 
+		data, err := g.Serialize(contentType)
 		if err != nil {
 			return r.respond(500, err)
 		} else if len(data) > 0 {
@@ -838,6 +881,11 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 
 			g := NewGraph(resource.URI)
 			g.ReadFile(resource.File)
+			var before *Graph
+			if req.AcceptType == rdfPatchMime {
+				before = NewGraph(resource.URI)
+				before.ReadFile(resource.File)
+			}
 
 			switch dataMime {
 			case "application/json":
@@ -849,11 +897,35 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 				if err != nil {
 					return r.respond(ecode, "Error processing SPARQL Update: "+err.Error())
 				}
+			case rdfPatchMime:
+				patch := NewRDFPatch(g.URI())
+				err = patch.Parse(body)
+				if err != nil {
+					return r.respond(400, "Error parsing RDF Patch: "+err.Error())
+				}
+				ecode, err := g.RDFPatch(patch)
+				if err != nil {
+					return r.respond(ecode, "Error processing RDF Patch: "+err.Error())
+				}
 			default:
-				if dataHasParser {
+				if resource.File == resource.AclFile {
+					err = g.ParseStrict(body, dataMime)
+					if err != nil {
+						return r.respond(400, "Error parsing ACL: "+err.Error())
+					}
+				} else if dataHasParser {
 					g.Parse(body, dataMime)
 				}
 			}
+			if resp := req.checkShapes(w, r, resource, g); resp != nil {
+				return resp
+			}
+			if resource.File == resource.AclFile {
+				aclStatus, err := acl.checkACL(resource, g)
+				if err != nil {
+					return r.respond(aclStatus, err.Error())
+				}
+			}
 
 			if !resource.Exists {
 				err = os.MkdirAll(_path.Dir(resource.File), 0755)
@@ -878,7 +950,7 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 			onUpdateURI(resource.URI)
 			onUpdateURI(resource.ParentURI)
 
-			return r.respond(200)
+			return req.respondDelta(w, r, 200, before, g)
 		}
 
 	case "POST":
@@ -984,6 +1056,12 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 				s.debug.Println("POST LDPR req.pathInfo err: " + err.Error())
 				return r.respond(500, err)
 			}
+			if resource.File == resource.AclFile {
+				aclControl, err := acl.AllowControl(resource.URI)
+				if aclControl > 200 || err != nil {
+					return r.respond(aclControl, handleStatusText(aclControl, err))
+				}
+			}
 			w.Header().Set("Location", resource.URI)
 			w.Header().Set("Link", brack(resource.MetaURI)+"; rel=\"meta\", "+brack(resource.AclURI)+"; rel=\"acl\"")
 			// LDP header
@@ -1021,6 +1099,9 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 						} else {
 							newFile = resource.File + files[i].Filename
 						}
+						if strings.HasSuffix(newFile, s.Config.ACLSuffix) {
+							return r.respond(403, "ACL resources cannot be uploaded")
+						}
 						dst, err := os.OpenFile(newFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 						defer dst.Close()
 						if err != nil {
@@ -1046,9 +1127,15 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 				resource.File = resource.File + "/" + s.Config.MetaSuffix
 			}
 
+			var before, after *Graph
 			if dataHasParser {
 				g := NewGraph(resource.URI)
 				g.ReadFile(resource.File)
+				if req.AcceptType == rdfPatchMime {
+					before = NewGraph(resource.URI)
+					before.ReadFile(resource.File)
+					after = g
+				}
 
 				switch dataMime {
 				case "application/json":
@@ -1061,8 +1148,34 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 						println(err.Error())
 						return r.respond(ecode, "Error processing SPARQL Update: "+err.Error())
 					}
+				case rdfPatchMime:
+					patch := NewRDFPatch(g.URI())
+					err = patch.Parse(req.Body)
+					if err != nil {
+						return r.respond(400, "Error parsing RDF Patch: "+err.Error())
+					}
+					ecode, err := g.RDFPatch(patch)
+					if err != nil {
+						return r.respond(ecode, "Error processing RDF Patch: "+err.Error())
+					}
 				default:
-					g.Parse(req.Body, dataMime)
+					if resource.File == resource.AclFile {
+						err = g.ParseStrict(req.Body, dataMime)
+						if err != nil {
+							return r.respond(400, "Error parsing ACL: "+err.Error())
+						}
+					} else {
+						g.Parse(req.Body, dataMime)
+					}
+				}
+				if resp := req.checkShapes(w, r, resource, g); resp != nil {
+					return resp
+				}
+				if resource.File == resource.AclFile {
+					aclStatus, err := acl.checkACL(resource, g)
+					if err != nil {
+						return r.respond(aclStatus, err.Error())
+					}
 				}
 				f, err := os.OpenFile(resource.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 				if err != nil {
@@ -1079,6 +1192,9 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 					}
 				}
 			} else {
+				if resource.File == resource.AclFile {
+					return r.respond(415, "ACL resources must be written as RDF")
+				}
 				f, err := os.OpenFile(resource.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 				if err != nil {
 					s.debug.Println("POST os.OpenFile err: " + err.Error())
@@ -1097,9 +1213,9 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 				onUpdateURI(resource.ParentURI)
 			}
 			if isNew {
-				return r.respond(201)
+				return req.respondDelta(w, r, 201, before, after)
 			}
-			return r.respond(200)
+			return req.respondDelta(w, r, 200, before, after)
 		}
 
 	case "PUT":
@@ -1150,6 +1266,48 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 			onUpdateURI(resource.ParentURI)
 			return r.respond(201)
 		}
+		// validate RDF documents written to containers that have shapes,
+		// and keep the previous graph if the client wants the changes
+		var (
+			body          io.Reader = req.Body
+			before, after *Graph
+		)
+		isACL := !resource.IsDir && resource.File == resource.AclFile
+		if isACL && len(dataMime) > 0 && dataMime != "text/turtle" {
+			return r.respond(415, "ACL resources must be written as text/turtle")
+		}
+		hasShapes := dataHasParser && !resource.IsDir && len(req.shapesFor(resource)) > 0
+		if isACL || hasShapes || (dataHasParser && req.AcceptType == rdfPatchMime) {
+			buf, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				s.debug.Println("PUT ioutil.ReadAll err: " + err.Error())
+				return r.respond(500, err)
+			}
+			after = NewGraph(resource.URI)
+			if isACL {
+				err = after.ParseStrict(bytes.NewReader(buf), "text/turtle")
+				if err != nil {
+					return r.respond(400, "Error parsing ACL: "+err.Error())
+				}
+				aclStatus, err := acl.checkACL(resource, after)
+				if err != nil {
+					return r.respond(aclStatus, err.Error())
+				}
+			} else {
+				after.Parse(bytes.NewReader(buf), dataMime)
+			}
+			if hasShapes {
+				if resp := req.checkShapes(w, r, resource, after); resp != nil {
+					return resp
+				}
+			}
+			if req.AcceptType == rdfPatchMime {
+				before = NewGraph(resource.URI)
+				before.ReadFile(resource.File)
+			}
+			body = bytes.NewReader(buf)
+		}
+
 		err = os.MkdirAll(_path.Dir(resource.File), 0755)
 		if err != nil {
 			s.debug.Println("PUT MkdirAll err: " + err.Error())
@@ -1167,7 +1325,7 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 		}
 		defer f.Close()
 
-		_, err = io.Copy(f, req.Body)
+		_, err = io.Copy(f, body)
 		if err != nil {
 			s.debug.Println("PUT io.Copy err: " + err.Error())
 		}
@@ -1181,9 +1339,9 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 		onUpdateURI(resource.URI)
 		onUpdateURI(resource.ParentURI)
 		if isNew {
-			return r.respond(201)
+			return req.respondDelta(w, r, 201, before, after)
 		}
-		return r.respond(200)
+		return req.respondDelta(w, r, 200, before, after)
 
 	case "DELETE":
 		unlock := lock(resource.Path)
@@ -1197,6 +1355,13 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 		if len(resource.Path) == 0 {
 			return r.respond(500, "500 - Cannot DELETE root (/)")
 		}
+		if resource.File == resource.AclFile {
+			// the policies inherited from the parent containers take over
+			aclStatus, err := acl.checkACL(resource, NewGraph(resource.URI))
+			if err != nil {
+				return r.respond(aclStatus, err.Error())
+			}
+		}
 		// remove ACL and meta files first
 		if resource.File != resource.AclFile {
 			_ = os.Remove(resource.AclFile)
@@ -1251,6 +1416,12 @@ func (s *Server) handle(w http.ResponseWriter, req *httpRequest) (r *response) {
 		if aclWrite > 200 || err != nil {
 			return r.respond(aclWrite, handleStatusText(aclWrite, err))
 		}
+		if dest := req.Header.Get("Destination"); len(dest) > 0 {
+			// ACL resources are only written through validated PUT, PATCH or POST requests
+			if strings.HasSuffix(dest, s.Config.ACLSuffix) {
+				return r.respond(403, "ACL resources cannot be the destination of "+req.Method)
+			}
+		}
 		s.webdav.ServeHTTP(w, req.Request)
 
 	default:
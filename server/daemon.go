@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"log"
 	"net"
@@ -26,6 +27,8 @@ var (
 
 	cookieT = flag.Int64("cookieAge", 24, "lifetime for cookies (in hours)")
 	debug   = flag.Bool("debug", false, "output extra logging?")
+	stream  = flag.Bool("streaming", false, "stream RDF responses instead of buffering them?")
+	control = flag.Bool("controlGrantsAll", false, "let acl:Control grant every access mode, as older versions did?")
 	root    = flag.String("root", ".", "path to file storage root")
 	app     = flag.String("app", "tabulator", "default viewer app for HTML clients")
 	tlsCert = flag.String("tlsCertFile", "", "TLS certificate eg. cert.pem")
@@ -33,6 +36,14 @@ var (
 	vhosts  = flag.Bool("vhosts", false, "run in virtual hosts mode?")
 	bolt    = flag.String("boltPath", "", "path to the location of the Bolt db file (uses /tmp/bolt.db by default)")
 
+	keyFile    = flag.String("keyFile", "", "path to the file holding the cookie and token signing keys (uses /tmp/gold-keys.json by default)")
+	rotateKeys = flag.Bool("rotateKeys", false, "rotate the signing keys of the key file and exit")
+
+	importFile      = flag.String("import", "", "restore this account archive (tar or zip) and exit")
+	importBase      = flag.String("importBase", "", "base URI of the account to restore the archive into, eg. https://example.org/alice/")
+	importDryRun    = flag.Bool("importDryRun", false, "only report what the import would do, including conflicts with existing files")
+	importOverwrite = flag.Bool("importOverwrite", false, "replace the existing files of the account when importing")
+
 	metaSuffix = flag.String("metaSuffix", ",meta", "default suffix for meta files")
 	aclSuffix  = flag.String("aclSuffix", ",acl", "default suffix for ACL files")
 
@@ -43,8 +54,14 @@ var (
 
 	salt = flag.String("salt", "", "used for storing hashed user passwords")
 
+	auditLog     = flag.String("auditLog", "", "path to the audit log of access decisions (disabled by default)")
+	auditMaxSize = flag.Int64("auditLogMaxSize", 10000000, "size (in bytes) after which the audit log is rotated")
+	auditBackups = flag.Int("auditLogBackups", 5, "number of rotated audit logs to keep")
+
 	agent = flag.String("agent", "", "WebID of the agent used for delegated authentication")
 
+	admins = flag.String("admins", "", "space separated list of the WebIDs of the server administrators")
+
 	emailName     = flag.String("emailName", "", "remote SMTP server account name")
 	emailAddr     = flag.String("emailAddr", "", "remote SMTP server email address")
 	emailUser     = flag.String("emailUser", "", "remote SMTP server username")
@@ -120,8 +137,16 @@ func main() {
 		config.CookieAge = *cookieT
 		config.TokenAge = *tokenT
 		config.Debug = *debug
+		config.Streaming = *stream
+		config.ControlGrantsAll = *control
 		config.DataRoot = serverRoot
 		config.BoltPath = *bolt
+		if len(*keyFile) > 0 {
+			config.KeyFile = *keyFile
+		}
+		config.AuditLog = *auditLog
+		config.AuditLogMaxSize = *auditMaxSize
+		config.AuditLogBackups = *auditBackups
 		config.Vhosts = *vhosts
 		config.Insecure = *insecure
 		config.NoHTTP = *nohttp
@@ -129,6 +154,7 @@ func main() {
 		config.MetaSuffix = *metaSuffix
 		config.ACLSuffix = *aclSuffix
 		config.Agent = *agent
+		config.Admins = strings.Fields(*admins)
 		config.ProxyTemplate = *proxy
 		config.ProxyLocal = *local
 		if len(*emailName) > 0 && len(*emailAddr) > 0 && len(*emailUser) > 0 &&
@@ -150,6 +176,15 @@ func main() {
 
 	handler := gold.NewServer(config)
 
+	if *rotateKeys {
+		err = handler.RotateKeys()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Rotated the signing keys in " + config.KeyFile)
+		return
+	}
+
 	// Start Bolt
 	err = handler.StartBolt()
 	if err != nil {
@@ -157,6 +192,18 @@ func main() {
 	}
 	defer handler.BoltDB.Close()
 
+	if len(*importFile) > 0 {
+		report, err := handler.ImportAccount(*importFile, *importBase, *importDryRun, *importOverwrite)
+		if report != nil {
+			data, _ := json.MarshalIndent(report, "", "  ")
+			log.Println(string(data))
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	if os.Getenv("FCGI_ROLE") != "" {
 		err = fcgi.Serve(nil, handler)
 		if err != nil {
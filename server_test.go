@@ -3,6 +3,7 @@ package gold
 import (
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	// "errors"
 	"fmt"
 	"io"
@@ -40,6 +41,12 @@ func init() {
 	testServer.TLS.NextProtos = []string{"http/1.1"}
 	testServer.StartTLS()
 	testServer.URL = strings.Replace(testServer.URL, "127.0.0.1", "localhost", 1)
+
+	// the test servers share one certificate, made for example.com: trust it when fetching
+	// profiles and keys, whatever the host
+	fetchTransport.TLSClientConfig.RootCAs = x509.NewCertPool()
+	fetchTransport.TLSClientConfig.RootCAs.AddCert(testServer.Certificate())
+	fetchTransport.TLSClientConfig.ServerName = "example.com"
 }
 
 // func noRedirect(req *http.Request, via []*http.Request) error {
@@ -663,9 +670,9 @@ func TestLDPLinkHeaders(t *testing.T) {
 }
 
 func TestStreaming(t *testing.T) {
-	Streaming = true
+	handler.Config.Streaming = true
 	defer func() {
-		Streaming = false
+		handler.Config.Streaming = false
 	}()
 	request, err := http.NewRequest("PUT", testServer.URL+"/_test/abc", strings.NewReader("<a> <b> <c> ."))
 	assert.NoError(t, err)
@@ -794,6 +801,32 @@ func TestPATCHSPARQL(t *testing.T) {
 	assert.Nil(t, g.One(NewResource("http://a.com"), NewResource("http://b.com"), NewResource("http://c.com")))
 }
 
+func TestPATCHKeepsPrefixes(t *testing.T) {
+	file := "_test/prefixes.ttl"
+	request, err := http.NewRequest("PUT", testServer.URL+"/"+file, strings.NewReader("@prefix ex: <http://example.org/ns#> .\n<#b> ex:p ex:o .\n"))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, response.StatusCode)
+
+	sparqlData := `INSERT DATA { <#a> <http://example.org/ns#p> <http://example.org/ns#o2> . }`
+	request, err = http.NewRequest("PATCH", testServer.URL+"/"+file, strings.NewReader(sparqlData))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/sparql-update")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "@prefix ex: <http://example.org/ns#> .\n@prefix rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#> .\n\n"+
+		"<#a>\n    ex:p ex:o2 .\n\n<#b>\n    ex:p ex:o .\n\n", string(data))
+
+	// cleanup
+	os.Remove(file)
+}
+
 func TestPATCHFailParse(t *testing.T) {
 	sparqlData := `I { <a> <b> <c> . }`
 	request, err := http.NewRequest("PATCH", testServer.URL+"/_test/abc", strings.NewReader(sparqlData))
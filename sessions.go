@@ -0,0 +1,369 @@
+package gold
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	sessionType = "Sessions"
+	// sessionIndexType holds a bucket of session IDs for each WebID
+	sessionIndexType = "SessionIndex"
+
+	// sessionMaxPerUser is the number of sessions kept for a WebID, the least recently used ones are dropped
+	sessionMaxPerUser = 50
+	// sessionTouchAge is how often the last use of a session is saved
+	sessionTouchAge = time.Minute
+)
+
+var errSessionRevoked = errors.New("The session has been revoked")
+
+// session is a cookie session of the registry
+type session struct {
+	ID        string    `json:"id"`
+	WebID     string    `json:"webid"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Expires   time.Time `json:"expires"`
+	Remote    string    `json:"remote,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Current   bool      `json:"current,omitempty"`
+}
+
+// newSession registers a new session for the WebID, dropping expired and surplus sessions of the same WebID
+func (s *Server) newSession(host string, webid string, expires time.Time, remote string, agent string) (*session, error) {
+	now := time.Now().UTC()
+	sess := &session{
+		ID:        hex.EncodeToString(securecookie.GenerateRandomKey(16)),
+		WebID:     webid,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   expires.UTC(),
+		Remote:    remote,
+		UserAgent: agent,
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return nil, err
+	}
+	err = s.BoltDB.Update(func(tx *bolt.Tx) error {
+		bucket, index, err := sessionBuckets(tx, host, webid, true)
+		if err != nil {
+			return err
+		}
+		sessions, expired, err := userSessions(bucket, index)
+		if err != nil {
+			return err
+		}
+		var active []*session
+		for _, other := range sessions {
+			if now.After(other.Expires) {
+				expired = append(expired, []byte(other.ID))
+			} else {
+				active = append(active, other)
+			}
+		}
+		if len(active) >= sessionMaxPerUser {
+			sort.Slice(active, func(i, j int) bool { return active[i].LastSeen.Before(active[j].LastSeen) })
+			for _, other := range active[:len(active)-sessionMaxPerUser+1] {
+				expired = append(expired, []byte(other.ID))
+			}
+		}
+		if err = deleteSessions(bucket, index, expired); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte(sess.ID), data); err != nil {
+			return err
+		}
+		return index.Put([]byte(sess.ID), []byte{})
+	})
+	return sess, err
+}
+
+// sessionBuckets returns the session bucket of the host and the index bucket of the sessions
+// of the WebID, creating them if create is set. Buckets that do not exist are nil.
+func sessionBuckets(tx *bolt.Tx, host string, webid string, create bool) (*bolt.Bucket, *bolt.Bucket, error) {
+	if !create {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil, nil, nil
+		}
+		bucket, index := hostBucket.Bucket([]byte(sessionType)), hostBucket.Bucket([]byte(sessionIndexType))
+		if bucket == nil || index == nil {
+			return bucket, nil, nil
+		}
+		return bucket, index.Bucket([]byte(webid)), nil
+	}
+	hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+	if err != nil {
+		return nil, nil, err
+	}
+	bucket, err := hostBucket.CreateBucketIfNotExists([]byte(sessionType))
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := hostBucket.CreateBucketIfNotExists([]byte(sessionIndexType))
+	if err != nil {
+		return nil, nil, err
+	}
+	userIndex, err := index.CreateBucketIfNotExists([]byte(webid))
+	return bucket, userIndex, err
+}
+
+// userSessions returns the sessions of an index bucket, and the IDs of the indexed sessions
+// that are gone
+func userSessions(bucket *bolt.Bucket, index *bolt.Bucket) ([]*session, [][]byte, error) {
+	var sessions []*session
+	var gone [][]byte
+	if bucket == nil || index == nil {
+		return sessions, gone, nil
+	}
+	err := index.ForEach(func(k, v []byte) error {
+		data := bucket.Get(k)
+		if data == nil {
+			gone = append(gone, append([]byte{}, k...))
+			return nil
+		}
+		sess := new(session)
+		if err := json.Unmarshal(data, sess); err != nil {
+			return err
+		}
+		sessions = append(sessions, sess)
+		return nil
+	})
+	return sessions, gone, err
+}
+
+// deleteSessions removes sessions and their index entries
+func deleteSessions(bucket *bolt.Bucket, index *bolt.Bucket, ids [][]byte) error {
+	for _, k := range ids {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+		if err := index.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexSessions indexes by WebID the sessions registered by older versions
+func indexSessions(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(host []byte, hostBucket *bolt.Bucket) error {
+			bucket := hostBucket.Bucket([]byte(sessionType))
+			if bucket == nil || hostBucket.Bucket([]byte(sessionIndexType)) != nil {
+				return nil
+			}
+			index, err := hostBucket.CreateBucket([]byte(sessionIndexType))
+			if err != nil {
+				return err
+			}
+			return bucket.ForEach(func(k, v []byte) error {
+				sess := new(session)
+				if err := json.Unmarshal(v, sess); err != nil {
+					return err
+				}
+				userIndex, err := index.CreateBucketIfNotExists([]byte(sess.WebID))
+				if err != nil {
+					return err
+				}
+				return userIndex.Put(k, []byte{})
+			})
+		})
+	})
+}
+
+// sweepSessions removes the expired sessions of all hosts
+func sweepSessions(db *bolt.DB) (int, error) {
+	n := 0
+	now := time.Now().UTC()
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(host []byte, hostBucket *bolt.Bucket) error {
+			bucket := hostBucket.Bucket([]byte(sessionType))
+			if bucket == nil {
+				return nil
+			}
+			expired := map[string][][]byte{}
+			err := bucket.ForEach(func(k, v []byte) error {
+				sess := new(session)
+				if json.Unmarshal(v, sess) == nil && now.After(sess.Expires) {
+					expired[sess.WebID] = append(expired[sess.WebID], k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for webid, ids := range expired {
+				_, index, err := sessionBuckets(tx, string(host), webid, true)
+				if err != nil {
+					return err
+				}
+				if err = deleteSessions(bucket, index, ids); err != nil {
+					return err
+				}
+				n += len(ids)
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+// checkSession returns the WebID of a registered session, and records its use
+func (s *Server) checkSession(host string, id string) (string, error) {
+	var sess *session
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(sessionType))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		sess = new(session)
+		return json.Unmarshal(data, sess)
+	})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	if sess == nil || now.After(sess.Expires) {
+		return "", errSessionRevoked
+	}
+	if now.Sub(sess.LastSeen) > sessionTouchAge {
+		sess.LastSeen = now
+		data, err := json.Marshal(sess)
+		if err != nil {
+			return "", err
+		}
+		err = s.BoltDB.Update(func(tx *bolt.Tx) error {
+			hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+			if err != nil {
+				return err
+			}
+			bucket, err := hostBucket.CreateBucketIfNotExists([]byte(sessionType))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(id), data)
+		})
+		if err != nil {
+			s.debug.Println("Could not save the session use: " + err.Error())
+		}
+	}
+	return sess.WebID, nil
+}
+
+// listSessions returns the active sessions of the WebID on the host
+func (s *Server) listSessions(host string, webid string) ([]*session, error) {
+	sessions := []*session{}
+	now := time.Now().UTC()
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		bucket, index, err := sessionBuckets(tx, host, webid, false)
+		if err != nil {
+			return err
+		}
+		all, _, err := userSessions(bucket, index)
+		for _, sess := range all {
+			if now.Before(sess.Expires) {
+				sessions = append(sessions, sess)
+			}
+		}
+		return err
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+	return sessions, err
+}
+
+// revokeSessions removes the sessions of the WebID with the given IDs, or all of them except keep
+// if ids is empty, and returns how many were removed
+func (s *Server) revokeSessions(host string, webid string, ids []string, keep string) (int, error) {
+	n := 0
+	err := s.BoltDB.Update(func(tx *bolt.Tx) error {
+		bucket, index, err := sessionBuckets(tx, host, webid, false)
+		if err != nil || index == nil {
+			return err
+		}
+		sessions, _, err := userSessions(bucket, index)
+		if err != nil {
+			return err
+		}
+		var revoked [][]byte
+		for _, sess := range sessions {
+			if len(ids) == 0 && sess.ID == keep {
+				continue
+			}
+			if len(ids) == 0 || hasString(ids, sess.ID) {
+				revoked = append(revoked, []byte(sess.ID))
+			}
+		}
+		n = len(revoked)
+		return deleteSessions(bucket, index, revoked)
+	})
+	return n, err
+}
+
+// accountSessions lists (GET) and revokes (POST or DELETE, with an id parameter, or all=true
+// for all the other sessions) the sessions of the authenticated user
+func accountSessions(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if s.BoltDB == nil {
+		return SystemReturn{Status: 503, Body: "The session registry requires the Bolt database"}
+	}
+	host := hostOf(req.BaseURI())
+	current := req.sessionID()
+
+	switch req.Method {
+	case "GET":
+		sessions, err := s.listSessions(host, req.User)
+		if err != nil {
+			s.debug.Println("Session registry error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		for _, sess := range sessions {
+			sess.Current = sess.ID == current
+		}
+		data, err := json.Marshal(sessions)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		w.Header().Set(HCType, "application/json")
+		return SystemReturn{Status: 200, Body: string(data)}
+	case "POST", "DELETE":
+		var ids []string
+		if req.FormValue("all") != "true" {
+			if len(req.FormValue("id")) == 0 {
+				return SystemReturn{Status: 400, Body: "Missing session id"}
+			}
+			ids = []string{req.FormValue("id")}
+		}
+		n, err := s.revokeSessions(host, req.User, ids, current)
+		if err != nil {
+			s.debug.Println("Session registry error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		if len(ids) > 0 && n == 0 {
+			return SystemReturn{Status: 404, Body: "Session not found"}
+		}
+		data, _ := json.Marshal(map[string]int{"revoked": n})
+		w.Header().Set(HCType, "application/json")
+		return SystemReturn{Status: 200, Body: string(data)}
+	}
+	return SystemReturn{Status: 405, Body: "Method not allowed"}
+}
@@ -0,0 +1,131 @@
+package gold
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountSessions(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/sessions.db")()
+
+	webid := "https://dave.example/profile/card#me"
+	err := handler.setPassword(testServer.URL+"/", webid, "secret")
+	assert.NoError(t, err)
+	login := func() string {
+		response, _ := oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/login", url.Values{
+			"webid":    {webid},
+			"password": {"secret"},
+		}, nil)
+		assert.Equal(t, 301, response.StatusCode)
+		for _, c := range response.Cookies() {
+			if c.Name == "Session" {
+				assert.True(t, c.HttpOnly)
+				assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+				return c.Name + "=" + c.Value
+			}
+		}
+		t.Fatal("missing session cookie")
+		return ""
+	}
+	api := testServer.URL + "/" + SystemPrefix + "/sessions"
+	list := func(cookie string) (int, []session) {
+		response, body := oidcDo(t, httpClient, "GET", api, nil, map[string]string{"Cookie": cookie})
+		var sessions []session
+		if response.StatusCode == 200 {
+			assert.NoError(t, json.Unmarshal([]byte(body), &sessions))
+		}
+		return response.StatusCode, sessions
+	}
+
+	response, _ := oidcDo(t, httpClient, "GET", api, nil, nil)
+	assert.Equal(t, 401, response.StatusCode)
+
+	first := login()
+	second := login()
+	third := login()
+	status, sessions := list(second)
+	assert.Equal(t, 200, status)
+	assert.Len(t, sessions, 3)
+	current := ""
+	for _, sess := range sessions {
+		assert.Equal(t, webid, sess.WebID)
+		if sess.Current {
+			current = sess.ID
+		}
+	}
+	assert.NotEmpty(t, current)
+
+	// revoke the first session
+	_, sessions = list(first)
+	for _, sess := range sessions {
+		if sess.Current {
+			current = sess.ID
+		}
+	}
+	response, body := oidcDo(t, httpClient, "DELETE", api+"?id="+current, nil, map[string]string{"Cookie": second})
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, `{"revoked":1}`, body)
+	status, _ = list(first)
+	assert.Equal(t, 401, status)
+	response, _ = oidcDo(t, httpClient, "DELETE", api+"?id="+current, nil, map[string]string{"Cookie": second})
+	assert.Equal(t, 404, response.StatusCode)
+
+	// revoke all the other sessions
+	response, body = oidcDo(t, httpClient, "POST", api, url.Values{"all": {"true"}}, map[string]string{"Cookie": second})
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, `{"revoked":1}`, body)
+	status, _ = list(third)
+	assert.Equal(t, 401, status)
+	status, sessions = list(second)
+	assert.Equal(t, 200, status)
+	assert.Len(t, sessions, 1)
+
+	// logging out ends the session
+	response, _ = oidcDo(t, httpClient, "GET", testServer.URL+"/"+SystemPrefix+"/logout", nil, map[string]string{"Cookie": second})
+	assert.Equal(t, 200, response.StatusCode)
+	status, _ = list(second)
+	assert.Equal(t, 401, status)
+}
+
+func TestSessionIndex(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/sessionindex.db")()
+	host := "sessions.example"
+	alice, bob := "https://alice.example/#me", "https://bob.example/#me"
+
+	_, err := handler.newSession(host, alice, time.Now().Add(time.Hour), "", "")
+	assert.NoError(t, err)
+	expired, err := handler.newSession(host, alice, time.Now().Add(-time.Minute), "", "")
+	assert.NoError(t, err)
+	_, err = handler.newSession(host, bob, time.Now().Add(time.Hour), "", "")
+	assert.NoError(t, err)
+	sessions, err := handler.listSessions(host, alice)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	// sessions of older versions are indexed at startup
+	assert.NoError(t, handler.BoltDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(host)).DeleteBucket([]byte(sessionIndexType))
+	}))
+	sessions, _ = handler.listSessions(host, bob)
+	assert.Empty(t, sessions)
+	assert.NoError(t, indexSessions(handler.BoltDB))
+	sessions, _ = handler.listSessions(host, bob)
+	assert.Len(t, sessions, 1)
+
+	n, err := sweepSessions(handler.BoltDB)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = handler.checkSession(host, expired.ID)
+	assert.Equal(t, errSessionRevoked, err)
+	n, err = handler.revokeSessions(host, alice, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	sessions, _ = handler.listSessions(host, bob)
+	assert.Len(t, sessions, 1)
+}
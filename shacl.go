@@ -0,0 +1,601 @@
+package gold
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationResult is a single SHACL constraint violation (or warning/info)
+type ValidationResult struct {
+	Focus     Term
+	Path      Term
+	Inverse   bool
+	Value     Term
+	Shape     Term
+	Component string
+	Severity  Term
+	Message   string
+}
+
+// ValidationReport holds the results of validating a data graph against a shapes graph
+type ValidationReport struct {
+	Results []*ValidationResult
+}
+
+// Conforms returns true if the validation did not produce any results
+func (report *ValidationReport) Conforms() bool {
+	return len(report.Results) == 0
+}
+
+// Violated returns true if at least one result has the sh:Violation severity
+func (report *ValidationReport) Violated() bool {
+	for _, res := range report.Results {
+		if res.Severity.Equal(ns.sh.Get("Violation")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Graph returns the sh:ValidationReport as RDF
+func (report *ValidationReport) Graph(uri string) *Graph {
+	g := NewGraph(uri)
+	root := NewBlankNode("report")
+	g.AddTriple(root, ns.rdf.Get("type"), ns.sh.Get("ValidationReport"))
+	g.AddTriple(root, ns.sh.Get("conforms"), NewLiteralWithDatatype(strconv.FormatBool(report.Conforms()), ns.xsd.Get("boolean")))
+	for i, res := range report.Results {
+		node := NewBlankNode(fmt.Sprintf("result%d", i))
+		g.AddTriple(root, ns.sh.Get("result"), node)
+		g.AddTriple(node, ns.rdf.Get("type"), ns.sh.Get("ValidationResult"))
+		g.AddTriple(node, ns.sh.Get("focusNode"), res.Focus)
+		g.AddTriple(node, ns.sh.Get("sourceConstraintComponent"), ns.sh.Get(res.Component))
+		g.AddTriple(node, ns.sh.Get("resultSeverity"), res.Severity)
+		if res.Shape != nil {
+			g.AddTriple(node, ns.sh.Get("sourceShape"), res.Shape)
+		}
+		if res.Path != nil {
+			if res.Inverse {
+				path := NewBlankNode(fmt.Sprintf("path%d", i))
+				g.AddTriple(path, ns.sh.Get("inversePath"), res.Path)
+				g.AddTriple(node, ns.sh.Get("resultPath"), path)
+			} else {
+				g.AddTriple(node, ns.sh.Get("resultPath"), res.Path)
+			}
+		}
+		if res.Value != nil {
+			g.AddTriple(node, ns.sh.Get("value"), res.Value)
+		}
+		if len(res.Message) > 0 {
+			g.AddTriple(node, ns.sh.Get("resultMessage"), NewLiteral(res.Message))
+		}
+	}
+	return g
+}
+
+// shapeValidator validates a data graph against the shapes found in a shapes graph.
+// It supports the SHACL Core value type, cardinality, value range, string based, sh:in,
+// sh:hasValue and sh:node constraints, on predicate and inverse paths.
+type shapeValidator struct {
+	data   *Graph
+	shapes *Graph
+	report *ValidationReport
+}
+
+// maxShapeDepth limits the nesting of sh:node constraints (and guards against recursive shapes)
+const maxShapeDepth = 16
+
+// ValidateShapes validates the data graph against the shapes graph
+func ValidateShapes(data *Graph, shapes *Graph) *ValidationReport {
+	v := &shapeValidator{
+		data:   data,
+		shapes: shapes,
+		report: &ValidationReport{},
+	}
+	for _, shape := range v.shapeNodes() {
+		if v.deactivated(shape) {
+			continue
+		}
+		for _, focus := range v.targets(shape) {
+			v.report.Results = append(v.report.Results, v.validateNode(shape, focus, 0)...)
+		}
+	}
+	return v.report
+}
+
+// shapeNodes returns the (sorted) node shapes that have targets
+func (v *shapeValidator) shapeNodes() []Term {
+	found := map[string]Term{}
+	for _, p := range []string{"targetNode", "targetClass", "targetSubjectsOf", "targetObjectsOf"} {
+		for _, t := range v.shapes.All(nil, ns.sh.Get(p), nil) {
+			found[termKey(t.Subject)] = t.Subject
+		}
+	}
+	// implicit class targets
+	for _, t := range v.shapes.All(nil, ns.rdf.Get("type"), ns.sh.Get("NodeShape")) {
+		if len(v.shapes.All(t.Subject, ns.rdf.Get("type"), ns.rdfs.Get("Class"))) > 0 {
+			found[termKey(t.Subject)] = t.Subject
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	shapes := make([]Term, len(keys))
+	for i, key := range keys {
+		shapes[i] = found[key]
+	}
+	return shapes
+}
+
+// targets returns the focus nodes of a shape in the data graph
+func (v *shapeValidator) targets(shape Term) []Term {
+	var nodes []Term
+	for _, t := range v.shapes.All(shape, ns.sh.Get("targetNode"), nil) {
+		nodes = append(nodes, t.Object)
+	}
+	classes := v.objects(v.shapes, shape, ns.sh.Get("targetClass"))
+	if len(v.shapes.All(shape, ns.rdf.Get("type"), ns.rdfs.Get("Class"))) > 0 {
+		classes = append(classes, shape)
+	}
+	for _, class := range classes {
+		for _, t := range v.data.All(nil, ns.rdf.Get("type"), nil) {
+			if v.isSubClass(t.Object, class) {
+				nodes = append(nodes, t.Subject)
+			}
+		}
+	}
+	for _, p := range v.objects(v.shapes, shape, ns.sh.Get("targetSubjectsOf")) {
+		for _, t := range v.data.All(nil, p, nil) {
+			nodes = append(nodes, t.Subject)
+		}
+	}
+	for _, p := range v.objects(v.shapes, shape, ns.sh.Get("targetObjectsOf")) {
+		for _, t := range v.data.All(nil, p, nil) {
+			nodes = append(nodes, t.Object)
+		}
+	}
+	return unique(nodes)
+}
+
+// validateNode validates a focus node against a node shape
+func (v *shapeValidator) validateNode(shape Term, focus Term, depth int) []*ValidationResult {
+	results := v.validateValues(shape, focus, nil, false, []Term{focus}, depth)
+	for _, property := range v.objects(v.shapes, shape, ns.sh.Get("property")) {
+		if v.deactivated(property) {
+			continue
+		}
+		path, inverse, ok := v.path(property)
+		if !ok {
+			continue
+		}
+		var values []Term
+		if inverse {
+			for _, t := range v.data.All(nil, path, focus) {
+				values = append(values, t.Subject)
+			}
+		} else {
+			for _, t := range v.data.All(focus, path, nil) {
+				values = append(values, t.Object)
+			}
+		}
+		results = append(results, v.validateValues(property, focus, path, inverse, unique(values), depth)...)
+	}
+	return results
+}
+
+// path returns the predicate of a property shape, and whether it is an inverse path
+func (v *shapeValidator) path(property Term) (Term, bool, bool) {
+	for _, path := range v.objects(v.shapes, property, ns.sh.Get("path")) {
+		switch path.(type) {
+		case *Resource:
+			return path, false, true
+		case *BlankNode:
+			for _, inv := range v.objects(v.shapes, path, ns.sh.Get("inversePath")) {
+				if _, ok := inv.(*Resource); ok {
+					return inv, true, true
+				}
+			}
+		}
+	}
+	return nil, false, false
+}
+
+// validateValues checks the constraints of a shape on the value nodes of a focus node
+func (v *shapeValidator) validateValues(shape Term, focus Term, path Term, inverse bool, values []Term, depth int) []*ValidationResult {
+	var results []*ValidationResult
+	fail := func(component string, value Term, msg string) {
+		res := &ValidationResult{
+			Focus:     focus,
+			Path:      path,
+			Inverse:   inverse,
+			Value:     value,
+			Shape:     shape,
+			Component: component,
+			Severity:  ns.sh.Get("Violation"),
+			Message:   msg,
+		}
+		if severity := v.objects(v.shapes, shape, ns.sh.Get("severity")); len(severity) > 0 {
+			res.Severity = severity[0]
+		}
+		if message := v.objects(v.shapes, shape, ns.sh.Get("message")); len(message) > 0 {
+			if l, ok := message[0].(*Literal); ok {
+				res.Message = l.Value
+			}
+		}
+		results = append(results, res)
+	}
+
+	if path != nil {
+		if n, ok := v.integer(shape, "minCount"); ok && len(values) < n {
+			fail("MinCountConstraintComponent", nil, fmt.Sprintf("Less than %d values", n))
+		}
+		if n, ok := v.integer(shape, "maxCount"); ok && len(values) > n {
+			fail("MaxCountConstraintComponent", nil, fmt.Sprintf("More than %d values", n))
+		}
+	}
+
+	for _, datatype := range v.objects(v.shapes, shape, ns.sh.Get("datatype")) {
+		for _, value := range values {
+			if !datatypeOf(value).Equal(datatype) {
+				fail("DatatypeConstraintComponent", value, "Value does not have datatype "+datatype.String())
+			}
+		}
+	}
+	for _, class := range v.objects(v.shapes, shape, ns.sh.Get("class")) {
+		for _, value := range values {
+			if !v.isInstance(value, class) {
+				fail("ClassConstraintComponent", value, "Value is not an instance of "+class.String())
+			}
+		}
+	}
+	for _, kind := range v.objects(v.shapes, shape, ns.sh.Get("nodeKind")) {
+		for _, value := range values {
+			if !hasNodeKind(value, kind) {
+				fail("NodeKindConstraintComponent", value, "Value does not have node kind "+kind.String())
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		name, component string
+		check           func(float64, float64) bool
+	}{
+		{"minInclusive", "MinInclusiveConstraintComponent", func(x, lim float64) bool { return x >= lim }},
+		{"maxInclusive", "MaxInclusiveConstraintComponent", func(x, lim float64) bool { return x <= lim }},
+		{"minExclusive", "MinExclusiveConstraintComponent", func(x, lim float64) bool { return x > lim }},
+		{"maxExclusive", "MaxExclusiveConstraintComponent", func(x, lim float64) bool { return x < lim }},
+	} {
+		for _, limit := range v.objects(v.shapes, shape, ns.sh.Get(c.name)) {
+			lim, ok := numericValue(limit)
+			if !ok {
+				continue
+			}
+			for _, value := range values {
+				if x, ok := numericValue(value); !ok || !c.check(x, lim) {
+					fail(c.component, value, "Value does not satisfy sh:"+c.name+" "+limit.String())
+				}
+			}
+		}
+	}
+
+	if n, ok := v.integer(shape, "minLength"); ok {
+		for _, value := range values {
+			if s, ok := stringValue(value); !ok || utf8.RuneCountInString(s) < n {
+				fail("MinLengthConstraintComponent", value, fmt.Sprintf("Value is shorter than %d characters", n))
+			}
+		}
+	}
+	if n, ok := v.integer(shape, "maxLength"); ok {
+		for _, value := range values {
+			if s, ok := stringValue(value); !ok || utf8.RuneCountInString(s) > n {
+				fail("MaxLengthConstraintComponent", value, fmt.Sprintf("Value is longer than %d characters", n))
+			}
+		}
+	}
+	for _, pattern := range v.objects(v.shapes, shape, ns.sh.Get("pattern")) {
+		l, ok := pattern.(*Literal)
+		if !ok {
+			continue
+		}
+		expr := l.Value
+		if flags := v.objects(v.shapes, shape, ns.sh.Get("flags")); len(flags) > 0 {
+			if f, ok := flags[0].(*Literal); ok && len(f.Value) > 0 {
+				expr = "(?" + f.Value + ")" + expr
+			}
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		for _, value := range values {
+			if s, ok := stringValue(value); !ok || !re.MatchString(s) {
+				fail("PatternConstraintComponent", value, "Value does not match pattern \""+l.Value+"\"")
+			}
+		}
+	}
+
+	for _, list := range v.objects(v.shapes, shape, ns.sh.Get("in")) {
+		members := v.list(list)
+		for _, value := range values {
+			if !containsTerm(members, value) {
+				fail("InConstraintComponent", value, "Value is not in the list of allowed values")
+			}
+		}
+	}
+	for _, expected := range v.objects(v.shapes, shape, ns.sh.Get("hasValue")) {
+		if !containsTerm(values, expected) {
+			fail("HasValueConstraintComponent", nil, "Missing expected value "+expected.String())
+		}
+	}
+
+	for _, node := range v.objects(v.shapes, shape, ns.sh.Get("node")) {
+		if depth >= maxShapeDepth {
+			break
+		}
+		for _, value := range values {
+			if len(v.validateNode(node, value, depth+1)) > 0 {
+				fail("NodeConstraintComponent", value, "Value does not conform to shape "+node.String())
+			}
+		}
+	}
+
+	return results
+}
+
+// deactivated checks if a shape has sh:deactivated true
+func (v *shapeValidator) deactivated(shape Term) bool {
+	for _, o := range v.objects(v.shapes, shape, ns.sh.Get("deactivated")) {
+		if l, ok := o.(*Literal); ok && l.Value == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// integer returns the integer value of a shape parameter
+func (v *shapeValidator) integer(shape Term, name string) (int, bool) {
+	for _, o := range v.objects(v.shapes, shape, ns.sh.Get(name)) {
+		if l, ok := o.(*Literal); ok {
+			if n, err := strconv.Atoi(l.Value); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// objects returns the objects of all the triples matching s and p in g
+func (v *shapeValidator) objects(g *Graph, s Term, p Term) []Term {
+	var objects []Term
+	for _, t := range g.All(s, p, nil) {
+		objects = append(objects, t.Object)
+	}
+	return objects
+}
+
+// list returns the members of an RDF collection from the shapes graph
+func (v *shapeValidator) list(head Term) []Term {
+	var members []Term
+	seen := map[string]bool{}
+	for head != nil && !head.Equal(ns.rdf.Get("nil")) && !seen[termKey(head)] {
+		seen[termKey(head)] = true
+		members = append(members, v.objects(v.shapes, head, ns.rdf.Get("first"))...)
+		rest := v.objects(v.shapes, head, ns.rdf.Get("rest"))
+		if len(rest) == 0 {
+			break
+		}
+		head = rest[0]
+	}
+	return members
+}
+
+// isInstance checks if node has an rdf:type which is the class or one of its subclasses
+func (v *shapeValidator) isInstance(node Term, class Term) bool {
+	for _, t := range v.data.All(node, ns.rdf.Get("type"), nil) {
+		if v.isSubClass(t.Object, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubClass checks if sub is class or (transitively) a rdfs:subClassOf class in the data graph
+func (v *shapeValidator) isSubClass(sub Term, class Term) bool {
+	seen := map[string]bool{}
+	queue := []Term{sub}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if c.Equal(class) {
+			return true
+		}
+		if seen[termKey(c)] {
+			continue
+		}
+		seen[termKey(c)] = true
+		queue = append(queue, v.objects(v.data, c, ns.rdfs.Get("subClassOf"))...)
+	}
+	return false
+}
+
+// datatypeOf returns the datatype of a literal (xsd:string or rdf:langString for plain literals)
+func datatypeOf(t Term) Term {
+	l, ok := t.(*Literal)
+	if !ok {
+		return NewResource("")
+	}
+	if len(l.Language) > 0 {
+		return ns.rdf.Get("langString")
+	}
+	if l.Datatype == nil {
+		return ns.xsd.Get("string")
+	}
+	return l.Datatype
+}
+
+// hasNodeKind checks a term against one of the sh:nodeKind values
+func hasNodeKind(t Term, kind Term) bool {
+	var k string
+	switch t.(type) {
+	case *Resource:
+		k = "IRI"
+	case *BlankNode:
+		k = "BlankNode"
+	case *Literal:
+		k = "Literal"
+	}
+	r, ok := kind.(*Resource)
+	if !ok || !strings.HasPrefix(r.URI, string(ns.sh)) {
+		return false
+	}
+	for _, allowed := range strings.Split(r.URI[len(ns.sh):], "Or") {
+		if allowed == k {
+			return true
+		}
+	}
+	return false
+}
+
+// stringValue returns the lexical form of a literal or the URI of a resource
+func stringValue(t Term) (string, bool) {
+	switch t := t.(type) {
+	case *Literal:
+		return t.Value, true
+	case *Resource:
+		return t.URI, true
+	}
+	return "", false
+}
+
+// numericValue returns the value of a numeric literal
+func numericValue(t Term) (float64, bool) {
+	l, ok := t.(*Literal)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(l.Value, 64)
+	return f, err == nil
+}
+
+func containsTerm(list []Term, t Term) bool {
+	for _, elt := range list {
+		if elt.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func unique(terms []Term) []Term {
+	seen := map[string]bool{}
+	var out []Term
+	for _, t := range terms {
+		key := t.String()
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// shapesFor returns the URI of the shapes graph constraining a resource, as declared
+// in its container's meta file with ldp:constrainedBy or sh:shapesGraph
+func (req *httpRequest) shapesFor(resource *pathInfo) string {
+	if resource.File == resource.MetaFile || resource.File == resource.AclFile {
+		return ""
+	}
+	container := resource
+	if !resource.IsDir {
+		var err error
+		container, err = req.pathInfo(resource.ParentURI)
+		if err != nil {
+			return ""
+		}
+	}
+	kb := NewGraph(container.MetaURI)
+	kb.ReadFile(container.MetaFile)
+	for _, p := range []Term{ns.ldp.Get("constrainedBy"), ns.sh.Get("shapesGraph")} {
+		for _, t := range kb.All(nil, p, nil) {
+			if r, ok := t.Object.(*Resource); ok {
+				return r.URI
+			}
+		}
+	}
+	return ""
+}
+
+// loadShapes reads the shapes graph from the local file system, if the user can read it,
+// or fetches it through the group cache if it is remote. It returns the status to use if
+// the graph cannot be loaded.
+func (req *httpRequest) loadShapes(resource *pathInfo, uri string) (*Graph, int, error) {
+	doc := defrag(uri)
+	if strings.HasPrefix(doc, resource.Base+"/") {
+		res, err := req.pathInfo(doc)
+		if err != nil {
+			return nil, 500, err
+		}
+		if !res.Exists {
+			return nil, 500, fmt.Errorf("Could not find the shapes graph %s", doc)
+		}
+		if status, err := NewWAC(req, req.Server, nil, req.User, "").AllowRead(res.URI); status != 200 {
+			if err == nil {
+				err = fmt.Errorf("Cannot read the shapes graph %s", doc)
+			}
+			return nil, status, err
+		}
+		shapes := NewGraph(doc)
+		shapes.ReadFile(res.File)
+		return shapes, 200, nil
+	}
+	shapes := req.Server.groupCache.get(doc)
+	if shapes.Len() == 0 {
+		return nil, 500, fmt.Errorf("Could not fetch the shapes graph %s", doc)
+	}
+	return shapes, 200, nil
+}
+
+// checkShapes validates the graph that is about to be written to a resource against the
+// shapes of its container; it returns a 422 response with the validation report if the
+// graph does not conform, or nil if the write can proceed
+func (req *httpRequest) checkShapes(w http.ResponseWriter, r *response, resource *pathInfo, g *Graph) *response {
+	if resource.IsDir {
+		return nil
+	}
+	shapesURI := req.shapesFor(resource)
+	if len(shapesURI) == 0 || defrag(shapesURI) == resource.URI {
+		return nil
+	}
+	w.Header().Add("Link", brack(shapesURI)+"; rel=\"http://www.w3.org/ns/ldp#constrainedBy\"")
+
+	shapes, status, err := req.loadShapes(resource, shapesURI)
+	if err != nil {
+		req.debug.Println("Could not load shapes graph: " + err.Error())
+		return r.respond(status, err)
+	}
+	report := ValidateShapes(g, shapes)
+	if !report.Violated() {
+		return nil
+	}
+	req.debug.Println("Graph for", resource.URI, "does not conform to", shapesURI)
+
+	mime := "text/turtle"
+	if req.AcceptType == "application/ld+json" {
+		mime = req.AcceptType
+	}
+	body := new(bytes.Buffer)
+	err = report.Graph(resource.URI).Stream(req.Context(), body, mime)
+	if err != nil {
+		return r.respond(500, err)
+	}
+	w.Header().Set(HCType, mime)
+	return r.respond(422, body.String())
+}
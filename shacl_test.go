@@ -0,0 +1,211 @@
+package gold
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	shapesTurtle = `@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+@prefix vcard: <http://www.w3.org/2006/vcard/ns#> .
+
+<#ContactShape>
+    a sh:NodeShape ;
+    sh:targetClass vcard:Individual ;
+    sh:property [
+        sh:path vcard:fn ;
+        sh:minCount 1 ;
+        sh:maxCount 1 ;
+        sh:datatype xsd:string ;
+    ] ;
+    sh:property [
+        sh:path vcard:hasEmail ;
+        sh:nodeKind sh:IRI ;
+        sh:pattern "^mailto:" ;
+    ] .
+`
+	shapesDir = "/_test/shapes/"
+)
+
+func TestValidateShapes(t *testing.T) {
+	shapes := NewGraph(testServer.URL + shapesDir + "contact-shapes.ttl")
+	shapes.Parse(strings.NewReader(shapesTurtle), "text/turtle")
+
+	data := NewGraph(testServer.URL + shapesDir + "contacts/alice")
+	data.Parse(strings.NewReader(`<#me> a <http://www.w3.org/2006/vcard/ns#Individual> ;
+    <http://www.w3.org/2006/vcard/ns#fn> "Alice" ;
+    <http://www.w3.org/2006/vcard/ns#hasEmail> <mailto:alice@example.org> .`), "text/turtle")
+	report := ValidateShapes(data, shapes)
+	assert.True(t, report.Conforms())
+	assert.False(t, report.Violated())
+
+	data = NewGraph(testServer.URL + shapesDir + "contacts/bob")
+	data.Parse(strings.NewReader(`<#me> a <http://www.w3.org/2006/vcard/ns#Individual> ;
+    <http://www.w3.org/2006/vcard/ns#hasEmail> "bob@example.org" .`), "text/turtle")
+	report = ValidateShapes(data, shapes)
+	assert.False(t, report.Conforms())
+	assert.True(t, report.Violated())
+	components := []string{}
+	for _, res := range report.Results {
+		assert.Equal(t, testServer.URL+shapesDir+"contacts/bob#me", termKey(res.Focus))
+		components = append(components, res.Component)
+	}
+	assert.Contains(t, components, "MinCountConstraintComponent")
+	assert.Contains(t, components, "NodeKindConstraintComponent")
+	assert.Contains(t, components, "PatternConstraintComponent")
+
+	g := report.Graph(data.URI())
+	assert.NotNil(t, g.One(nil, ns.rdf.Get("type"), ns.sh.Get("ValidationReport")))
+	assert.NotNil(t, g.One(nil, ns.sh.Get("conforms"), NewLiteralWithDatatype("false", ns.xsd.Get("boolean"))))
+	assert.Equal(t, len(report.Results), len(g.All(nil, ns.rdf.Get("type"), ns.sh.Get("ValidationResult"))))
+}
+
+func TestShapesInit(t *testing.T) {
+	request, err := http.NewRequest("PUT", testServer.URL+shapesDir+"contact-shapes.ttl", strings.NewReader(shapesTurtle))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, response.StatusCode)
+
+	request, err = http.NewRequest("PUT", testServer.URL+shapesDir+"contacts/.meta", strings.NewReader("<> <http://www.w3.org/ns/ldp#constrainedBy> <../contact-shapes.ttl> ."))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, response.StatusCode)
+
+	request, err = http.NewRequest("HEAD", testServer.URL+shapesDir+"contacts/", nil)
+	assert.NoError(t, err)
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Contains(t, ParseLinkHeader(strings.Join(response.Header["Link"], ", ")).MatchRel("http://www.w3.org/ns/ldp#constrainedBy"), shapesDir+"contact-shapes.ttl")
+}
+
+func TestShapesPUT(t *testing.T) {
+	request, err := http.NewRequest("PUT", testServer.URL+shapesDir+"contacts/alice", strings.NewReader(`<#me> a <http://www.w3.org/2006/vcard/ns#Individual> ;
+    <http://www.w3.org/2006/vcard/ns#fn> "Alice" .`))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, response.StatusCode)
+	assert.Contains(t, ParseLinkHeader(strings.Join(response.Header["Link"], ", ")).MatchRel("http://www.w3.org/ns/ldp#constrainedBy"), shapesDir+"contact-shapes.ttl")
+
+	request, err = http.NewRequest("PUT", testServer.URL+shapesDir+"contacts/bob", strings.NewReader(`<#me> a <http://www.w3.org/2006/vcard/ns#Individual> .`))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 422, response.StatusCode)
+	assert.Equal(t, "text/turtle", response.Header.Get("Content-Type"))
+	assert.Contains(t, ParseLinkHeader(strings.Join(response.Header["Link"], ", ")).MatchRel("http://www.w3.org/ns/ldp#constrainedBy"), shapesDir+"contact-shapes.ttl")
+
+	g := NewGraph(testServer.URL + shapesDir + "contacts/bob")
+	g.Parse(strings.NewReader(string(body)), "text/turtle")
+	assert.NotNil(t, g.One(nil, ns.rdf.Get("type"), ns.sh.Get("ValidationReport")))
+	assert.NotNil(t, g.One(nil, ns.sh.Get("sourceConstraintComponent"), ns.sh.Get("MinCountConstraintComponent")))
+
+	request, err = http.NewRequest("GET", testServer.URL+shapesDir+"contacts/bob", nil)
+	assert.NoError(t, err)
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 404, response.StatusCode)
+
+	// JSON-LD reports
+	request, err = http.NewRequest("PUT", testServer.URL+shapesDir+"contacts/bob", strings.NewReader(`<#me> a <http://www.w3.org/2006/vcard/ns#Individual> .`))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	request.Header.Add("Accept", "application/ld+json")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	body, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 422, response.StatusCode)
+	assert.Equal(t, "application/ld+json", response.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "http://www.w3.org/ns/shacl#ValidationReport")
+}
+
+func TestShapesPOST(t *testing.T) {
+	request, err := http.NewRequest("POST", testServer.URL+shapesDir+"contacts/", strings.NewReader(`<#me> a <http://www.w3.org/2006/vcard/ns#Individual> ;
+    <http://www.w3.org/2006/vcard/ns#fn> "Carol", "Caroline" .`))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	request.Header.Add("Slug", "carol")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 422, response.StatusCode)
+
+	request, err = http.NewRequest("POST", testServer.URL+shapesDir+"contacts/", strings.NewReader(`<#me> a <http://www.w3.org/2006/vcard/ns#Individual> ;
+    <http://www.w3.org/2006/vcard/ns#fn> "Carol" .`))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	request.Header.Add("Slug", "carol")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 201, response.StatusCode)
+	assert.Equal(t, testServer.URL+shapesDir+"contacts/carol", response.Header.Get("Location"))
+}
+
+func TestShapesPATCH(t *testing.T) {
+	sparqlData := `DELETE DATA { <#me> <http://www.w3.org/2006/vcard/ns#fn> "Alice" . }`
+	request, err := http.NewRequest("PATCH", testServer.URL+shapesDir+"contacts/alice", strings.NewReader(sparqlData))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/sparql-update")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 422, response.StatusCode)
+
+	sparqlData = `INSERT DATA { <#me> <http://www.w3.org/2006/vcard/ns#hasEmail> <mailto:alice@example.org> . }`
+	request, err = http.NewRequest("PATCH", testServer.URL+shapesDir+"contacts/alice", strings.NewReader(sparqlData))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "application/sparql-update")
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 200, response.StatusCode)
+}
+
+func TestShapesReadAccess(t *testing.T) {
+	shapes := testServer.URL + shapesDir + "contact-shapes.ttl"
+	aclFile := "_test/shapes/contact-shapes.ttl" + config.ACLSuffix
+	err := ioutil.WriteFile(aclFile, []byte("@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n"+
+		"<#Owner> acl:accessTo <"+shapes+"> ;\n"+
+		"	acl:agent <https://owner.example/#me> ;\n"+
+		"	acl:mode acl:Read, acl:Write, acl:Control ."), 0644)
+	assert.NoError(t, err)
+	defer os.Remove(aclFile)
+
+	// writers are only constrained by shapes they can read
+	dave := `<#me> a <http://www.w3.org/2006/vcard/ns#Individual> ;
+    <http://www.w3.org/2006/vcard/ns#fn> "Dave" .`
+	assert.Equal(t, 401, wacDo(t, httpClient, "PUT", testServer.URL+shapesDir+"contacts/dave", dave))
+	_, err = os.Stat("_test/shapes/contacts/dave")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShapesCleanup(t *testing.T) {
+	for _, path := range []string{"contacts/alice", "contacts/carol", "contacts/.meta", "contacts/", "contact-shapes.ttl", ""} {
+		request, err := http.NewRequest("DELETE", testServer.URL+shapesDir+path, nil)
+		assert.NoError(t, err)
+		response, err := httpClient.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, 200, response.StatusCode)
+	}
+}
@@ -0,0 +1,367 @@
+package gold
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// streamFlushSize is the number of triples written between two flushes
+	streamFlushSize = 512
+)
+
+// GraphWriter writes triples one at a time, without building the whole document in memory
+type GraphWriter interface {
+	WriteTriple(*Triple) error
+	Close() error
+}
+
+var streamWriters = map[string]func(io.Writer, string) GraphWriter{
+	"text/turtle":           newTurtleWriter,
+	"application/n-triples": newNTriplesWriter,
+	"application/ld+json":   newJSONLDWriter,
+}
+
+// NewGraphWriter returns a streaming writer for the given mime type (nil if the type cannot be streamed)
+func NewGraphWriter(w io.Writer, mime string, base string) GraphWriter {
+	newWriter, ok := streamWriters[mime]
+	if !ok {
+		return nil
+	}
+	return newWriter(w, base)
+}
+
+// Stream writes the graph to w using the serializer for the given mime type,
+// flushing periodically and stopping as soon as ctx is done (e.g. client disconnect)
+func (g *Graph) Stream(ctx context.Context, w io.Writer, mime string) error {
+	bw := bufio.NewWriter(w)
+	flush := func() error {
+		err := bw.Flush()
+		if f, ok := w.(http.Flusher); ok && err == nil {
+			f.Flush()
+		}
+		return err
+	}
+
+	gw := NewGraphWriter(bw, mime, g.uri)
+	if gw == nil {
+		// fall back to raptor for the other serializations
+		data, err := g.Serialize(mime)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(bw, data); err != nil {
+			return err
+		}
+		return flush()
+	}
+
+	for i, triple := range g.sortedTriples() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := gw.WriteTriple(triple); err != nil {
+			return err
+		}
+		if (i+1)%streamFlushSize == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// sortedTriples returns the triples of the graph grouped by subject and predicate
+func (g *Graph) sortedTriples() []*Triple {
+	triples := make([]*Triple, 0, len(g.triples))
+	for triple := range g.triples {
+		triples = append(triples, triple)
+	}
+	sort.Slice(triples, func(i, j int) bool {
+		a, b := triples[i], triples[j]
+		if s1, s2 := termKey(a.Subject), termKey(b.Subject); s1 != s2 {
+			return s1 < s2
+		}
+		if p1, p2 := termKey(a.Predicate), termKey(b.Predicate); p1 != p2 {
+			return p1 < p2
+		}
+		return termKey(a.Object) < termKey(b.Object)
+	})
+	return triples
+}
+
+// termKey returns the raw value of a term, used for sorting
+func termKey(t Term) string {
+	switch t := t.(type) {
+	case *Resource:
+		return t.URI
+	case *BlankNode:
+		return "_:" + t.ID
+	case *Literal:
+		return t.String()
+	}
+	return ""
+}
+
+type ntriplesWriter struct {
+	w io.Writer
+}
+
+func newNTriplesWriter(w io.Writer, base string) GraphWriter {
+	return &ntriplesWriter{w: w}
+}
+
+func (nt *ntriplesWriter) WriteTriple(t *Triple) error {
+	_, err := io.WriteString(nt.w, t.String()+"\n")
+	return err
+}
+
+func (nt *ntriplesWriter) Close() error {
+	return nil
+}
+
+type turtleWriter struct {
+	w        io.Writer
+	base     string
+	prefixes map[string]string
+	started  bool
+	subject  Term
+	property Term
+}
+
+func newTurtleWriter(w io.Writer, base string) GraphWriter {
+	return &turtleWriter{
+		w:    w,
+		base: base,
+		prefixes: map[string]string{
+			"rdf": string(ns.rdf),
+		},
+	}
+}
+
+// header writes the prefix declarations, sorted by prefix
+func (tw *turtleWriter) header() error {
+	tw.started = true
+	names := make([]string, 0, len(tw.prefixes))
+	for name := range tw.prefixes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := ""
+	for _, name := range names {
+		out += "@prefix " + name + ": <" + tw.prefixes[name] + "> .\n"
+	}
+	_, err := io.WriteString(tw.w, out+"\n")
+	return err
+}
+
+// WriteTriple expects triples grouped by subject and predicate
+func (tw *turtleWriter) WriteTriple(t *Triple) error {
+	var (
+		out string
+		err error
+	)
+	if !tw.started {
+		if err = tw.header(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case tw.subject != nil && tw.subject.Equal(t.Subject) && tw.property.Equal(t.Predicate):
+		out = ", " + tw.term(t.Object)
+	case tw.subject != nil && tw.subject.Equal(t.Subject):
+		out = " ;\n    " + tw.predicate(t.Predicate) + " " + tw.term(t.Object)
+	default:
+		if tw.subject != nil {
+			out = " .\n\n"
+		}
+		out += tw.term(t.Subject) + "\n    " + tw.predicate(t.Predicate) + " " + tw.term(t.Object)
+	}
+	tw.subject, tw.property = t.Subject, t.Predicate
+	_, err = io.WriteString(tw.w, out)
+	return err
+}
+
+func (tw *turtleWriter) Close() error {
+	if !tw.started {
+		return tw.header()
+	}
+	if tw.subject != nil {
+		_, err := io.WriteString(tw.w, " .\n\n")
+		return err
+	}
+	return nil
+}
+
+func (tw *turtleWriter) predicate(t Term) string {
+	if t.Equal(ns.rdf.Get("type")) {
+		return "a"
+	}
+	return tw.term(t)
+}
+
+// term returns the turtle representation of a term, using the prefixes and
+// the base URI when possible
+func (tw *turtleWriter) term(t Term) string {
+	switch t := t.(type) {
+	case *Literal:
+		if len(t.Language) == 0 && t.Datatype != nil {
+			lit := *t
+			lit.Datatype = nil
+			return lit.String() + "^^" + tw.term(t.Datatype)
+		}
+		return t.String()
+	case *Resource:
+		return tw.uri(t.URI)
+	}
+	return t.String()
+}
+
+func (tw *turtleWriter) uri(uri string) string {
+	if len(tw.base) > 0 && uri == tw.base {
+		return "<>"
+	}
+	if name, ok := tw.prefixed(uri); ok {
+		return name
+	}
+	if len(tw.base) > 0 && strings.HasPrefix(uri, tw.base+"#") {
+		return brack(uri[len(tw.base):])
+	}
+	if i := strings.LastIndex(tw.base, "/"); i > len("https://") {
+		if dir := tw.base[:i+1]; strings.HasPrefix(uri, dir) {
+			if rel := relativeTo(uri[len(dir):]); resolves(tw.base, rel, uri) {
+				return brack(rel)
+			}
+		}
+	}
+	return brack(uri)
+}
+
+// relativeTo returns the reference of a path relative to the document directory, adding
+// a leading "./" where the path alone would point to the document or look like a scheme
+func relativeTo(path string) string {
+	slash := strings.Index(path, "/")
+	if slash < 0 {
+		slash = len(path)
+	}
+	if len(path) == 0 || path[0] == '#' || path[0] == '?' || strings.Contains(path[:slash], ":") {
+		return "./" + path
+	}
+	return path
+}
+
+// resolves checks that a relative reference resolves to uri against base, so that it
+// can be written in place of uri
+func resolves(base string, rel string, uri string) bool {
+	b, err := url.Parse(base)
+	if err != nil {
+		return false
+	}
+	r, err := url.Parse(rel)
+	if err != nil {
+		return false
+	}
+	return b.ResolveReference(r).String() == uri
+}
+
+// prefixed returns the prefixed name of a URI, using the longest matching namespace
+func (tw *turtleWriter) prefixed(uri string) (string, bool) {
+	name, match := "", ""
+	for prefix, namespace := range tw.prefixes {
+		if len(namespace) == 0 || !strings.HasPrefix(uri, namespace) || !isLocalName(uri[len(namespace):]) {
+			continue
+		}
+		if len(namespace) > len(match) || (len(namespace) == len(match) && prefix < name) {
+			name, match = prefix, namespace
+		}
+	}
+	if len(match) == 0 {
+		return "", false
+	}
+	return name + ":" + uri[len(match):], true
+}
+
+// isLocalName checks if a string can be used as the local part of a prefixed name
+func isLocalName(s string) bool {
+	if len(s) == 0 || s[0] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+type jsonldWriter struct {
+	w     io.Writer
+	count int
+}
+
+func newJSONLDWriter(w io.Writer, base string) GraphWriter {
+	return &jsonldWriter{w: w}
+}
+
+func (jw *jsonldWriter) WriteTriple(t *Triple) error {
+	one := map[string]interface{}{
+		"@id": termKey(t.Subject),
+	}
+	switch o := t.Object.(type) {
+	case *Resource:
+		one[termKey(t.Predicate)] = []map[string]string{
+			{
+				"@id": o.URI,
+			},
+		}
+	case *BlankNode:
+		one[termKey(t.Predicate)] = []map[string]string{
+			{
+				"@id": termKey(o),
+			},
+		}
+	case *Literal:
+		v := map[string]string{
+			"@value": o.Value,
+		}
+		if o.Datatype != nil && len(o.Datatype.String()) > 0 {
+			v["@type"] = o.Datatype.String()
+		}
+		if len(o.Language) > 0 {
+			v["@language"] = o.Language
+		}
+		one[termKey(t.Predicate)] = []map[string]string{v}
+	}
+	b, err := json.Marshal(one)
+	if err != nil {
+		return err
+	}
+	sep := ","
+	if jw.count == 0 {
+		sep = "["
+	}
+	jw.count++
+	_, err = io.WriteString(jw.w, sep+string(b))
+	return err
+}
+
+func (jw *jsonldWriter) Close() error {
+	end := "]"
+	if jw.count == 0 {
+		end = "[]"
+	}
+	_, err := io.WriteString(jw.w, end)
+	return err
+}
@@ -3,6 +3,7 @@ package gold
 import (
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -46,6 +47,20 @@ type statusResponse struct {
 	Response  accountResponse `json:"response"`
 }
 
+type permissionGrant struct {
+	Allowed       bool   `json:"allowed"`
+	Status        int    `json:"status"`
+	ACL           string `json:"acl,omitempty"`
+	Authorization string `json:"authorization,omitempty"`
+}
+
+type permissionsResponse struct {
+	URI   string                     `json:"uri"`
+	WebID string                     `json:"webid"`
+	Modes []string                   `json:"modes"`
+	Grant map[string]permissionGrant `json:"grants"`
+}
+
 type accountInformation struct {
 	DiskUsed  string
 	DiskLimit string
@@ -53,9 +68,14 @@ type accountInformation struct {
 
 // HandleSystem is a router for system specific APIs
 func HandleSystem(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
-	if strings.HasSuffix(req.Request.URL.Path, "status") {
+	if req.Request.URL.Path == oidcDiscoveryPath || strings.Contains(req.Request.URL.Path, "/"+oidcPrefix+"/") {
+		return HandleOIDC(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "status") {
 		// unsupported yet when server is running on one host
 		return accountStatus(w, req, s)
+	} else if len(req.Delegations) > 0 || req.Token != nil || req.AuthMethod == "DPoP" || req.AuthMethod == "HTTP-Signature" {
+		// delegates, bearer tokens and the tokens or keys of apps act on resources, they cannot manage the account
+		return SystemReturn{Status: 403, Body: "Delegated, token and app requests cannot manage the account"}
 	} else if strings.HasSuffix(req.Request.URL.Path, "new") {
 		return newAccount(w, req, s)
 	} else if strings.HasSuffix(req.Request.URL.Path, "cert") {
@@ -68,17 +88,36 @@ func HandleSystem(w http.ResponseWriter, req *httpRequest, s *Server) SystemRetu
 		return accountTokens(w, req, s)
 	} else if strings.HasSuffix(req.Request.URL.Path, "recovery") {
 		return accountRecovery(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "permissions") {
+		return accountPermissions(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "capabilities") {
+		return accountCapabilities(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "audit") {
+		return accountAudit(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "profilecache") {
+		return accountProfileCache(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "sessions") {
+		return accountSessions(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "totp") {
+		return accountTOTP(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "delegations") {
+		return accountDelegations(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "export") {
+		return accountExport(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "import") {
+		return accountImport(w, req, s)
+	} else if strings.HasSuffix(req.Request.URL.Path, "admin") {
+		return accountAdmin(w, req, s)
 	}
 	return SystemReturn{Status: 200}
 }
 
 func logOut(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
-	s.userCookieDelete(w)
+	req.userCookieDelete(w)
 	return SystemReturn{Status: 200, Body: "You have been signed out!"}
 }
 
 func logIn(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
-	var passL string
 	redirTo := req.FormValue("redirect")
 	origin := req.FormValue("origin")
 
@@ -91,7 +130,7 @@ func logIn(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
 			"origin": origin,
 		}
 		// refresh cookie
-		err := s.userCookieSet(w, req.User)
+		err := req.userCookieSet(w, req.User)
 		if err != nil {
 			s.debug.Println("Error setting new cookie: " + err.Error())
 			return SystemReturn{Status: 500, Body: err.Error()}
@@ -112,43 +151,46 @@ func logIn(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
 		return SystemReturn{Status: 200, Body: LoginTemplate(redirTo, origin, webid)}
 	}
 
-	if len(webid) == 0 && len(passF) == 0 {
-		return SystemReturn{Status: 409, Body: "You must supply a valid WebID and password."}
-	}
-	resource, err := req.pathInfo(req.BaseURI())
-	if err != nil {
-		s.debug.Println("PathInfo error: " + err.Error())
-		return SystemReturn{Status: 500, Body: err.Error()}
-	}
-	// try to fetch hashed password from root ,acl
-	resource, _ = req.pathInfo(resource.Base)
-	kb := NewGraph(resource.AclURI)
-	kb.ReadFile(resource.AclFile)
-	s.debug.Println("Looking for password in", resource.AclFile)
-	// find the policy containing root acl
-	for _, m := range kb.All(nil, ns.acl.Get("mode"), ns.acl.Get("Control")) {
-		p := kb.One(m.Subject, ns.acl.Get("password"), nil)
-		if p != nil && kb.One(m.Subject, ns.acl.Get("agent"), NewResource(webid)) != nil {
-			passL = unquote(p.Object.String())
-			break
+	// the password was already checked if the second factor is pending
+	totpToken := req.FormValue("totptoken")
+	if len(totpToken) > 0 {
+		values, err := ValidateSecureToken("TOTPLogin", totpToken, s)
+		if err == nil {
+			err = IsTokenDateValid(values["valid"])
+		}
+		if err != nil {
+			return SystemReturn{Status: 403, Body: "Access denied! The login has expired, please try again."}
+		}
+		webid = values["webid"]
+	} else {
+		if len(webid) == 0 && len(passF) == 0 {
+			return SystemReturn{Status: 409, Body: "You must supply a valid WebID and password."}
+		}
+		status, err := req.checkPassword(webid, passF)
+		if err != nil {
+			setRetryAfter(w, err)
+			return SystemReturn{Status: status, Body: err.Error()}
 		}
-	}
-	// exit if no pass
-	if len(passL) == 0 {
-		s.debug.Println("Access denied! Could not find a password for WebID: " + webid)
-		return SystemReturn{Status: 403, Body: "Access denied! Could not find a password for WebID: " + webid}
 	}
 
-	// check if passwords match
-	passF = saltedPassword(s.Config.Salt, passF)
-	if passF != passL {
-		s.debug.Println("Access denied! Bad WebID or password.")
-		return SystemReturn{Status: 403, Body: "Access denied! Bad WebID or password."}
+	status, err := req.checkSecondFactor(webid)
+	if err != nil {
+		if len(totpToken) == 0 {
+			t := time.Duration(s.Config.TokenAge) * time.Minute
+			totpToken, err = NewSecureToken("TOTPLogin", map[string]string{"webid": webid}, t, s)
+			if err != nil {
+				return SystemReturn{Status: 500, Body: err.Error()}
+			}
+			// ask for the code, without requiring the password again
+			return SystemReturn{Status: 200, Body: TOTPTemplate(redirTo, origin, totpToken, "")}
+		}
+		setRetryAfter(w, err)
+		return SystemReturn{Status: status, Body: TOTPTemplate(redirTo, origin, totpToken, err.Error())}
 	}
 
 	// auth OK
 	// also set cookie now
-	err = s.userCookieSet(w, webid)
+	err = req.userCookieSet(w, webid)
 	if err != nil {
 		s.debug.Println("Error setting new cookie: " + err.Error())
 		return SystemReturn{Status: 500, Body: err.Error()}
@@ -167,6 +209,105 @@ func logIn(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
 	return SystemReturn{Status: 200}
 }
 
+// checkPassword verifies the password of a WebID against the one stored in the root ACL
+func (req *httpRequest) checkPassword(webid string, pass string) (int, error) {
+	s := req.Server
+	resource, err := req.pathInfo(req.BaseURI())
+	if err != nil {
+		s.debug.Println("PathInfo error: " + err.Error())
+		return 500, err
+	}
+	resource, _ = req.pathInfo(resource.Base)
+	host := hostOf(resource.URI)
+
+	keys := []string{webidAttemptKey("login", webid), ipAttemptKey("login", req)}
+	lockout, err := s.reserveAttempt(host, keys...)
+	if err != nil {
+		s.debug.Println("Login throttled for " + webid + ": " + err.Error())
+		status := throttleStatus(err)
+		s.auditLogin(req, "Login", webid, status, err)
+		return status, err
+	}
+
+	status, err := req.matchPassword(resource, webid, pass)
+	switch {
+	case status == 200:
+		if ferr := s.releaseAttempt(host, keys[1]); ferr != nil {
+			s.debug.Println("Could not release the login attempt of " + webid + ": " + ferr.Error())
+		}
+		if err = s.clearAttempts(host, keys[0]); err != nil {
+			s.debug.Println("Could not clear the failed logins of " + webid + ": " + err.Error())
+		}
+		s.auditLogin(req, "Login", webid, status, nil)
+		return status, nil
+	case status == 403:
+		if lockout != nil {
+			s.debug.Println(lockout.Error())
+			s.auditLogin(req, "Login", webid, status, lockout)
+		} else {
+			s.auditLogin(req, "Login", webid, status, err)
+		}
+	default:
+		// the password was not checked
+		if ferr := s.releaseAttempt(host, keys...); ferr != nil {
+			s.debug.Println("Could not release the login attempt of " + webid + ": " + ferr.Error())
+		}
+	}
+	return status, err
+}
+
+// matchPassword checks the password of the WebID for the account at resource
+func (req *httpRequest) matchPassword(resource *pathInfo, webid string, pass string) (int, error) {
+	s := req.Server
+	cred, err := s.getCredential(hostOf(resource.URI), webid)
+	if err != nil {
+		s.debug.Println("Credential store error: " + err.Error())
+		return 503, err
+	}
+	if cred != nil {
+		ok, err := verifyPassword(cred.Hash, pass)
+		if err != nil {
+			s.debug.Println("Password hash error: " + err.Error())
+			return 500, err
+		}
+		if !ok {
+			s.debug.Println("Access denied! Bad WebID or password.")
+			return 403, errors.New("Access denied! Bad WebID or password.")
+		}
+		return 200, nil
+	}
+
+	// try to fetch a hashed password from the root ,acl, as kept by older versions
+	kb := NewGraph(resource.AclURI)
+	kb.ReadFile(resource.AclFile)
+	s.debug.Println("Looking for password in", resource.AclFile)
+	passL := legacyPassword(kb, webid)
+	// exit if no pass
+	if len(passL) == 0 {
+		s.debug.Println("Access denied! Could not find a password for WebID: " + webid)
+		return 403, errors.New("Access denied! Could not find a password for WebID: " + webid)
+	}
+
+	// check if passwords match
+	if subtle.ConstantTimeCompare([]byte(saltedPassword(s.Config.Salt, pass)), []byte(passL)) != 1 {
+		s.debug.Println("Access denied! Bad WebID or password.")
+		return 403, errors.New("Access denied! Bad WebID or password.")
+	}
+
+	// move the password to the credential store
+	err = s.setPassword(resource.URI, webid, pass)
+	if err != nil {
+		s.debug.Println("Could not migrate the password of " + webid + ": " + err.Error())
+		return 200, nil
+	}
+	err = stripPasswords(resource.AclURI, resource.AclFile, webid)
+	if err != nil {
+		s.debug.Println("Could not remove passwords from " + resource.AclFile + ": " + err.Error())
+	}
+	s.debug.Println("Migrated the password of " + webid + " to the credential store")
+	return 200, nil
+}
+
 func loginRedirect(w http.ResponseWriter, req *httpRequest, s *Server, values map[string]string, redirTo string) SystemReturn {
 	key := ""
 	// try to get existing token
@@ -215,6 +356,19 @@ func sendRecoveryToken(w http.ResponseWriter, req *httpRequest, s *Server) Syste
 	}
 	// try to fetch recovery email from root ,acl
 	resource, _ = req.pathInfo(resource.Base)
+
+	// every request counts against the client, so that the endpoint cannot be used to flood
+	// the owner with emails. The WebID is not throttled, or anyone could lock its owner out
+	// of recovery.
+	host := hostOf(resource.URI)
+	if _, err = s.reserveAttempt(host, ipAttemptKey("recovery", req)); err != nil {
+		s.debug.Println("Recovery throttled for " + webid + ": " + err.Error())
+		setRetryAfter(w, err)
+		status := throttleStatus(err)
+		s.auditLogin(req, "Recovery", webid, status, err)
+		return SystemReturn{Status: status, Body: err.Error()}
+	}
+
 	email := ""
 	kb := NewGraph(resource.AclURI)
 	kb.ReadFile(resource.AclFile)
@@ -258,6 +412,19 @@ func sendRecoveryToken(w http.ResponseWriter, req *httpRequest, s *Server) Syste
 }
 
 func validateRecoveryToken(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	resource, _ := req.pathInfo(req.BaseURI())
+	accountBase := resource.Base + "/"
+	resource, _ = req.pathInfo(accountBase)
+	host := hostOf(resource.URI)
+
+	ipKey := ipAttemptKey("recovery", req)
+	if _, err := s.reserveAttempt(host, ipKey); err != nil {
+		s.debug.Println("Recovery throttled: " + err.Error())
+		setRetryAfter(w, err)
+		status := throttleStatus(err)
+		s.auditLogin(req, "Recovery", "", status, err)
+		return SystemReturn{Status: status, Body: err.Error()}
+	}
 	token, err := decodeQuery(req.FormValue("token"))
 	if err != nil {
 		s.debug.Println("Decode query err: " + err.Error())
@@ -267,8 +434,13 @@ func validateRecoveryToken(w http.ResponseWriter, req *httpRequest, s *Server) S
 	err = s.cookie.Decode("Recovery", token, &value)
 	if err != nil {
 		s.debug.Println("Decoding err: " + err.Error())
+		s.auditLogin(req, "Recovery", "", 500, err)
 		return SystemReturn{Status: 500, Body: err.Error()}
 	}
+	// only bad tokens count against the client
+	if err = s.releaseAttempt(host, ipKey); err != nil {
+		s.debug.Println("Could not release the recovery attempt: " + err.Error())
+	}
 
 	if len(value["valid"]) == 0 {
 		return SystemReturn{Status: 499, Body: "Missing validity date for token."}
@@ -277,9 +449,25 @@ func validateRecoveryToken(w http.ResponseWriter, req *httpRequest, s *Server) S
 	if err != nil {
 		return SystemReturn{Status: 500, Body: err.Error()}
 	}
-	// also set cookie now
+	// the token alone does not log in accounts with a second factor
 	webid := value["webid"]
-	err = s.userCookieSet(w, webid)
+	status, err := req.checkSecondFactor(webid)
+	if err == errSecondFactorRequired {
+		return SystemReturn{Status: 200, Body: NewPassTemplate(token, true, "")}
+	} else if err != nil {
+		setRetryAfter(w, err)
+		return SystemReturn{Status: status, Body: NewPassTemplate(token, true, err.Error())}
+	}
+	secondFactor := len(req.FormValue("otp")) > 0
+
+	// the token proves control of the account, so release any lockout
+	err = s.clearAttempts(host, webidAttemptKey("login", webid), ipAttemptKey("login", req), ipKey)
+	if err != nil {
+		s.debug.Println("Could not release the lockout of " + webid + ": " + err.Error())
+	}
+	s.auditLogin(req, "Recovery", webid, 200, nil)
+	// also set cookie now
+	err = req.userCookieSet(w, webid)
 	if err != nil {
 		s.debug.Println("Error setting new cookie: " + err.Error())
 		return SystemReturn{Status: 500, Body: err.Error()}
@@ -290,51 +478,28 @@ func validateRecoveryToken(w http.ResponseWriter, req *httpRequest, s *Server) S
 	if len(pass) > 0 && len(verif) > 0 {
 		if pass != verif {
 			// passwords don't match,
-			return SystemReturn{Status: 200, Body: NewPassTemplate(token, "Passwords do not match!")}
+			return SystemReturn{Status: 200, Body: NewPassTemplate(token, secondFactor, "Passwords do not match!")}
 		}
 		// save new password
-		resource, _ := req.pathInfo(req.BaseURI())
-		accountBase := resource.Base + "/"
-		resource, _ = req.pathInfo(accountBase)
-
-		g := NewGraph(resource.AclURI)
-		g.ReadFile(resource.AclFile)
-		// find the policy containing root acl
-		for _, m := range g.All(nil, ns.acl.Get("mode"), ns.acl.Get("Control")) {
-			p := g.One(m.Subject, ns.acl.Get("agent"), NewResource(webid))
-			if p != nil {
-				passT := g.One(nil, ns.acl.Get("password"), nil)
-				// remove old password
-				if passT != nil {
-					g.Remove(passT)
-				}
-			}
-			// add new password
-			g.AddTriple(m.Subject, ns.acl.Get("password"), NewLiteral(saltedPassword(s.Config.Salt, pass)))
-
-			// write account acl to disk
-			// open account acl file
-			f, err := os.OpenFile(resource.AclFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-			if err != nil {
-				s.debug.Println("Could not open file to save new password. Error: " + err.Error())
-				return SystemReturn{Status: 500, Body: err.Error()}
-			}
-			defer f.Close()
-			err = g.WriteFile(f, "text/turtle")
-			if err != nil {
-				s.debug.Println("Could not save account acl file with new password. Error: " + err.Error())
-				return SystemReturn{Status: 500, Body: err.Error()}
-			}
-			// All set
-			return SystemReturn{Status: 200, Body: "Password saved!"}
-			break
+		err = s.setPassword(resource.URI, webid, pass)
+		if err != nil {
+			s.debug.Println("Could not save new password. Error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
 		}
+		// drop the passwords kept in the account acl by older versions
+		err = stripPasswords(resource.AclURI, resource.AclFile, webid)
+		if err != nil {
+			s.debug.Println("Could not remove passwords from " + resource.AclFile + ". Error: " + err.Error())
+		}
+		// All set
+		return SystemReturn{Status: 200, Body: "Password saved!"}
 	}
 
-	return SystemReturn{Status: 200, Body: NewPassTemplate(token, "")}
+	return SystemReturn{Status: 200, Body: NewPassTemplate(token, secondFactor, "")}
 }
 
-func newAccount(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+// newAccountBase returns the base URI of the account of the given user on this host
+func (req *httpRequest) newAccountBase(username string) string {
 	resource, _ := req.pathInfo(req.BaseURI())
 	host, port, _ := net.SplitHostPort(req.Host)
 	if len(host) == 0 {
@@ -345,18 +510,26 @@ func newAccount(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn
 	}
 
 	accountBase := resource.Base + "/"
-
-	username := strings.ToLower(req.FormValue("username"))
+	username = strings.ToLower(username)
 	if !strings.HasPrefix(host, username) {
 		accountBase = resource.Base + "/" + username + "/"
-		if s.Config.Vhosts == true {
+		if req.Server.Config.Vhosts == true {
 			accountBase = "https://" + username + "." + host + port + "/"
 		}
 	}
+	return accountBase
+}
 
+func newAccount(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.FormValue("password")) > 0 && s.BoltDB == nil {
+		s.debug.Println("Cannot save the password: " + errNoCredentialStore.Error())
+		return SystemReturn{Status: 503, Body: errNoCredentialStore.Error()}
+	}
+
+	accountBase := req.newAccountBase(req.FormValue("username"))
 	webidURL := accountBase + "profile/card"
 	webidURI := webidURL + "#me"
-	resource, _ = req.pathInfo(accountBase)
+	resource, _ := req.pathInfo(accountBase)
 
 	account := webidAccount{
 		Root:          resource.Root,
@@ -407,6 +580,8 @@ func newAccount(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn
 
 	// Generate WebID profile graph for this account
 	g := NewWebIDProfile(account)
+	// advertise the built-in identity provider
+	g.AddTriple(NewResource(account.WebID), ns.st.Get("oidcIssuer"), NewResource(account.BaseURI))
 
 	// write WebID profile to disk
 	err = g.WriteFile(f, "text/turtle")
@@ -468,9 +643,6 @@ func newAccount(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn
 	g.AddTriple(aclTerm, ns.acl.Get("accessTo"), NewResource(resource.URI))
 	g.AddTriple(aclTerm, ns.acl.Get("accessTo"), NewResource(resource.AclURI))
 	g.AddTriple(aclTerm, ns.acl.Get("agent"), NewResource(webidURI))
-	if len(req.FormValue("password")) > 0 {
-		g.AddTriple(aclTerm, ns.acl.Get("password"), NewLiteral(saltedPassword(s.Config.Salt, req.FormValue("password"))))
-	}
 	if len(req.FormValue("email")) > 0 {
 		g.AddTriple(aclTerm, ns.acl.Get("agent"), NewResource("mailto:"+req.FormValue("email")))
 	}
@@ -493,8 +665,25 @@ func newAccount(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn
 		return SystemReturn{Status: 500, Body: err.Error()}
 	}
 
+	// keep a record of the account for the administrators
+	if s.BoltDB != nil {
+		err = s.putAccount(&accountRecord{Base: accountBase, WebID: webidURI, Created: time.Now().UTC()})
+		if err != nil {
+			s.debug.Println("Saving account record error: " + err.Error())
+		}
+	}
+
+	// save the password in the credential store
+	if len(req.FormValue("password")) > 0 {
+		err = s.setPassword(resource.URI, webidURI, req.FormValue("password"))
+		if err != nil {
+			s.debug.Println("Saving password error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+	}
+
 	// Authenticate the user (set cookie)
-	err = s.userCookieSet(w, webidURI)
+	err = req.userCookieSet(w, webidURI)
 	if err != nil {
 		s.debug.Println("Error setting new cookie: " + err.Error())
 		return SystemReturn{Status: 500, Body: err.Error()}
@@ -699,6 +888,9 @@ func accountTokens(w http.ResponseWriter, req *httpRequest, s *Server) SystemRet
 	if !req.IsOwner {
 		return SystemReturn{Status: 403, Body: "You are not allowed to view this page"}
 	}
+	if req.Method != "GET" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		return accountTokensJSON(w, req, s)
+	}
 
 	tokensHtml := "<div>"
 
@@ -731,6 +923,68 @@ func accountTokens(w http.ResponseWriter, req *httpRequest, s *Server) SystemRet
 	return SystemReturn{Status: 200, Body: TokensTemplate(tokensHtml)}
 }
 
+// accountPermissions reports the effective modes of a WebID (the current user by
+// default) on a resource, and which ACL file and authorization granted them.
+// Checking the permissions of someone else requires Control over the resource.
+func accountPermissions(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	base, _ := req.pathInfo(req.BaseURI())
+	uri := req.FormValue("uri")
+	if len(uri) == 0 {
+		return SystemReturn{Status: 400, Body: "Missing uri parameter"}
+	}
+	if uri != base.Base && !strings.HasPrefix(uri, base.Base+"/") {
+		return SystemReturn{Status: 400, Body: "The resource " + uri + " is not hosted on this server"}
+	}
+	resource, err := req.pathInfo(uri)
+	if err != nil {
+		s.debug.Println("PathInfo error: " + err.Error())
+		return SystemReturn{Status: 400, Body: err.Error()}
+	}
+
+	webid := req.FormValue("webid")
+	if len(webid) == 0 {
+		webid = req.User
+	}
+	if webid != req.User {
+		if len(req.User) == 0 {
+			return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+		}
+		status, err := NewWAC(req, s, nil, req.User, "").AllowControl(resource.URI)
+		if status != 200 || err != nil {
+			return SystemReturn{Status: 403, Body: "You need Control access to " + resource.URI + " to check the permissions of " + webid}
+		}
+	}
+
+	res := permissionsResponse{
+		URI:   resource.URI,
+		WebID: webid,
+		Modes: []string{},
+		Grant: map[string]permissionGrant{},
+	}
+	acl := NewWAC(req, s, nil, webid, "")
+	for _, mode := range wacModes {
+		status, err := acl.allow(mode, resource.URI)
+		grant := permissionGrant{
+			Allowed:       status == 200 && err == nil,
+			Status:        status,
+			ACL:           acl.grantACL,
+			Authorization: acl.grantAuth,
+		}
+		if grant.Allowed {
+			res.Modes = append(res.Modes, strings.ToLower(mode))
+		}
+		res.Grant[strings.ToLower(mode)] = grant
+	}
+
+	jsonData, err := json.Marshal(res)
+	if err != nil {
+		s.debug.Println("Marshal error: " + err.Error())
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	w.Header().Set(HCType, "application/json")
+	return SystemReturn{Status: 200, Body: string(jsonData)}
+}
+
 // DiskUsage returns the total size occupied by dir and contents
 func DiskUsage(dirPath string) (int64, error) {
 	var totalSize int64
@@ -750,6 +1004,11 @@ func (s *Server) StartBolt() error {
 	if err != nil {
 		return err
 	}
+	if err = indexSessions(s.BoltDB); err != nil {
+		s.BoltDB.Close()
+		return err
+	}
+	go s.sweepTokensEvery(s.BoltDB, tokenSweepInterval)
 	return nil
 }
 
@@ -768,6 +1027,7 @@ func (s *Server) newPersistedToken(tokenType, host string, values map[string]str
 		bucket, err := userBucket.CreateBucketIfNotExists([]byte(tokenType))
 		id, _ := bucket.NextSequence()
 		values["id"] = fmt.Sprintf("%d", id)
+		values["created"] = fmt.Sprintf("%d", time.Now().Unix())
 		// set validity if not alreay set
 		if len(values["valid"]) == 0 {
 			// age times the duration of 6 month
@@ -836,7 +1096,8 @@ func (s *Server) getTokenByOrigin(tokenType, host, origin string) (string, error
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
 			key := string(k)
 			values, err := s.getPersistedToken(tokenType, host, key)
-			if err == nil && values["origin"] == origin {
+			// tokens of the API are not handed out to applications
+			if err == nil && values["origin"] == origin && !tokenScoped(values) && IsTokenDateValid(values["valid"]) == nil {
 				token = key
 				break
 			}
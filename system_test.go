@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -50,7 +51,24 @@ func init() {
 	handler2 = NewServer(config2)
 }
 
+// startTestBolt opens a throwaway Bolt DB for the server, and returns a function closing it
+func startTestBolt(t *testing.T, s *Server, path string) func() {
+	boltPath := s.Config.BoltPath
+	s.Config.BoltPath = path
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	assert.NoError(t, err)
+	err = s.StartBolt()
+	assert.NoError(t, err)
+	return func() {
+		s.BoltDB.Close()
+		s.BoltDB = nil
+		s.Config.BoltPath = boltPath
+		os.Remove(path)
+	}
+}
+
 func TestNewAccountWithoutVhosts(t *testing.T) {
+	defer startTestBolt(t, handler2, "_test/accounts.db")()
 	ts := httptest.NewUnstartedServer(handler2)
 	ts.TLS = new(tls.Config)
 	ts.TLS.ClientAuth = tls.RequestClientCert
@@ -118,6 +136,7 @@ func TestNewAccountWithoutVhosts(t *testing.T) {
 }
 
 func TestNewAccountWithVhosts(t *testing.T) {
+	defer startTestBolt(t, handler1, "_test/accounts.db")()
 	ts := httptest.NewUnstartedServer(handler1)
 	ts.TLS = new(tls.Config)
 	ts.TLS.ClientAuth = tls.RequestClientCert
@@ -264,6 +283,7 @@ func TestNewAccountWithVhosts(t *testing.T) {
 // }
 
 func TestNewAccountWithoutSPKAC(t *testing.T) {
+	defer startTestBolt(t, handler1, "_test/accounts.db")()
 	testServer1 := httptest.NewUnstartedServer(handler1)
 	testServer1.TLS = new(tls.Config)
 	testServer1.TLS.ClientAuth = tls.RequestClientCert
@@ -326,6 +346,54 @@ func TestNewAccountWithoutSPKAC(t *testing.T) {
 // 	assert.NotEmpty(t, body)
 // }
 
+func TestAccountPassword(t *testing.T) {
+	defer startTestBolt(t, handler2, "_test/accounts.db")()
+	ts := httptest.NewUnstartedServer(handler2)
+	ts.TLS = new(tls.Config)
+	ts.TLS.ClientAuth = tls.RequestClientCert
+	ts.TLS.NextProtos = []string{"http/1.1"}
+	ts.StartTLS()
+	defer ts.Close()
+
+	response, _ := oidcDo(t, httpClient, "POST", ts.URL+"/"+SystemPrefix+"/new", url.Values{
+		"username": {"user"},
+		"password": {"zomg"},
+	}, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	webid := ts.URL + "/user/profile/card#me"
+
+	// the password is not kept in the account ACL
+	acl, err := ioutil.ReadFile(config2.DataRoot + "user/" + config2.ACLSuffix)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(acl), "password")
+
+	login := func(pass string) int {
+		response, _ := oidcDo(t, httpClient, "POST", ts.URL+"/user/"+SystemPrefix+"/login", url.Values{
+			"webid":    {webid},
+			"password": {pass},
+		}, nil)
+		return response.StatusCode
+	}
+	assert.Equal(t, 301, login("zomg"))
+	assert.Equal(t, 403, login("zomg2"))
+
+	// set a new password through a recovery token
+	token, err := NewSecureToken("Recovery", map[string]string{"webid": webid}, time.Minute, handler2)
+	assert.NoError(t, err)
+	response, body := oidcDo(t, httpClient, "POST", ts.URL+"/user/"+SystemPrefix+"/recovery", url.Values{
+		"token":      {token},
+		"password":   {"zomg2"},
+		"verifypass": {"zomg2"},
+	}, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "Password saved!", body)
+	assert.Equal(t, 403, login("zomg"))
+	assert.Equal(t, 301, login("zomg2"))
+
+	err = os.RemoveAll("_test/")
+	assert.NoError(t, err)
+}
+
 func TestAccountRecoveryForm(t *testing.T) {
 	request, err := http.NewRequest("POST", testServer.URL+"/"+SystemPrefix+"/recovery", nil)
 	assert.NoError(t, err)
@@ -1,5 +1,10 @@
 package gold
 
+import (
+	"html"
+	"net/url"
+)
+
 var (
 	// Apps contains a list of default apps that get server instead of RDF
 	Apps = map[string]string{
@@ -89,13 +94,22 @@ var (
 	}
 )
 
-func NewPassTemplate(token string, err string) string {
+// NewPassTemplate asks for a new password, and for a one-time code if otp is set
+func NewPassTemplate(token string, otp bool, err string) string {
+	code := ""
+	if otp {
+		code = `
+    One-time code from your authenticator app, or a recovery code:
+    <br>
+    <input type="text" name="otp" autocomplete="one-time-code" autofocus>
+    <br>`
+	}
 	template := `<!DOCTYPE html>
 <html id="docHTML">
 <body>
     <form method="POST" action="/` + SystemPrefix + `/recovery?token=` + token + `">
     <h2>Please provide a new password</h2>
-    <p style="color: red;">` + err + `</p>
+    <p style="color: red;">` + err + `</p>` + code + `
     Password:
     <br>
     <input type="password" name="password">
@@ -164,6 +178,81 @@ func UnauthorizedTemplate(redirTo, webid string) string {
 	return template
 }
 
+// OIDCLoginTemplate is the login form of the OpenID Provider
+func OIDCLoginTemplate(action, webid, err string) string {
+	template := `<!DOCTYPE html>
+<html id="docHTML">
+<body>
+    <form method="POST" action="` + html.EscapeString(action) + `">
+    <h2>Login</h2>
+    <p style="color: red;">` + html.EscapeString(err) + `</p>
+    WebID:
+    <br>
+    <input type="url" name="webid" value="` + html.EscapeString(webid) + `" autocorrect="off">
+    <br>
+    Password:
+    <br>
+    <input type="password" name="password" autofocus>
+    <br>
+    One-time code (if two-factor authentication is enabled):
+    <br>
+    <input type="text" name="otp" autocomplete="one-time-code" inputmode="numeric">
+    <br>
+    <input type="submit" value="Login">
+    </form>
+    <p><a href="/` + SystemPrefix + `/recovery">Forgot your password?</a></p>
+</body>
+</html>`
+
+	return template
+}
+
+// TOTPTemplate asks for the second factor of a login, once the password was checked
+func TOTPTemplate(redir, origin, token, err string) string {
+	template := `<!DOCTYPE html>
+<html id="docHTML">
+<body>
+    <form method="POST" action="/` + SystemPrefix + `/login?redirect=` + url.QueryEscape(redir) + `&origin=` + url.QueryEscape(origin) + `">
+    <h2>Two-factor authentication</h2>
+    <p style="color: red;">` + html.EscapeString(err) + `</p>
+    <input type="hidden" name="totptoken" value="` + html.EscapeString(token) + `">
+    One-time code from your authenticator app, or a recovery code:
+    <br>
+    <input type="text" name="otp" autocomplete="one-time-code" autofocus>
+    <br>
+    <input type="submit" value="Verify">
+    </form>
+</body>
+</html>`
+
+	return template
+}
+
+// ConsentTemplate asks the user to allow an application to use their WebID
+func ConsentTemplate(action, token, client, redirectURI, webid string, scopes []string) string {
+	items := ""
+	for _, scope := range scopes {
+		items += `
+        <li>` + html.EscapeString(scope) + `</li>`
+	}
+	template := `<!DOCTYPE html>
+<html id="docHTML">
+<body>
+    <form method="POST" action="` + html.EscapeString(action) + `">
+    <h2>Authorize ` + html.EscapeString(client) + `</h2>
+    <p>The application <strong>` + html.EscapeString(client) + `</strong> (` + html.EscapeString(redirectURI) + `) would like to log you in as ` + html.EscapeString(webid) + `, with the following scopes:</p>
+    <ul>` + items + `
+    </ul>
+    <input type="hidden" name="token" value="` + html.EscapeString(token) + `">
+    <button type="submit" name="consent" value="allow">Allow</button>
+    <button type="submit" name="consent" value="deny">Deny</button>
+    </form>
+</body>
+</html>`
+
+	return template
+}
+
 func LogoutTemplate(webid string) string {
 	template := `<!DOCTYPE html>
 <html id="docHTML">
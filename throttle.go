@@ -0,0 +1,311 @@
+package gold
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	loginAttemptType = "LoginAttempts"
+
+	// loginBackoff is the delay imposed after the second failure, doubled with every further failure
+	loginBackoff = time.Second
+)
+
+// loginAttempts holds the failed attempts of a WebID or a client IP
+type loginAttempts struct {
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`
+	Until    time.Time `json:"until"`
+	Locked   bool      `json:"locked,omitempty"`
+}
+
+// lockoutError is returned while a WebID or client IP has to wait before trying again
+type lockoutError struct {
+	Until  time.Time
+	Locked bool
+}
+
+func (e *lockoutError) Error() string {
+	if e.Locked {
+		return "Too many failed attempts! Access is locked until " + e.Until.Format(time.RFC3339) +
+			", or until the password is reset through account recovery."
+	}
+	return "Too many failed attempts! Please try again after " + e.Until.Format(time.RFC3339) + "."
+}
+
+// RetryAfter returns the number of seconds to wait
+func (e *lockoutError) RetryAfter() int {
+	secs := int(time.Until(e.Until)/time.Second) + 1
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// setRetryAfter sets the Retry-After header if err is a lockout
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if e, ok := err.(*lockoutError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter()))
+	}
+}
+
+// webidAttemptKey and ipAttemptKey name the failure counters
+func webidAttemptKey(kind string, webid string) string {
+	return kind + " webid " + webid
+}
+
+func ipAttemptKey(kind string, req *httpRequest) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	return kind + " ip " + ip
+}
+
+// maxFailures returns the number of failures after which a counter is locked
+func (s *Server) maxFailures(key string) int {
+	if strings.Contains(key, " ip ") {
+		return s.Config.LoginMaxFailuresIP
+	}
+	return s.Config.LoginMaxFailures
+}
+
+// throttleEnabled tells if failed attempts are tracked
+func (s *Server) throttleEnabled() bool {
+	return s.BoltDB != nil && s.Config.LoginMaxFailures > 0
+}
+
+// getAttempts returns the failure counters of the given keys on the host
+func (s *Server) getAttempts(host string, keys ...string) (map[string]*loginAttempts, error) {
+	res := make(map[string]*loginAttempts)
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(loginAttemptType))
+		if bucket == nil {
+			return nil
+		}
+		for _, key := range keys {
+			data := bucket.Get([]byte(key))
+			if data == nil {
+				continue
+			}
+			a := new(loginAttempts)
+			if err := json.Unmarshal(data, a); err != nil {
+				return err
+			}
+			res[key] = a
+		}
+		return nil
+	})
+	return res, err
+}
+
+// countFailure adds a failure to the counter of key, forgetting old failures once a lockout
+// period has passed without new ones
+func (s *Server) countFailure(a *loginAttempts, key string, now time.Time) {
+	if now.After(a.Until) && now.Sub(a.Last) > time.Duration(s.Config.LoginLockout)*time.Minute {
+		*a = loginAttempts{}
+	}
+	a.Failures++
+	a.Last = now
+	s.setBackoff(a, key)
+}
+
+// setBackoff sets how long the counter of key has to wait after its last failure
+func (s *Server) setBackoff(a *loginAttempts, key string) {
+	lockoutAge := time.Duration(s.Config.LoginLockout) * time.Minute
+	a.Locked, a.Until = false, time.Time{}
+	if a.Failures >= s.maxFailures(key) {
+		a.Locked = true
+		a.Until = a.Last.Add(lockoutAge)
+	} else if a.Failures > 1 {
+		delay := loginBackoff << uint(a.Failures-2)
+		if delay > lockoutAge {
+			delay = lockoutAge
+		}
+		a.Until = a.Last.Add(delay)
+	}
+}
+
+// updateAttempts applies fn to the failure counters of the keys in a single transaction, and
+// saves them (or removes the ones left without failures) unless fn returns an error
+func (s *Server) updateAttempts(host string, keys []string, fn func(attempts map[string]*loginAttempts) error) error {
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+		if err != nil {
+			return err
+		}
+		bucket, err := hostBucket.CreateBucketIfNotExists([]byte(loginAttemptType))
+		if err != nil {
+			return err
+		}
+		attempts := make(map[string]*loginAttempts, len(keys))
+		for _, key := range keys {
+			a := new(loginAttempts)
+			if data := bucket.Get([]byte(key)); data != nil {
+				if err = json.Unmarshal(data, a); err != nil {
+					return err
+				}
+			}
+			attempts[key] = a
+		}
+		if err = fn(attempts); err != nil {
+			return err
+		}
+		for key, a := range attempts {
+			if a.Failures <= 0 {
+				err = bucket.Delete([]byte(key))
+			} else {
+				var data []byte
+				if data, err = json.Marshal(a); err == nil {
+					err = bucket.Put([]byte(key), data)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recordFailure counts a failed attempt for each key, and returns the resulting lockout (if any)
+func (s *Server) recordFailure(host string, keys ...string) (*lockoutError, error) {
+	if !s.throttleEnabled() {
+		return nil, nil
+	}
+	var lockout *lockoutError
+	now := time.Now().UTC()
+	err := s.updateAttempts(host, keys, func(attempts map[string]*loginAttempts) error {
+		for key, a := range attempts {
+			s.countFailure(a, key, now)
+			if a.Locked && (lockout == nil || a.Until.After(lockout.Until)) {
+				lockout = &lockoutError{Until: a.Until, Locked: true}
+			}
+		}
+		return nil
+	})
+	return lockout, err
+}
+
+// reserveAttempt checks that none of the keys has to wait, and counts the attempt as a
+// failure in the same transaction, so that concurrent attempts cannot all pass the check.
+// It returns the lockout that applies if the attempt fails, and a lockoutError if the
+// attempt has to wait. Attempts that succeed are given back with releaseAttempt.
+func (s *Server) reserveAttempt(host string, keys ...string) (*lockoutError, error) {
+	if !s.throttleEnabled() {
+		return nil, nil
+	}
+	var lockout *lockoutError
+	now := time.Now().UTC()
+	err := s.updateAttempts(host, keys, func(attempts map[string]*loginAttempts) error {
+		var wait *lockoutError
+		for _, a := range attempts {
+			if now.Before(a.Until) && (wait == nil || a.Until.After(wait.Until)) {
+				wait = &lockoutError{Until: a.Until, Locked: a.Locked}
+			}
+		}
+		if wait != nil {
+			return wait
+		}
+		for key, a := range attempts {
+			s.countFailure(a, key, now)
+			if a.Locked && (lockout == nil || a.Until.After(lockout.Until)) {
+				lockout = &lockoutError{Until: a.Until, Locked: true}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lockout, nil
+}
+
+// releaseAttempt takes back an attempt counted by reserveAttempt
+func (s *Server) releaseAttempt(host string, keys ...string) error {
+	if !s.throttleEnabled() {
+		return nil
+	}
+	return s.updateAttempts(host, keys, func(attempts map[string]*loginAttempts) error {
+		for key, a := range attempts {
+			if a.Failures > 0 {
+				a.Failures--
+				s.setBackoff(a, key)
+			}
+		}
+		return nil
+	})
+}
+
+// clearAttempts removes the failure counters (and lockouts) of the keys
+func (s *Server) clearAttempts(host string, keys ...string) error {
+	if s.BoltDB == nil {
+		return nil
+	}
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(loginAttemptType))
+		if bucket == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// auditLogin records a password login or recovery event in the audit log
+func (s *Server) auditLogin(req *httpRequest, mode string, webid string, status int, err error) {
+	if s.auditLog == nil {
+		return
+	}
+	e := &AuditEntry{
+		Time:     time.Now().UTC(),
+		Host:     req.Host,
+		Remote:   req.RemoteAddr,
+		WebID:    webid,
+		Method:   req.Method,
+		URI:      req.BaseURI(),
+		Mode:     mode,
+		Decision: "deny",
+		Status:   status,
+	}
+	if err == nil {
+		e.Decision = "allow"
+	} else {
+		e.Reason = err.Error()
+		if l, ok := err.(*lockoutError); ok && l.Locked {
+			e.Decision = "lockout"
+			until := l.Until
+			e.LockedUntil = &until
+		}
+	}
+	if werr := s.auditLog.Write(e); werr != nil {
+		s.debug.Println("Audit log error: " + werr.Error())
+	}
+}
+
+// throttleStatus returns the status to use for a throttled request
+func throttleStatus(err error) int {
+	if _, ok := err.(*lockoutError); ok {
+		return 429
+	}
+	return 503
+}
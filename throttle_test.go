@@ -0,0 +1,144 @@
+package gold
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/throttle.db")()
+	file := "_test/throttle.log"
+	handler.auditLog = newAuditLog(file, 0, 0)
+	maxFailures := handler.Config.LoginMaxFailures
+	handler.Config.LoginMaxFailures = 3
+	defer func() {
+		handler.auditLog.Close()
+		handler.auditLog = nil
+		handler.Config.LoginMaxFailures = maxFailures
+		os.Remove(file)
+	}()
+
+	webid := "https://bob.example/profile/card#me"
+	host := hostOf(testServer.URL)
+	err := handler.setPassword(testServer.URL+"/", webid, "secret")
+	assert.NoError(t, err)
+
+	login := func(pass string) *http.Response {
+		response, _ := oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/login", url.Values{
+			"webid":    {webid},
+			"password": {pass},
+		}, nil)
+		return response
+	}
+
+	// the first failure is free, the next ones have to wait
+	assert.Equal(t, 403, login("wrong").StatusCode)
+	assert.Equal(t, 403, login("wrong").StatusCode)
+	response := login("secret")
+	assert.Equal(t, 429, response.StatusCode)
+	n, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.True(t, n >= 1 && n <= 2)
+
+	// lock the WebID out
+	lockout, err := handler.recordFailure(host, webidAttemptKey("login", webid))
+	assert.NoError(t, err)
+	assert.NotNil(t, lockout)
+	assert.True(t, lockout.Locked)
+	attempts, err := handler.getAttempts(host, webidAttemptKey("login", webid))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts[webidAttemptKey("login", webid)].Failures)
+	response = login("secret")
+	assert.Equal(t, 429, response.StatusCode)
+	n, _ = strconv.Atoi(response.Header.Get("Retry-After"))
+	assert.True(t, n > 60)
+
+	entries, err := handler.auditLog.Query(func(e *AuditEntry) bool {
+		return e.WebID == webid && e.Decision == "lockout"
+	}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	if len(entries) > 0 {
+		assert.Equal(t, "Login", entries[0].Mode)
+		assert.Equal(t, 429, entries[0].Status)
+		assert.NotNil(t, entries[0].LockedUntil)
+	}
+}
+
+func TestRecoveryReleasesLockout(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/throttle.db")()
+
+	webid := "https://carol.example/profile/card#me"
+	host := hostOf(testServer.URL)
+	err := handler.setPassword(testServer.URL+"/", webid, "secret")
+	assert.NoError(t, err)
+	for i := 0; i < handler.Config.LoginMaxFailures; i++ {
+		_, err = handler.recordFailure(host, webidAttemptKey("login", webid))
+		assert.NoError(t, err)
+	}
+	login := func(pass string) int {
+		response, _ := oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/login", url.Values{
+			"webid":    {webid},
+			"password": {pass},
+		}, nil)
+		return response.StatusCode
+	}
+	assert.Equal(t, 429, login("secret"))
+
+	// a bad token counts against the client
+	response, _ := oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/recovery", url.Values{
+		"token": {"bogus"},
+	}, nil)
+	assert.Equal(t, 500, response.StatusCode)
+
+	token, err := NewSecureToken("Recovery", map[string]string{"webid": webid}, time.Minute, handler)
+	assert.NoError(t, err)
+	response, _ = oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/recovery", url.Values{
+		"token": {token},
+	}, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, 301, login("secret"))
+}
+
+func TestReserveAttempt(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/throttle.db")()
+	host := "throttle.example"
+	key := webidAttemptKey("login", "https://dan.example/#me")
+
+	// attempts are counted before they are made, and the ones that succeed are given back
+	lockout, err := handler.reserveAttempt(host, key)
+	assert.NoError(t, err)
+	assert.Nil(t, lockout)
+	_, err = handler.reserveAttempt(host, key)
+	assert.NoError(t, err)
+	_, err = handler.reserveAttempt(host, key)
+	assert.IsType(t, &lockoutError{}, err)
+	assert.NoError(t, handler.releaseAttempt(host, key))
+	attempts, err := handler.getAttempts(host, key)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempts[key].Failures)
+	assert.True(t, attempts[key].Until.IsZero())
+	assert.NoError(t, handler.releaseAttempt(host, key))
+	attempts, err = handler.getAttempts(host, key)
+	assert.NoError(t, err)
+	assert.Empty(t, attempts)
+}
+
+func TestRecoveryRequestsDoNotLockTheWebID(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/throttle.db")()
+	webid := "https://erin.example/profile/card#me"
+	for i := 0; i < handler.Config.LoginMaxFailures+1; i++ {
+		oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/recovery", url.Values{
+			"webid": {webid},
+		}, nil)
+	}
+	attempts, err := handler.getAttempts(hostOf(testServer.URL), webidAttemptKey("recovery", webid), webidAttemptKey("login", webid))
+	assert.NoError(t, err)
+	assert.Empty(t, attempts)
+}
@@ -0,0 +1,313 @@
+package gold
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	authzTokenType = "Authorization"
+
+	// tokenSweepInterval is how often expired authorization tokens are removed
+	tokenSweepInterval = time.Hour
+	// tokenTouchAge is how often the last use of a token is saved
+	tokenTouchAge = time.Minute
+)
+
+// apiToken describes an authorization token of the JSON API. The token itself is only
+// returned when it is created.
+type apiToken struct {
+	ID       string   `json:"id"`
+	WebID    string   `json:"webid"`
+	Label    string   `json:"label,omitempty"`
+	Origin   string   `json:"origin,omitempty"`
+	Modes    []string `json:"modes,omitempty"`
+	Prefix   string   `json:"prefix,omitempty"`
+	Created  int64    `json:"created,omitempty"`
+	Expires  int64    `json:"expires"`
+	LastUsed int64    `json:"lastUsed,omitempty"`
+	Token    string   `json:"token,omitempty"`
+}
+
+type tokenRequest struct {
+	Label   string   `json:"label"`
+	Modes   []string `json:"modes"`
+	Prefix  string   `json:"prefix"`
+	Expires string   `json:"expires"`
+	TTL     int64    `json:"ttl"`
+}
+
+func newAPIToken(values map[string]string) *apiToken {
+	t := &apiToken{
+		ID:     values["id"],
+		WebID:  values["webid"],
+		Label:  values["label"],
+		Origin: values["origin"],
+		Modes:  strings.Fields(values["modes"]),
+		Prefix: values["prefix"],
+	}
+	t.Created, _ = strconv.ParseInt(values["created"], 10, 64)
+	t.Expires, _ = strconv.ParseInt(values["valid"], 10, 64)
+	t.LastUsed, _ = strconv.ParseInt(values["lastUsed"], 10, 64)
+	return t
+}
+
+// tokenScoped tells if the token is restricted to some modes or resources
+func tokenScoped(values map[string]string) bool {
+	return len(values["modes"]) > 0 || len(values["prefix"]) > 0
+}
+
+// scopeCovers checks if the resource is the prefix, or is under it if the prefix ends with a slash
+func scopeCovers(prefix string, uri string) bool {
+	return uri == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(uri, prefix))
+}
+
+// scopeGrants checks if the mode is one of the modes (Write implies Append)
+func scopeGrants(modes []string, mode string) bool {
+	for _, m := range modes {
+		if m == mode || (mode == "Append" && m == "Write") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowToken checks if the scope of the bearer token of the request allows the mode on the
+// resource. ACL resources need Control over the resource they protect.
+func (acl *WAC) allowToken(mode string, path string) (int, error) {
+	values := acl.req.Token
+	if !tokenScoped(values) {
+		return 200, nil
+	}
+	p, err := acl.req.pathInfo(path)
+	if err != nil {
+		return 500, err
+	}
+	uri := p.URI
+	if p.File == p.AclFile {
+		mode = "Control"
+		uri = strings.TrimSuffix(p.URI, acl.srv.Config.ACLSuffix)
+	}
+	if len(values["prefix"]) > 0 && !scopeCovers(values["prefix"], uri) {
+		return 403, errors.New("The token does not grant access to " + uri)
+	}
+	if modes := strings.Fields(values["modes"]); len(modes) > 0 && !scopeGrants(modes, mode) {
+		return 403, errors.New("The token does not grant " + mode + " access")
+	}
+	return 200, nil
+}
+
+// touchToken records the use of a token
+func (s *Server) touchToken(host string, token string, values map[string]string) {
+	now := time.Now()
+	if last, _ := strconv.ParseInt(values["lastUsed"], 10, 64); now.Sub(time.Unix(last, 0)) < tokenTouchAge {
+		return
+	}
+	values["lastUsed"] = fmt.Sprintf("%d", now.Unix())
+	data, err := json.Marshal(values)
+	if err == nil {
+		err = s.BoltDB.Update(func(tx *bolt.Tx) error {
+			hostBucket := tx.Bucket([]byte(host))
+			if hostBucket == nil {
+				return nil
+			}
+			bucket := hostBucket.Bucket([]byte(authzTokenType))
+			if bucket == nil || bucket.Get([]byte(token)) == nil {
+				return nil
+			}
+			return bucket.Put([]byte(token), data)
+		})
+	}
+	if err != nil {
+		s.debug.Println("Could not save the token use: " + err.Error())
+	}
+}
+
+// sweepTokens removes the expired authorization tokens of all hosts
+func sweepTokens(db *bolt.DB) (int, error) {
+	n := 0
+	now := time.Now().Unix()
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(host []byte, hostBucket *bolt.Bucket) error {
+			bucket := hostBucket.Bucket([]byte(authzTokenType))
+			if bucket == nil {
+				return nil
+			}
+			var expired [][]byte
+			err := bucket.ForEach(func(k, v []byte) error {
+				values := map[string]string{}
+				if v == nil || json.Unmarshal(v, &values) != nil {
+					return nil
+				}
+				if valid, err := strconv.ParseInt(values["valid"], 10, 64); err == nil && now > valid {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err = bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			n += len(expired)
+			return nil
+		})
+	})
+	return n, err
+}
+
+// sweepTokensEvery removes expired tokens and sessions until the database is closed
+func (s *Server) sweepTokensEvery(db *bolt.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := sweepTokens(db)
+		if err == bolt.ErrDatabaseNotOpen {
+			return
+		} else if err != nil {
+			s.debug.Println("Token sweeper error: " + err.Error())
+		} else if n > 0 {
+			s.debug.Println(fmt.Sprintf("Removed %d expired tokens", n))
+		}
+		n, err = sweepSessions(db)
+		if err == bolt.ErrDatabaseNotOpen {
+			return
+		} else if err != nil {
+			s.debug.Println("Session sweeper error: " + err.Error())
+		} else if n > 0 {
+			s.debug.Println(fmt.Sprintf("Removed %d expired sessions", n))
+		}
+	}
+}
+
+// findTokenByID returns the token with the given ID
+func (s *Server) findTokenByID(host string, id string) (string, error) {
+	tokens, err := s.getTokensByType(authzTokenType, host)
+	if err != nil {
+		return "", errors.New("Unknown token")
+	}
+	for token, values := range tokens {
+		if values["id"] == id {
+			return token, nil
+		}
+	}
+	return "", errors.New("Unknown token")
+}
+
+// accountTokensJSON lists (GET), creates (POST) and revokes (DELETE, by id) the authorization
+// tokens of the pod. Tokens can be scoped to some modes and to the resources under a prefix.
+func accountTokensJSON(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if s.BoltDB == nil {
+		return SystemReturn{Status: 503, Body: "Tokens require a database"}
+	}
+	host := req.Host
+	w.Header().Set(HCType, "application/json")
+
+	switch req.Method {
+	case "GET", "HEAD":
+		list := []*apiToken{}
+		tokens, err := s.getTokensByType(authzTokenType, host)
+		if err == nil {
+			for _, values := range tokens {
+				list = append(list, newAPIToken(values))
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+		data, err := json.Marshal(list)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200, Body: string(data)}
+
+	case "DELETE":
+		token, err := s.findTokenByID(host, req.FormValue("id"))
+		if err != nil {
+			return SystemReturn{Status: 404, Body: err.Error()}
+		}
+		if err = s.deletePersistedToken(authzTokenType, host, token); err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 200}
+
+	case "POST":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		var tokReq tokenRequest
+		if err = json.Unmarshal(data, &tokReq); err != nil {
+			return SystemReturn{Status: 400, Body: err.Error()}
+		}
+		values, err := req.newTokenValuesFrom(tokReq)
+		if err != nil {
+			return SystemReturn{Status: 400, Body: err.Error()}
+		}
+		token, err := s.newPersistedToken(authzTokenType, host, values)
+		if err != nil {
+			s.debug.Println("Could not generate a token for " + req.User + ": " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		t := newAPIToken(values)
+		t.Token = token
+		data, err = json.Marshal(t)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return SystemReturn{Status: 201, Body: string(data)}
+	}
+	return SystemReturn{Status: 405, Body: "405 - Method Not Allowed: " + req.Method}
+}
+
+// newTokenValuesFrom validates a token request; tokens need at least one mode
+func (req *httpRequest) newTokenValuesFrom(tokReq tokenRequest) (map[string]string, error) {
+	values := NewTokenValues()
+	values["webid"] = req.User
+	values["label"] = tokReq.Label
+
+	if len(tokReq.Prefix) > 0 {
+		base, _ := req.pathInfo(req.BaseURI())
+		if !strings.HasPrefix(tokReq.Prefix, base.Base+"/") {
+			return nil, errors.New("The resource " + tokReq.Prefix + " is not hosted on this server")
+		}
+		values["prefix"] = tokReq.Prefix
+	}
+	var modes []string
+	for _, mode := range tokReq.Modes {
+		m, ok := map[string]string{"read": "Read", "write": "Write", "append": "Append", "control": "Control"}[strings.ToLower(mode)]
+		if !ok {
+			return nil, errors.New("Unknown mode " + mode)
+		}
+		modes = append(modes, m)
+	}
+	if len(modes) == 0 {
+		return nil, errors.New("Missing modes")
+	}
+	values["modes"] = strings.Join(modes, " ")
+
+	switch {
+	case len(tokReq.Expires) > 0:
+		expires, err := time.Parse(time.RFC3339, tokReq.Expires)
+		if err != nil {
+			return nil, err
+		}
+		if !expires.After(time.Now()) {
+			return nil, errors.New("The expiry date must be in the future")
+		}
+		values["valid"] = fmt.Sprintf("%d", expires.Unix())
+	case tokReq.TTL > 0:
+		values["valid"] = fmt.Sprintf("%d", time.Now().Add(time.Duration(tokReq.TTL)*time.Second).Unix())
+	}
+	return values, nil
+}
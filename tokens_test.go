@@ -0,0 +1,125 @@
+package gold
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokensAPI(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/tokens.db")()
+
+	webid := "https://erin.example/profile/card#me"
+	err := handler.setPassword(testServer.URL+"/", webid, "secret")
+	assert.NoError(t, err)
+	response, _ := oidcDo(t, httpClient, "POST", testServer.URL+"/"+SystemPrefix+"/login", url.Values{
+		"webid":    {webid},
+		"password": {"secret"},
+	}, nil)
+	assert.Equal(t, 301, response.StatusCode)
+	assert.NotEmpty(t, response.Cookies())
+	cookie := ""
+	for _, c := range response.Cookies() {
+		cookie = c.Name + "=" + c.Value
+	}
+
+	// erin owns the pod, and controls tokendir
+	dir := testServer.URL + "/_test/tokendir/"
+	api := testServer.URL + "/" + SystemPrefix + "/tokens"
+	assert.NoError(t, os.MkdirAll("_test/tokendir/a", 0755))
+	defer os.RemoveAll("_test/tokendir")
+	files := map[string]string{
+		"_test/tokendir/.acl": "@prefix acl: <http://www.w3.org/ns/auth/acl#> .\n" +
+			"<#Owner> acl:accessTo <" + dir + "> ;\n" +
+			"	acl:default <" + dir + "> ;\n" +
+			"	acl:agent <" + webid + "> ;\n" +
+			"	acl:mode acl:Read, acl:Write, acl:Control .",
+		"_test/tokendir/a/doc": "<a> <b> <c> .",
+		"_test/tokendir/b":     "<a> <b> <c> .",
+		handler.Config.ACLSuffix: "<#Owner> <http://www.w3.org/ns/auth/acl#accessTo> <" + testServer.URL + "/> ;\n" +
+			"	<http://www.w3.org/ns/auth/acl#agent> <" + webid + "> ;\n" +
+			"	<http://www.w3.org/ns/auth/acl#mode> <http://www.w3.org/ns/auth/acl#Write> .",
+	}
+	for file, data := range files {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(data), 0644))
+	}
+	defer os.Remove(handler.Config.ACLSuffix)
+
+	do := func(method string, uri string, body string, auth string) (int, string) {
+		request, err := http.NewRequest(method, uri, strings.NewReader(body))
+		assert.NoError(t, err)
+		request.Header.Add("Accept", "application/json")
+		if strings.HasPrefix(auth, "Session=") {
+			request.Header.Add("Cookie", auth)
+		} else if len(auth) > 0 {
+			request.Header.Add("Authorization", "Bearer "+auth)
+		}
+		if strings.HasPrefix(body, "<") {
+			request.Header.Add("Content-Type", "text/turtle")
+		}
+		response, err := httpClient.Do(request)
+		assert.NoError(t, err)
+		data, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return response.StatusCode, string(data)
+	}
+
+	status, _ := do("POST", api, `{"modes":["read"]}`, "")
+	assert.Equal(t, 401, status)
+	status, _ = do("POST", api, `{"prefix":"`+dir+`a/"}`, cookie)
+	assert.Equal(t, 400, status)
+	status, body := do("POST", api, `{"label":"backup","modes":["read"],"prefix":"`+dir+`a/","ttl":3600}`, cookie)
+	assert.Equal(t, 201, status)
+	created := new(apiToken)
+	assert.NoError(t, json.Unmarshal([]byte(body), created))
+	assert.NotEmpty(t, created.Token)
+	assert.Equal(t, webid, created.WebID)
+	assert.Equal(t, []string{"Read"}, created.Modes)
+	assert.True(t, created.Expires <= time.Now().Add(time.Hour).Unix())
+
+	// the token only works within its scope
+	status, _ = do("GET", dir+"a/doc", "", created.Token)
+	assert.Equal(t, 200, status)
+	status, _ = do("PUT", dir+"a/doc", "<d> <e> <f> .", created.Token)
+	assert.Equal(t, 403, status)
+	status, _ = do("GET", dir+"b", "", created.Token)
+	assert.Equal(t, 403, status)
+	status, _ = do("GET", api, "", created.Token)
+	assert.Equal(t, 403, status)
+
+	status, body = do("GET", api, "", cookie)
+	assert.Equal(t, 200, status)
+	var list []*apiToken
+	assert.NoError(t, json.Unmarshal([]byte(body), &list))
+	assert.Len(t, list, 1)
+	if len(list) > 0 {
+		assert.Equal(t, "backup", list[0].Label)
+		assert.Empty(t, list[0].Token)
+		assert.NotZero(t, list[0].LastUsed)
+	}
+
+	// expired tokens are swept
+	_, err = handler.newPersistedToken(authzTokenType, hostOf(testServer.URL), map[string]string{
+		"webid": webid,
+		"valid": fmt.Sprintf("%d", time.Now().Add(-time.Minute).Unix()),
+	})
+	assert.NoError(t, err)
+	n, err := sweepTokens(handler.BoltDB)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	status, _ = do("DELETE", api+"?id="+created.ID, "", cookie)
+	assert.Equal(t, 200, status)
+	status, _ = do("DELETE", api+"?id="+created.ID, "", cookie)
+	assert.Equal(t, 404, status)
+	status, _ = do("GET", dir+"a/doc", "", created.Token)
+	assert.Equal(t, 401, status)
+}
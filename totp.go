@@ -0,0 +1,345 @@
+package gold
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	totpType = "TOTP"
+
+	// RFC 6238 defaults, as supported by most authenticator apps
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+	totpSecret = 20
+
+	totpRecoveryCodes = 10
+)
+
+var (
+	errSecondFactorRequired = errors.New("A one-time code from your authenticator app is required")
+	errBadSecondFactor      = errors.New("Access denied! Bad one-time code.")
+	totpEncoding            = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// totpEnrolment holds the (encrypted) TOTP secret and the hashed recovery codes of a WebID
+type totpEnrolment struct {
+	WebID         string    `json:"webid"`
+	Secret        string    `json:"secret"`
+	Enabled       bool      `json:"enabled"`
+	RecoveryCodes []string  `json:"recoveryCodes,omitempty"`
+	LastCounter   int64     `json:"lastCounter"`
+	Created       time.Time `json:"created"`
+}
+
+// hotp returns the RFC 4226 one-time password of the counter
+func hotp(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// checkTOTP returns the time step matched by the code, which must be later than last
+// so that a code cannot be used twice
+func checkTOTP(secret []byte, code string, now time.Time, last int64) (int64, bool) {
+	counter := now.Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		c := counter + i
+		if c <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI used to enrol the secret in an authenticator app
+func totpURI(issuer string, webid string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", totpEncoding.EncodeToString(secret))
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+webid) + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns single-use recovery codes, and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, totpRecoveryCodes)
+	hashes := make([]string, totpRecoveryCodes)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(hex.EncodeToString(b))
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = recoveryCodeHash(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// getTOTP returns the TOTP enrolment of the WebID on the host, or nil if there is none
+func (s *Server) getTOTP(host string, webid string) (*totpEnrolment, error) {
+	if s.BoltDB == nil {
+		return nil, nil
+	}
+	var e *totpEnrolment
+	err := s.BoltDB.View(func(tx *bolt.Tx) error {
+		hostBucket := tx.Bucket([]byte(host))
+		if hostBucket == nil {
+			return nil
+		}
+		bucket := hostBucket.Bucket([]byte(totpType))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(webid))
+		if data == nil {
+			return nil
+		}
+		e = new(totpEnrolment)
+		return json.Unmarshal(data, e)
+	})
+	return e, err
+}
+
+// putTOTP saves the TOTP enrolment, or removes it if e is only a WebID
+func (s *Server) putTOTP(host string, e *totpEnrolment) error {
+	return s.BoltDB.Update(func(tx *bolt.Tx) error {
+		hostBucket, err := tx.CreateBucketIfNotExists([]byte(host))
+		if err != nil {
+			return err
+		}
+		bucket, err := hostBucket.CreateBucketIfNotExists([]byte(totpType))
+		if err != nil {
+			return err
+		}
+		if len(e.Secret) == 0 {
+			return bucket.Delete([]byte(e.WebID))
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(e.WebID), data)
+	})
+}
+
+// verifyTOTP checks a one-time or recovery code against the enrolment, and saves
+// the used time step or drops the used recovery code
+func (s *Server) verifyTOTP(host string, e *totpEnrolment, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		secret, err := s.cookie.open(e.Secret)
+		if err != nil {
+			return false, err
+		}
+		counter, ok := checkTOTP(secret, code, time.Now(), e.LastCounter)
+		if !ok {
+			return false, nil
+		}
+		e.LastCounter = counter
+		return true, s.putTOTP(host, e)
+	}
+	if !e.Enabled {
+		return false, nil
+	}
+	hash := recoveryCodeHash(code)
+	for i, h := range e.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			return true, s.putTOTP(host, e)
+		}
+	}
+	return false, nil
+}
+
+// checkSecondFactor verifies the otp parameter of a login if the WebID is enrolled in TOTP.
+// It returns errSecondFactorRequired if the code is missing.
+func (req *httpRequest) checkSecondFactor(webid string) (int, error) {
+	s := req.Server
+	host := hostOf(req.BaseURI())
+	e, err := s.getTOTP(host, webid)
+	if err != nil {
+		s.debug.Println("TOTP store error: " + err.Error())
+		return 500, err
+	}
+	if e == nil || !e.Enabled {
+		return 200, nil
+	}
+	code := req.FormValue("otp")
+	if len(code) == 0 {
+		return 401, errSecondFactorRequired
+	}
+
+	keys := []string{webidAttemptKey("login", webid), ipAttemptKey("login", req)}
+	lockout, err := s.reserveAttempt(host, keys...)
+	if err != nil {
+		status := throttleStatus(err)
+		s.auditLogin(req, "TOTP", webid, status, err)
+		return status, err
+	}
+	ok, err := s.verifyTOTP(host, e, code)
+	if !ok && err == nil {
+		s.debug.Println("Access denied! Bad one-time code for WebID: " + webid)
+		if lockout != nil {
+			s.auditLogin(req, "TOTP", webid, 403, lockout)
+		} else {
+			s.auditLogin(req, "TOTP", webid, 403, errBadSecondFactor)
+		}
+		return 403, errBadSecondFactor
+	}
+	if ferr := s.releaseAttempt(host, keys...); ferr != nil {
+		s.debug.Println("Could not release the login attempt of " + webid + ": " + ferr.Error())
+	}
+	if err != nil {
+		s.debug.Println("TOTP verification error: " + err.Error())
+		return 500, err
+	}
+	s.auditLogin(req, "TOTP", webid, 200, nil)
+	return 200, nil
+}
+
+// accountTOTP manages the TOTP enrolment of the authenticated user. GET returns its state,
+// POST without a code starts an enrolment and returns the secret and its otpauth URI,
+// POST with a code confirms the enrolment (or renews the recovery codes once enrolled) and
+// returns new recovery codes, and DELETE with a code disables TOTP.
+func accountTOTP(w http.ResponseWriter, req *httpRequest, s *Server) SystemReturn {
+	if len(req.User) == 0 {
+		return SystemReturn{Status: 401, Body: UnauthorizedTemplate(req.FormValue("redirect"), "")}
+	}
+	if s.BoltDB == nil {
+		return SystemReturn{Status: 503, Body: "Two-factor authentication requires the Bolt database"}
+	}
+	host := hostOf(req.BaseURI())
+	e, err := s.getTOTP(host, req.User)
+	if err != nil {
+		s.debug.Println("TOTP store error: " + err.Error())
+		return SystemReturn{Status: 500, Body: err.Error()}
+	}
+	reply := func(v interface{}) SystemReturn {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		w.Header().Set(HCType, "application/json")
+		return SystemReturn{Status: 200, Body: string(data)}
+	}
+	code := req.FormValue("code")
+	checkCode := func() (int, error) {
+		keys := []string{webidAttemptKey("login", req.User), ipAttemptKey("login", req)}
+		if _, err := s.reserveAttempt(host, keys...); err != nil {
+			setRetryAfter(w, err)
+			return throttleStatus(err), err
+		}
+		ok, err := s.verifyTOTP(host, e, code)
+		if !ok && err == nil {
+			return 403, errBadSecondFactor
+		}
+		if ferr := s.releaseAttempt(host, keys...); ferr != nil {
+			s.debug.Println("Could not release the code attempt of " + req.User + ": " + ferr.Error())
+		}
+		if err != nil {
+			s.debug.Println("TOTP verification error: " + err.Error())
+			return 500, err
+		}
+		return 200, nil
+	}
+
+	switch req.Method {
+	case "GET":
+		state := map[string]interface{}{"enabled": false, "pending": false}
+		if e != nil {
+			state["enabled"] = e.Enabled
+			state["pending"] = !e.Enabled
+			state["recoveryCodes"] = len(e.RecoveryCodes)
+		}
+		return reply(state)
+	case "POST":
+		if len(code) == 0 {
+			if e != nil && e.Enabled {
+				return SystemReturn{Status: 409, Body: "Two-factor authentication is already enabled"}
+			}
+			secret := make([]byte, totpSecret)
+			if _, err = rand.Read(secret); err != nil {
+				return SystemReturn{Status: 500, Body: err.Error()}
+			}
+			enc, err := s.cookie.seal(secret)
+			if err != nil {
+				s.debug.Println("Could not encrypt the TOTP secret: " + err.Error())
+				return SystemReturn{Status: 500, Body: err.Error()}
+			}
+			e = &totpEnrolment{WebID: req.User, Secret: enc, Created: time.Now().UTC()}
+			if err = s.putTOTP(host, e); err != nil {
+				s.debug.Println("TOTP store error: " + err.Error())
+				return SystemReturn{Status: 500, Body: err.Error()}
+			}
+			return reply(map[string]string{
+				"secret": totpEncoding.EncodeToString(secret),
+				"uri":    totpURI(hostOf(req.BaseURI()), req.User, secret),
+			})
+		}
+		if e == nil {
+			return SystemReturn{Status: 404, Body: "No pending enrolment"}
+		}
+		if status, err := checkCode(); err != nil {
+			return SystemReturn{Status: status, Body: err.Error()}
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		e.Enabled = true
+		e.RecoveryCodes = hashes
+		if err = s.putTOTP(host, e); err != nil {
+			s.debug.Println("TOTP store error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		s.auditLogin(req, "TOTP", req.User, 200, nil)
+		return reply(map[string][]string{"recoveryCodes": codes})
+	case "DELETE":
+		if e == nil {
+			return SystemReturn{Status: 404, Body: "Two-factor authentication is not enabled"}
+		}
+		if status, err := checkCode(); err != nil {
+			return SystemReturn{Status: status, Body: err.Error()}
+		}
+		if err = s.putTOTP(host, &totpEnrolment{WebID: req.User}); err != nil {
+			s.debug.Println("TOTP store error: " + err.Error())
+			return SystemReturn{Status: 500, Body: err.Error()}
+		}
+		return reply(map[string]bool{"enabled": false})
+	}
+	return SystemReturn{Status: 405, Body: "Method not allowed"}
+}
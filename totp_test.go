@@ -0,0 +1,161 @@
+package gold
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 4226, appendix D
+	secret := []byte("12345678901234567890")
+	for i, code := range []string{"755224", "287082", "359152", "969429", "338314"} {
+		assert.Equal(t, code, hotp(secret, int64(i)))
+	}
+
+	// RFC 6238, appendix B (last 6 digits)
+	counter, ok := checkTOTP(secret, "287082", time.Unix(59, 0), 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), counter)
+	// codes cannot be used twice
+	_, ok = checkTOTP(secret, "287082", time.Unix(59, 0), counter)
+	assert.False(t, ok)
+	_, ok = checkTOTP(secret, "969429", time.Unix(59, 0), 0)
+	assert.False(t, ok)
+
+	uri := totpURI("example.org", "https://example.org/profile/card#me", secret)
+	assert.Equal(t, "otpauth://totp/example.org:https:%2F%2Fexample.org%2Fprofile%2Fcard%23me?"+
+		"algorithm=SHA1&digits=6&issuer=example.org&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri)
+}
+
+func TestTOTPLogin(t *testing.T) {
+	defer startTestBolt(t, handler, "_test/totp.db")()
+
+	webid := "https://erin.example/profile/card#me"
+	err := handler.setPassword(testServer.URL+"/", webid, "secret")
+	assert.NoError(t, err)
+	loginURL := testServer.URL + "/" + SystemPrefix + "/login"
+	api := testServer.URL + "/" + SystemPrefix + "/totp"
+
+	response, _ := oidcDo(t, httpClient, "POST", loginURL, url.Values{
+		"webid":    {webid},
+		"password": {"secret"},
+	}, nil)
+	assert.Equal(t, 301, response.StatusCode)
+	assert.Len(t, response.Cookies(), 1)
+	cookie := map[string]string{"Cookie": response.Cookies()[0].Name + "=" + response.Cookies()[0].Value}
+
+	// enrol
+	response, body := oidcDo(t, httpClient, "POST", api, url.Values{}, cookie)
+	assert.Equal(t, 200, response.StatusCode)
+	enrolment := map[string]string{}
+	assert.NoError(t, json.Unmarshal([]byte(body), &enrolment))
+	assert.Contains(t, enrolment["uri"], "otpauth://totp/")
+	secret, err := totpEncoding.DecodeString(enrolment["secret"])
+	assert.NoError(t, err)
+
+	// the secret is not kept in clear
+	e, err := handler.getTOTP(hostOf(testServer.URL), webid)
+	assert.NoError(t, err)
+	assert.False(t, e.Enabled)
+	assert.NotContains(t, e.Secret, enrolment["secret"])
+
+	response, _ = oidcDo(t, httpClient, "POST", api, url.Values{"code": {"000000"}}, cookie)
+	assert.Equal(t, 403, response.StatusCode)
+	code := hotp(secret, time.Now().Unix()/totpPeriod)
+	response, body = oidcDo(t, httpClient, "POST", api, url.Values{"code": {code}}, cookie)
+	assert.Equal(t, 200, response.StatusCode)
+	codes := map[string][]string{}
+	assert.NoError(t, json.Unmarshal([]byte(body), &codes))
+	assert.Len(t, codes["recoveryCodes"], totpRecoveryCodes)
+	response, body = oidcDo(t, httpClient, "GET", api, nil, cookie)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, `{"enabled":true,"pending":false,"recoveryCodes":10}`, body)
+	clearTestAttempts(t, webid)
+
+	// the password alone is not enough anymore
+	response, body = oidcDo(t, httpClient, "POST", loginURL, url.Values{
+		"webid":    {webid},
+		"password": {"secret"},
+	}, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Empty(t, response.Cookies())
+	assert.Contains(t, body, "Two-factor authentication")
+	match := regexp.MustCompile(`name="totptoken" value="([^"]+)"`).FindStringSubmatch(body)
+	assert.Len(t, match, 2)
+	token := match[1]
+
+	response, _ = oidcDo(t, httpClient, "POST", loginURL, url.Values{
+		"totptoken": {token},
+		"otp":       {"000000"},
+	}, nil)
+	assert.Equal(t, 403, response.StatusCode)
+	assert.Empty(t, response.Cookies())
+	response, _ = oidcDo(t, httpClient, "POST", loginURL, url.Values{
+		"totptoken": {token},
+		"otp":       {codes["recoveryCodes"][0]},
+	}, nil)
+	assert.Equal(t, 301, response.StatusCode)
+	assert.Len(t, response.Cookies(), 1)
+	// recovery codes are single-use
+	response, _ = oidcDo(t, httpClient, "POST", loginURL, url.Values{
+		"totptoken": {token},
+		"otp":       {codes["recoveryCodes"][0]},
+	}, nil)
+	assert.Equal(t, 403, response.StatusCode)
+	response, _ = oidcDo(t, httpClient, "POST", loginURL, url.Values{
+		"totptoken": {"bogus"},
+		"otp":       {codes["recoveryCodes"][1]},
+	}, nil)
+	assert.Equal(t, 403, response.StatusCode)
+
+	// neither is a recovery link
+	clearTestAttempts(t, webid)
+	recovery, err := NewSecureToken("Recovery", map[string]string{"webid": webid}, time.Minute, handler)
+	assert.NoError(t, err)
+	recoveryURL := testServer.URL + "/" + SystemPrefix + "/recovery"
+	response, body = oidcDo(t, httpClient, "POST", recoveryURL, url.Values{"token": {recovery}}, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Empty(t, response.Cookies())
+	assert.Contains(t, body, `name="otp"`)
+	response, _ = oidcDo(t, httpClient, "POST", recoveryURL, url.Values{
+		"token":      {recovery},
+		"otp":        {"000000"},
+		"password":   {"secret"},
+		"verifypass": {"secret"},
+	}, nil)
+	assert.Equal(t, 403, response.StatusCode)
+	assert.Empty(t, response.Cookies())
+	clearTestAttempts(t, webid)
+	response, body = oidcDo(t, httpClient, "POST", recoveryURL, url.Values{
+		"token":      {recovery},
+		"otp":        {codes["recoveryCodes"][2]},
+		"password":   {"secret"},
+		"verifypass": {"secret"},
+	}, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "Password saved!", body)
+	assert.Len(t, response.Cookies(), 1)
+
+	// disable
+	clearTestAttempts(t, webid)
+	response, _ = oidcDo(t, httpClient, "DELETE", api+"?code="+codes["recoveryCodes"][1], nil, cookie)
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = oidcDo(t, httpClient, "POST", loginURL, url.Values{
+		"webid":    {webid},
+		"password": {"secret"},
+	}, nil)
+	assert.Equal(t, 301, response.StatusCode)
+}
+
+// clearTestAttempts forgets the failed logins of the WebID and of the test client
+func clearTestAttempts(t *testing.T, webid string) {
+	client := &httpRequest{Request: &http.Request{RemoteAddr: "127.0.0.1:0"}}
+	err := handler.clearAttempts(hostOf(testServer.URL), webidAttemptKey("login", webid), ipAttemptKey("login", client))
+	assert.NoError(t, err)
+}
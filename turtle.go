@@ -0,0 +1,117 @@
+package gold
+
+import (
+	"bufio"
+	"io"
+)
+
+// turtleDocument writes a whole graph as Turtle, nesting the blank nodes that are
+// referenced only once inside their parent
+type turtleDocument struct {
+	*turtleWriter
+	bySubject map[string][]*Triple
+	refs      map[string]int
+	written   map[string]bool
+}
+
+// WriteTurtle writes the graph as Turtle, reusing the prefixes declared in the parsed
+// documents. Subjects, predicates and objects are sorted so that edits produce small diffs.
+func (g *Graph) WriteTurtle(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	tw := &turtleWriter{
+		w:        bw,
+		base:     g.uri,
+		prefixes: map[string]string{},
+	}
+	hasRDF := false
+	for prefix, uri := range g.prefixes {
+		tw.prefixes[prefix] = uri
+		hasRDF = hasRDF || uri == string(ns.rdf)
+	}
+	if _, ok := tw.prefixes["rdf"]; !ok && !hasRDF {
+		tw.prefixes["rdf"] = string(ns.rdf)
+	}
+
+	d := &turtleDocument{
+		turtleWriter: tw,
+		bySubject:    map[string][]*Triple{},
+		refs:         map[string]int{},
+		written:      map[string]bool{},
+	}
+	var subjects []Term
+	for _, triple := range g.sortedTriples() {
+		key := termKey(triple.Subject)
+		if _, ok := d.bySubject[key]; !ok {
+			subjects = append(subjects, triple.Subject)
+		}
+		d.bySubject[key] = append(d.bySubject[key], triple)
+		if _, ok := triple.Object.(*BlankNode); ok {
+			d.refs[termKey(triple.Object)]++
+		}
+	}
+
+	if err := tw.header(); err != nil {
+		return err
+	}
+	for _, subject := range subjects {
+		if d.nested(subject) {
+			continue
+		}
+		if err := d.writeSubject(subject); err != nil {
+			return err
+		}
+	}
+	// blank nodes that only reference each other have to be written with their labels
+	for _, subject := range subjects {
+		if d.written[termKey(subject)] {
+			continue
+		}
+		if err := d.writeSubject(subject); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// nested checks if a term is a blank node that can be written inline
+func (d *turtleDocument) nested(t Term) bool {
+	_, ok := t.(*BlankNode)
+	return ok && d.refs[termKey(t)] == 1
+}
+
+func (d *turtleDocument) writeSubject(subject Term) error {
+	key := termKey(subject)
+	d.written[key] = true
+	_, err := io.WriteString(d.w, d.term(subject)+"\n"+d.properties(d.bySubject[key], "    ")+" .\n\n")
+	return err
+}
+
+// properties returns the predicate-object list of a subject
+func (d *turtleDocument) properties(triples []*Triple, indent string) string {
+	out := ""
+	for i, triple := range triples {
+		switch {
+		case i == 0:
+			out += indent + d.predicate(triple.Predicate) + " "
+		case triple.Predicate.Equal(triples[i-1].Predicate):
+			out += ", "
+		default:
+			out += " ;\n" + indent + d.predicate(triple.Predicate) + " "
+		}
+		out += d.object(triple.Object, indent)
+	}
+	return out
+}
+
+func (d *turtleDocument) object(t Term, indent string) string {
+	key := termKey(t)
+	if !d.nested(t) || d.written[key] {
+		return d.term(t)
+	}
+	d.written[key] = true
+	triples := d.bySubject[key]
+	if len(triples) == 0 {
+		return "[]"
+	}
+	return "[\n" + d.properties(triples, indent+"    ") + "\n" + indent + "]"
+}
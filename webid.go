@@ -1,19 +1,24 @@
 package gold
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"os"
 	_path "path"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 	"unicode"
 )
@@ -56,22 +61,98 @@ var (
 		{Name: "Inbox", Label: "Inbox", Type: ""},
 	}
 
-	// cache
-	webidL  = new(sync.Mutex)
-	pkeyURI = map[string]string{}
+	errNoProfileKey = errors.New("No matching key found in the profile")
 )
 
 func pkeyTypeNE(pkey interface{}) (t, n, e string) {
 	switch pkey := pkey.(type) {
-	//TODO: case *dsa.PublicKey
 	case *rsa.PublicKey:
 		t = "RSAPublicKey"
 		n = fmt.Sprintf("%x", pkey.N)
 		e = fmt.Sprintf("%d", pkey.E)
+	case *ecdsa.PublicKey:
+		t = "ECPublicKey"
+		n = fmt.Sprintf("%x/%x", pkey.X, pkey.Y)
+		e = pkey.Curve.Params().Name
+	case ed25519.PublicKey:
+		t = "Ed25519PublicKey"
+		n = fmt.Sprintf("%x", []byte(pkey))
 	}
 	return
 }
 
+// profileKeys returns the public keys listed with cert:key in a WebID profile, described
+// either by an RSA modulus and exponent, a PEM encoded key (cert:pem) or a JWK (sec:publicKeyJwk)
+func profileKeys(g *Graph, webid string) []crypto.PublicKey {
+	keys := []crypto.PublicKey{}
+	for _, keyT := range g.All(NewResource(webid), ns.cert.Get("key"), nil) {
+		keys = append(keys, termKeys(g, keyT.Object)...)
+	}
+	return keys
+}
+
+// termKeys returns the public keys described by a key resource of a profile
+func termKeys(g *Graph, key Term) []crypto.PublicKey {
+	keys := []crypto.PublicKey{}
+	for _, pubN := range g.All(key, ns.cert.Get("modulus"), nil) {
+		n, ok := new(big.Int).SetString(strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) || r == ':' {
+				return -1
+			}
+			return r
+		}, term2C(pubN.Object).String()), 16)
+		if !ok {
+			continue
+		}
+		for _, pubE := range g.All(key, ns.cert.Get("exponent"), nil) {
+			e, err := strconv.Atoi(strings.TrimSpace(term2C(pubE.Object).String()))
+			if err == nil {
+				keys = append(keys, &rsa.PublicKey{N: n, E: e})
+			}
+		}
+	}
+	for _, pubP := range g.All(key, ns.cert.Get("pem"), nil) {
+		if pub, err := parsePublicPEM([]byte(term2C(pubP.Object).String())); err == nil {
+			keys = append(keys, pub)
+		}
+	}
+	for _, pubJ := range g.All(key, ns.sec.Get("publicKeyJwk"), nil) {
+		jwk := new(JWK)
+		if err := json.Unmarshal([]byte(term2C(pubJ.Object).String()), jwk); err != nil {
+			continue
+		}
+		if pub, err := jwk.PublicKey(); err == nil {
+			keys = append(keys, pub)
+		}
+	}
+	return keys
+}
+
+// findProfileKey looks for a key of the WebID profile accepted by match, fetching
+// the profile again if the cached copy has none, as the user may have added one
+func (s *Server) findProfileKey(webid string, match func(crypto.PublicKey) bool) error {
+	for _, refresh := range []bool{false, true} {
+		g, err := s.profileCache.get(webid, refresh)
+		if err != nil {
+			return err
+		}
+		for _, key := range profileKeys(g, webid) {
+			if match(key) {
+				return nil
+			}
+		}
+	}
+	return errNoProfileKey
+}
+
+// samePublicKey tells whether two public keys are equal
+func samePublicKey(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	return ok && k.Equal(b)
+}
+
 // WebIDDigestAuth performs a digest authentication using WebID-RSA
 func WebIDDigestAuth(req *httpRequest) (string, error) {
 	if len(req.Header.Get("Authorization")) == 0 {
@@ -87,7 +168,18 @@ func WebIDDigestAuth(req *httpRequest) (string, error) {
 		return "", errors.New("Bad source URI for auth token: " + authH.Source + " -- possible MITM attack!")
 	}
 
-	claim := sha1.Sum([]byte(authH.Source + authH.Username + authH.Nonce))
+	var claim []byte
+	toSign := []byte(authH.Source + authH.Username + authH.Nonce)
+	switch authH.Algorithm {
+	case "", "SHA-1":
+		sum := sha1.Sum(toSign)
+		claim = sum[:]
+	case "SHA-256":
+		sum := sha256.Sum256(toSign)
+		claim = sum[:]
+	default:
+		return "", errors.New("Unsupported claim algorithm " + authH.Algorithm)
+	}
 	signature, err := base64.StdEncoding.DecodeString(authH.Signature)
 	if err != nil {
 		return "", errors.New(err.Error() + " in " + authH.Signature)
@@ -117,52 +209,30 @@ func WebIDDigestAuth(req *httpRequest) (string, error) {
 	if len(tValues["secret"]) == 0 {
 		return "", errors.New("Missing secret from token (tempered with?)")
 	}
-	if tValues["secret"] != string(req.Server.cookieSalt) {
+	if !req.Server.cookie.validSalt(tValues["secret"]) {
 		return "", errors.New("Wrong secret value in client token!")
 	}
 
-	g := NewGraph(authH.Username)
-	err = g.LoadURI(authH.Username)
-	if err != nil {
-		return "", err
-	}
-
 	req.debug.Println("Checking for public keys for user", authH.Username)
-	for _, keyT := range g.All(NewResource(authH.Username), ns.cert.Get("key"), nil) {
-		for range g.All(keyT.Object, ns.rdf.Get("type"), ns.cert.Get("RSAPublicKey")) {
-			req.debug.Println("Found RSA key in user's profile", keyT.Object.String())
-			for _, pubP := range g.All(keyT.Object, ns.cert.Get("pem"), nil) {
-				keyP := term2C(pubP.Object).String()
-				req.debug.Println("Found matching public key in user's profile", keyP[:10], "...", keyP[len(keyP)-10:len(keyP)])
-				parser, err := ParseRSAPublicPEMKey([]byte(keyP))
-				if err == nil {
-					err = parser.Verify(claim[:], signature)
-					if err == nil {
-						return authH.Username, nil
-					}
-				}
-				req.debug.Println("Unable to verify signature with key", keyP[:10], "...", keyP[len(keyP)-10:len(keyP)], "-- reason:", err)
-			}
-			// also loop through modulus/exp
-			for _, pubN := range g.All(keyT.Object, ns.cert.Get("modulus"), nil) {
-				keyN := term2C(pubN.Object).String()
-				for _, pubE := range g.All(keyT.Object, ns.cert.Get("exponent"), nil) {
-					keyE := term2C(pubE.Object).String()
-					req.debug.Println("Found matching modulus and exponent in user's profile", keyN[:10], "...", keyN[len(keyN)-10:len(keyN)])
-					parser, err := ParseRSAPublicKeyNE("RSAPublicKey", keyN, keyE)
-					if err == nil {
-						err = parser.Verify(claim[:], signature)
-						if err == nil {
-							return authH.Username, nil
-						}
-					}
-					req.debug.Println("Unable to verify signature with key", keyN[:10], "...", keyN[len(keyN)-10:len(keyN)], "-- reason:", err)
-				}
-			}
+	err = req.Server.findProfileKey(authH.Username, func(key crypto.PublicKey) bool {
+		if _, ok := key.(*rsa.PublicKey); !ok && len(claim) == sha1.Size {
+			// SHA-1 claims are only accepted from RSA keys, for older clients
+			return false
+		}
+		parser, err := ParsePublicKey(key)
+		if err != nil {
+			return false
 		}
+		if err = parser.Verify(claim, signature); err != nil {
+			req.debug.Println("Unable to verify signature with", fmt.Sprintf("%T", key), "key -- reason:", err)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
 	}
-
-	return "", err
+	return authH.Username, nil
 }
 
 // WebIDTLSAuth - performs WebID-TLS authentication
@@ -218,56 +288,23 @@ func WebIDTLSAuth(req *httpRequest) (uri string, err error) {
 		}
 
 		pkey := tls.PeerCertificates[0].PublicKey
-		t, n, e := pkeyTypeNE(pkey)
+		t, _, _ := pkeyTypeNE(pkey)
 		if len(t) == 0 {
 			continue
 		}
 
-		pkeyk := fmt.Sprint([]string{t, n, e})
-		webidL.Lock()
-		uri = pkeyURI[pkeyk]
-		webidL.Unlock()
-		if len(uri) > 0 {
-			return
-		}
-
 		// pkey from client contains WebID claim
-
-		g := NewGraph(claim)
-		err = g.LoadURI(claim)
-		if err != nil {
+		err = req.Server.findProfileKey(claim, func(key crypto.PublicKey) bool {
+			return samePublicKey(key, pkey)
+		})
+		if err == errNoProfileKey {
+			continue
+		} else if err != nil {
 			return "", err
 		}
-
-		for _, keyT := range g.All(NewResource(claim), ns.cert.Get("key"), nil) {
-			// found pkey in the profile
-			for range g.All(keyT.Object, ns.rdf.Get("type"), ns.cert.Get(t)) {
-				for range g.All(keyT.Object, ns.cert.Get("modulus"), NewLiteral(n)) {
-					goto matchModulus
-				}
-				for range g.All(keyT.Object, ns.cert.Get("modulus"), NewLiteralWithDatatype(n, NewResource("http://www.w3.org/2001/XMLSchema#hexBinary"))) {
-					goto matchModulus
-				}
-			matchModulus:
-				// found a matching modulus in the profile
-				for range g.All(keyT.Object, ns.cert.Get("exponent"), NewLiteral(e)) {
-					goto matchExponent
-				}
-				for range g.All(keyT.Object, ns.cert.Get("exponent"), NewLiteralWithDatatype(e, NewResource("http://www.w3.org/2001/XMLSchema#int"))) {
-					goto matchExponent
-				}
-			matchExponent:
-				// found a matching exponent in the profile
-				req.debug.Println("Found matching public modulus and exponent in user's profile")
-				uri = claim
-				webidL.Lock()
-				pkeyURI[pkeyk] = uri
-				webidL.Unlock()
-				return
-			}
-			// could not find a certificate in the profile
-		}
-		// could not find a certificate pkey in the profile
+		// found pkey in the profile
+		req.debug.Println("Found matching", t, "in user's profile")
+		return claim, nil
 	}
 	return
 }
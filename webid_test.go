@@ -1,13 +1,34 @@
 package gold
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestWebIDTLSauth(t *testing.T) {
+	// the profile of user1 is gone by now, publish its key again
+	defer publishTestUsers(t)()
+
 	request, err := http.NewRequest("HEAD", testServer.URL, nil)
 	assert.NoError(t, err)
 	response, err := user1h.Do(request)
@@ -18,6 +39,140 @@ func TestWebIDTLSauth(t *testing.T) {
 	assert.Equal(t, user1, response.Header.Get("User"))
 }
 
+// publishTestUsers publishes the keys of user1 and user2 again when their profiles were
+// removed by earlier tests, and returns a function removing the profiles it published
+func publishTestUsers(t *testing.T) func() {
+	var published []string
+	for webid, key := range map[string]*rsa.PublicKey{user1: user1p, user2: user2p} {
+		if wacDo(t, httpClient, "HEAD", webid, "") == 200 {
+			continue
+		}
+		jwk, err := NewJWK(key)
+		assert.NoError(t, err)
+		jwkJSON, err := json.Marshal(jwk)
+		assert.NoError(t, err)
+		quoted, err := json.Marshal(string(jwkJSON))
+		assert.NoError(t, err)
+		assert.Equal(t, 201, wacDo(t, httpClient, "PUT", webid, "<#id> <http://www.w3.org/ns/auth/cert#key> <#key> .\n"+
+			"<#key> <https://w3id.org/security#publicKeyJwk> "+string(quoted)+" ."))
+		handler.profileCache.flush(webid)
+		published = append(published, webid)
+	}
+	return func() {
+		for _, webid := range published {
+			assert.Equal(t, 200, wacDo(t, httpClient, "DELETE", webid, ""))
+			handler.profileCache.flush(webid)
+		}
+	}
+}
+
+// newKeyClient returns a client presenting a WebID certificate for any type of key
+func newKeyClient(t *testing.T, webid string, priv crypto.Signer) *http.Client {
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	values, err := asn1.Marshal([]asn1.RawValue{{Class: 2, Tag: 6, Bytes: []byte("URI: " + webid)}})
+	assert.NoError(t, err)
+	template.ExtraExtensions = []pkix.Extension{{Id: subjectAltName, Value: values}}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	assert.NoError(t, err)
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+}
+
+func TestWebIDModernKeys(t *testing.T) {
+	webid := testServer.URL + "/_test/keys#id"
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	// the EC key is published as a JWK, the Ed25519 key as PEM
+	jwk, err := NewJWK(&ecKey.PublicKey)
+	assert.NoError(t, err)
+	jwkJSON, err := json.Marshal(jwk)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(edKey.Public())
+	assert.NoError(t, err)
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	quote := func(s string) string {
+		q, _ := json.Marshal(s)
+		return string(q)
+	}
+	profile := "<#id> <http://www.w3.org/ns/auth/cert#key> <#ec>, <#ed> .\n" +
+		"<#ec> <https://w3id.org/security#publicKeyJwk> " + quote(string(jwkJSON)) + " .\n" +
+		"<#ed> <http://www.w3.org/ns/auth/cert#pem> " + quote(string(edPEM)) + " ."
+	request, err := http.NewRequest("PUT", webid, strings.NewReader(profile))
+	assert.NoError(t, err)
+	request.Header.Add("Content-Type", "text/turtle")
+	response, err := httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 201, response.StatusCode)
+
+	// WebID-TLS
+	for _, priv := range []crypto.Signer{ecKey, edKey} {
+		response, err = newKeyClient(t, webid, priv).Get(testServer.URL)
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, webid, response.Header.Get("User"))
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	response, err = newKeyClient(t, webid, other).Get(testServer.URL)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Empty(t, response.Header.Get("User"))
+
+	// WebID-RSA with SHA-256 claims
+	rsaAuth := func(priv crypto.PrivateKey, algorithm string) string {
+		nonce, err := NewSecureToken("WWW-Authenticate", map[string]string{"secret": handler.cookie.salt()}, time.Minute, handler)
+		assert.NoError(t, err)
+		source := testServer.URL + "/"
+		claim := sha256.Sum256([]byte(source + webid + nonce))
+		digest := claim[:]
+		if algorithm == "SHA-1" {
+			sum := sha1.Sum([]byte(source + webid + nonce))
+			digest = sum[:]
+		}
+		signer, err := ParsePrivateKey(priv)
+		assert.NoError(t, err)
+		signed, err := signer.Sign(digest)
+		assert.NoError(t, err)
+		request, err := http.NewRequest("GET", source, nil)
+		assert.NoError(t, err)
+		request.Header.Add("Authorization", `WebID-RSA source="`+source+`", username="`+webid+`", nonce="`+nonce+`", sig="`+base64.StdEncoding.EncodeToString(signed)+`", algorithm="`+algorithm+`"`)
+		response, err := httpClient.Do(request)
+		assert.NoError(t, err)
+		response.Body.Close()
+		return response.Header.Get("User")
+	}
+	assert.Equal(t, webid, rsaAuth(ecKey, "SHA-256"))
+	assert.Equal(t, webid, rsaAuth(edKey, "SHA-256"))
+	assert.Empty(t, rsaAuth(other, "SHA-256"))
+	// SHA-1 claims are only accepted from RSA keys
+	assert.Empty(t, rsaAuth(ecKey, "SHA-1"))
+
+	request, err = http.NewRequest("DELETE", webid, nil)
+	assert.NoError(t, err)
+	response, err = httpClient.Do(request)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 200, response.StatusCode)
+}
+
 func TestAddProfileKeys(t *testing.T) {
 	webid := testServer.URL + "/_test/user1#id"
 	var account = webidAccount{